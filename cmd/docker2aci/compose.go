@@ -0,0 +1,100 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appc/docker2aci/lib"
+	"github.com/appc/spec/schema"
+)
+
+// runCompose runs `docker2aci compose` with the arguments following it,
+// converting the images of the services of a compose file with config and
+// writing the pod manifest running them. It returns the exit code.
+func runCompose(ctx context.Context, args []string, config docker2aci.Config) int {
+	fs := flag.NewFlagSet("compose", flag.ContinueOnError)
+	file := fs.String("file", "docker-compose.yml", "Compose file to translate")
+	podManifest := fs.String("pod-manifest", "pod-manifest.json", "File to write the pod manifest to")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker2aci [OPTIONS] compose [COMPOSE OPTIONS]")
+		fmt.Fprintln(os.Stderr, "The images of the services are squashed, the pod manifest runs their ACIs.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 1
+	}
+
+	b, err := ioutil.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading compose file: %v\n", err)
+		return 1
+	}
+	compose, err := docker2aci.ParseCompose(b, filepath.Dir(*file))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", *file, err)
+		return 1
+	}
+
+	// an app of the pod runs a single ACI
+	config.Squash = docker2aci.SquashOnly
+	acis := make(map[string]string)
+	var apps []docker2aci.PodApp
+	for _, name := range compose.ServiceNames() {
+		service := compose.Services[name]
+		if _, ok := acis[service.Image]; !ok {
+			aciPaths, err := runDocker2ACI(ctx, service.Image, config)
+			if ctx.Err() != nil {
+				return exitInterrupted
+			} else if err != nil {
+				return exitCodeFor(err)
+			}
+			acis[service.Image] = aciPaths[len(aciPaths)-1]
+		}
+		app := service.App
+		app.ACI = acis[service.Image]
+		apps = append(apps, app)
+	}
+
+	pod, err := docker2aci.GeneratePodManifest(apps)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating pod manifest: %v\n", err)
+		return 1
+	}
+	if err := writePodManifest(*podManifest, pod); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing pod manifest: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(docker2aci.Messages, "\nGenerated pod manifest:\n%s\n", *podManifest)
+	return 0
+}
+
+func writePodManifest(p string, pod *schema.PodManifest) error {
+	b, err := json.MarshalIndent(pod, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, append(b, '\n'), 0644)
+}
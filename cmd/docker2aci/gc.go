@@ -0,0 +1,101 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+// runGC runs `docker2aci gc` with the arguments following it, pruning the
+// cache dir and the work dir of config. It returns the exit code.
+func runGC(args []string, config docker2aci.Config) int {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	maxAge := fs.String("max-age", "", "Remove the files not used for longer than this duration (e.g. 30d or 12h)")
+	maxSize := fs.String("max-size", "", "Then remove the files used the longest ago until the ones left take at most this size (e.g. 20G)")
+	dryRun := fs.Bool("dry-run", false, "Print the files which would be removed without removing them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker2aci [--cache-dir DIR] [--work-dir DIR] gc [GC OPTIONS]")
+		fmt.Fprintln(os.Stderr, "The downloaded layers, the packed layer ACIs and the registry responses are removed, and the files left by interrupted conversions.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 1
+	}
+	if config.CacheDir == "" && config.WorkDir == "" {
+		fmt.Fprintln(os.Stderr, "gc needs --cache-dir or --work-dir")
+		return 1
+	}
+
+	var policy docker2aci.GCPolicy
+	var err error
+	if policy.MaxAge, err = parseAge(*maxAge); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --max-age: %v\n", err)
+		return 1
+	}
+	if policy.MaxSize, err = parseSize(*maxSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --max-size: %v\n", err)
+		return 1
+	}
+	if policy.MaxAge == 0 && policy.MaxSize == 0 {
+		fmt.Fprintln(os.Stderr, "gc needs --max-age or --max-size")
+		return 1
+	}
+	policy.DryRun = *dryRun
+
+	result, err := docker2aci.GC(config.CacheDir, config.WorkDir, policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "GC error: %v\n", err)
+		return exitStore
+	}
+	if *dryRun {
+		for _, p := range result.Removed {
+			fmt.Fprintln(docker2aci.Messages, p)
+		}
+		fmt.Fprintf(docker2aci.Messages, "Would remove %d file(s), %s, and keep %s\n", len(result.Removed), formatSize(result.Freed), formatSize(result.Kept))
+		return 0
+	}
+	fmt.Fprintf(docker2aci.Messages, "Removed %d file(s), %s, kept %s\n", len(result.Removed), formatSize(result.Freed), formatSize(result.Kept))
+	return 0
+}
+
+// parseAge parses a duration, which can also be a number of days like 30d.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+// lockfile pins every converted image reference to the Docker image it
+// resolved to and records the ACIs produced from it, so a later run with
+// --from-lockfile can reproduce the same conversion.
+type lockfile struct {
+	Images []lockedImage `json:"images"`
+}
+
+type lockedImage struct {
+	Reference string      `json:"reference"`
+	ImageID   string      `json:"imageID"`
+	ACIs      []lockedACI `json:"acis"`
+}
+
+type lockedACI struct {
+	File    string `json:"file"`
+	ImageID string `json:"imageID"`
+}
+
+func readLockfile(path string) (*lockfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lf lockfile
+	if err := json.Unmarshal(b, &lf); err != nil {
+		return nil, fmt.Errorf("error unmarshaling lockfile %s: %v", path, err)
+	}
+
+	return &lf, nil
+}
+
+func (lf *lockfile) write(path string) error {
+	b, err := json.MarshalIndent(lf, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func (lf *lockfile) get(reference string) *lockedImage {
+	for i := range lf.Images {
+		if lf.Images[i].Reference == reference {
+			return &lf.Images[i]
+		}
+	}
+	return nil
+}
+
+// set adds or replaces the entry of image.Reference.
+func (lf *lockfile) set(image lockedImage) {
+	if li := lf.get(image.Reference); li != nil {
+		*li = image
+		return
+	}
+	lf.Images = append(lf.Images, image)
+}
+
+// sort orders the entries like references, the ones of other references
+// last.
+func (lf *lockfile) sort(references []string) {
+	index := make(map[string]int)
+	for i, r := range references {
+		if _, ok := index[r]; !ok {
+			index[r] = i
+		}
+	}
+	rank := func(r string) int {
+		if i, ok := index[r]; ok {
+			return i
+		}
+		return len(references)
+	}
+	sort.SliceStable(lf.Images, func(i, j int) bool {
+		return rank(lf.Images[i].Reference) < rank(lf.Images[j].Reference)
+	})
+}
+
+// lockACIs returns the lockfile entries of the given ACIs.
+func lockACIs(aciPaths []string) ([]lockedACI, error) {
+	var acis []lockedACI
+	for _, p := range aciPaths {
+		id, err := docker2aci.ACIImageID(p)
+		if err != nil {
+			return nil, err
+		}
+		acis = append(acis, lockedACI{File: filepath.Base(p), ImageID: id})
+	}
+	return acis, nil
+}
+
+// verify checks that the given ACIs are the ones recorded in li.
+func (li *lockedImage) verify(acis []lockedACI) error {
+	if len(acis) != len(li.ACIs) {
+		return fmt.Errorf("%s: got %d ACI(s), the lockfile has %d", li.Reference, len(acis), len(li.ACIs))
+	}
+	for i, a := range acis {
+		if a != li.ACIs[i] {
+			return fmt.Errorf("%s: %s has image ID %s, the lockfile has %s for %s", li.Reference, a.File, a.ImageID, li.ACIs[i].ImageID, li.ACIs[i].File)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,929 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+const (
+	rocketDir = "/var/lib/rkt"
+
+	containersStoragePrefix = "containers-storage:"
+	dockerArchivePrefix     = "docker-archive:"
+	dockerDaemonPrefix      = "docker-daemon:"
+	ociLayoutPrefix         = "oci:"
+
+	// exitFailure is the exit code of a conversion which failed for
+	// another reason than the ones below, e.g. an invalid image.
+	exitFailure = 1
+	// exitDeadline is the exit code used when --deadline passes before
+	// the conversion is finished.
+	exitDeadline = 3
+	// exitAuth is the exit code used when a registry rejects the
+	// credentials, or wants some.
+	exitAuth = 4
+	// exitNotFound is the exit code used when a registry or a local
+	// store doesn't have the image.
+	exitNotFound = 5
+	// exitNetwork is the exit code used when a registry can't be reached
+	// or a connection fails.
+	exitNetwork = 6
+	// exitStore is the exit code used when reading or writing the files
+	// of the conversion fails, e.g. when the disk is full.
+	exitStore = 7
+	// exitUntrusted is the exit code used when --content-trust refuses
+	// the tag of an image.
+	exitUntrusted = 8
+	// exitInterrupted is the exit code used when a signal interrupts the
+	// conversion, the one of shells for SIGINT.
+	exitInterrupted = 130
+)
+
+// squashFlag is a flag.Value accepting true, false or also. It can be used
+// as a boolean flag, so plain --squash means true.
+type squashFlag struct {
+	mode docker2aci.SquashMode
+}
+
+func (f *squashFlag) String() string {
+	switch f.mode {
+	case docker2aci.SquashNone:
+		return "false"
+	case docker2aci.SquashAlso:
+		return "also"
+	}
+	return "true"
+}
+
+func (f *squashFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.mode = docker2aci.SquashOnly
+	case "false":
+		f.mode = docker2aci.SquashNone
+	case "also":
+		f.mode = docker2aci.SquashAlso
+	default:
+		return fmt.Errorf("invalid squash mode %q (must be true, false or also)", s)
+	}
+	return nil
+}
+
+func (f *squashFlag) IsBoolFlag() bool {
+	return true
+}
+
+// keyValueFlag is a flag.Value collecting key=value pairs. It can be given
+// several times.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid value %q (must be key=value)", s)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// listFlag is a flag.Value collecting the values of a flag that can be given
+// multiple times.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+var (
+	flagNoSquash         = flag.Bool("nosquash", false, "Don't Squash layers and output every layer as ACI")
+	flagPushURL          = flag.String("push-url", "", "Upload the generated ACIs (and their signatures) to this http(s):// or s3:// URL")
+	flagSignKey          = flag.String("sign-key", "", "Sign the generated ACIs with this gpg key, writing their signatures next to them with an .asc extension")
+	flagRktTrust         = flag.Bool("rkt-trust", false, "Trust the public key of --sign-key in rkt's keystore for the names of the generated ACIs, as rkt trust --prefix does")
+	flagRktKeystore      = flag.String("rkt-keystore", docker2aci.DefaultRktKeystore, "Directory of the keys trusted by rkt which --rkt-trust writes to")
+	flagDiscoveryURL     = flag.String("discovery-url", "", "Generate appc discovery pages for the ACIs hosted at this URL")
+	flagDiscoveryPubKeys = flag.String("discovery-pubkeys", "", "URL of the public keys to advertise in the discovery pages")
+	flagStorageRoot      = flag.String("storage-root", docker2aci.DefaultStorageRoot, "Graph root of the containers storage used by containers-storage:IMAGE")
+	flagDeadline         = flag.String("deadline", "", "Stop converting new layers after this duration (e.g. 30m) or RFC 3339 time, and report what remains")
+	flagDockerConfig     = flag.String("docker-config", "", "Docker config file with the registry credentials (default ~/.docker/config.json or ~/.dockercfg)")
+	flagEmitLockfile     = flag.String("emit-lockfile", "", "Write a lockfile with the resolved image IDs and the produced ACI image IDs")
+	flagFromLockfile     = flag.String("from-lockfile", "", "Convert the image IDs pinned in this lockfile and check the ACIs match it")
+	flagName             = flag.String("name", "", "Name of the generated ACI (e.g. example.com/myapp) instead of REGISTRYURL/IMAGE_NAME")
+	flagExec             = flag.String("exec", "", "Command to run instead of the image's entrypoint and cmd, split on spaces")
+	flagUser             = flag.String("user", "", "User name or ID to run the app as instead of the image's")
+	flagGroup            = flag.String("group", "", "Group name or ID to run the app as instead of the image's")
+	flagWorkDir          = flag.String("workdir", "", "Working directory of the app instead of the image's")
+	flagMemory           = flag.String("memory", "", "Memory limit of the app (e.g. 512M) instead of the image's")
+	flagCPU              = flag.String("cpu", "", "CPU limit of the app (e.g. 500m)")
+	flagCapRetain        = flag.String("cap-retain", "", "Comma-separated Linux capabilities to retain, dropping all the others")
+	flagCapRemove        = flag.String("cap-remove", "", "Comma-separated Linux capabilities to remove")
+	flagStripCaps        = flag.Bool("strip-capabilities", false, "Remove the file capabilities (security.capability) of the layers' files")
+	flagStripSetuid      = flag.Bool("strip-suid", false, "Remove the setuid and setgid bits of the layers' files")
+	flagMaxLayerSize     = flag.String("max-layer-size", "", "Fail if a layer has more than this size of files (e.g. 2G)")
+	flagMaxImageSize     = flag.String("max-image-size", "", "Fail if the image has more than this size of files (e.g. 10G)")
+	flagUIDMap           = flag.String("uid-map", "", "Comma-separated CONTAINERID:HOSTID:SIZE maps of the containers storage owners (e.g. 0:1000:1,1:100000:65536)")
+	flagGIDMap           = flag.String("gid-map", "", "Comma-separated CONTAINERID:HOSTID:SIZE maps of the containers storage groups")
+	flagPrePackHook      = flag.String("pre-pack-hook", "", "Shell command to run in the root filesystem of the squashed ACI, also given in $ROOTFS, before packing it")
+	flagAllowForeign     = flag.Bool("allow-foreign-layers", false, "Download the foreign layers missing from the containers storage from the URLs of the image manifest")
+	flagForce            = flag.Bool("force", false, "Convert images for other operating systems than Linux, labeling them with their OS")
+	flagHardlinkDups     = flag.Bool("hardlink-duplicates", false, "Hard link the identical files of the squashed ACI to a single copy")
+	flagCompressionLevel = flag.Int("compression-level", 0, "Gzip the generated ACIs with this level, from 1 (fastest) to 9 (smallest), or -1 for the default level; 0 doesn't compress")
+	flagMaxIdleConns     = flag.Int("max-idle-conns", docker2aci.DefaultMaxIdleConnsPerHost, "Number of idle connections to each registry kept alive between requests")
+	flagConnectTimeout   = flag.Duration("connect-timeout", docker2aci.DefaultConnectTimeout, "Fail if connecting to a registry takes longer than this; 0 waits forever")
+	flagReadTimeout      = flag.Duration("read-timeout", docker2aci.DefaultReadTimeout, "Fail if a registry sends no data for this long; 0 waits forever")
+	flagTmpDir           = flag.String("tmpdir", "", "Directory for the downloads and temporary files, e.g. on a large scratch disk (default $TMPDIR or /tmp)")
+	flagWorkDirectory    = flag.String("work-dir", "", "Keep the downloaded layers and packed layer ACIs in this directory so an interrupted conversion can be resumed by running it again")
+	flagCacheDir         = flag.String("cache-dir", "", "Keep the layers downloaded from registries in this directory so later conversions of images sharing them don't download them again")
+	flagContentTrust     = flag.Bool("content-trust", os.Getenv("DOCKER_CONTENT_TRUST") == "1", "Verify the tags of the registry images against their Notary trust data before converting them, refusing unsigned or tampered tags, as Docker Content Trust does (default $DOCKER_CONTENT_TRUST)")
+	flagNotaryServer     = flag.String("notary-server", os.Getenv("DOCKER_CONTENT_TRUST_SERVER"), "Notary server of --content-trust (default $DOCKER_CONTENT_TRUST_SERVER, notary.docker.io for Docker Hub or the registry)")
+	flagTrustDir         = flag.String("trust-dir", "", "Directory pinning the roots of the trust data verified by --content-trust (default ~/.docker2aci/trust)")
+	flagOffline          = flag.Bool("offline", false, "Convert the images from --cache-dir only, without contacting the registries; fails if a conversion needs something not cached")
+	flagSkipExisting     = flag.Bool("skip-existing", false, "Don't convert an image again if its ACIs are already in the output directory")
+	flagProgress         = flag.String("progress", "auto", "How to show the progress: auto (progress bars on a terminal), plain (no progress bars) or json (lines of JSON events on stdout, the messages go to stderr)")
+	flagJobs             = flag.Int("jobs", 1, "Number of images converted at once")
+	flagChunks           = flag.Int("chunks", 1, "Download each layer larger than 256M with this many ranged requests at once")
+	flagStats            = flag.Bool("stats", false, "Print the time and the size each layer took to download, read and pack, and the totals, after converting an image")
+	flagStatsFile        = flag.String("stats-file", "", "Write the stats of the conversions to this file as JSON")
+	flagSkipSpaceCheck   = flag.Bool("skip-space-check", false, "Don't check that the temporary and output directories have room for the image before converting it")
+	flagTraceHTTP        = flag.Bool("trace-http", false, "Print the requests made to the registries and their responses, with their headers, on stderr; credentials are redacted")
+	flagLimitRate        = flag.String("limit-rate", "", "Download at most this many bytes per second in total (e.g. 500K or 2M)")
+	flagCACert           = flag.String("cacert", "", "PEM file with the certificates of additional CAs to trust, e.g. the one of a private registry")
+	flagTimestamp        = flag.String("timestamp", os.Getenv("SOURCE_DATE_EPOCH"), "Clamp the modification times of the ACIs' files to this Unix time or RFC 3339 time (default $SOURCE_DATE_EPOCH)")
+	flagSquash           squashFlag
+	flagLabels           = make(keyValueFlag)
+	flagAnnotations      = make(keyValueFlag)
+	flagExclude          listFlag
+	flagInclude          listFlag
+)
+
+var (
+	// lockfiles loaded from --from-lockfile and to write to --emit-lockfile
+	fromLockfile *lockfile
+	emitLockfile *lockfile
+	// emitMu guards emitLockfile, images are converted concurrently with
+	// --jobs
+	emitMu sync.Mutex
+	// outputMu keeps the lists of generated files of an image together
+	outputMu sync.Mutex
+	// stats is the report to write to --stats-file
+	stats *statsReport
+)
+
+func init() {
+	flag.Var(&flagSquash, "squash", "Squash layers: true, false, or also (output every layer as ACI and the squashed ACI)")
+	flag.Var(flagLabels, "label", "Add the label key=value to the generated ACIs (can be repeated)")
+	flag.Var(flagAnnotations, "annotation", "Add the annotation key=value to the generated ACIs (can be repeated)")
+	flag.Var(&flagExclude, "exclude", "Leave the paths matching this glob pattern (e.g. /usr/share/doc) out of the generated ACIs (can be repeated)")
+	flag.Var(&flagInclude, "include", "Keep the paths matching this glob pattern even if they are excluded (can be repeated)")
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseIDMaps parses comma-separated CONTAINERID:HOSTID:SIZE ID maps.
+func parseIDMaps(s string) ([]docker2aci.IDMap, error) {
+	var maps []docker2aci.IDMap
+	for _, item := range splitList(s) {
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid ID map %q (must be CONTAINERID:HOSTID:SIZE)", item)
+		}
+		var ids [3]int
+		for i, p := range parts {
+			id, err := strconv.Atoi(p)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid ID map %q (must be CONTAINERID:HOSTID:SIZE)", item)
+			}
+			ids[i] = id
+		}
+		maps = append(maps, docker2aci.IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return maps, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix, in
+// powers of 1024. The empty string is 0.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	digits := s
+	if i := strings.IndexAny(s, "KMGT"); i == len(s)-1 {
+		multiplier = 1 << (10 * uint(strings.IndexByte("KMGT", s[i])+1))
+		digits = s[:i]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// a product wrapping negative would disable the limit
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return n * multiplier, nil
+}
+
+// isTerminal reports whether f is a terminal, so progress bars can be drawn
+// on it.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// parseDeadline parses a deadline given as a duration from now or as an
+// RFC 3339 time.
+func parseDeadline(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deadline %q: must be a duration or an RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// parseTimestamp parses a timestamp given as seconds since the Unix epoch,
+// like SOURCE_DATE_EPOCH, or as an RFC 3339 time.
+func parseTimestamp(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q: must be a Unix time or an RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// loadCredentials loads the registry credentials from the docker config file
+// given with --docker-config or, if none is given, from the default ones if
+// they exist.
+func loadCredentials() (map[string]docker2aci.Credentials, error) {
+	if *flagDockerConfig != "" {
+		return docker2aci.LoadDockerCredentials(*flagDockerConfig)
+	}
+
+	home := os.Getenv("HOME")
+	for _, p := range []string{
+		filepath.Join(home, ".docker", "config.json"),
+		filepath.Join(home, ".dockercfg"),
+	} {
+		if _, err := os.Stat(p); err == nil {
+			return docker2aci.LoadDockerCredentials(p)
+		}
+	}
+
+	return nil, nil
+}
+
+// handleSignals calls cancel on SIGINT or SIGTERM so the conversion stops
+// and removes its files. A second signal exits at once.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "Interrupted, cleaning up (interrupt again to exit now)")
+		cancel()
+		<-signals
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// loadTLSConfig returns the TLS settings trusting the CAs of the PEM file
+// caFile besides the system ones, or nil if caFile is empty.
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// pinImage sets config.ImageID to the image ID reference is pinned to in
+// --from-lockfile or, when only emitting a lockfile, to the image ID its tag
+// currently resolves to. It returns the lockfile entry to check and record
+// the generated ACIs with, if any.
+func pinImage(ctx context.Context, reference string, config *docker2aci.Config) (*lockedImage, error) {
+	if fromLockfile != nil {
+		li := fromLockfile.get(reference)
+		if li == nil {
+			return nil, fmt.Errorf("%s is not in the lockfile", reference)
+		}
+		config.ImageID = li.ImageID
+		return li, nil
+	}
+
+	if emitLockfile != nil {
+		imageID, err := docker2aci.ResolveImageIDWithContext(ctx, reference, config.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		config.ImageID = imageID
+		return &lockedImage{Reference: reference, ImageID: imageID}, nil
+	}
+
+	return nil, nil
+}
+
+// lockImage checks the ACIs generated for li against --from-lockfile and
+// records them for --emit-lockfile.
+func lockImage(li *lockedImage, aciPaths []string) error {
+	acis, err := lockACIs(aciPaths)
+	if err != nil {
+		return err
+	}
+
+	if fromLockfile != nil {
+		if err := li.verify(acis); err != nil {
+			return err
+		}
+	}
+
+	if emitLockfile != nil {
+		emitMu.Lock()
+		emitLockfile.set(lockedImage{Reference: li.Reference, ImageID: li.ImageID, ACIs: acis})
+		emitMu.Unlock()
+	}
+
+	return nil
+}
+
+// namedSource is a source opened from the arguments with a prefix, whose
+// image is named after what it was found as.
+type namedSource interface {
+	docker2aci.Source
+	Name() string
+	Close() error
+}
+
+// openSource opens the source of arg if it starts with the prefix of one,
+// returning nil otherwise:
+//
+//	docker-archive:PATH[:REF]
+//	oci:DIR[:REF]
+//	docker-daemon:IMAGE
+func openSource(ctx context.Context, arg string, tmpDir string) (namedSource, error) {
+	switch {
+	case strings.HasPrefix(arg, dockerArchivePrefix):
+		p, ref := splitSourceRef(strings.TrimPrefix(arg, dockerArchivePrefix))
+		return docker2aci.NewDockerArchiveSource(p, ref)
+	case strings.HasPrefix(arg, ociLayoutPrefix):
+		dir, ref := splitSourceRef(strings.TrimPrefix(arg, ociLayoutPrefix))
+		return docker2aci.NewOCILayoutSource(dir, ref)
+	case strings.HasPrefix(arg, dockerDaemonPrefix):
+		image := strings.TrimPrefix(arg, dockerDaemonPrefix)
+		return docker2aci.NewDockerDaemonSource(ctx, "", image, tmpDir)
+	}
+	return nil, nil
+}
+
+// splitSourceRef splits PATH[:REF] at the first colon.
+func splitSourceRef(s string) (string, string) {
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func runDocker2ACI(ctx context.Context, arg string, config docker2aci.Config) ([]string, error) {
+	var aciLayerPaths []string
+	var locked *lockedImage
+	if config.Stats == nil && (*flagStats || stats != nil) {
+		config.Stats = &docker2aci.Stats{}
+	}
+	src, err := openSource(ctx, arg, config.TmpDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Conversion error: %v\n", err)
+		return nil, err
+	}
+	if src != nil {
+		defer src.Close()
+		// the layers are already on disk
+		config.CacheDir = ""
+		aciLayerPaths, err = docker2aci.ConvertSource(ctx, src, src.Name(), config)
+	} else if strings.HasPrefix(arg, containersStoragePrefix) {
+		image := strings.TrimPrefix(arg, containersStoragePrefix)
+		aciLayerPaths, err = docker2aci.ConvertContainersStorageWithContext(ctx, *flagStorageRoot, image, config)
+	} else {
+		if locked, err = pinImage(ctx, arg, &config); err != nil {
+			fmt.Fprintf(os.Stderr, "Lockfile error: %v\n", err)
+			return nil, err
+		}
+		aciLayerPaths, err = docker2aci.ConvertWithContext(ctx, arg, config)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Conversion error: %v\n", err)
+		return nil, err
+	}
+
+	outputMu.Lock()
+	fmt.Fprintf(docker2aci.Messages, "\nGenerated ACI(s):\n")
+	for _, aciFile := range aciLayerPaths {
+		fmt.Fprintln(docker2aci.Messages, aciFile)
+	}
+	if *flagStats {
+		printStats(docker2aci.Messages, arg, config.Stats)
+	}
+	outputMu.Unlock()
+	if stats != nil {
+		stats.add(arg, config.Stats)
+	}
+
+	if locked != nil {
+		if err := lockImage(locked, aciLayerPaths); err != nil {
+			fmt.Fprintf(os.Stderr, "Lockfile error: %v\n", err)
+			return nil, err
+		}
+	}
+
+	if *flagSignKey != "" {
+		for _, aciFile := range aciLayerPaths {
+			if err := docker2aci.SignACI(ctx, aciFile, *flagSignKey); err != nil {
+				fmt.Fprintf(os.Stderr, "Signing error: %v\n", err)
+				return nil, err
+			}
+		}
+	}
+
+	if *flagRktTrust {
+		keys, err := docker2aci.TrustACIs(ctx, aciLayerPaths, *flagRktKeystore, *flagSignKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Trust error: %v\n", err)
+			return nil, err
+		}
+
+		outputMu.Lock()
+		fmt.Fprintf(docker2aci.Messages, "\nTrusted key(s):\n")
+		for _, key := range keys {
+			fmt.Fprintln(docker2aci.Messages, key)
+		}
+		outputMu.Unlock()
+	}
+
+	if *flagDiscoveryURL != "" {
+		pages, err := docker2aci.GenerateDiscovery(aciLayerPaths, *flagDiscoveryURL, *flagDiscoveryPubKeys, ".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Discovery error: %v\n", err)
+			return nil, err
+		}
+
+		outputMu.Lock()
+		fmt.Fprintf(docker2aci.Messages, "\nGenerated discovery page(s):\n")
+		for _, page := range pages {
+			fmt.Fprintln(docker2aci.Messages, page)
+		}
+		outputMu.Unlock()
+	}
+
+	if *flagPushURL != "" {
+		if err := docker2aci.PushWithContext(ctx, aciLayerPaths, *flagPushURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Push error: %v\n", err)
+			return nil, err
+		}
+	}
+
+	return aciLayerPaths, nil
+}
+
+// exitCodeFor returns the exit code of a conversion which failed with err.
+func exitCodeFor(err error) int {
+	var aerr *docker2aci.ErrAuth
+	var nferr *docker2aci.ErrNotFound
+	var sterr *docker2aci.ErrStore
+	var uerr *docker2aci.ErrUntrusted
+	switch {
+	case errors.As(err, &uerr):
+		return exitUntrusted
+	case errors.As(err, &aerr):
+		return exitAuth
+	case errors.As(err, &nferr):
+		return exitNotFound
+	case errors.As(err, &sterr):
+		return exitStore
+	}
+	var herr *docker2aci.HTTPError
+	if errors.As(err, &herr) {
+		switch herr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return exitAuth
+		case http.StatusNotFound:
+			return exitNotFound
+		}
+		return exitNetwork
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return exitNetwork
+	}
+	var perr *os.PathError
+	var lerr *os.LinkError
+	var serr *os.SyscallError
+	if errors.As(err, &perr) || errors.As(err, &lerr) || errors.As(err, &serr) {
+		return exitStore
+	}
+	return exitFailure
+}
+
+// convertAll converts the images of args with jobs of them at once. It
+// returns the exit code of the first conversion which failed, 0 if none did,
+// or the exit code if the conversions had to stop: the images not started
+// then are left out.
+func convertAll(ctx context.Context, args []string, config docker2aci.Config, jobs int) (int, int) {
+	var mu sync.Mutex
+	failed := 0
+	exitCode := 0
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return exitCode != 0
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for arg := range queue {
+				if stopped() {
+					continue
+				}
+				_, err := runDocker2ACI(ctx, arg, config)
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				if ctx.Err() != nil {
+					exitCode = exitInterrupted
+				} else if derr, ok := err.(*docker2aci.DeadlineError); ok {
+					// report what was done in a machine-readable way
+					outputMu.Lock()
+					json.NewEncoder(os.Stdout).Encode(derr)
+					outputMu.Unlock()
+					if exitCode == 0 {
+						exitCode = exitDeadline
+					}
+				} else if failed == 0 {
+					failed = exitCodeFor(err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, arg := range args {
+		if stopped() {
+			break
+		}
+		queue <- arg
+	}
+	close(queue)
+	wg.Wait()
+
+	return failed, exitCode
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 {
+		fmt.Println("Usage: docker2aci [OPTIONS] [REGISTRYURL/]IMAGE_NAME[:TAG]...")
+		fmt.Println("       docker2aci [OPTIONS] containers-storage:IMAGE...")
+		fmt.Println("       docker2aci [OPTIONS] docker-archive:PATH[:REF]...")
+		fmt.Println("       docker2aci [OPTIONS] oci:DIR[:REF]...")
+		fmt.Println("       docker2aci [OPTIONS] docker-daemon:IMAGE...")
+		fmt.Println("       docker2aci [OPTIONS] serve [SERVE OPTIONS]")
+		fmt.Println("       docker2aci [OPTIONS] watch [WATCH OPTIONS] [REGISTRYURL/]IMAGE_NAME[:TAG]...")
+		fmt.Println("       docker2aci [OPTIONS] compose [COMPOSE OPTIONS]")
+		fmt.Println("       docker2aci [OPTIONS] run [--pod-manifest FILE] [DOCKER RUN OPTIONS] IMAGE [COMMAND [ARG...]]")
+		fmt.Println("       docker2aci [--cache-dir DIR] [--work-dir DIR] gc [GC OPTIONS]")
+		fmt.Println("       docker2aci validate [VALIDATE OPTIONS] ACI...")
+		flag.PrintDefaults()
+		fmt.Println()
+		fmt.Println("Exit codes:")
+		fmt.Printf("  %-4d the conversion failed\n", exitFailure)
+		fmt.Printf("  %-4d --deadline passed\n", exitDeadline)
+		fmt.Printf("  %-4d the registry rejected the credentials or wants some\n", exitAuth)
+		fmt.Printf("  %-4d the image wasn't found in the registry or the local store\n", exitNotFound)
+		fmt.Printf("  %-4d a registry couldn't be reached or a connection failed\n", exitNetwork)
+		fmt.Printf("  %-4d reading or writing files failed, e.g. the disk is full\n", exitStore)
+		fmt.Printf("  %-4d --content-trust refused the tag of an image\n", exitUntrusted)
+		fmt.Printf("  %-4d the conversion was interrupted\n", exitInterrupted)
+		return
+	}
+
+	if *flagJobs < 1 {
+		fmt.Fprintln(os.Stderr, "--jobs must be at least 1")
+		os.Exit(1)
+	}
+	if *flagChunks < 1 {
+		fmt.Fprintln(os.Stderr, "--chunks must be at least 1")
+		os.Exit(1)
+	}
+
+	if *flagOffline && *flagCacheDir == "" {
+		fmt.Fprintln(os.Stderr, "--offline needs --cache-dir")
+		os.Exit(1)
+	}
+	if *flagOffline && *flagContentTrust {
+		fmt.Fprintln(os.Stderr, "--content-trust can't be used with --offline, the trust data is on the Notary servers")
+		os.Exit(1)
+	}
+	if *flagOffline && *flagEmitLockfile != "" && *flagFromLockfile == "" {
+		// resolving the tags takes the registries
+		fmt.Fprintln(os.Stderr, "--offline can only emit a lockfile with --from-lockfile")
+		os.Exit(1)
+	}
+
+	// the subcommands take their own arguments and convert several images
+	// with their own names
+	subcommand := ""
+	switch args[0] {
+	case "serve", "watch", "compose", "run", "gc", "validate":
+		subcommand = args[0]
+	}
+	if *flagName != "" && subcommand != "" {
+		fmt.Fprintf(os.Stderr, "--name can't be used with %s\n", subcommand)
+		os.Exit(1)
+	}
+	if (*flagEmitLockfile != "" || *flagFromLockfile != "") && subcommand != "" {
+		fmt.Fprintf(os.Stderr, "the lockfiles can't be used with %s\n", subcommand)
+		os.Exit(1)
+	}
+	if (*flagSignKey != "" || *flagRktTrust) && subcommand == "serve" {
+		fmt.Fprintln(os.Stderr, "--sign-key and --rkt-trust can't be used with serve, which takes its own --sign-key")
+		os.Exit(1)
+	}
+	if *flagRktTrust && *flagSignKey == "" {
+		fmt.Fprintln(os.Stderr, "--rkt-trust needs --sign-key")
+		os.Exit(1)
+	}
+	if *flagName != "" && len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "--name can only be used with a single image")
+		os.Exit(1)
+	}
+
+	config := docker2aci.Config{
+		Squash:    flagSquash.mode,
+		OutputDir: ".",
+		Name:      *flagName,
+		App: docker2aci.AppOverrides{
+			Exec:               strings.Fields(*flagExec),
+			User:               *flagUser,
+			Group:              *flagGroup,
+			WorkingDirectory:   *flagWorkDir,
+			Memory:             *flagMemory,
+			CPU:                *flagCPU,
+			RetainCapabilities: splitList(*flagCapRetain),
+			RemoveCapabilities: splitList(*flagCapRemove),
+		},
+		Labels:             flagLabels,
+		Annotations:        flagAnnotations,
+		StripCapabilities:  *flagStripCaps,
+		StripSetuid:        *flagStripSetuid,
+		Exclude:            flagExclude,
+		Include:            flagInclude,
+		PrePackHook:        *flagPrePackHook,
+		AllowForeignLayers: *flagAllowForeign,
+		AllowNonLinux:      *flagForce,
+		HardlinkDuplicates: *flagHardlinkDups,
+		CompressionLevel:   *flagCompressionLevel,
+		TmpDir:             *flagTmpDir,
+		WorkDir:            *flagWorkDirectory,
+		CacheDir:           *flagCacheDir,
+		Offline:            *flagOffline,
+		ContentTrust:       *flagContentTrust,
+		NotaryServer:       *flagNotaryServer,
+		TrustDir:           *flagTrustDir,
+		ChunkedDownloads:   *flagChunks,
+		SkipSpaceCheck:     *flagSkipSpaceCheck,
+		SkipExisting:       *flagSkipExisting,
+	}
+	if *flagNoSquash {
+		config.Squash = docker2aci.SquashNone
+	}
+	if *flagContentTrust && config.TrustDir == "" {
+		config.TrustDir = filepath.Join(os.Getenv("HOME"), ".docker2aci", "trust")
+	}
+	switch *flagProgress {
+	case "auto":
+		config.ShowProgress = isTerminal(os.Stdout)
+	case "plain":
+	case "json":
+		// stdout only has the events
+		config.Events = os.Stdout
+		docker2aci.Messages = os.Stderr
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --progress %q: must be auto, plain or json\n", *flagProgress)
+		os.Exit(1)
+	}
+	if *flagDeadline != "" {
+		deadline, err := parseDeadline(*flagDeadline)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		config.Deadline = deadline
+	}
+	if *flagTimestamp != "" {
+		timestamp, err := parseTimestamp(*flagTimestamp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		config.Timestamp = timestamp
+	}
+
+	for _, limit := range []struct {
+		flag string
+		dest *int64
+	}{
+		{*flagMaxLayerSize, &config.MaxLayerSize},
+		{*flagMaxImageSize, &config.MaxImageSize},
+	} {
+		size, err := parseSize(limit.flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*limit.dest = size
+	}
+
+	for _, m := range []struct {
+		flag string
+		dest *[]docker2aci.IDMap
+	}{
+		{*flagUIDMap, &config.UIDMap},
+		{*flagGIDMap, &config.GIDMap},
+	} {
+		maps, err := parseIDMaps(m.flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*m.dest = maps
+	}
+
+	rateLimit, err := parseSize(*flagLimitRate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tlsConfig, err := loadTLSConfig(*flagCACert)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading CA certificates: %v\n", err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	// resolving tags and pushing use the default client too
+	httpOptions := docker2aci.HTTPOptions{
+		MaxIdleConnsPerHost: *flagMaxIdleConns,
+		TLSConfig:           tlsConfig,
+		ConnectTimeout:      *flagConnectTimeout,
+		ReadTimeout:         *flagReadTimeout,
+		RateLimit:           rateLimit,
+	}
+	if *flagTraceHTTP {
+		httpOptions.Trace = os.Stderr
+	}
+	docker2aci.DefaultHTTPClient = docker2aci.NewHTTPClient(httpOptions)
+
+	credentials, err := loadCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading credentials: %v\n", err)
+		os.Exit(1)
+	}
+	config.Credentials = credentials
+
+	switch subcommand {
+	case "serve":
+		os.Exit(runServe(ctx, args[1:], config))
+	case "watch":
+		os.Exit(runWatch(ctx, args[1:], config))
+	case "compose":
+		os.Exit(runCompose(ctx, args[1:], config))
+	case "run":
+		os.Exit(runDockerRun(ctx, args[1:], config))
+	case "gc":
+		os.Exit(runGC(args[1:], config))
+	case "validate":
+		os.Exit(runValidate(args[1:]))
+	}
+
+	if *flagFromLockfile != "" {
+		if fromLockfile, err = readLockfile(*flagFromLockfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading lockfile: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagEmitLockfile != "" {
+		emitLockfile = &lockfile{}
+	}
+	if *flagStatsFile != "" {
+		stats = &statsReport{}
+	}
+
+	// the images share the ACIs of their common layers
+	if len(args) > 1 {
+		config.Layers = docker2aci.NewLayerSet()
+	}
+	failed, exitCode := convertAll(ctx, args, config, *flagJobs)
+	if config.Layers != nil {
+		config.Layers.Close()
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+
+	if emitLockfile != nil {
+		// in the order of the arguments, whichever image was converted
+		// first
+		emitLockfile.sort(args)
+		if err := emitLockfile.write(*flagEmitLockfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing lockfile: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if stats != nil {
+		if err := stats.write(*flagStatsFile, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing stats: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if failed != 0 {
+		os.Exit(failed)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+const runUsage = "Usage: docker2aci [OPTIONS] run [--pod-manifest FILE] [DOCKER RUN OPTIONS] IMAGE [COMMAND [ARG...]]"
+
+// runDockerRun runs `docker2aci run` with the arguments following it,
+// converting the image of docker run arguments with config and writing the
+// pod manifest running it the way docker run would. It returns the exit
+// code.
+func runDockerRun(ctx context.Context, args []string, config docker2aci.Config) int {
+	// the options of docker run follow ours
+	podManifest := "pod-manifest.json"
+	for len(args) > 0 {
+		if args[0] == "--pod-manifest" && len(args) > 1 {
+			podManifest, args = args[1], args[2:]
+		} else if strings.HasPrefix(args[0], "--pod-manifest=") {
+			podManifest, args = strings.TrimPrefix(args[0], "--pod-manifest="), args[1:]
+		} else {
+			break
+		}
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, runUsage)
+		fmt.Fprintln(os.Stderr, "The image is squashed, the pod manifest runs its ACI with the ports, volumes, environment and limits of the options, as docker run would.")
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	image, app, err := docker2aci.ParseDockerRun(args, wd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid docker run arguments: %v\n%s\n", err, runUsage)
+		return 1
+	}
+
+	// an app of the pod runs a single ACI
+	config.Squash = docker2aci.SquashOnly
+	aciPaths, err := runDocker2ACI(ctx, image, config)
+	if ctx.Err() != nil {
+		return exitInterrupted
+	} else if err != nil {
+		return exitCodeFor(err)
+	}
+	app.ACI = aciPaths[len(aciPaths)-1]
+
+	pod, err := docker2aci.GeneratePodManifest([]docker2aci.PodApp{*app})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating pod manifest: %v\n", err)
+		return 1
+	}
+	if err := writePodManifest(podManifest, pod); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing pod manifest: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(docker2aci.Messages, "\nGenerated pod manifest:\n%s\n", podManifest)
+	return 0
+}
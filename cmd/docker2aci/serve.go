@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+// runServe runs `docker2aci serve` with the arguments following it,
+// converting the images rkt asks for with config. It returns the exit code.
+func runServe(ctx context.Context, args []string, config docker2aci.Config) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := fs.String("listen", ":8080", "Address to listen on")
+	registry := fs.String("registry", "", "Registry the images are converted from, e.g. quay.io (default Docker Hub)")
+	domain := fs.String("domain", "", "Domain of the image names served, e.g. example.com (default the host of each request)")
+	baseURL := fs.String("base-url", "", "URL the server is reached at, advertised in the discovery pages (default the scheme and host of each request)")
+	dir := fs.String("dir", ".", "Directory to convert the ACIs to and keep them in")
+	signKey := fs.String("sign-key", "", "gpg key to sign the ACIs with, advertised in the discovery pages")
+	refresh := fs.Duration("refresh", docker2aci.DefaultServerRefresh, "How long a converted ACI is served before its tag is resolved again")
+	jobTTL := fs.Duration("job-ttl", docker2aci.DefaultJobTTL, "How long a finished job, its log and its ACIs are kept")
+	tlsCert := fs.String("tls-cert", "", "PEM certificate to serve HTTPS with, rkt only discovers over HTTPS unless --insecure-options=http")
+	tlsKey := fs.String("tls-key", "", "PEM key of --tls-cert")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker2aci [OPTIONS] serve [SERVE OPTIONS]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 1
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "--tls-cert and --tls-key must be given together")
+		return 1
+	}
+
+	server := docker2aci.NewServer(ctx, docker2aci.ServerOptions{
+		Registry: *registry,
+		Domain:   *domain,
+		BaseURL:  *baseURL,
+		Dir:      *dir,
+		SignKey:  *signKey,
+		Refresh:  *refresh,
+		Config:   config,
+		Metrics:  docker2aci.NewMetrics(),
+		Jobs:     *flagJobs,
+		JobTTL:   *jobTTL,
+	})
+	srv := &http.Server{Addr: *listen, Handler: server}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving ACIs on %s, metrics at /metrics\n", *listen)
+	var err error
+	if *tlsCert != "" {
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return exitInterrupted
+}
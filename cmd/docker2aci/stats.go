@@ -0,0 +1,146 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+// statsReport is the file of --stats-file, with the stats of every image
+// converted.
+type statsReport struct {
+	mu     sync.Mutex
+	Images []imageStats `json:"images"`
+}
+
+type imageStats struct {
+	Reference string `json:"reference"`
+	*docker2aci.Stats
+}
+
+func (r *statsReport) add(reference string, stats *docker2aci.Stats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Images = append(r.Images, imageStats{Reference: reference, Stats: stats})
+}
+
+// write writes the report with the images in the order of references.
+func (r *statsReport) write(path string, references []string) error {
+	index := make(map[string]int)
+	for i, ref := range references {
+		if _, ok := index[ref]; !ok {
+			index[ref] = i
+		}
+	}
+	sort.SliceStable(r.Images, func(i, j int) bool {
+		return index[r.Images[i].Reference] < index[r.Images[j].Reference]
+	})
+
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// printStats prints the stats of the conversion of reference as a table of
+// its layers followed by the totals.
+func printStats(w io.Writer, reference string, stats *docker2aci.Stats) {
+	fmt.Fprintf(w, "\nStats of %s:\n", reference)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tDOWNLOAD\tREAD\tPACK\tDOWNLOADED\tFILES\tACI")
+
+	var downloadTime, readTime, packTime time.Duration
+	var downloaded, files, acis int64
+	for _, l := range stats.Layers {
+		id := l.Layer
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		acis += l.ACISize
+		if l.Reused {
+			fmt.Fprintf(tw, "%s\treused\t-\t-\t-\t-\t%s\n", id, formatSize(l.ACISize))
+			continue
+		}
+		download := formatDuration(l.DownloadTime)
+		if l.Cached {
+			download = "cached"
+		}
+		pack := "-"
+		if l.ACI != "" {
+			pack = formatDuration(l.PackTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, download, formatDuration(l.ReadTime), pack,
+			formatSize(l.DownloadSize), formatSize(l.FilesSize), formatSize(l.ACISize))
+
+		downloadTime += l.DownloadTime
+		readTime += l.ReadTime
+		packTime += l.PackTime
+		downloaded += l.DownloadSize
+		files += l.FilesSize
+	}
+	fmt.Fprintf(tw, "total\t%s\t%s\t%s\t%s\t%s\t%s\n", formatDuration(downloadTime), formatDuration(readTime), formatDuration(packTime),
+		formatSize(downloaded), formatSize(files), formatSize(acis))
+	tw.Flush()
+
+	for _, step := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"Squashing", stats.SquashTime},
+		{"Pre-pack hook", stats.HookTime},
+		{"Compression", stats.CompressTime},
+	} {
+		if step.d > 0 {
+			fmt.Fprintf(w, "%s: %s\n", step.name, formatDuration(step.d))
+		}
+	}
+	for _, a := range stats.ACIs {
+		fmt.Fprintf(w, "%s: %s\n", filepath.Base(a.File), formatSize(a.Size))
+	}
+	fmt.Fprintf(w, "Total time: %s (layers are downloaded while others are converted)\n", formatDuration(stats.TotalTime))
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// formatSize formats n bytes in binary units, e.g. 4.2M.
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
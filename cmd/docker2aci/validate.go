@@ -0,0 +1,58 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+// runValidate runs `docker2aci validate` with the arguments following it,
+// validating the ACIs they name. It returns the exit code, exitFailure if an
+// ACI is invalid.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	noDeps := fs.Bool("no-dependencies", false, "Don't check the dependency chains of the ACIs")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker2aci validate [VALIDATE OPTIONS] ACI...")
+		fmt.Fprintln(os.Stderr, "The layout and the manifest of the ACIs are validated as actool validate does, and their dependencies are resolved among the ACIs given and the ones next to them.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	exitCode := 0
+	for _, aciPath := range fs.Args() {
+		_, err := docker2aci.ValidateACI(aciPath)
+		if err == nil && !*noDeps {
+			err = docker2aci.ValidateDependencies(aciPath, fs.Args())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", aciPath, err)
+			exitCode = exitFailure
+			continue
+		}
+		fmt.Fprintf(docker2aci.Messages, "%s: valid\n", aciPath)
+	}
+	return exitCode
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/docker2aci/lib"
+)
+
+// watchedImage is an image of `docker2aci watch`: its repository and the tag
+// watched, every tag if it's empty.
+type watchedImage struct {
+	repo string
+	tag  string
+}
+
+// parseWatchedImage splits arg into its repository and tag. A colon before
+// the last slash is the one of a registry port.
+func parseWatchedImage(arg string) watchedImage {
+	if i := strings.LastIndex(arg, ":"); i > strings.LastIndex(arg, "/") {
+		return watchedImage{repo: arg[:i], tag: arg[i+1:]}
+	}
+	return watchedImage{repo: arg}
+}
+
+// runWatch runs `docker2aci watch` with the arguments following it,
+// converting the tags of the images with config whenever they're new or
+// moved, until ctx is done. It returns the exit code.
+func runWatch(ctx context.Context, args []string, config docker2aci.Config) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", 10*time.Minute, "How often to poll the registries for new or moved tags")
+	tagsPattern := fs.String("tags", "", "Only watch the tags matching this regular expression, for the images given without a tag")
+	metricsListen := fs.String("metrics-listen", "", "Address to serve the Prometheus metrics of the conversions on, at /metrics")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker2aci [OPTIONS] watch [WATCH OPTIONS] [REGISTRYURL/]IMAGE_NAME[:TAG]...")
+		fmt.Fprintln(os.Stderr, "Every tag of the images given without a tag is watched.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "--interval must be positive")
+		return 1
+	}
+	tags, err := regexp.Compile(*tagsPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --tags: %v\n", err)
+		return 1
+	}
+
+	var images []watchedImage
+	for _, arg := range fs.Args() {
+		images = append(images, parseWatchedImage(arg))
+	}
+	// the ACIs converted by an earlier run are reused
+	config.SkipExisting = true
+	w := &watcher{config: config, tags: tags, seen: make(map[string]string)}
+	if *metricsListen != "" {
+		w.metrics = docker2aci.NewMetrics()
+		if err := serveMetrics(ctx, *metricsListen, w.metrics); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	for {
+		w.poll(ctx, images)
+		select {
+		case <-ctx.Done():
+			return exitInterrupted
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// watcher converts the tags of the watched images which moved since it last
+// polled them.
+type watcher struct {
+	config docker2aci.Config
+	tags   *regexp.Regexp
+	// metrics, if not nil, records the conversions
+	metrics *docker2aci.Metrics
+
+	mu sync.Mutex
+	// seen are the image IDs of the tags converted, keyed by their
+	// reference
+	seen map[string]string
+}
+
+// poll lists the tags of images and converts the new or moved ones, --jobs
+// at once. The failed conversions are tried again at the next poll.
+func (w *watcher) poll(ctx context.Context, images []watchedImage) {
+	sem := make(chan struct{}, *flagJobs)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, img := range images {
+		ids, err := docker2aci.ListTagsWithContext(ctx, img.repo, w.config.Credentials)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing the tags of %s: %v\n", img.repo, err)
+			continue
+		}
+		if img.tag != "" {
+			if _, ok := ids[img.tag]; !ok {
+				fmt.Fprintf(os.Stderr, "Warning: %s has no tag %s\n", img.repo, img.tag)
+			}
+		}
+
+		for _, tag := range w.moved(img, ids) {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(ref string, id string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				config := w.config
+				// the image seen, even if the tag moves again meanwhile
+				config.ImageID = id
+				if w.metrics != nil {
+					config.Stats = &docker2aci.Stats{}
+				}
+				start := time.Now()
+				_, err := runDocker2ACI(ctx, ref, config)
+				if w.metrics != nil {
+					w.metrics.Observe(time.Since(start), config.Stats, err)
+				}
+				if err != nil {
+					return
+				}
+				w.mu.Lock()
+				w.seen[ref] = id
+				w.mu.Unlock()
+			}(img.repo+":"+tag, ids[tag])
+		}
+	}
+}
+
+// moved returns the watched tags of img, sorted, whose image is not the one
+// converted last, given their image IDs.
+func (w *watcher) moved(img watchedImage, ids map[string]string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var moved []string
+	for tag, id := range ids {
+		if img.tag != "" && tag != img.tag {
+			continue
+		}
+		if img.tag == "" && !w.tags.MatchString(tag) {
+			continue
+		}
+		if w.seen[img.repo+":"+tag] != id {
+			moved = append(moved, tag)
+		}
+	}
+	sort.Strings(moved)
+	return moved
+}
+
+// serveMetrics serves metrics at /metrics on addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string, metrics *docker2aci.Metrics) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go srv.Serve(l)
+	return nil
+}
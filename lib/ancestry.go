@@ -0,0 +1,326 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/appc/docker2aci/tarball"
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema/types"
+)
+
+// ancestryState holds what the layer being converted inherits from the lower
+// layers of its image. Layers have to be added from the base one.
+type ancestryState struct {
+	users   userDatabase
+	history []DockerHistory
+	// filter selects the files written to the ACIs, the others are
+	// ignored.
+	filter *pathFilter
+	// parentLayerID and parentImageID are the layer ID and the image ID of
+	// the ACI the layer depends on, the one of the closest ancestor that
+	// wasn't empty.
+	parentLayerID string
+	parentImageID string
+	// parentApp and parentLabels, if parentApp isn't nil, are the name and
+	// the labels of that ACI when it was converted with another image,
+	// see LayerSet, and has another name than the layer's image gives it.
+	parentApp    *types.ACName
+	parentLabels types.Labels
+
+	// files are the paths of the image's root filesystem as seen from the
+	// last layer added, without the leading slash.
+	files map[string]struct{}
+	// deleted reports whether the last layer added had whiteouts, and empty
+	// whether it had no entries at all, like the layers of ENV or LABEL
+	// instructions.
+	deleted bool
+	empty   bool
+	// setuid are the regular files of files with the setuid or setgid
+	// bit.
+	setuid map[string]struct{}
+	// symlinks are the symlinks of files, with their targets.
+	symlinks map[string]string
+
+	// layerSize is the size of the files of the last layer added and
+	// imageSize the one of all the layers added.
+	layerSize int64
+	imageSize int64
+}
+
+// clone returns a copy of state which can be changed independently of it.
+func (state *ancestryState) clone() *ancestryState {
+	c := *state
+	c.history = append([]DockerHistory(nil), state.history...)
+	c.files = copySet(state.files)
+	c.setuid = copySet(state.setuid)
+	if state.symlinks != nil {
+		c.symlinks = make(map[string]string, len(state.symlinks))
+		for name, target := range state.symlinks {
+			c.symlinks[name] = target
+		}
+	}
+	return &c
+}
+
+func copySet(set map[string]struct{}) map[string]struct{} {
+	if set == nil {
+		return nil
+	}
+	c := make(map[string]struct{}, len(set))
+	for name := range set {
+		c[name] = struct{}{}
+	}
+	return c
+}
+
+const (
+	// blockSize is the size of the blocks of a tarball.
+	blockSize = 512
+	// maxSymlinks is the most symlinks followed to resolve a path, the
+	// limit of Linux.
+	maxSymlinks = 40
+)
+
+// layerEntry is what addLayer records about the entries of a layer.
+type layerEntry struct {
+	name     string
+	setuid   bool
+	symlink  bool
+	linkname string
+}
+
+// addLayer updates state with the files of the layer tarball, which can be
+// compressed, and rewinds it. The layer's whiteouts only delete files of the
+// lower layers, so they are applied before its own files are added: an
+// opaque directory keeps the files the layer puts in it.
+func (state *ancestryState) addLayer(layer io.ReadSeeker) error {
+	reader, err := newLayerReader(layer)
+	if err != nil {
+		return err
+	}
+
+	var added []layerEntry
+	var whiteouts []string
+	state.layerSize = 0
+	walker := func(t *tarball.TarFile) error {
+		state.layerSize += t.Header.Size
+		name := tarball.CleanName(t.Name())
+		if name == "" || tarball.Escapes(t.Name()) {
+			return nil
+		}
+		if state.filter.excluded(name) {
+			return nil
+		}
+		if tarball.IsWhiteout(name) {
+			whiteouts = append(whiteouts, name)
+			return nil
+		}
+		added = append(added, layerEntry{
+			name:    name,
+			setuid:  isSetuid(t.Header),
+			symlink:  t.Header.Typeflag == tar.TypeSymlink,
+			linkname: t.Linkname(),
+		})
+		return state.users.addFile(name, t.TarStream)
+	}
+
+	if err := tarball.Walk(*reader, walker); err != nil {
+		return err
+	}
+
+	if state.files == nil {
+		state.files = make(map[string]struct{})
+		state.setuid = make(map[string]struct{})
+		state.symlinks = make(map[string]string)
+	}
+	for _, w := range whiteouts {
+		state.delete(tarball.WhiteoutTarget(w), tarball.IsOpaqueWhiteout(w))
+	}
+	for _, e := range added {
+		state.files[e.name] = struct{}{}
+		setMember(state.setuid, e.name, e.setuid)
+		if e.symlink {
+			state.symlinks[e.name] = e.linkname
+		} else {
+			delete(state.symlinks, e.name)
+		}
+	}
+	for name := range state.setuid {
+		if _, ok := state.files[name]; !ok {
+			delete(state.setuid, name)
+		}
+	}
+	for name := range state.symlinks {
+		if _, ok := state.files[name]; !ok {
+			delete(state.symlinks, name)
+		}
+	}
+	// a whiteout, like an opaque one of etc, can have deleted the users
+	state.users.prune(state.files)
+	state.deleted = len(whiteouts) > 0
+	state.empty = len(added) == 0 && len(whiteouts) == 0
+	state.imageSize += state.layerSize
+
+	_, err = layer.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// newLayerReader returns a tar reader of the layer tarball, which can be
+// compressed. aci.NewCompressedTarReader doesn't recognize uncompressed
+// layers without entries, which are empty or only have the end-of-archive
+// blocks, as tarballs.
+func newLayerReader(layer io.ReadSeeker) (*tar.Reader, error) {
+	if _, err := layer.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 2*blockSize)
+	n, err := io.ReadFull(layer, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if _, err := layer.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(head[:n], make([]byte, n)) {
+		return tar.NewReader(layer), nil
+	}
+	return aci.NewCompressedTarReader(layer)
+}
+
+// setMember adds name to set if member is true and removes it otherwise.
+func setMember(set map[string]struct{}, name string, member bool) {
+	if member {
+		set[name] = struct{}{}
+	} else {
+		delete(set, name)
+	}
+}
+
+// escapesThroughSymlink reports whether the parent directory of name, a
+// cleaned entry name, is out of the image's root filesystem once the
+// symlinks of the root filesystem it goes through are followed, like
+// lib -> ../lib. Writing the entry would follow them. Absolute targets are
+// taken from the image's root, and paths going through more than maxSymlinks
+// symlinks, like loops, are taken for escaping.
+func (state *ancestryState) escapesThroughSymlink(name string) bool {
+	dir := path.Dir(name)
+	if dir == "." {
+		return false
+	}
+	// resolved is the part of dir resolved, from the root, and rest the
+	// components left
+	resolved := ""
+	rest := strings.Split(dir, "/")
+	followed := 0
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return true
+			}
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+		p := path.Join(resolved, c)
+		target, ok := state.symlinks[p]
+		if !ok {
+			resolved = p
+			continue
+		}
+		if followed++; followed > maxSymlinks {
+			return true
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return false
+}
+
+// delete removes p and everything under it from state.files. Opaque
+// deletions keep p itself.
+func (state *ancestryState) delete(p string, opaque bool) {
+	if !opaque {
+		delete(state.files, p)
+	}
+	prefix := p + "/"
+	if p == "" {
+		prefix = ""
+	}
+	for f := range state.files {
+		if strings.HasPrefix(f, prefix) {
+			delete(state.files, f)
+		}
+	}
+}
+
+// pathWhitelist returns the pathWhitelist of the last layer added: every path
+// of the image's root filesystem if the layer deleted files, so rendering
+// the ACI hides them like Docker does, or nil otherwise.
+func (state *ancestryState) pathWhitelist() []string {
+	if !state.deleted {
+		return nil
+	}
+
+	whitelist := make([]string, 0, len(state.files))
+	for f := range state.files {
+		whitelist = append(whitelist, "/"+f)
+	}
+	sort.Strings(whitelist)
+	return whitelist
+}
+
+// setuidFiles returns the paths of the setuid and setgid files of the image's
+// root filesystem, sorted.
+func (state *ancestryState) setuidFiles() []string {
+	var files []string
+	for f := range state.setuid {
+		files = append(files, "/"+f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// addHistory records how the layer was built. Image configs carry the whole
+// history of the image; v1 layers only describe themselves, the command they
+// were created by being the one of their container.
+func (state *ancestryState) addHistory(layerData DockerImageData) {
+	if len(layerData.History) > 0 {
+		state.history = layerData.History
+		return
+	}
+	state.history = append(state.history, DockerHistory{
+		Created:   layerData.Created,
+		Author:    layerData.Author,
+		CreatedBy: strings.Join(layerData.ContainerConfig.Cmd, " "),
+		Comment:   layerData.Comment,
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testLayer returns a layer tarball of hdrs, the regular files having their
+// names as contents.
+func testLayer(t *testing.T, hdrs []tar.Header) *bytes.Reader {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.WriteString(tw, hdr.Name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+func TestEscapesThroughSymlink(t *testing.T) {
+	state := &ancestryState{}
+	base := testLayer(t, []tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"},
+		{Name: "lib64", Typeflag: tar.TypeSymlink, Linkname: "/lib"},
+		{Name: "usr/lib/cache", Typeflag: tar.TypeSymlink, Linkname: "../../var/cache"},
+		{Name: "host", Typeflag: tar.TypeSymlink, Linkname: "../"},
+		{Name: "usr/lib/up", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"},
+	})
+	if err := state.addLayer(base); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"etc/passwd", false},
+		{"lib", false},
+		{"lib/libc.so", false},
+		{"lib64/libc.so", false},
+		{"lib/cache/apt/archives", false},
+		{"host/etc/passwd", true},
+		{"lib/up/etc/passwd", true},
+		{"lib64/up/etc/passwd", true},
+		{"loop/file", true},
+	}
+	for _, tt := range tests {
+		if got := state.escapesThroughSymlink(tt.name); got != tt.want {
+			t.Errorf("escapesThroughSymlink(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteACIThroughSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker2aci-ancestry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := &ancestryState{}
+	base := testLayer(t, []tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"},
+		{Name: "host", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+	})
+	if err := state.addLayer(base); err != nil {
+		t.Fatal(err)
+	}
+	layer := testLayer(t, []tar.Header{
+		{Name: "lib/libc.so", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "host/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+	})
+	if err := state.addLayer(layer); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "layer.aci")
+	if _, err := writeACI(layer, testImageManifest("example.com/layer"), output, Config{}, state); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "manifest" && hdr.Name != "rootfs" {
+			names = append(names, hdr.Name)
+		}
+	}
+	if want := []string{"rootfs/lib/libc.so", "rootfs/usr/bin"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %q, want %q", names, want)
+	}
+}
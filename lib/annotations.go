@@ -0,0 +1,267 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	// dockerAnnotationPrefix is the prefix of the annotations keeping the
+	// Docker metadata that has no ACI equivalent.
+	dockerAnnotationPrefix = "appc.io/docker/"
+	labelAnnotationPrefix  = dockerAnnotationPrefix + "label/"
+
+	dockerVersionAnnotation = dockerAnnotationPrefix + "docker-version"
+	commentAnnotation       = dockerAnnotationPrefix + "comment"
+	historyAnnotation       = dockerAnnotationPrefix + "history"
+	// originalNameAnnotation keeps the Docker name of the image, which
+	// had to be sanitized into the ACI name.
+	originalNameAnnotation = dockerAnnotationPrefix + "original-name"
+	// configAnnotation keeps the Docker config of the layer as it was
+	// stored, so the original image can be reconstructed.
+	configAnnotation = dockerAnnotationPrefix + "config"
+	// layerIDAnnotation keeps the ID of the layer converted, which the
+	// squashed image has no layer label for.
+	layerIDAnnotation = dockerAnnotationPrefix + "layer-id"
+	// strippedSetuidAnnotation lists the files whose setuid and setgid
+	// bits were removed.
+	strippedSetuidAnnotation = dockerAnnotationPrefix + "stripped-setuid"
+	// excludeAnnotation and includeAnnotation keep the patterns of the
+	// paths left out of the image and kept anyway.
+	excludeAnnotation = dockerAnnotationPrefix + "exclude"
+	includeAnnotation = dockerAnnotationPrefix + "include"
+	// trustedDigestAnnotation keeps the digest of the manifest the tag
+	// was signed for, verified with Config.ContentTrust.
+	trustedDigestAnnotation = dockerAnnotationPrefix + "trusted-digest"
+	// settingsAnnotation keeps the fingerprint of the options the image
+	// was converted with, see convertSettings.
+	settingsAnnotation = dockerAnnotationPrefix + "settings"
+
+	stopSignalAnnotation        = dockerAnnotationPrefix + "stop-signal"
+	onBuildAnnotation           = dockerAnnotationPrefix + "onbuild"
+	healthcheckAnnotationPrefix = dockerAnnotationPrefix + "healthcheck/"
+)
+
+// reservedAnnotations are the annotations defined by the appc spec. Their
+// values have to follow its rules, so Docker labels with these names are
+// moved under labelAnnotationPrefix.
+var reservedAnnotations = map[string]bool{
+	"authors":       true,
+	"created":       true,
+	"documentation": true,
+	"homepage":      true,
+}
+
+// annotationBuilder collects the annotations of a manifest. Only the first
+// value given for a name is kept.
+type annotationBuilder struct {
+	annotations types.Annotations
+	names       map[string]bool
+	// logger gets the warnings about the labels left out
+	logger Logger
+}
+
+// add adds the annotation name with value. name must be a valid ACName.
+func (ab *annotationBuilder) add(name string, value string) error {
+	acName, err := types.NewACName(name)
+	if err != nil {
+		return fmt.Errorf("invalid annotation name %q: %w", name, err)
+	}
+
+	if ab.names == nil {
+		ab.names = make(map[string]bool)
+	}
+	if ab.names[name] {
+		return nil
+	}
+	ab.names[name] = true
+
+	ab.annotations = append(ab.annotations, types.Annotation{Name: *acName, Value: value})
+	return nil
+}
+
+// addList adds the annotation name with values as a JSON array, if there are
+// any.
+func (ab *annotationBuilder) addList(name string, values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return ab.add(name, string(b))
+}
+
+// addLabels adds the labels of a Docker image as annotations, sanitizing
+// their keys into ACNames.
+func (ab *annotationBuilder) addLabels(labels map[string]string) error {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name, err := types.SanitizeACName(k)
+		if err != nil {
+			logWarn(ab.logger, fmt.Sprintf("skipping label %q: %v", k, err), LogField{"label", k})
+			continue
+		}
+		if reservedAnnotations[name] {
+			name = labelAnnotationPrefix + name
+		}
+		if ab.names[name] {
+			logWarn(ab.logger, fmt.Sprintf("skipping label %q, its name is already used", k), LogField{"label", k})
+			continue
+		}
+		if err := ab.add(name, labels[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addUserAnnotations adds the annotations given by the user, sorted by name.
+func (ab *annotationBuilder) addUserAnnotations(annotations map[string]string) error {
+	var names []string
+	for n := range annotations {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if err := ab.add(n, annotations[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addProvenance adds the authors and created annotations, and the version of
+// Docker and the comment the layer was created with.
+func (ab *annotationBuilder) addProvenance(layerData DockerImageData) error {
+	var created string
+	if !layerData.Created.IsZero() {
+		created = layerData.Created.UTC().Format(time.RFC3339)
+	}
+
+	provenance := []struct {
+		name  string
+		value string
+	}{
+		{"authors", layerData.Author},
+		{"created", created},
+		{dockerVersionAnnotation, layerData.DockerVersion},
+		{commentAnnotation, layerData.Comment},
+	}
+
+	for _, p := range provenance {
+		if p.value == "" {
+			continue
+		}
+		if err := ab.add(p.name, p.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addHistory adds the history of the image up to the layer, as a JSON array
+// of the steps it was built with, from the base one.
+func (ab *annotationBuilder) addHistory(history []DockerHistory) error {
+	if len(history) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return ab.add(historyAnnotation, string(b))
+}
+
+// addHealthcheck adds the HEALTHCHECK of a Docker image as annotations under
+// healthcheckAnnotationPrefix: the command to exec as a JSON array, the
+// durations in Go's format (e.g. 1m30s) and the retries. A disabled check
+// only gets disabled=true. appc has no event for health checks, so this is
+// left to the tools running the image.
+func (ab *annotationBuilder) addHealthcheck(hc *DockerHealthConfig) error {
+	if hc == nil || len(hc.Test) == 0 {
+		return nil
+	}
+
+	var command []string
+	switch hc.Test[0] {
+	case "NONE":
+		return ab.add(healthcheckAnnotationPrefix+"disabled", "true")
+	case "CMD":
+		command = hc.Test[1:]
+	case "CMD-SHELL":
+		if len(hc.Test) != 2 {
+			return fmt.Errorf("invalid healthcheck %q", hc.Test)
+		}
+		command = []string{"/bin/sh", "-c", hc.Test[1]}
+	default:
+		return fmt.Errorf("unknown healthcheck type %q", hc.Test[0])
+	}
+
+	b, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	if err := ab.add(healthcheckAnnotationPrefix+"command", string(b)); err != nil {
+		return err
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"interval", hc.Interval},
+		{"timeout", hc.Timeout},
+		{"start-period", hc.StartPeriod},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			continue
+		}
+		if err := ab.add(healthcheckAnnotationPrefix+d.name, d.value.String()); err != nil {
+			return err
+		}
+	}
+
+	if hc.Retries > 0 {
+		return ab.add(healthcheckAnnotationPrefix+"retries", strconv.Itoa(hc.Retries))
+	}
+
+	return nil
+}
+
+// addOnBuild adds the ONBUILD triggers of a Docker image, as a JSON array of
+// instructions, so tools can tell the image is meant to be built upon.
+func (ab *annotationBuilder) addOnBuild(onBuild []string) error {
+	return ab.addList(onBuildAnnotation, onBuild)
+}
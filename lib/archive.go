@@ -0,0 +1,388 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	archiveManifest = "manifest.json"
+
+	// DefaultDockerHost is the socket of the Docker daemon used when
+	// $DOCKER_HOST isn't set.
+	DefaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+// compressionMagics are the first bytes of the compressed files we recognize.
+var compressionMagics = map[string][]byte{
+	"gzip":  {0x1f, 0x8b},
+	"bzip2": []byte("BZh"),
+	"xz":    {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	"zstd":  {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// archiveImage is an entry of the manifest.json of a docker save archive.
+type archiveImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveEntry is where the contents of a file of the archive are.
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+// DockerArchiveSource takes an image from a tarball written by docker save.
+// The archive is read in place, so it can't be compressed.
+type DockerArchiveSource struct {
+	*configImage
+	f    *os.File
+	name string
+	// layerFiles are the entries of the layer tarballs of the image
+	layerFiles map[string]archiveEntry
+	// remove is removed once the source is closed, for the archives
+	// written by the source itself
+	remove bool
+}
+
+// NewDockerArchiveSource opens the docker save archive at archivePath and its
+// image ref, of the form:
+//
+//	[{registry}/]{image name}[:{tag}]
+//
+// or the ID of the image. ref can be empty if the archive has a single image.
+func NewDockerArchiveSource(archivePath string, ref string) (*DockerArchiveSource, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newDockerArchiveSource(f, ref)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading %s: %w", archivePath, err)
+	}
+	return src, nil
+}
+
+func newDockerArchiveSource(f *os.File, ref string) (*DockerArchiveSource, error) {
+	head := make([]byte, 6)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for format, magic := range compressionMagics {
+		if bytes.HasPrefix(head[:n], magic) {
+			return nil, fmt.Errorf("the archive is compressed with %s, decompress it first", format)
+		}
+	}
+
+	entries, err := indexArchive(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []archiveImage
+	if err := readArchiveJSON(f, entries, archiveManifest, &images); err != nil {
+		return nil, err
+	}
+	image, err := findArchiveImage(images, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	rawConfig, err := readArchiveFile(f, entries, image.Config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image config: %w", err)
+	}
+	img, err := newConfigImage(rawConfig, image.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &DockerArchiveSource{
+		configImage: img,
+		f:           f,
+		name:        archiveImageName(*image, ref),
+		layerFiles:  make(map[string]archiveEntry),
+	}
+	for i, l := range image.Layers {
+		e, ok := entries[l]
+		if !ok {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("layer %s not found", l)}
+		}
+		src.layerFiles[img.layers[i]] = e
+	}
+	return src, nil
+}
+
+// indexArchive returns where the regular files of the archive are, keyed by
+// their cleaned name. Symlinks, which docker save writes for the layers
+// shared by several images, are resolved.
+func indexArchive(f *os.File) (map[string]archiveEntry, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	entries := make(map[string]archiveEntry)
+	links := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading tar: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// the reader stops at the contents of the entry
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			entries[name] = archiveEntry{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			links[name] = path.Clean(hdr.Linkname)
+		}
+	}
+
+	for name, target := range links {
+		// links can point to other links, a cycle can't be longer
+		// than all of them
+		for i := 0; i < len(links); i++ {
+			next, ok := links[target]
+			if !ok {
+				break
+			}
+			target = next
+		}
+		if e, ok := entries[target]; ok {
+			entries[name] = e
+		}
+	}
+	return entries, nil
+}
+
+func readArchiveFile(f *os.File, entries map[string]archiveEntry, name string) ([]byte, error) {
+	e, ok := entries[path.Clean(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	return ioutil.ReadAll(io.NewSectionReader(f, e.offset, e.size))
+}
+
+func readArchiveJSON(f *os.File, entries map[string]archiveEntry, name string, v interface{}) error {
+	b, err := readArchiveFile(f, entries, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error unmarshaling %s: %w", name, err)
+	}
+	return nil
+}
+
+// findArchiveImage looks an image up by tag or ID like findStorageImage, or
+// returns the only image of the archive if ref is empty.
+func findArchiveImage(images []archiveImage, ref string) (*archiveImage, error) {
+	if ref == "" {
+		if len(images) != 1 {
+			return nil, fmt.Errorf("the archive has %d images, one must be chosen", len(images))
+		}
+		return &images[0], nil
+	}
+
+	wanted, err := parseDockerURL(ref)
+	if err != nil {
+		return nil, err
+	}
+	for i, image := range images {
+		if strings.HasPrefix(archiveImageID(image), strings.TrimPrefix(ref, storageDigestID)) {
+			return &images[i], nil
+		}
+		for _, tag := range image.RepoTags {
+			candidate, err := parseDockerURL(tag)
+			if err != nil {
+				continue
+			}
+			if normalizeStorageName(candidate) == normalizeStorageName(wanted) {
+				return &images[i], nil
+			}
+		}
+	}
+
+	return nil, &ErrNotFound{Image: ref}
+}
+
+// archiveImageID returns the ID of image, the digest of its config, which
+// docker save names <ID>.json or blobs/sha256/<ID>.
+func archiveImageID(image archiveImage) string {
+	return strings.TrimSuffix(path.Base(image.Config), ".json")
+}
+
+// archiveImageName returns the name of image chosen with ref: the tag ref
+// matched, the first tag if ref didn't name one, or the short ID of images
+// without tags.
+func archiveImageName(image archiveImage, ref string) string {
+	if ref != "" {
+		if wanted, err := parseDockerURL(ref); err == nil {
+			for _, tag := range image.RepoTags {
+				candidate, err := parseDockerURL(tag)
+				if err == nil && normalizeStorageName(candidate) == normalizeStorageName(wanted) {
+					return tag
+				}
+			}
+		}
+	}
+	if len(image.RepoTags) > 0 {
+		return image.RepoTags[0]
+	}
+	id := archiveImageID(image)
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// Name returns the name of the image, to pass to ConvertSource.
+func (s *DockerArchiveSource) Name() string {
+	return s.name
+}
+
+// GetLayerReader returns the uncompressed tarball of layerID, read from the
+// archive.
+func (s *DockerArchiveSource) GetLayerReader(ctx context.Context, layerID string) (io.ReadCloser, error) {
+	e, ok := s.layerFiles[layerID]
+	if !ok {
+		return nil, &ErrNotFound{Layer: layerID}
+	}
+	return &sizedBody{ReadCloser: ioutil.NopCloser(io.NewSectionReader(s.f, e.offset, e.size)), size: e.size}, nil
+}
+
+// getLayerSize returns the size of the uncompressed layer tarball, about
+// the size of its files.
+func (s *DockerArchiveSource) getLayerSize(ctx context.Context, layerID string) (int64, error) {
+	if e, ok := s.layerFiles[layerID]; ok {
+		return e.size, nil
+	}
+	return -1, nil
+}
+
+// Close closes the archive, once the conversions taking the image from the
+// source are done.
+func (s *DockerArchiveSource) Close() error {
+	err := s.f.Close()
+	if s.remove {
+		os.Remove(s.f.Name())
+	}
+	return err
+}
+
+// NewDockerDaemonSource exports image from the Docker daemon listening on
+// host, like docker save, to a file in tmpDir and takes it from there. host
+// is a unix:// or tcp:// address, $DOCKER_HOST or DefaultDockerHost if it's
+// empty. The file is removed once the source is closed.
+func NewDockerDaemonSource(ctx context.Context, host string, image string, tmpDir string) (*DockerArchiveSource, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = DefaultDockerHost
+	}
+	client, base, err := dockerDaemonClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(tmpDir, "docker2aci-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	src, err := saveDaemonImage(ctx, client, host, base, image, f)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	src.remove = true
+	return src, nil
+}
+
+// dockerDaemonClient returns the client of the daemon at host and the base
+// URL of its API.
+func dockerDaemonClient(host string) (*http.Client, string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid Docker host %q: %w", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		dialer := &net.Dialer{}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", u.Path)
+			},
+		}
+		// the host of the URLs is ignored
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp":
+		return &http.Client{}, "http://" + u.Host, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported Docker host %q", host)
+	}
+}
+
+func saveDaemonImage(ctx context.Context, client *http.Client, host string, base string, image string, f *os.File) (*DockerArchiveSource, error) {
+	u := base + "/images/get?" + url.Values{"names": {image}}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error exporting image from the Docker daemon: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, withImage(fmt.Errorf("error exporting image from the Docker daemon: %w", statusError(res, host, "", "")), image)
+	}
+
+	logInfo(nil, "Exporting image: "+image, LogField{"image", image})
+	if _, err := io.Copy(f, res.Body); err != nil {
+		return nil, fmt.Errorf("error exporting image from the Docker daemon: %w", err)
+	}
+	src, err := newDockerArchiveSource(f, image)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the image exported by the Docker daemon: %w", err)
+	}
+	return src, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Credentials are the username and password used to log into a registry.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type dockerAuthEntry struct {
+	Auth string `json:"auth"`
+}
+
+// LoadDockerCredentials reads the credentials stored by `docker login` in
+// the config file at path, either in the ~/.docker/config.json format or in
+// the older ~/.dockercfg one. The returned map is keyed by registry host.
+func LoadDockerCredentials(path string) (map[string]Credentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Auths map[string]dockerAuthEntry `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %w", path, err)
+	}
+	entries := config.Auths
+	if entries == nil {
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("error unmarshaling %s: %w", path, err)
+		}
+	}
+
+	credentials := make(map[string]Credentials)
+	for registry, entry := range entries {
+		if entry.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding credentials for %s: %w", registry, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid credentials for %s", registry)
+		}
+		credentials[registryHost(registry)] = Credentials{
+			Username: parts[0],
+			Password: parts[1],
+		}
+	}
+
+	return credentials, nil
+}
+
+// registryHost returns the host of a registry given as a host or a URL, as
+// used to key credentials. Docker Hub's aliases are all keyed as
+// defaultIndex.
+func registryHost(registry string) string {
+	host := registry
+	if strings.Contains(registry, "://") {
+		if u, err := url.Parse(registry); err == nil {
+			host = u.Host
+		}
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+
+	if host == "docker.io" {
+		return defaultIndex
+	}
+	return host
+}
+
+// credentialsFor returns the credentials for the registry host, if any.
+func credentialsFor(credentials map[string]Credentials, host string) (Credentials, bool) {
+	c, ok := credentials[registryHost(host)]
+	return c, ok
+}
+
+// setAuth authenticates req with the tokens the index gave us or, if there
+// are none, with the credentials of the host the request goes to.
+func setAuth(req *http.Request, repoData *RepoData) {
+	if len(repoData.Tokens) == 0 {
+		if c, ok := credentialsFor(repoData.Credentials, req.URL.Host); ok {
+			req.SetBasicAuth(c.Username, c.Password)
+			return
+		}
+	}
+	setAuthToken(req, repoData.Tokens)
+}
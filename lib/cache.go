@@ -0,0 +1,59 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleDownloadAge is the age after which a download left in the cache is
+// taken for an interrupted one. Younger ones can belong to another
+// conversion sharing the cache.
+const staleDownloadAge = 24 * time.Hour
+
+// cacheLayersDir is the directory of the cache with a directory of layers for
+// each registry.
+const cacheLayersDir = "layers"
+
+// openLayerCache returns the directory of the layer cache dir for the
+// registry indexURL, where the layers downloaded from it are kept named after
+// their ID, which is what images sharing layers have in common. The IDs are
+// only unique within a registry. Layers are only renamed to their ID once
+// complete, so conversions can share the cache.
+func openLayerCache(dir string, indexURL string) (string, error) {
+	layersDir := filepath.Join(dir, cacheLayersDir, registryDirName(indexURL))
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := removeStale(layersDir, layerDownloadPrefix, staleDownloadAge); err != nil {
+		return "", err
+	}
+
+	return layersDir, nil
+}
+
+// registryDirName returns the name of the directory of the layers of the
+// registry indexURL.
+func registryDirName(indexURL string) string {
+	name := url.PathEscape(indexURL)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
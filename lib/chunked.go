@@ -0,0 +1,204 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// chunkedDownloadMin is the size from which the layers are downloaded
+	// in chunks, when Config.ChunkedDownloads allows it.
+	chunkedDownloadMin = 256 << 20
+	downloadChunkSize  = 16 << 20
+)
+
+// chunkFetcher gets the bytes start to end, included, of a layer.
+type chunkFetcher func(ctx context.Context, start, end int64) (*http.Response, error)
+
+// chunkedBody is a layer downloaded with several ranged requests at once.
+// The chunks are read in order, the ones after the current one are
+// downloaded meanwhile and kept in memory, so parallel+1 chunks are in
+// memory at most.
+type chunkedBody struct {
+	// cur is the chunk being read, the body of the first request for the
+	// first chunk
+	cur    io.Reader
+	first  io.Closer
+	chunks chan chan chunkResult
+	closed chan struct{}
+	// cancel aborts the requests of the chunks being downloaded
+	cancel context.CancelFunc
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// newChunkedBody returns the layer of size bytes whose first chunk is the
+// body first, of the first downloadChunkSize bytes. The others are taken
+// with fetch, up to parallel of them ahead of the one read.
+func newChunkedBody(ctx context.Context, first io.ReadCloser, size int64, parallel int, fetch chunkFetcher) *chunkedBody {
+	ctx, cancel := context.WithCancel(ctx)
+	cb := &chunkedBody{
+		cur:    &exactReader{r: first, left: firstChunkSize(size)},
+		first:  first,
+		chunks: make(chan chan chunkResult, parallel),
+		closed: make(chan struct{}),
+		cancel: cancel,
+	}
+	go func() {
+		defer close(cb.chunks)
+		for start := int64(downloadChunkSize); start < size; start += downloadChunkSize {
+			end := start + downloadChunkSize - 1
+			if end >= size {
+				end = size - 1
+			}
+			c := make(chan chunkResult, 1)
+			select {
+			case cb.chunks <- c:
+			case <-cb.closed:
+				return
+			}
+			go func(start, end int64) {
+				data, err := fetchChunk(ctx, fetch, start, end)
+				c <- chunkResult{data: data, err: err}
+			}(start, end)
+		}
+	}()
+	return cb
+}
+
+func (cb *chunkedBody) Read(p []byte) (int, error) {
+	for {
+		n, err := cb.cur.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		c, ok := <-cb.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		res := <-c
+		if res.err != nil {
+			return 0, res.err
+		}
+		cb.cur = bytes.NewReader(res.data)
+	}
+}
+
+// Close stops downloading new chunks, the requests of the ones being
+// downloaded are aborted.
+func (cb *chunkedBody) Close() error {
+	close(cb.closed)
+	cb.cancel()
+	return cb.first.Close()
+}
+
+// firstChunkSize is the size of the first chunk of a layer of size bytes.
+func firstChunkSize(size int64) int64 {
+	if size < downloadChunkSize {
+		return size
+	}
+	return downloadChunkSize
+}
+
+// exactReader reads the left bytes of r, it fails if r ends before.
+type exactReader struct {
+	r    io.Reader
+	left int64
+	got  int64
+}
+
+func (er *exactReader) Read(p []byte) (int, error) {
+	if er.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > er.left {
+		p = p[:er.left]
+	}
+	n, err := er.r.Read(p)
+	er.left -= int64(n)
+	er.got += int64(n)
+	if err == io.EOF && er.left > 0 {
+		return n, fmt.Errorf("got %d bytes for bytes 0-%d", er.got, er.got+er.left-1)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func fetchChunk(ctx context.Context, fetch chunkFetcher, start, end int64) ([]byte, error) {
+	res, err := fetch(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return nil, &HTTPError{StatusCode: res.StatusCode, URL: res.Request.URL.String()}
+	}
+	if s, e, _, err := contentRange(res); err != nil || s != start || e != end {
+		return nil, fmt.Errorf("unexpected Content-Range %q for bytes %d-%d", res.Header.Get("Content-Range"), start, end)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("got %d bytes for bytes %d-%d", len(data), start, end)
+	}
+	return data, nil
+}
+
+// contentRange returns the start and end of the range of a 206 response and
+// the size of the whole resource, -1 if it's unknown.
+func contentRange(res *http.Response) (int64, int64, int64, error) {
+	// bytes START-END/SIZE
+	cr := res.Header.Get("Content-Range")
+	rangeSpec := strings.TrimPrefix(cr, "bytes ")
+	slash := strings.Index(rangeSpec, "/")
+	dash := strings.Index(rangeSpec, "-")
+	if rangeSpec == cr || slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", cr)
+	}
+	start, err := strconv.ParseInt(rangeSpec[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", cr)
+	}
+	end, err := strconv.ParseInt(rangeSpec[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", cr)
+	}
+	if rangeSpec[slash+1:] == "*" {
+		return start, end, -1, nil
+	}
+	size, err := strconv.ParseInt(rangeSpec[slash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", cr)
+	}
+	return start, end, size, nil
+}
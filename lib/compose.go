@@ -0,0 +1,652 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// composeIgnoredKeys are the keys of the services which have no pod manifest
+// equivalent, or none of their own, and are left out without a warning.
+var composeIgnoredKeys = map[string]bool{
+	"build":          true,
+	"container_name": true,
+	"depends_on":     true,
+	"labels":         true,
+	"restart":        true,
+}
+
+// ComposeFile is what docker2aci translates of a docker-compose.yml: the
+// services and how they run their images.
+type ComposeFile struct {
+	// Services are keyed by their name.
+	Services map[string]ComposeService
+}
+
+// ComposeService is a service of a compose file.
+type ComposeService struct {
+	Image string
+	// App is how the service runs its image, named after the service.
+	// Its ACI is the one of Image, left for the caller to convert.
+	App PodApp
+}
+
+// ServiceNames returns the names of the services, sorted.
+func (f *ComposeFile) ServiceNames() []string {
+	var names []string
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCompose parses the compose file b. The relative host paths of its
+// volumes are relative to dir and the variables in its values, like
+// ${TAG:-latest}, are the ones of the environment, as docker-compose does.
+// The keys without a pod manifest equivalent are skipped with a warning.
+func ParseCompose(b []byte, dir string) (*ComposeFile, error) {
+	doc, err := parseYAML(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing compose file: %w", err)
+	}
+	if doc, err = interpolateCompose(doc); err != nil {
+		return nil, fmt.Errorf("error parsing compose file: %w", err)
+	}
+	top, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("error parsing compose file: not a mapping")
+	}
+
+	// version 1 files have their services at the top
+	services := top
+	if s, ok := top["services"]; ok {
+		if services, ok = s.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("error parsing compose file: services is not a mapping")
+		}
+	} else {
+		delete(services, "version")
+	}
+
+	f := &ComposeFile{Services: make(map[string]ComposeService)}
+	for name, s := range services {
+		m, ok := s.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("service %s: not a mapping", name)
+		}
+		service, err := parseComposeService(name, m, dir)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		f.Services[name] = *service
+	}
+	if len(f.Services) == 0 {
+		return nil, fmt.Errorf("error parsing compose file: no services")
+	}
+	return f, nil
+}
+
+func parseComposeService(name string, m map[string]interface{}, dir string) (*ComposeService, error) {
+	s := &ComposeService{App: PodApp{Name: name}}
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var err error
+	for _, k := range keys {
+		v := m[k]
+		switch k {
+		case "image":
+			s.Image, err = composeString(v)
+		case "command":
+			s.App.Cmd, err = composeCommand(v)
+		case "entrypoint":
+			s.App.Entrypoint, err = composeCommand(v)
+		case "environment":
+			s.App.Env, err = composeEnvironment(v)
+		case "user":
+			var user string
+			user, err = composeString(v)
+			parts := strings.SplitN(user, ":", 2)
+			s.App.User = parts[0]
+			if len(parts) == 2 {
+				s.App.Group = parts[1]
+			}
+		case "working_dir":
+			s.App.WorkingDirectory, err = composeString(v)
+		case "mem_limit":
+			s.App.Memory, err = composeMemory(v)
+		case "cpus":
+			s.App.CPU, err = composeCPUs(v)
+		case "deploy":
+			err = parseComposeDeploy(s, v)
+		case "ports":
+			var ports []PodPort
+			ports, err = composePorts(v)
+			s.App.Ports = append(s.App.Ports, ports...)
+		case "expose":
+			// the ports of the app, not published on the host
+			var ports []PodPort
+			ports, err = composePorts(v)
+			s.App.Ports = append(s.App.Ports, ports...)
+		case "volumes":
+			s.App.Mounts, err = composeVolumes(v, dir)
+		default:
+			if !composeIgnoredKeys[k] {
+				logWarn(nil, fmt.Sprintf("service %s: skipping %s, it isn't translated", name, k), LogField{"service", name})
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k, err)
+		}
+	}
+
+	if s.Image == "" {
+		return nil, fmt.Errorf("no image, build it and give its name in image")
+	}
+	return s, nil
+}
+
+// parseComposeDeploy reads the limits of deploy.resources.limits. They lose
+// to mem_limit and cpus.
+func parseComposeDeploy(s *ComposeService, v interface{}) error {
+	limits, _ := composeLookup(v, "resources", "limits").(map[string]interface{})
+	var err error
+	if mem, ok := limits["memory"]; ok && s.App.Memory == "" {
+		if s.App.Memory, err = composeMemory(mem); err != nil {
+			return err
+		}
+	}
+	if cpus, ok := limits["cpus"]; ok && s.App.CPU == "" {
+		if s.App.CPU, err = composeCPUs(cpus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// composeLookup returns the value at the keys of the mappings nested in v,
+// nil if there's none.
+func composeLookup(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func composeString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("not a string")
+}
+
+func composeStrings(v interface{}) ([]string, error) {
+	seq, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+	strs := make([]string, 0, len(seq))
+	for _, item := range seq {
+		s, err := composeString(item)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// composeCommand reads a command, a list or a string split into words like
+// a shell does.
+func composeCommand(v interface{}) ([]string, error) {
+	if s, ok := v.(string); ok {
+		return splitShellWords(s)
+	}
+	return composeStrings(v)
+}
+
+// composeEnvironment reads the variables of a list of KEY=VALUE or of a
+// mapping. The variables without a value take the one of the environment,
+// and are left out if it has none.
+func composeEnvironment(v interface{}) ([]string, error) {
+	var env []string
+	add := func(key string, value *string) {
+		if value == nil {
+			v, ok := os.LookupEnv(key)
+			if !ok {
+				return
+			}
+			value = &v
+		}
+		env = append(env, key+"="+*value)
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if m[k] == nil {
+				add(k, nil)
+				continue
+			}
+			value, err := composeString(m[k])
+			if err != nil {
+				return nil, err
+			}
+			add(k, &value)
+		}
+		return env, nil
+	}
+
+	vars, err := composeStrings(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range vars {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 1 {
+			add(parts[0], nil)
+		} else {
+			add(parts[0], &parts[1])
+		}
+	}
+	return env, nil
+}
+
+// composeMemory translates a Docker memory size, in binary units like 512m,
+// into the quantity of a memory isolator.
+func composeMemory(v interface{}) (string, error) {
+	s, err := composeString(v)
+	if err != nil {
+		return "", err
+	}
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	units := map[byte]string{'k': "Ki", 'm': "Mi", 'g': "Gi", 't': "Ti"}
+	number := s
+	unit := ""
+	if s != "" {
+		if u, ok := units[s[len(s)-1]]; ok {
+			number, unit = s[:len(s)-1], u
+		}
+	}
+	if _, err := strconv.ParseUint(number, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid memory size %q", v)
+	}
+	return number + unit, nil
+}
+
+// composeCPUs translates a number of CPUs, like 0.5, into the millicores of
+// a CPU isolator.
+func composeCPUs(v interface{}) (string, error) {
+	s, err := composeString(v)
+	if err != nil {
+		return "", err
+	}
+	cpus, err := strconv.ParseFloat(s, 64)
+	if err != nil || cpus <= 0 {
+		return "", fmt.Errorf("invalid number of CPUs %q", s)
+	}
+	return strconv.FormatInt(int64(cpus*1000+0.5), 10) + "m", nil
+}
+
+// composePorts reads the ports of a list of [[IP:]HOST:]CONTAINER[/PROTOCOL]
+// or of mappings with target, published and protocol.
+func composePorts(v interface{}) ([]PodPort, error) {
+	seq, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+	var ports []PodPort
+	for _, item := range seq {
+		if m, ok := item.(map[string]interface{}); ok {
+			target, err := composeString(m["target"])
+			if err != nil {
+				return nil, err
+			}
+			published, err := composeString(m["published"])
+			if err != nil {
+				return nil, err
+			}
+			protocol, err := composeString(m["protocol"])
+			if err != nil {
+				return nil, err
+			}
+			spec := target
+			if published != "" {
+				spec = published + ":" + target
+			}
+			if protocol != "" {
+				spec += "/" + protocol
+			}
+			item = spec
+		}
+		spec, err := composeString(item)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parsePortSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p...)
+	}
+	return ports, nil
+}
+
+// parsePortSpec parses [[IP:]HOST:]CONTAINER[/PROTOCOL], where the ports can
+// be ranges like 8000-8010, as given to docker run -p. The IP is ignored, pod
+// manifests don't have it.
+func parsePortSpec(spec string) ([]PodPort, error) {
+	protocol := "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		spec, protocol = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	parts := strings.Split(spec, ":")
+	start, end, err := parsePortRange(parts[len(parts)-1])
+	if err != nil {
+		return nil, err
+	}
+	var hostStart, hostEnd uint
+	if len(parts) > 1 && parts[len(parts)-2] != "" {
+		if hostStart, hostEnd, err = parsePortRange(parts[len(parts)-2]); err != nil {
+			return nil, err
+		}
+		if hostEnd-hostStart != end-start {
+			return nil, fmt.Errorf("invalid port %q: the host and container ranges differ", spec)
+		}
+	}
+
+	var ports []PodPort
+	for i := uint(0); i <= end-start; i++ {
+		p := PodPort{Port: start + i, Protocol: protocol}
+		if hostStart != 0 {
+			p.HostPort = hostStart + i
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+func parsePortRange(s string) (uint, uint, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || start == 0 {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	end := start
+	if len(parts) == 2 {
+		if end, err = strconv.ParseUint(parts[1], 10, 16); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return uint(start), uint(end), nil
+}
+
+// composeVolumes reads the volumes of a list of [SOURCE:]TARGET[:MODE] or of
+// mappings with type, source, target and read_only.
+func composeVolumes(v interface{}, dir string) ([]PodMount, error) {
+	seq, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+	var mounts []PodMount
+	for _, item := range seq {
+		var m PodMount
+		if long, ok := item.(map[string]interface{}); ok {
+			kind, err := composeString(long["type"])
+			if err != nil {
+				return nil, err
+			}
+			if m.Source, err = composeString(long["source"]); err != nil {
+				return nil, err
+			}
+			if m.Target, err = composeString(long["target"]); err != nil {
+				return nil, err
+			}
+			readOnly, err := composeString(long["read_only"])
+			if err != nil {
+				return nil, err
+			}
+			m.ReadOnly = readOnly == "true"
+			switch kind {
+			case "bind":
+				m.Source = composeHostPath(m.Source, dir)
+			case "volume", "":
+			case "tmpfs":
+				m.Source = ""
+			default:
+				return nil, fmt.Errorf("unsupported volume type %q", kind)
+			}
+		} else {
+			spec, err := composeString(item)
+			if err != nil {
+				return nil, err
+			}
+			if m, err = parseVolumeSpec(spec, dir); err != nil {
+				return nil, err
+			}
+		}
+		if m.Target == "" {
+			return nil, fmt.Errorf("volume without target")
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// parseVolumeSpec parses [SOURCE:]TARGET[:MODE], as given to docker run -v.
+// A SOURCE which is a path, relative to dir, is a host directory, otherwise
+// it names a volume.
+func parseVolumeSpec(spec string, dir string) (PodMount, error) {
+	parts := strings.Split(spec, ":")
+	var m PodMount
+	switch len(parts) {
+	case 1:
+		m.Target = parts[0]
+	case 2, 3:
+		m.Source, m.Target = parts[0], parts[1]
+		if len(parts) == 3 {
+			for _, opt := range strings.Split(parts[2], ",") {
+				switch opt {
+				case "ro":
+					m.ReadOnly = true
+				case "rw", "z", "Z", "cached", "delegated", "consistent", "nocopy":
+				default:
+					return m, fmt.Errorf("invalid volume %q: unknown mode %q", spec, opt)
+				}
+			}
+		}
+	default:
+		return m, fmt.Errorf("invalid volume %q", spec)
+	}
+	if strings.HasPrefix(m.Source, "/") || strings.HasPrefix(m.Source, ".") || strings.HasPrefix(m.Source, "~") {
+		m.Source = composeHostPath(m.Source, dir)
+	}
+	return m, nil
+}
+
+// composeHostPath returns the absolute path of the host path p, relative to
+// dir or to the home directory.
+func composeHostPath(p string, dir string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = filepath.Join(os.Getenv("HOME"), p[1:])
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return p
+}
+
+// interpolateCompose replaces the variables in the strings of v.
+func interpolateCompose(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return interpolate(v, os.LookupEnv)
+	case []interface{}:
+		for i, item := range v {
+			var err error
+			if v[i], err = interpolateCompose(item); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			var err error
+			if v[k], err = interpolateCompose(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// interpolate replaces $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error} and ${VAR?error} in s with the values of lookup, and $$ with
+// $.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch {
+		case s[i] == '$':
+			b.WriteByte('$')
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable in %q", s)
+			}
+			value, err := expandVariable(s[i+1:i+end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || j > i && s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			if j == i {
+				b.WriteByte('$')
+				b.WriteByte(s[i])
+				continue
+			}
+			value, _ := lookup(s[i:j])
+			b.WriteString(value)
+			i = j - 1
+		}
+	}
+	return b.String(), nil
+}
+
+// expandVariable returns the value of the variable of ${expr}.
+func expandVariable(expr string, lookup func(string) (string, bool)) (string, error) {
+	for _, op := range []string{":-", ":?", "-", "?"} {
+		i := strings.Index(expr, op)
+		if i < 0 {
+			continue
+		}
+		name, arg := expr[:i], expr[i+len(op):]
+		value, ok := lookup(name)
+		// with a colon an empty variable counts as unset
+		set := ok && (value != "" || !strings.HasPrefix(op, ":"))
+		if set {
+			return value, nil
+		}
+		if strings.HasSuffix(op, "?") {
+			if arg == "" {
+				arg = "not set"
+			}
+			return "", fmt.Errorf("variable %s: %s", name, arg)
+		}
+		return arg, nil
+	}
+	value, _ := lookup(expr)
+	return value, nil
+}
+
+// splitShellWords splits s into words the way a shell does, without
+// expanding anything: quotes group words and backslashes escape.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(s) && (quote == 0 || strings.IndexByte("\"\\$`", s[i+1]) >= 0):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
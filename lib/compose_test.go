@@ -0,0 +1,359 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testLookup looks variables up in vars instead of the environment.
+func testLookup(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestParseCompose(t *testing.T) {
+	os.Setenv("DOCKER2ACI_TEST_TAG", "1.2")
+	os.Setenv("DOCKER2ACI_TEST_FROM_ENV", "inherited")
+	defer os.Unsetenv("DOCKER2ACI_TEST_TAG")
+	defer os.Unsetenv("DOCKER2ACI_TEST_FROM_ENV")
+
+	tests := []struct {
+		desc    string
+		compose string
+		want    map[string]ComposeService
+		wantErr bool
+	}{
+		{
+			desc: "version 3",
+			compose: `version: "3"
+services:
+  web:
+    image: example.com/web:${DOCKER2ACI_TEST_TAG}
+    command: serve --addr ":8080" 'a b'
+    environment:
+      MODE: production
+      DOCKER2ACI_TEST_FROM_ENV:
+      DOCKER2ACI_TEST_UNSET:
+    user: "1000:100"
+    working_dir: /srv
+    mem_limit: 512m
+    cpus: "0.5"
+    ports:
+      - "8080:80"
+      - "53:53/udp"
+      - target: 443
+        published: 8443
+    expose:
+      - "9000"
+    volumes:
+      - ./data:/data:ro
+      - cache:/cache
+      - /tmp
+    restart: always
+  db:
+    image: db:${DOCKER2ACI_TEST_UNSET:-latest}
+    entrypoint: ["/bin/db", "--fast"]
+    environment:
+      - A=1
+      - DOCKER2ACI_TEST_FROM_ENV
+    deploy:
+      resources:
+        limits:
+          memory: 1g
+          cpus: "2"
+`,
+			want: map[string]ComposeService{
+				"web": {
+					Image: "example.com/web:1.2",
+					App: PodApp{
+						Name:             "web",
+						Cmd:              []string{"serve", "--addr", ":8080", "a b"},
+						Env:              []string{"DOCKER2ACI_TEST_FROM_ENV=inherited", "MODE=production"},
+						User:             "1000",
+						Group:            "100",
+						WorkingDirectory: "/srv",
+						Memory:           "512Mi",
+						CPU:              "500m",
+						Ports: []PodPort{
+							{Port: 9000, Protocol: "tcp"},
+							{Port: 80, Protocol: "tcp", HostPort: 8080},
+							{Port: 53, Protocol: "udp", HostPort: 53},
+							{Port: 443, Protocol: "tcp", HostPort: 8443},
+						},
+						Mounts: []PodMount{
+							{Source: "/srv/app/data", Target: "/data", ReadOnly: true},
+							{Source: "cache", Target: "/cache"},
+							{Target: "/tmp"},
+						},
+					},
+				},
+				"db": {
+					Image: "db:latest",
+					App: PodApp{
+						Name:       "db",
+						Entrypoint: []string{"/bin/db", "--fast"},
+						Env:        []string{"A=1", "DOCKER2ACI_TEST_FROM_ENV=inherited"},
+						Memory:     "1Gi",
+						CPU:        "2000m",
+					},
+				},
+			},
+		},
+		{
+			desc: "version 1",
+			compose: `web:
+  image: web
+  volumes:
+    - type: bind
+      source: ./conf
+      target: /etc/web
+      read_only: true
+    - type: tmpfs
+      target: /run
+`,
+			want: map[string]ComposeService{
+				"web": {
+					Image: "web",
+					App: PodApp{
+						Name: "web",
+						Mounts: []PodMount{
+							{Source: "/srv/app/conf", Target: "/etc/web", ReadOnly: true},
+							{Target: "/run"},
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:    "no image",
+			compose: "services:\n  web:\n    command: serve\n",
+			wantErr: true,
+		},
+		{
+			desc:    "no services",
+			compose: "version: \"3\"\nservices: {}\n",
+			wantErr: true,
+		},
+		{
+			desc:    "not a mapping",
+			compose: "- web\n",
+			wantErr: true,
+		},
+		{
+			desc:    "required variable",
+			compose: "services:\n  web:\n    image: web:${DOCKER2ACI_TEST_UNSET:?give a tag}\n",
+			wantErr: true,
+		},
+		{
+			desc:    "invalid port",
+			compose: "services:\n  web:\n    image: web\n    ports: [\"80-81:80\"]\n",
+			wantErr: true,
+		},
+		{
+			desc:    "invalid volume type",
+			compose: "services:\n  web:\n    image: web\n    volumes:\n      - type: npipe\n        target: /pipe\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		f, err := ParseCompose([]byte(tt.compose), "/srv/app")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: parsed to %+v, want an error", tt.desc, f.Services)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(f.Services, tt.want) {
+			t.Errorf("%s: services = %+v, want %+v", tt.desc, f.Services, tt.want)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"TAG": "1.2", "EMPTY": "", "A_1": "a"}
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "plain", want: "plain"},
+		{s: "$TAG", want: "1.2"},
+		{s: "web:${TAG}", want: "web:1.2"},
+		{s: "$A_1-$TAG", want: "a-1.2"},
+		{s: "$UNSET", want: ""},
+		{s: "${UNSET:-latest}", want: "latest"},
+		{s: "${EMPTY:-latest}", want: "latest"},
+		{s: "${EMPTY-latest}", want: ""},
+		{s: "${UNSET-latest}", want: "latest"},
+		{s: "${TAG:-latest}", want: "1.2"},
+		{s: "${TAG:?required}", want: "1.2"},
+		{s: "${EMPTY?required}", want: ""},
+		{s: "$$TAG", want: "$TAG"},
+		{s: "cost: 5$", want: "cost: 5$"},
+		{s: "$ alone", want: "$ alone"},
+		{s: "${UNSET:?give a tag}", wantErr: true},
+		{s: "${EMPTY:?}", wantErr: true},
+		{s: "${UNSET?}", wantErr: true},
+		{s: "${TAG", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := interpolate(tt.s, testLookup(vars))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("interpolate(%q) = %q, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("interpolate(%q): %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("interpolate(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []string
+		wantErr bool
+	}{
+		{s: "", want: nil},
+		{s: "  ", want: nil},
+		{s: "serve", want: []string{"serve"}},
+		{s: "serve  --addr\t:80\n", want: []string{"serve", "--addr", ":80"}},
+		{s: `echo "a b" 'c d'`, want: []string{"echo", "a b", "c d"}},
+		{s: `echo ""`, want: []string{"echo", ""}},
+		{s: `a"b c"d`, want: []string{"ab cd"}},
+		{s: `echo a\ b`, want: []string{"echo", "a b"}},
+		{s: `echo "\"quoted\" \$HOME \n"`, want: []string{"echo", `"quoted" $HOME \n`}},
+		{s: `echo 'it\'s'`, wantErr: true},
+		{s: `echo 'a\b'`, want: []string{"echo", `a\b`}},
+		{s: `sh -c 'echo $HOME'`, want: []string{"sh", "-c", "echo $HOME"}},
+		{s: `echo "unterminated`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := splitShellWords(tt.s)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitShellWords(%q) = %q, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitShellWords(%q): %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitShellWords(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParsePortSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []PodPort
+		wantErr bool
+	}{
+		{spec: "80", want: []PodPort{{Port: 80, Protocol: "tcp"}}},
+		{spec: "80/udp", want: []PodPort{{Port: 80, Protocol: "udp"}}},
+		{spec: "80/TCP", want: []PodPort{{Port: 80, Protocol: "tcp"}}},
+		{spec: "8080:80", want: []PodPort{{Port: 80, Protocol: "tcp", HostPort: 8080}}},
+		{spec: "127.0.0.1:8080:80", want: []PodPort{{Port: 80, Protocol: "tcp", HostPort: 8080}}},
+		{spec: "127.0.0.1::80", want: []PodPort{{Port: 80, Protocol: "tcp"}}},
+		{spec: "8000-8002", want: []PodPort{
+			{Port: 8000, Protocol: "tcp"},
+			{Port: 8001, Protocol: "tcp"},
+			{Port: 8002, Protocol: "tcp"},
+		}},
+		{spec: "9000-9001:8000-8001/udp", want: []PodPort{
+			{Port: 8000, Protocol: "udp", HostPort: 9000},
+			{Port: 8001, Protocol: "udp", HostPort: 9001},
+		}},
+		{spec: "", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "65536", wantErr: true},
+		{spec: "http", wantErr: true},
+		{spec: "8002-8000", wantErr: true},
+		{spec: "9000-9002:8000-8001", wantErr: true},
+		{spec: "x:80", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePortSpec(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePortSpec(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortSpec(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePortSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseVolumeSpec(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", "/home/user")
+	tests := []struct {
+		spec    string
+		want    PodMount
+		wantErr bool
+	}{
+		{spec: "/data", want: PodMount{Target: "/data"}},
+		{spec: "cache:/cache", want: PodMount{Source: "cache", Target: "/cache"}},
+		{spec: "/srv/data:/data", want: PodMount{Source: "/srv/data", Target: "/data"}},
+		{spec: "./data:/data", want: PodMount{Source: "/srv/app/data", Target: "/data"}},
+		{spec: "../data:/data", want: PodMount{Source: "/srv/data", Target: "/data"}},
+		{spec: "~/data:/data", want: PodMount{Source: "/home/user/data", Target: "/data"}},
+		{spec: "cache:/cache:ro", want: PodMount{Source: "cache", Target: "/cache", ReadOnly: true}},
+		{spec: "cache:/cache:rw,z", want: PodMount{Source: "cache", Target: "/cache"}},
+		{spec: "cache:/cache:ro,cached", want: PodMount{Source: "cache", Target: "/cache", ReadOnly: true}},
+		{spec: "cache:/cache:exec", wantErr: true},
+		{spec: "a:b:ro:extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVolumeSpec(tt.spec, "/srv/app")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseVolumeSpec(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVolumeSpec(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseVolumeSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/pgzip"
+)
+
+// compressACI gzips the ACI at aciPath in place with the given level. pgzip
+// compresses blocks of the ACI in parallel on all the cores, which matters
+// for big images where compression takes most of the time. Image IDs are the
+// hashes of uncompressed ACIs, so the dependencies on the ACI still hold.
+// Compression stops once ctx is done.
+func compressACI(ctx context.Context, aciPath string, level int) error {
+	in, err := os.Open(aciPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(aciPath), partialPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if err := keepMode(out, aciPath); err != nil {
+		return err
+	}
+
+	zw, err := pgzip.NewWriterLevel(out, level)
+	if err != nil {
+		return fmt.Errorf("invalid compression level %d: %w", level, err)
+	}
+	if _, err := io.Copy(zw, &cancelReader{r: in, ctx: ctx}); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), aciPath)
+}
+
+// keepMode gives f, the file replacing the one at origPath, the mode of the
+// latter: TempFile creates files only their owner can read.
+func keepMode(f *os.File, origPath string) error {
+	fi, err := os.Stat(origPath)
+	if err != nil {
+		return err
+	}
+	return f.Chmod(fi.Mode())
+}
@@ -1,10 +1,13 @@
 package docker2aci
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
 	"fmt"
 	"hash"
 	"io"
-	"io/ioutil"
 	"os"
 
 	"github.com/appc/spec/aci"
@@ -27,36 +30,50 @@ type aciInfo struct {
 // advantage of acirenderer to generate a squashed ACI Image.
 type ConversionStore struct {
 	acis map[string]*aciInfo
+	// ctx, if not nil, fails the reads of the streams once it's done:
+	// acirenderer reads them through ReadStream, which takes no context
+	ctx context.Context
 }
 
 func NewConversionStore() *ConversionStore {
 	return &ConversionStore{acis: make(map[string]*aciInfo)}
 }
 
+// WriteACI adds the ACI at path to the store and returns its key. The ACIs
+// are written under a temporary name and renamed once complete, see
+// createPartial, so the ones found at their path are whole.
 func (ms *ConversionStore) WriteACI(path string) (string, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	imageID := types.NewHashSHA512(data)
+	// the ACI is hashed as it's read, not loaded in memory
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
 
 	im, err := aci.ManifestFromImage(f)
 	if err != nil {
 		return "", err
 	}
 
-	key := imageID.String()
-	ms.acis[key] = &aciInfo{path: path, key: key, ImageManifest: im}
+	key := ms.HashToKey(h)
+	ms.addACI(path, key, im)
 	return key, nil
 }
 
+// addACI adds the ACI at path, whose key and manifest are known because it
+// was just written, without reading it.
+func (ms *ConversionStore) addACI(path string, key string, im *schema.ImageManifest) {
+	ms.acis[key] = &aciInfo{path: path, key: key, ImageManifest: im}
+}
+
 func (ms *ConversionStore) GetImageManifest(key string) (*schema.ImageManifest, error) {
 	aci, ok := ms.acis[key]
 	if !ok {
@@ -76,6 +93,8 @@ func (ms *ConversionStore) GetACI(name types.ACName, labels types.Labels) (strin
 	return "", fmt.Errorf("aci not found")
 }
 
+// ReadStream returns the uncompressed stream of the ACI of key. The layer ACIs
+// reused from the images converted earlier can be compressed already.
 func (ms *ConversionStore) ReadStream(key string) (io.ReadCloser, error) {
 	aci, ok := ms.acis[key]
 	if !ok {
@@ -85,8 +104,19 @@ func (ms *ConversionStore) ReadStream(key string) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error opening aci: %s", aci.path)
 	}
+	r, err := uncompressedACI(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading aci %s: %w", aci.path, err)
+	}
 
-	return f, nil
+	if ms.ctx != nil {
+		r = &cancelReader{r: r, ctx: ms.ctx}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
 }
 
 func (ms *ConversionStore) ResolveKey(key string) (string, error) {
@@ -97,3 +127,34 @@ func (ms *ConversionStore) HashToKey(h hash.Hash) string {
 	s := h.Sum(nil)
 	return fmt.Sprintf("%s%x", hashPrefix, s)
 }
+
+// ACIImageID returns the image ID of the ACI at aciPath, the SHA-512 of its
+// uncompressed contents. The ACI can be compressed.
+func ACIImageID(aciPath string) (string, error) {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r, err := uncompressedACI(f)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%x", hashPrefix, h.Sum(nil)), nil
+}
+
+// uncompressedACI returns the uncompressed contents of the ACI read from r,
+// which can be gzipped.
+func uncompressedACI(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
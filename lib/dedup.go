@@ -0,0 +1,108 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// duplicateLinker writes regular files to a tarball, replacing the ones
+// identical to a file already written, in contents and metadata, with hard
+// links to it. Files are spooled to disk to be hashed before their header is
+// written.
+type duplicateLinker struct {
+	spool   *os.File
+	written map[fileKey]string
+}
+
+// fileKey is what files must have in common to be hard linked, since links
+// share their metadata.
+type fileKey struct {
+	sum     [sha256.Size]byte
+	size    int64
+	mode    int64
+	uid     int
+	gid     int
+	modTime int64
+	xattrs  string
+}
+
+// newDuplicateLinker returns a duplicateLinker spooling files in tmpDir, or
+// the default directory for temporary files if it's empty.
+func newDuplicateLinker(tmpDir string) (*duplicateLinker, error) {
+	spool, err := ioutil.TempFile(tmpDir, "docker2aci-")
+	if err != nil {
+		return nil, err
+	}
+	return &duplicateLinker{
+		spool:   spool,
+		written: make(map[fileKey]string),
+	}, nil
+}
+
+// Close removes the spool file of dl.
+func (dl *duplicateLinker) Close() error {
+	dl.spool.Close()
+	return os.Remove(dl.spool.Name())
+}
+
+// write writes the regular file of hdr, with the contents of r, to tw.
+func (dl *duplicateLinker) write(tw *sparseWriter, hdr *tar.Header, r io.Reader) error {
+	h := sha256.New()
+	n, data, err := spoolSparse(dl.spool, io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+
+	key := fileKey{
+		size:    n,
+		mode:    hdr.Mode,
+		uid:     hdr.Uid,
+		gid:     hdr.Gid,
+		modTime: hdr.ModTime.UnixNano(),
+		xattrs:  xattrsKey(hdr.Xattrs),
+	}
+	copy(key.sum[:], h.Sum(nil))
+
+	if target, ok := dl.written[key]; ok {
+		link := *hdr
+		link.Typeflag = tar.TypeLink
+		link.Linkname = target
+		link.Size = 0
+		return tw.WriteHeader(&link)
+	}
+
+	if err := tw.writeSparse(hdr, dl.spool, data); err != nil {
+		return err
+	}
+	dl.written[key] = hdr.Name
+	return nil
+}
+
+// xattrsKey returns a string identifying the extended attributes xattrs.
+func xattrsKey(xattrs map[string]string) string {
+	var pairs []string
+	for k, v := range xattrs {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+)
+
+const discoveryIndex = "index.html"
+
+var discoveryTemplate = template.Must(template.New("discovery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Name}}</title>
+{{range .Templates}}<meta name="ac-discovery" content="{{$.Name}} {{.}}">
+{{end}}{{if .PubKeys}}<meta name="ac-discovery-pubkeys" content="{{.Name}} {{.PubKeys}}">
+{{end}}</head>
+<body>
+<ul>
+{{range .Files}}<li><a href="{{.}}">{{.}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+var discoveryIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>ACIs</title>
+</head>
+<body>
+<ul>
+{{range .}}<li><a href="{{.Path}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type discoveryPage struct {
+	Name      string
+	Templates []string
+	PubKeys   string
+	Files     []string
+}
+
+type discoveryIndexEntry struct {
+	Name string
+	Path string
+}
+
+// GenerateDiscovery writes in outputDir the HTML pages needed to serve the
+// given ACIs with appc discovery once they are uploaded to baseURL.
+// For every image name, e.g. example.com/app, it writes app/index.html with
+// the ac-discovery meta tags (and ac-discovery-pubkeys if pubKeysURL is not
+// empty), so the contents of outputDir can be served from the root of
+// example.com. It also writes a top-level index.html linking every image.
+// It returns the list of generated pages.
+func GenerateDiscovery(aciPaths []string, baseURL string, pubKeysURL string, outputDir string) ([]string, error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	pages := make(map[string]*discoveryPage)
+
+	for _, aciPath := range aciPaths {
+		manifest, err := readManifest(aciPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest from %s: %w", aciPath, err)
+		}
+
+		name := manifest.Name.String()
+		page, ok := pages[name]
+		if !ok {
+			page = &discoveryPage{Name: name, PubKeys: pubKeysURL}
+			pages[name] = page
+		}
+
+		var values []string
+		var variables []string
+		for _, l := range []string{"version", "os", "arch"} {
+			for _, label := range manifest.Labels {
+				if label.Name.String() == l {
+					values = append(values, label.Value)
+					variables = append(variables, "{"+l+"}")
+				}
+			}
+		}
+
+		fileName := filepath.Base(aciPath)
+		tmpl := discoveryURLTemplate(strings.TrimSuffix(fileName, ".aci"), values, variables)
+		page.Templates = append(page.Templates, baseURL+"/"+tmpl)
+		page.Files = append(page.Files, baseURL+"/"+fileName)
+	}
+
+	var names []string
+	for name := range pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var generated []string
+	var index []discoveryIndexEntry
+	writeIndex := true
+	for _, name := range names {
+		pagePath := path.Join(discoveryPath(name), discoveryIndex)
+		if pagePath == discoveryIndex {
+			// the image is served from the root, don't overwrite it
+			writeIndex = false
+		}
+		p := filepath.Join(outputDir, filepath.FromSlash(pagePath))
+		if err := writeDiscoveryFile(p, discoveryTemplate, pages[name]); err != nil {
+			return nil, err
+		}
+		generated = append(generated, p)
+		index = append(index, discoveryIndexEntry{Name: name, Path: pagePath})
+	}
+
+	if writeIndex {
+		p := filepath.Join(outputDir, discoveryIndex)
+		if err := writeDiscoveryFile(p, discoveryIndexTemplate, index); err != nil {
+			return nil, err
+		}
+		generated = append(generated, p)
+	}
+
+	return generated, nil
+}
+
+// discoveryURLTemplate replaces the label values at the end of an ACI file
+// name by their discovery template variables, so a single template serves
+// every version of an image named like the ones we generate:
+//
+//	library-busybox-latest -> library-busybox-{version}.{ext}
+//
+// If the file name doesn't end in the label values it is served verbatim.
+func discoveryURLTemplate(baseName string, values []string, variables []string) string {
+	for len(values) > 0 {
+		suffix := "-" + strings.Join(values, "-")
+		if strings.HasSuffix(baseName, suffix) {
+			return strings.TrimSuffix(baseName, suffix) + "-" + strings.Join(variables, "-") + ".{ext}"
+		}
+		values = values[:len(values)-1]
+		variables = variables[:len(variables)-1]
+	}
+	return baseName + ".{ext}"
+}
+
+// discoveryPath returns the path, relative to the root of the web server,
+// where the discovery page of an image name has to be served. That is the
+// name without its leading domain.
+func discoveryPath(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+func writeDiscoveryFile(p string, tmpl *template.Template, data interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("error creating dir: %w", err)
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", p, err)
+	}
+	defer f.Close()
+
+	if err := tmpl.Execute(f, data); err != nil {
+		return fmt.Errorf("error writing %s: %w", p, err)
+	}
+
+	return nil
+}
+
+func readManifest(aciPath string) (*schema.ImageManifest, error) {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return aci.ManifestFromImage(f)
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkDiskSpace fails if the file systems of the directories the layers of
+// ancestry are downloaded and converted to, downloadDir and layersDir, and of
+// the temporary and output directories don't have room for the conversion,
+// as estimated from the sizes of the layers. The estimate is an upper bound
+// as the layers are downloaded compressed, layers of unknown size count for
+// nothing and directories whose free space can't be told aren't checked. If
+// keep is true the layers stay in downloadDir, and the ones already there
+// aren't downloaded again.
+func checkDiskSpace(ctx context.Context, src Source, ancestry []string, config Config, downloadDir string, layersDir string, keep bool) error {
+	tmpDir := config.TmpDir
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	outputDir := config.OutputDir
+	if outputDir == "" {
+		outputDir = "."
+	}
+
+	var sizes []int64
+	var total, downloads int64
+	for _, layerID := range ancestry {
+		size, err := sourceLayerSize(ctx, src, layerID)
+		if err != nil {
+			return fmt.Errorf("error getting size of layer %s: %w", layerID, err)
+		}
+		if size <= 0 {
+			continue
+		}
+		total += size
+		if !keep {
+			sizes = append(sizes, size)
+		} else if _, err := os.Stat(filepath.Join(downloadDir, layerID)); err != nil {
+			downloads += size
+		}
+	}
+	if !keep {
+		// the layer being converted and the next one are downloaded at
+		// once
+		sort.Sort(sort.Reverse(int64Slice(sizes)))
+		for i := 0; i < len(sizes) && i < 2; i++ {
+			downloads += sizes[i]
+		}
+	}
+
+	var needs []spaceNeed
+	needs = addSpaceNeed(needs, downloadDir, downloads)
+	needs = addSpaceNeed(needs, layersDir, total)
+	if config.Squash != SquashNone {
+		needs = addSpaceNeed(needs, outputDir, total)
+	}
+	if config.PrePackHook != "" {
+		// the squashed ACI is extracted for the hook
+		needs = addSpaceNeed(needs, tmpDir, total)
+	}
+
+	for _, n := range needs {
+		if n.bytes > n.space.free {
+			const mib = 1 << 20
+			return fmt.Errorf("not enough disk space in %s: the conversion needs about %d MiB, %d MiB are free", strings.Join(n.dirs, " and "), (n.bytes+mib-1)/mib, n.space.free/mib)
+		}
+	}
+	return nil
+}
+
+// spaceNeed is the space needed in the directories of a file system.
+type spaceNeed struct {
+	dirs  []string
+	space fsSpace
+	bytes int64
+}
+
+// addSpaceNeed adds bytes needed in dir to needs, adding them up for the
+// directories of the same file system.
+func addSpaceNeed(needs []spaceNeed, dir string, bytes int64) []spaceNeed {
+	space, ok := freeSpace(dir)
+	if !ok {
+		return needs
+	}
+	for i := range needs {
+		if needs[i].space.fsID != space.fsID {
+			continue
+		}
+		if !containsString(needs[i].dirs, dir) {
+			needs[i].dirs = append(needs[i].dirs, dir)
+		}
+		needs[i].bytes += bytes
+		return needs
+	}
+	return append(needs, spaceNeed{dirs: []string{dir}, space: space, bytes: bytes})
+}
+
+// fsSpace is the free space of a file system.
+type fsSpace struct {
+	fsID uint64
+	free int64
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,38 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the space of dir's file system available to the user.
+// It reports false if it can't be told.
+func freeSpace(dir string) (fsSpace, bool) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fsSpace{}, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fsSpace{}, false
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return fsSpace{}, false
+	}
+	return fsSpace{fsID: uint64(st.Dev), free: int64(fs.Bavail) * int64(fs.Bsize)}, true
+}
@@ -18,6 +18,9 @@ package docker2aci
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -26,8 +29,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/appc/docker2aci/tarball"
@@ -37,9 +42,26 @@ import (
 	"github.com/appc/spec/schema/types"
 )
 
+// dockerArchs maps the architectures used by Docker (arm ones with their
+// variant) to the appc ones.
+var dockerArchs = map[string]string{
+	"386":   "i386",
+	"arm64": "aarch64",
+	"armv8": "aarch64",
+	"arm":   "armv7l",
+	"armv6": "armv6l",
+	"armv7": "armv7l",
+}
+
 const (
 	defaultTag    = "latest"
 	schemaVersion = "0.1.1"
+
+	shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=/.,:@%"
+
+	// acNameSeparators are the characters allowed between the
+	// alphanumeric runs of an ACName.
+	acNameSeparators = "-._~/"
 )
 
 // Convert generates ACI images from docker registry URLs.
@@ -54,63 +76,627 @@ const (
 // own ACI in outputDir.
 // It returns the list of generated ACI paths.
 func Convert(dockerURL string, squash bool, outputDir string) ([]string, error) {
+	config := Config{
+		Squash:    SquashOnly,
+		OutputDir: outputDir,
+	}
+	if !squash {
+		config.Squash = SquashNone
+	}
+
+	return ConvertWithConfig(dockerURL, config)
+}
+
+// ConvertWithConfig is like Convert but takes its options from config.
+// With SquashAlso it places every layer in its own ACI in config.OutputDir
+// and also squashes them in one file, which is the last of the returned
+// paths.
+func ConvertWithConfig(dockerURL string, config Config) ([]string, error) {
+	return ConvertWithContext(context.Background(), dockerURL, config)
+}
+
+// ConvertWithContext is like ConvertWithConfig but stops once ctx is done:
+// requests in flight are aborted, the temporary files and the ACI being
+// written are removed and the error of ctx is returned. ACIs already written
+// are kept. Unlike config.Deadline, a deadline of ctx doesn't wait for the
+// layer being converted.
+func ConvertWithContext(ctx context.Context, dockerURL string, config Config) ([]string, error) {
+	aciPaths, err := convertFromRegistry(ctx, dockerURL, config)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return aciPaths, withImage(err, dockerURL)
+}
+
+func convertFromRegistry(ctx context.Context, dockerURL string, config Config) ([]string, error) {
 	parsedURL, err := parseDockerURL(dockerURL)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing docker url: %v\n", err)
+		return nil, fmt.Errorf("error parsing docker url: %w\n", err)
+	}
+
+	var metadata *metadataCache
+	if config.CacheDir != "" {
+		if metadata, err = openMetadataCache(config.CacheDir); err != nil {
+			return nil, fmt.Errorf("error opening cache: %w", err)
+		}
+	}
+
+	if config.ContentTrust && (config.Offline || config.Resolved != nil) {
+		return nil, fmt.Errorf("the trust data of the image can't be verified offline or with a resolved image")
+	}
+
+	var src *registrySource
+	var ancestry []string
+	if config.Offline {
+		if src, ancestry, err = offlineSource(parsedURL, config); err != nil {
+			return nil, err
+		}
+	} else if config.Resolved != nil {
+		if config.Resolved.RepoData == nil || len(config.Resolved.RepoData.Endpoints) == 0 {
+			return nil, fmt.Errorf("resolved image has no registry endpoints")
+		}
+		ancestry = config.Resolved.Ancestry
+		if len(ancestry) == 0 {
+			return nil, fmt.Errorf("resolved image has no ancestry")
+		}
+
+		repoData := *config.Resolved.RepoData
+		if repoData.Credentials == nil {
+			repoData.Credentials = config.Credentials
+		}
+		repoData.httpClient = httpClient(config)
+		repoData.metadata = metadata
+		repoData.indexURL = parsedURL.IndexURL
+		repoData.logger = config.Logger
+		// the layer JSON fetched later is added to a copy
+		layersJSON := make(map[string][]byte)
+		for id, j := range config.Resolved.LayersJSON {
+			layersJSON[id] = j
+		}
+		src = &registrySource{
+			repoData:     &repoData,
+			layersJSON:   layersJSON,
+			showProgress: config.ShowProgress,
+			logger:       config.Logger,
+			chunks:       config.ChunkedDownloads,
+		}
+	} else {
+		repoData, err := getRepoData(ctx, httpClient(config), parsedURL.IndexURL, parsedURL.ImageName, config.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("error getting repository data: %w\n", err)
+		}
+		repoData.metadata = metadata
+		repoData.indexURL = parsedURL.IndexURL
+		repoData.logger = config.Logger
+		src = &registrySource{repoData: repoData, showProgress: config.ShowProgress, logger: config.Logger, chunks: config.ChunkedDownloads}
+
+		appImageID := config.ImageID
+		var trusted *trustedImage
+		if config.ContentTrust {
+			trusted, err = verifyTrust(ctx, parsedURL, config)
+			if err != nil {
+				return nil, err
+			}
+			if appImageID != "" && appImageID != trusted.ImageID {
+				return nil, &ErrUntrusted{Tag: parsedURL.Tag, Err: fmt.Errorf("it was signed for image %s, not %s", trusted.ImageID, appImageID)}
+			}
+			appImageID = trusted.ImageID
+			annotations := make(map[string]string)
+			for k, v := range config.Annotations {
+				annotations[k] = v
+			}
+			annotations[trustedDigestAnnotation] = trusted.Digest
+			config.Annotations = annotations
+		}
+		if appImageID == "" {
+			// TODO(iaguis) check more endpoints
+			appImageID, err = getImageIDFromTag(ctx, repoData.Endpoints[0], parsedURL.ImageName, parsedURL.Tag, repoData)
+			if err != nil {
+				return nil, fmt.Errorf("error getting ImageID from tag %s: %w\n", parsedURL.Tag, err)
+			}
+		}
+
+		ancestry, err = getAncestry(ctx, appImageID, repoData.Endpoints[0], repoData)
+		if err != nil {
+			return nil, fmt.Errorf("error getting ancestry: %w\n", err)
+		}
+
+		if trusted != nil {
+			if err := trusted.checkAncestry(ancestry); err != nil {
+				return nil, &ErrUntrusted{Tag: parsedURL.Tag, Err: err}
+			}
+			// the layers are the ones signed: their JSON is the one of
+			// the manifest and their tarballs are checked against its
+			// digests. The layers cached or converted before are only
+			// known by their IDs, so they're all downloaded again.
+			src.layersJSON = make(map[string][]byte)
+			src.digests = make(map[string]string)
+			for _, l := range trusted.Layers {
+				src.layersJSON[l.ID] = l.JSON
+				src.digests[l.ID] = l.BlobSum
+			}
+			src.trustedTag = parsedURL.Tag
+			config.CacheDir = ""
+			config.WorkDir = ""
+			config.Layers = nil
+			config.SkipExisting = false
+		}
 	}
 
-	repoData, err := getRepoData(parsedURL.IndexURL, parsedURL.ImageName)
+	src.ancestry = ancestry
+	return convertImage(ctx, src, ancestry, parsedURL, config)
+}
+
+// ResolveImageID returns the ID of the Docker image the tag of dockerURL
+// refers to. Passing it as Config.ImageID pins later conversions to that
+// image even if the tag is moved.
+func ResolveImageID(dockerURL string, credentials map[string]Credentials) (string, error) {
+	return ResolveImageIDWithContext(context.Background(), dockerURL, credentials)
+}
+
+// ResolveImageIDWithContext is like ResolveImageID but aborts its requests
+// and returns the error of ctx once it's done.
+func ResolveImageIDWithContext(ctx context.Context, dockerURL string, credentials map[string]Credentials) (string, error) {
+	parsedURL, err := parseDockerURL(dockerURL)
 	if err != nil {
-		return nil, fmt.Errorf("error getting repository data: %v\n", err)
+		return "", fmt.Errorf("error parsing docker url: %w", err)
+	}
+
+	repoData, err := getRepoData(ctx, DefaultHTTPClient, parsedURL.IndexURL, parsedURL.ImageName, credentials)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", withImage(fmt.Errorf("error getting repository data: %w", err), dockerURL)
 	}
 
 	// TODO(iaguis) check more endpoints
-	appImageID, err := getImageIDFromTag(repoData.Endpoints[0], parsedURL.ImageName, parsedURL.Tag, repoData)
+	imageID, err := getImageIDFromTag(ctx, repoData.Endpoints[0], parsedURL.ImageName, parsedURL.Tag, repoData)
 	if err != nil {
-		return nil, fmt.Errorf("error getting ImageID from tag %s: %v\n", parsedURL.Tag, err)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", withImage(fmt.Errorf("error getting ImageID from tag %s: %w", parsedURL.Tag, err), dockerURL)
 	}
 
-	ancestry, err := getAncestry(appImageID, repoData.Endpoints[0], repoData)
+	return imageID, nil
+}
+
+// ListTags returns the tags of the repository of dockerURL, whose tag is
+// ignored, mapped to the IDs of the Docker images they refer to.
+func ListTags(dockerURL string, credentials map[string]Credentials) (map[string]string, error) {
+	return ListTagsWithContext(context.Background(), dockerURL, credentials)
+}
+
+// ListTagsWithContext is like ListTags but aborts its requests and returns
+// the error of ctx once it's done.
+func ListTagsWithContext(ctx context.Context, dockerURL string, credentials map[string]Credentials) (map[string]string, error) {
+	parsedURL, err := parseDockerURL(dockerURL)
 	if err != nil {
-		return nil, fmt.Errorf("error getting ancestry: %v\n", err)
+		return nil, fmt.Errorf("error parsing docker url: %w", err)
 	}
 
-	layersOutputDir := outputDir
-	if squash {
-		layersOutputDir, err = ioutil.TempDir("", "docker2aci-")
-		if err != nil {
-			return nil, fmt.Errorf("error creating dir: %v", err)
+	repoData, err := getRepoData(ctx, DefaultHTTPClient, parsedURL.IndexURL, parsedURL.ImageName, credentials)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, withImage(fmt.Errorf("error getting repository data: %w", err), dockerURL)
+	}
+
+	tags, err := getTags(ctx, repoData.Endpoints[0], parsedURL.ImageName, repoData)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, withImage(fmt.Errorf("error getting tags: %w", err), dockerURL)
+	}
+
+	return tags, nil
+}
+
+// registrySource fetches the layers from a Docker registry.
+type registrySource struct {
+	repoData *RepoData
+	ancestry []string
+	// mu guards layersJSON and sizes, layers are downloaded in the
+	// background
+	mu         sync.Mutex
+	layersJSON map[string][]byte
+	sizes      map[string]int
+	// showProgress leaves the downloads to their progress bars
+	showProgress bool
+	// logger gets the messages of the conversion
+	logger Logger
+	// offline sources only have what's in the cache
+	offline bool
+	// chunks is the number of ranged requests large layers are
+	// downloaded with at once
+	chunks int
+	// digests, if not nil, are the digests the layers must have, the
+	// ones signed for trustedTag
+	digests    map[string]string
+	trustedTag string
+}
+
+func (rs *registrySource) GetAncestry(ctx context.Context) ([]string, error) {
+	return rs.ancestry, nil
+}
+
+func (rs *registrySource) GetImageConfig(ctx context.Context, layerID string) ([]byte, error) {
+	rs.mu.Lock()
+	j, ok := rs.layersJSON[layerID]
+	rs.mu.Unlock()
+	if ok {
+		return j, nil
+	}
+	if rs.offline {
+		return nil, fmt.Errorf("the JSON of layer %s isn't in the cache", layerID)
+	}
+
+	// TODO(iaguis) check more endpoints
+	j, size, err := getRemoteImageJSON(ctx, layerID, rs.repoData.Endpoints[0], rs.repoData)
+	if err != nil {
+		return nil, err
+	}
+
+	// the JSON is kept as getLayerSize fetches it before the conversion
+	rs.mu.Lock()
+	if rs.layersJSON == nil {
+		rs.layersJSON = make(map[string][]byte)
+	}
+	rs.layersJSON[layerID] = j
+	if rs.sizes == nil {
+		rs.sizes = make(map[string]int)
+	}
+	rs.sizes[layerID] = size
+	rs.mu.Unlock()
+
+	return j, nil
+}
+
+// getLayerSize returns the X-Docker-Size of the layer JSON, or its Size if
+// the registry didn't send one or the layer JSON came with a resolved image.
+func (rs *registrySource) getLayerSize(ctx context.Context, layerID string) (int64, error) {
+	j, err := rs.GetImageConfig(ctx, layerID)
+	if err != nil {
+		return -1, err
+	}
+	rs.mu.Lock()
+	size, ok := rs.sizes[layerID]
+	rs.mu.Unlock()
+	if ok && size >= 0 {
+		return int64(size), nil
+	}
+
+	var data struct {
+		Size *int64
+	}
+	if err := json.Unmarshal(j, &data); err != nil || data.Size == nil {
+		return -1, nil
+	}
+	return *data.Size, nil
+}
+
+func (rs *registrySource) GetLayerReader(ctx context.Context, layerID string) (io.ReadCloser, error) {
+	rs.mu.Lock()
+	size, ok := rs.sizes[layerID]
+	rs.mu.Unlock()
+	if !ok {
+		size = -1
+	}
+	if rs.offline {
+		return nil, fmt.Errorf("layer %s isn't in the cache", layerID)
+	}
+	if !rs.showProgress {
+		logInfo(rs.logger, "Downloading layer: "+layerID, LogField{"layer", layerID})
+	}
+	layer, err := getRemoteLayer(ctx, layerID, rs.repoData.Endpoints[0], rs.repoData, int64(size), rs.chunks)
+	if err != nil || rs.digests == nil {
+		return layer, err
+	}
+	vr := &verifiedReader{
+		ReadCloser: layer,
+		hash:       sha256.New(),
+		digest:     rs.digests[layerID],
+		tag:        rs.trustedTag,
+	}
+	sb, ok := layer.(*sizedBody)
+	if !ok {
+		return vr, nil
+	}
+	vr.ReadCloser = sb.ReadCloser
+	return &sizedBody{ReadCloser: vr, size: sb.size}, nil
+}
+
+// convertImage converts every layer in ancestry, taking them from src, and
+// squashes them according to config. Once ctx is done, the ACI being
+// written is removed and the error of ctx is returned.
+func convertImage(ctx context.Context, src Source, ancestry []string, dockerURL *ParsedDockerURL, config Config) ([]string, error) {
+	if config.PrePackHook != "" && config.Squash == SquashNone {
+		return nil, fmt.Errorf("the pre-pack hook needs a squashed image")
+	}
+
+	if len(ancestry) == 0 {
+		return nil, fmt.Errorf("the image has no layers")
+	}
+
+	start := time.Now()
+	stats := config.Stats
+	if stats == nil {
+		stats = &Stats{}
+	}
+	*stats = Stats{}
+
+	var err error
+	var work *workDir
+	if config.WorkDir != "" {
+		if work, err = openWorkDir(config.WorkDir); err != nil {
+			return nil, &ErrStore{Path: config.WorkDir, Err: fmt.Errorf("error opening work dir: %w", err)}
+		}
+	}
+
+	layersOutputDir := config.OutputDir
+	if config.Squash == SquashOnly {
+		if work != nil {
+			if layersOutputDir, err = work.acisDir(dockerURL.IndexURL); err != nil {
+				return nil, fmt.Errorf("error creating dir: %w", err)
+			}
+		} else if config.Layers != nil {
+			if layersOutputDir, err = config.Layers.acisDir(config.TmpDir); err != nil {
+				return nil, fmt.Errorf("error creating dir: %w", err)
+			}
+		} else {
+			layersOutputDir, err = ioutil.TempDir(config.TmpDir, "docker2aci-")
+			if err != nil {
+				return nil, fmt.Errorf("error creating dir: %w", err)
+			}
+			defer os.RemoveAll(layersOutputDir)
+		}
+	}
+
+	// the ACIs left partial by the conversions which died
+	for _, dir := range []string{config.OutputDir, layersOutputDir} {
+		if dir == "" {
+			dir = "."
+		}
+		if err := removeStale(dir, partialPrefix, stalePartialAge); err != nil {
+			return nil, fmt.Errorf("error cleaning partial ACIs: %w", err)
+		}
+	}
+
+	// from here on config.Name is the name of the image's ACIs
+	if config.Name == "" {
+		if config.Name, err = sanitizeImageName(dockerURL.IndexURL + "/" + dockerURL.ImageName); err != nil {
+			return nil, err
+		}
+	} else if _, err := types.NewACName(config.Name); err != nil {
+		return nil, fmt.Errorf("invalid name %q: %w", config.Name, err)
+	}
+
+	filter, err := newPathFilter(config.Exclude, config.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ACIs keep the fingerprint of the options they're converted with,
+	// so they're only reused with the same ones
+	settings, err := convertSettings(config)
+	if err != nil {
+		return nil, err
+	}
+	annotations := make(map[string]string)
+	for k, v := range config.Annotations {
+		annotations[k] = v
+	}
+	annotations[settingsAnnotation] = settings
+	config.Annotations = annotations
+
+	progress := newImageProgress(len(ancestry), dockerURL, config)
+	if config.SkipExisting {
+		if aciPaths, ok := findConvertedImage(ancestry[0], dockerURL, config, settings); ok {
+			logInfo(config.Logger, "Using converted image: "+ancestry[0], LogField{"layer", ancestry[0]})
+			progress.imageConverted(aciPaths, nil)
+			stats.addACIs(aciPaths)
+			stats.TotalTime = time.Since(start)
+			return aciPaths, nil
+		}
+	}
+
+	// ancestry[top:] are the layers converted with an earlier image, the
+	// others are converted here
+	top := len(ancestry)
+	var reused []*convertedLayer
+	if config.Layers != nil {
+		top, reused = config.Layers.reuse(ancestry)
+	}
+	progress.layers = top
+
+	// the layers are kept in the cache, or else in the work dir
+	var downloadDir string
+	keep := true
+	switch {
+	case config.CacheDir != "":
+		if downloadDir, err = openLayerCache(config.CacheDir, dockerURL.IndexURL); err != nil {
+			return nil, &ErrStore{Path: config.CacheDir, Err: fmt.Errorf("error opening cache: %w", err)}
+		}
+	case work != nil:
+		if downloadDir, err = work.layersDir(config, dockerURL.IndexURL); err != nil {
+			return nil, fmt.Errorf("error creating dir: %w", err)
+		}
+	default:
+		if downloadDir, err = ioutil.TempDir(config.TmpDir, "docker2aci-"); err != nil {
+			return nil, fmt.Errorf("error creating dir: %w", err)
+		}
+		defer os.RemoveAll(downloadDir)
+		keep = false
+	}
+
+	if !config.SkipSpaceCheck {
+		if err := checkDiskSpace(ctx, src, ancestry[:top], config, downloadDir, layersOutputDir, keep); err != nil {
+			return nil, err
 		}
-		defer os.RemoveAll(layersOutputDir)
 	}
 
 	conversionStore := NewConversionStore()
+	conversionStore.ctx = ctx
 
+	// layers are converted from the base one so the files they inherit,
+	// like /etc/passwd, are known. images and aciLayerPaths are kept in
+	// the order of the ancestry, top layer first.
 	var images acirenderer.Images
 	var aciLayerPaths []string
-	for i, layerID := range ancestry {
-		aciPath, manifest, err := buildACI(layerID, repoData, parsedURL, layersOutputDir)
-		if err != nil {
-			return nil, fmt.Errorf("error building layer: %v\n", err)
+	state := &ancestryState{filter: filter}
+	// the reused ACIs are compressed, if they are, by the conversion which
+	// built them
+	reusedPaths := make(map[string]bool)
+	// the image IDs of the layer ACIs
+	keys := make(map[string]string)
+	if len(reused) > 0 {
+		state = reused[0].state.clone()
+		state.filter = filter
+		for j, l := range reused {
+			if ancestry[top+j] == state.parentLayerID {
+				state.parentApp = &l.manifest.Name
+				state.parentLabels = l.manifest.Labels
+			}
+			// from the base layer
+			ls := LayerStats{Layer: ancestry[top+j], Reused: true}
+			if l.aciPath != "" {
+				ls.ACI, ls.ACISize = l.aciPath, fileSize(l.aciPath)
+			}
+			stats.Layers = append([]LayerStats{ls}, stats.Layers...)
+			if l.aciPath == "" {
+				continue
+			}
+			logInfo(config.Logger, "Using converted layer: "+ancestry[top+j], LogField{"layer", ancestry[top+j]})
+			progress.emit(Event{Type: EventLayerConverted, Layer: ancestry[top+j], ACI: l.aciPath, ImageID: l.key})
+			keys[l.aciPath] = l.key
+			conversionStore.addACI(l.aciPath, l.key, l.manifest)
+			images = append(images, acirenderer.Image{Im: l.manifest, Key: l.key})
+			aciLayerPaths = append(aciLayerPaths, l.aciPath)
+			reusedPaths[l.aciPath] = true
+		}
+	}
+	// the next layer is downloaded while the current one is converted
+	startDownload := func(layerID string) *layerDownload {
+		return startLayerDownload(ctx, src, layerID, downloadDir, keep, config.MaxLayerSize, config.Logger, progress.bar(layerID))
+	}
+	next := startDownload(ancestry[top-1])
+	defer func() {
+		if next != nil {
+			next.cancel()
+		}
+	}()
+	for i := top - 1; i >= 0; i-- {
+		layerID := ancestry[i]
+		if !config.Deadline.IsZero() && time.Now().After(config.Deadline) {
+			derr := &DeadlineError{
+				Deadline:  config.Deadline,
+				Completed: ancestry[i+1:],
+				Remaining: ancestry[:i+1],
+			}
+			if config.Squash != SquashOnly {
+				derr.ACIs = aciLayerPaths
+			}
+			return nil, derr
 		}
 
-		key, err := conversionStore.WriteACI(aciPath)
-		if err != nil {
-			return nil, fmt.Errorf("error inserting in the conversion store: %v\n", err)
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		images = append(images, acirenderer.Image{Im: manifest, Key: key, Level: uint16(i)})
-		aciLayerPaths = append(aciLayerPaths, aciPath)
+		download := next
+		next = nil
+		if i > 0 {
+			next = startDownload(ancestry[i-1])
+		}
+
+		// the overrides are for the image's app, the lower layers keep
+		// theirs
+		layerConfig := config
+		if i > 0 {
+			layerConfig.App = AppOverrides{}
+		}
+		ls := LayerStats{Layer: layerID}
+		aciPath, key, manifest, err := buildACI(ctx, layerID, src, download, dockerURL, layersOutputDir, layerConfig, state, work, &ls, i > 0)
+		if err != nil {
+			return nil, fmt.Errorf("error building layer: %w\n", err)
+		}
+		stats.Layers = append(stats.Layers, ls)
+		progress.emit(Event{Type: EventLayerConverted, Layer: layerID, ACI: aciPath, ImageID: key})
+		if aciPath != "" {
+			keys[aciPath] = key
+			conversionStore.addACI(aciPath, key, manifest)
+
+			state.parentLayerID = layerID
+			state.parentImageID = key
+			state.parentApp = nil
+			state.parentLabels = nil
+			images = append(acirenderer.Images{{Im: manifest, Key: key}}, images...)
+			aciLayerPaths = append([]string{aciPath}, aciLayerPaths...)
+		}
+		// the top layer has the app overrides, which its children
+		// in other images don't get
+		if config.Layers != nil && (i > 0 || config.App.empty()) {
+			config.Layers.add(layerID, aciPath, key, manifest, state)
+		}
+	}
+	for i := range images {
+		images[i].Level = uint16(i)
 	}
 
-	if squash {
-		squashedImagePath, err := SquashLayers(images, conversionStore, *parsedURL, outputDir)
+	if config.Squash != SquashNone {
+		var dups *duplicateLinker
+		if config.HardlinkDuplicates {
+			if dups, err = newDuplicateLinker(config.TmpDir); err != nil {
+				return nil, fmt.Errorf("error creating file: %w", err)
+			}
+			defer dups.Close()
+		}
+		squashStart := time.Now()
+		squashedImagePath, err := squashLayers(images, conversionStore, *dockerURL, config.OutputDir, config.TmpDir, state.files, dups)
 		if err != nil {
-			return nil, fmt.Errorf("error squashing image: %v\n", err)
+			return nil, fmt.Errorf("error squashing image: %w\n", err)
+		}
+		stats.SquashTime = time.Since(squashStart)
+		if config.PrePackHook != "" {
+			hookStart := time.Now()
+			if err := runPrePackHook(ctx, squashedImagePath, config.PrePackHook, config); err != nil {
+				return nil, err
+			}
+			stats.HookTime = time.Since(hookStart)
+		}
+		if config.Squash == SquashAlso {
+			aciLayerPaths = append(aciLayerPaths, squashedImagePath)
+		} else {
+			aciLayerPaths = []string{squashedImagePath}
 		}
-		aciLayerPaths = []string{squashedImagePath}
 	}
 
+	// the layers are squashed and hooked uncompressed. The layer ACIs
+	// packed by an interrupted conversion can be compressed already.
+	if config.CompressionLevel != 0 {
+		compressStart := time.Now()
+		for _, p := range aciLayerPaths {
+			if reusedPaths[p] || (work != nil && work.compressed(p)) {
+				continue
+			}
+			if err := compressACI(ctx, p, config.CompressionLevel); err != nil {
+				return nil, fmt.Errorf("error compressing ACI: %w\n", err)
+			}
+			if work != nil {
+				if err := work.setCompressed(p); err != nil {
+					return nil, fmt.Errorf("error recording progress: %w", err)
+				}
+			}
+		}
+		stats.CompressTime = time.Since(compressStart)
+	}
+
+	progress.imageConverted(aciLayerPaths, keys)
+	stats.addACIs(aciLayerPaths)
+	stats.TotalTime = time.Since(start)
 	return aciLayerPaths, nil
 }
 
@@ -121,6 +707,15 @@ func parseDockerURL(arg string) (*ParsedDockerURL, error) {
 	}
 	indexURL, imageName := splitReposName(taglessRemote)
 
+	// official images on Docker Hub live in the library namespace, both
+	// in the registry and in the names we give them
+	if indexURL == "docker.io" {
+		indexURL = defaultIndex
+	}
+	if indexURL == defaultIndex && !strings.Contains(imageName, "/") {
+		imageName = path.Join(officialNamespace, imageName)
+	}
+
 	return &ParsedDockerURL{
 		IndexURL:  indexURL,
 		ImageName: imageName,
@@ -128,8 +723,7 @@ func parseDockerURL(arg string) (*ParsedDockerURL, error) {
 	}, nil
 }
 
-func getRepoData(indexURL string, remote string) (*RepoData, error) {
-	client := &http.Client{}
+func getRepoData(ctx context.Context, client *http.Client, indexURL string, remote string, credentials map[string]Credentials) (*RepoData, error) {
 	repositoryURL := "https://" + path.Join(indexURL, "v1", "repositories", remote, "images")
 
 	req, err := http.NewRequest("GET", repositoryURL, nil)
@@ -137,17 +731,19 @@ func getRepoData(indexURL string, remote string) (*RepoData, error) {
 		return nil, err
 	}
 
-	// TODO(iaguis) add auth?
 	req.Header.Set("X-Docker-Token", "true")
+	if c, ok := credentialsFor(credentials, indexURL); ok {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
 
-	res, err := client.Do(req)
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP code: %d, URL: %s", res.StatusCode, req.URL)
+		return nil, statusError(res, indexURL, "", "")
 	}
 
 	var tokens []string
@@ -169,124 +765,207 @@ func getRepoData(indexURL string, remote string) (*RepoData, error) {
 	}
 
 	return &RepoData{
-		Endpoints: endpoints,
-		Tokens:    tokens,
-		Cookie:    cookies,
+		Endpoints:   endpoints,
+		Tokens:      tokens,
+		Cookie:      cookies,
+		Credentials: credentials,
+		httpClient:  client,
 	}, nil
 }
 
-func getImageIDFromTag(registry string, appName string, tag string, repoData *RepoData) (string, error) {
-	client := &http.Client{}
+func getImageIDFromTag(ctx context.Context, registry string, appName string, tag string, repoData *RepoData) (string, error) {
+	client := repoData.client()
 	req, err := http.NewRequest("GET", "https://"+path.Join(registry, "repositories", appName, "tags", tag), nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to get Image ID: %s, URL: %s", err, req.URL)
+		return "", fmt.Errorf("failed to get Image ID: %w, URL: %s", err, req.URL)
 	}
 
-	setAuthToken(req, repoData.Tokens)
+	setAuth(req, repoData)
 	setCookie(req, repoData.Cookie)
-	res, err := client.Do(req)
+	// the tag is only sent again if it moved
+	key := tagKey(repoData.indexURL, appName, tag)
+	cached, ok := cachedMetadata(repoData, key)
+	if ok {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", fmt.Errorf("failed to get Image ID: %s, URL: %s", err, req.URL)
+		return "", fmt.Errorf("failed to get Image ID: %w, URL: %s", err, req.URL)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("HTTP code: %d. URL: %s", res.StatusCode, req.URL)
+	if res.StatusCode == http.StatusNotModified && ok {
+		return string(cached.Body), nil
 	}
-
-	j, err := ioutil.ReadAll(res.Body)
-
-	if err != nil {
-		return "", err
+	if res.StatusCode != 200 {
+		return "", statusError(res, registry, tag, "")
 	}
 
 	var imageID string
 
-	if err := json.Unmarshal(j, &imageID); err != nil {
-		return "", fmt.Errorf("error unmarshaling: %v", err)
+	if err := json.NewDecoder(newBoundedReader(res.Body, maxJSONSize)).Decode(&imageID); err != nil {
+		return "", fmt.Errorf("error unmarshaling: %w", err)
 	}
 
+	cacheMetadata(repoData, metadataEntry{
+		Key:          key,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Size:         -1,
+		Body:         []byte(imageID),
+	})
 	return imageID, nil
 }
 
-func getAncestry(imgID, registry string, repoData *RepoData) ([]string, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://"+path.Join(registry, "images", imgID, "ancestry"), nil)
+// getTags returns the tags of appName mapped to their image IDs. Old
+// registries list them as an array rather than an object.
+func getTags(ctx context.Context, registry string, appName string, repoData *RepoData) (map[string]string, error) {
+	client := repoData.client()
+	req, err := http.NewRequest("GET", "https://"+path.Join(registry, "repositories", appName, "tags"), nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get tags: %w, URL: %s", err, req.URL)
 	}
 
-	setAuthToken(req, repoData.Tokens)
+	setAuth(req, repoData)
 	setCookie(req, repoData.Cookie)
-	res, err := client.Do(req)
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get tags: %w, URL: %s", err, req.URL)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP code: %d. URL: %s", res.StatusCode, req.URL)
+		return nil, statusError(res, registry, "", "")
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(newBoundedReader(res.Body, maxJSONSize)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("error unmarshaling: %w", err)
+	}
+	tags := make(map[string]string)
+	if err := json.Unmarshal(raw, &tags); err == nil {
+		return tags, nil
 	}
+	var list []struct {
+		Layer string `json:"layer"`
+		Name  string `json:"name"`
+	}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("error unmarshaling: %w", err)
+	}
+	for _, t := range list {
+		tags[t.Name] = t.Layer
+	}
+	return tags, nil
+}
 
+func getAncestry(ctx context.Context, imgID, registry string, repoData *RepoData) ([]string, error) {
 	var ancestry []string
+	// the ancestry of an image ID never changes
+	key := ancestryKey(repoData.indexURL, imgID)
+	if e, ok := cachedMetadata(repoData, key); ok && json.Unmarshal(e.Body, &ancestry) == nil {
+		return ancestry, nil
+	}
 
-	j, err := ioutil.ReadAll(res.Body)
+	client := repoData.client()
+	req, err := http.NewRequest("GET", "https://"+path.Join(registry, "images", imgID, "ancestry"), nil)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read downloaded json: %s (%s)", err, j)
+		return nil, err
 	}
 
-	if err := json.Unmarshal(j, &ancestry); err != nil {
-		return nil, fmt.Errorf("error unmarshaling: %v", err)
+	setAuth(req, repoData)
+	setCookie(req, repoData.Cookie)
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	return ancestry, nil
-}
+	if res.StatusCode != 200 {
+		return nil, statusError(res, registry, "", imgID)
+	}
 
-func buildACI(layerID string, repoData *RepoData, dockerURL *ParsedDockerURL, outputDir string) (string, *schema.ImageManifest, error) {
-	tmpDir, err := ioutil.TempDir("", "docker2aci-")
-	if err != nil {
-		return "", nil, fmt.Errorf("error creating dir: %v", err)
+	if err := json.NewDecoder(newBoundedReader(res.Body, maxJSONSize)).Decode(&ancestry); err != nil {
+		return nil, fmt.Errorf("error unmarshaling: %w", err)
 	}
-	defer os.RemoveAll(tmpDir)
 
-	layerDest := filepath.Join(tmpDir, "layer")
-	layerRootfs := filepath.Join(layerDest, "rootfs")
-	err = os.MkdirAll(layerRootfs, 0700)
-	if err != nil {
-		return "", nil, fmt.Errorf("error creating dir: %s", layerRootfs)
+	if b, err := json.Marshal(ancestry); err == nil {
+		cacheMetadata(repoData, metadataEntry{Key: key, Size: -1, Body: b})
 	}
+	return ancestry, nil
+}
 
-	j, size, err := getRemoteImageJSON(layerID, repoData.Endpoints[0], repoData)
+// buildACI converts the layer layerID of src, whose tarball is downloaded by
+// download, to an ACI in outputDir, applying config. state is updated with
+// the layer. If skipEmpty is true and the layer has no files, no ACI is
+// written and the returned path is empty: the layer only changed the config,
+// which its children inherit. The key of the ACI in a ConversionStore is
+// returned with its path. stats gets what the layer took.
+func buildACI(ctx context.Context, layerID string, src Source, download *layerDownload, dockerURL *ParsedDockerURL, outputDir string, config Config, state *ancestryState, work *workDir, stats *LayerStats, skipEmpty bool) (string, string, *schema.ImageManifest, error) {
+	defer download.cancel()
+
+	j, err := src.GetImageConfig(ctx, layerID)
 	if err != nil {
-		return "", nil, fmt.Errorf("error getting image json: %v", err)
+		return "", "", nil, fmt.Errorf("error getting image json: %w", err)
 	}
 
 	layerData := DockerImageData{}
 	if err := json.Unmarshal(j, &layerData); err != nil {
-		return "", nil, fmt.Errorf("error unmarshaling layer data: %v", err)
+		return "", "", nil, &ErrManifestInvalid{Layer: layerID, Err: fmt.Errorf("error unmarshaling layer data: %w", err)}
 	}
-
-	layer, err := getRemoteLayer(layerID, repoData.Endpoints[0], repoData, int64(size))
-	if err != nil {
-		return "", nil, fmt.Errorf("error getting the remote layer: %v", err)
+	// the layers are checked from the base one, before most of them are
+	// downloaded
+	if layerData.OS != "" && layerData.OS != "linux" && !config.AllowNonLinux {
+		return "", "", nil, fmt.Errorf("layer %s is for %s, only Linux images are supported", layerID, layerData.OS)
 	}
-	defer layer.Close()
 
-	layerFile, err := ioutil.TempFile(tmpDir, "dockerlayer-")
+	rawConfig, err := sourceRawConfig(ctx, src, layerID)
 	if err != nil {
-		return "", nil, fmt.Errorf("error creating layer: %v", err)
+		return "", "", nil, fmt.Errorf("error getting image config: %w", err)
 	}
 
-	_, err = io.Copy(layerFile, layer)
+	select {
+	case <-download.done:
+	case <-ctx.Done():
+		return "", "", nil, ctx.Err()
+	}
+	file, err := download.wait()
 	if err != nil {
-		return "", nil, fmt.Errorf("error getting layer: %v", err)
+		return "", "", nil, err
+	}
+	stats.Cached = download.cached
+	stats.DownloadTime = download.elapsed
+	if fi, err := file.Stat(); err == nil {
+		stats.DownloadSize = fi.Size()
 	}
+	layerFile := &cancelReadSeeker{ReadSeeker: file, ctx: ctx}
 
-	layerFile.Sync()
+	start := time.Now()
+	if err := state.addLayer(layerFile); err != nil {
+		return "", "", nil, fmt.Errorf("error reading layer: %w", err)
+	}
+	stats.ReadTime = time.Since(start)
+	stats.FilesSize = state.layerSize
+	if config.MaxLayerSize > 0 && state.layerSize > config.MaxLayerSize {
+		return "", "", nil, fmt.Errorf("layer %s has %d bytes of files, more than the maximum layer size of %d bytes", layerID, state.layerSize, config.MaxLayerSize)
+	}
+	if config.MaxImageSize > 0 && state.imageSize > config.MaxImageSize {
+		return "", "", nil, fmt.Errorf("the layers up to %s have %d bytes of files, more than the maximum image size of %d bytes", layerID, state.imageSize, config.MaxImageSize)
+	}
+	state.addHistory(layerData)
+	if skipEmpty && state.empty {
+		logInfo(config.Logger, "Skipping empty layer: "+layerID, LogField{"layer", layerID})
+		return "", "", nil, nil
+	}
 
-	manifest, err := generateManifest(layerData, dockerURL)
+	manifest, err := generateManifest(layerData, rawConfig, dockerURL, config, state)
 	if err != nil {
-		return "", nil, fmt.Errorf("error generating the manifest: %v", err)
+		return "", "", nil, fmt.Errorf("error generating the manifest: %w", err)
 	}
 
 	imageName := strings.Replace(dockerURL.ImageName, "/", "-", -1)
@@ -294,62 +973,103 @@ func buildACI(layerID string, repoData *RepoData, dockerURL *ParsedDockerURL, ou
 	if dockerURL.Tag != "" {
 		aciPath += "-" + dockerURL.Tag
 	}
-	if layerData.OS != "" {
-		aciPath += "-" + layerData.OS
-		if layerData.Architecture != "" {
-			aciPath += "-" + layerData.Architecture
+	if appcOS, appcArch := getAppcOSArch(layerData); appcOS != "" {
+		aciPath += "-" + appcOS
+		if appcArch != "" {
+			aciPath += "-" + appcArch
 		}
 	}
 	aciPath += ".aci"
 
 	aciPath = path.Join(outputDir, aciPath)
 
-	if err := writeACI(layerFile, *manifest, aciPath); err != nil {
-		return "", nil, fmt.Errorf("error writing ACI: %v", err)
+	// the layer is still added to state, which the next layers need
+	var settings string
+	if work != nil {
+		if settings, err = packSettings(*manifest, config); err != nil {
+			return "", "", nil, err
+		}
+		if key, ok := work.packed(dockerURL.IndexURL, layerID, aciPath, settings); ok {
+			logInfo(config.Logger, "Using packed layer: "+layerID, LogField{"layer", layerID})
+			stats.ACI, stats.ACISize = aciPath, fileSize(aciPath)
+			return aciPath, key, manifest, nil
+		}
 	}
 
-	if err := validateACI(aciPath); err != nil {
-		return "", nil, fmt.Errorf("invalid aci generated: %v", err)
+	start = time.Now()
+	key, err := writeACI(layerFile, *manifest, aciPath, config, state)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error writing ACI: %w", err)
 	}
+	stats.PackTime = time.Since(start)
+	stats.ACI, stats.ACISize = aciPath, fileSize(aciPath)
 
-	return aciPath, manifest, nil
+	if work != nil {
+		if err := work.setPacked(dockerURL.IndexURL, layerID, aciPath, key, settings); err != nil {
+			return "", "", nil, fmt.Errorf("error recording progress: %w", err)
+		}
+	}
+
+	return aciPath, key, manifest, nil
 }
 
-func validateACI(aciPath string) error {
-	aciFile, err := os.Open(aciPath)
-	if err != nil {
-		return err
-	}
-	defer aciFile.Close()
+// aciValidator validates an ACI with aci.ValidateArchive while it's written,
+// so it doesn't have to be read back.
+type aciValidator struct {
+	pw   *io.PipeWriter
+	errc chan error
+}
+
+// newACIValidator returns a validator and a writer writing to w what the
+// validator gets.
+func newACIValidator(w io.Writer) (*aciValidator, io.Writer) {
+	pr, pw := io.Pipe()
+	v := &aciValidator{pw: pw, errc: make(chan error, 1)}
+	go func() {
+		err := aci.ValidateArchive(tar.NewReader(pr))
+		// the writes block until the end of the ACI is read
+		io.Copy(ioutil.Discard, pr)
+		v.errc <- err
+	}()
+	return v, io.MultiWriter(w, pw)
+}
 
-	reader, err := aci.NewCompressedTarReader(aciFile)
+// close returns the result of validating the ACI, whose writing ended with
+// err.
+func (v *aciValidator) close(err error) error {
 	if err != nil {
+		v.pw.CloseWithError(err)
+		<-v.errc
 		return err
 	}
-
-	if err := aci.ValidateArchive(reader); err != nil {
-		return err
+	v.pw.Close()
+	if err := <-v.errc; err != nil {
+		return fmt.Errorf("invalid aci generated: %w", err)
 	}
-
 	return nil
 }
 
-func getRemoteImageJSON(imgID, registry string, repoData *RepoData) ([]byte, int, error) {
-	client := &http.Client{}
+func getRemoteImageJSON(ctx context.Context, imgID, registry string, repoData *RepoData) ([]byte, int, error) {
+	key := layerJSONKey(repoData.indexURL, imgID)
+	if e, ok := cachedMetadata(repoData, key); ok {
+		return e.Body, e.Size, nil
+	}
+
+	client := repoData.client()
 	req, err := http.NewRequest("GET", "https://"+path.Join(registry, "images", imgID, "json"), nil)
 	if err != nil {
 		return nil, -1, err
 	}
-	setAuthToken(req, repoData.Tokens)
+	setAuth(req, repoData)
 	setCookie(req, repoData.Cookie)
-	res, err := client.Do(req)
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, -1, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, -1, fmt.Errorf("HTTP code: %d, URL: %s", res.StatusCode, req.URL)
+		return nil, -1, statusError(res, registry, "", imgID)
 	}
 
 	imageSize := -1
@@ -361,192 +1081,575 @@ func getRemoteImageJSON(imgID, registry string, repoData *RepoData) ([]byte, int
 		}
 	}
 
-	b, err := ioutil.ReadAll(res.Body)
+	// the JSON is kept as it is, for the config annotation
+	b, err := ioutil.ReadAll(newBoundedReader(res.Body, maxJSONSize))
 	if err != nil {
-		return nil, -1, fmt.Errorf("failed to read downloaded json: %v (%s)", err, b)
+		return nil, -1, fmt.Errorf("failed to read downloaded json: %w", err)
 	}
 
+	cacheMetadata(repoData, metadataEntry{Key: key, Size: imageSize, Body: b})
 	return b, imageSize, nil
 }
 
-func getRemoteLayer(imgID, registry string, repoData *RepoData, imgSize int64) (io.ReadCloser, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://"+path.Join(registry, "images", imgID, "layer"), nil)
-	if err != nil {
-		return nil, err
+// getRemoteLayer returns the stream of the layer imgID, whose size is imgSize
+// if known. Large layers are downloaded with chunks ranged requests at once,
+// if more than 1 and the registry supports them.
+func getRemoteLayer(ctx context.Context, imgID, registry string, repoData *RepoData, imgSize int64, chunks int) (io.ReadCloser, error) {
+	client := repoData.client()
+	get := func(ctx context.Context, start, end int64) (*http.Response, error) {
+		req, err := http.NewRequest("GET", "https://"+path.Join(registry, "images", imgID, "layer"), nil)
+		if err != nil {
+			return nil, err
+		}
+		setAuth(req, repoData)
+		setCookie(req, repoData.Cookie)
+		if end >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		}
+		return client.Do(req.WithContext(ctx))
 	}
 
-	setAuthToken(req, repoData.Tokens)
-	setCookie(req, repoData.Cookie)
-
-	fmt.Printf("Downloading layer: %s\n", imgID)
-
-	res, err := client.Do(req)
+	end := int64(-1)
+	if chunks > 1 && imgSize >= chunkedDownloadMin {
+		end = downloadChunkSize - 1
+	}
+	res, err := get(ctx, 0, end)
 	if err != nil {
 		return nil, err
 	}
 
+	if res.StatusCode == http.StatusPartialContent {
+		start, end, total, err := contentRange(res)
+		if err == nil && (start != 0 || total < 0 || end != firstChunkSize(total)-1) {
+			err = fmt.Errorf("unexpected Content-Range %q", res.Header.Get("Content-Range"))
+		}
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return &sizedBody{ReadCloser: newChunkedBody(ctx, res.Body, total, chunks, get), size: total}, nil
+	}
+	// the registry can ignore the range and send the whole layer
 	if res.StatusCode != 200 {
 		res.Body.Close()
-		return nil, fmt.Errorf("HTTP code: %d. URL: %s", res.StatusCode, req.URL)
+		return nil, statusError(res, registry, "", imgID)
 	}
 
-	return res.Body, nil
+	size := res.ContentLength
+	if size < 0 {
+		size = imgSize
+	}
+	return &sizedBody{ReadCloser: res.Body, size: size}, nil
 }
 
-func generateManifest(layerData DockerImageData, dockerURL *ParsedDockerURL) (*schema.ImageManifest, error) {
-	dockerConfig := layerData.Config
-	genManifest := &schema.ImageManifest{}
+// generateManifest generates the manifest of a layer from what state knows
+// of its image and config. Layers are named {config.Name}-{layer ID}; the
+// squashed image is named config.Name.
+func generateManifest(layerData DockerImageData, rawConfig []byte, dockerURL *ParsedDockerURL, config Config, state *ancestryState) (*schema.ImageManifest, error) {
+	opts := ManifestOptions{
+		Name:          config.Name,
+		Image:         *dockerURL,
+		RawConfig:     rawConfig,
+		History:       state.history,
+		PathWhitelist: state.pathWhitelist(),
+		Passwd:        state.users.passwd,
+		Group:         state.users.group,
+		Labels:        config.Labels,
+		Annotations:   config.Annotations,
+		App:           config.App,
+		Exclude:       config.Exclude,
+		Include:       config.Include,
+		Logger:        config.Logger,
+	}
+	if config.StripSetuid {
+		opts.SetuidFiles = state.setuidFiles()
+	}
+	if state.parentLayerID != "" {
+		opts.Parent = &ManifestParent{
+			LayerID: state.parentLayerID,
+			ImageID: state.parentImageID,
+			App:     state.parentApp,
+			Labels:  state.parentLabels,
+		}
+	}
+	return GenerateManifest(layerData, opts)
+}
 
-	appURL := dockerURL.IndexURL + "/" + dockerURL.ImageName + "-" + layerData.ID
-	appURL, err := types.SanitizeACName(appURL)
-	if err != nil {
-		return nil, err
+// sanitizeImageName turns a Docker image name, which can have uppercase
+// letters, underscores or a port, into an ACName. Each path component is
+// lowercased, invalid characters are replaced by "-", runs of separators are
+// reduced to their first one and separators at the edges are dropped, so
+// localhost:5000/My_App becomes localhost-5000/my_app.
+func sanitizeImageName(dockerName string) (string, error) {
+	var components []string
+	for _, c := range strings.Split(strings.ToLower(dockerName), "/") {
+		var b []byte
+		for i := 0; i < len(c); i++ {
+			ch := c[i]
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= '0' && ch <= '9') && strings.IndexByte(acNameSeparators, ch) < 0 {
+				ch = '-'
+			}
+			if strings.IndexByte(acNameSeparators, ch) >= 0 && (len(b) == 0 || strings.IndexByte(acNameSeparators, b[len(b)-1]) >= 0) {
+				continue
+			}
+			b = append(b, ch)
+		}
+		sanitized := strings.TrimRight(string(b), acNameSeparators)
+		if sanitized != "" {
+			components = append(components, sanitized)
+		}
 	}
-	name, err := types.NewACName(appURL)
-	if err != nil {
-		return nil, err
+
+	name := strings.Join(components, "/")
+	if _, err := types.NewACName(name); err != nil {
+		return "", fmt.Errorf("cannot turn image name %q into an ACName: %w", dockerName, err)
 	}
-	genManifest.Name = *name
+	return name, nil
+}
 
-	acVersion, _ := types.NewSemVer(schemaVersion)
-	genManifest.ACVersion = *acVersion
+// addLabels adds the user's labels to the ones of a layer and of its
+// dependency, replacing those with the same name. All the layers get them,
+// so the dependency labels still match the parent's.
+func addLabels(labels types.Labels, parentLabels types.Labels, userLabels map[string]string) (types.Labels, types.Labels, error) {
+	var names []string
+	for n := range userLabels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
 
-	genManifest.ACKind = types.ACKind("ImageManifest")
+	for _, n := range names {
+		name, err := types.NewACName(n)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid label name %q: %w", n, err)
+		}
+		if n == "layer" {
+			return nil, nil, fmt.Errorf("the layer label can't be set")
+		}
+		labels = setLabel(labels, *name, userLabels[n], true)
+		parentLabels = setLabel(parentLabels, *name, userLabels[n], false)
+	}
 
-	var labels types.Labels
-	var parentLabels types.Labels
+	return labels, parentLabels, nil
+}
 
-	layer, _ := types.NewACName("layer")
-	labels = append(labels, types.Label{Name: *layer, Value: layerData.ID})
+// setLabel sets the value of the label name in labels. If it's missing, it
+// is only added if add is true.
+func setLabel(labels types.Labels, name types.ACName, value string, add bool) types.Labels {
+	for i := range labels {
+		if labels[i].Name == name {
+			labels[i].Value = value
+			return labels
+		}
+	}
+	if add {
+		labels = append(labels, types.Label{Name: name, Value: value})
+	}
+	return labels
+}
 
-	tag := dockerURL.Tag
-	version, _ := types.NewACName("version")
-	labels = append(labels, types.Label{Name: *version, Value: tag})
+// generateApp generates the app of a layer from its Docker config, which can
+// be nil, and overrides. Layers without a command, like the ones of scratch
+// images, get no app rather than one rkt can't run: the command has to be
+// given when running them.
+func generateApp(dockerConfig *DockerImageConfig, overrides AppOverrides, users *userDatabase) (*types.App, error) {
+	if dockerConfig == nil {
+		dockerConfig = &DockerImageConfig{}
+	}
 
-	if layerData.OS != "" {
-		os, _ := types.NewACName("os")
-		labels = append(labels, types.Label{Name: *os, Value: layerData.OS})
-		parentLabels = append(parentLabels, types.Label{Name: *os, Value: layerData.OS})
+	exec := getExecCommand(dockerConfig.Entrypoint, dockerConfig.Cmd)
+	if len(overrides.Exec) > 0 {
+		exec = getExecCommand(overrides.Exec, nil)
+	}
+	if exec == nil {
+		return nil, nil
+	}
 
-		if layerData.Architecture != "" {
-			arch, _ := types.NewACName("arch")
-			parentLabels = append(parentLabels, types.Label{Name: *arch, Value: layerData.Architecture})
+	dockerUser := dockerConfig.User
+	if overrides.User != "" {
+		dockerUser = overrides.User
+	}
+	if overrides.Group != "" {
+		user := strings.SplitN(dockerUser, ":", 2)[0]
+		if user == "" {
+			user = "0"
 		}
+		dockerUser = user + ":" + overrides.Group
+	}
+	user, group, err := users.resolve(dockerUser)
+	if err != nil {
+		return nil, err
 	}
 
-	genManifest.Labels = labels
+	workDir := dockerConfig.WorkingDir
+	if overrides.WorkingDirectory != "" {
+		workDir = overrides.WorkingDirectory
+	}
 
-	if dockerConfig != nil {
-		exec := getExecCommand(dockerConfig.Entrypoint, dockerConfig.Cmd)
-		if exec != nil {
-			user, group := parseDockerUser(dockerConfig.User)
-			var env types.Environment
-			for _, v := range dockerConfig.Env {
-				parts := strings.SplitN(v, "=", 2)
-				env.Set(parts[0], parts[1])
-			}
-			app := &types.App{
-				Exec:             exec,
-				User:             user,
-				Group:            group,
-				Environment:      env,
-				WorkingDirectory: dockerConfig.WorkingDir,
-			}
-			genManifest.App = app
-		}
+	app := &types.App{
+		Exec:             exec,
+		User:             user,
+		Group:            group,
+		Environment:      getEnvironment(dockerConfig.Env),
+		WorkingDirectory: getWorkingDirectory(workDir),
+	}
+	ports, err := getPorts(dockerConfig.ExposedPorts)
+	if err != nil {
+		return nil, err
 	}
+	app.Ports = ports
+	mountPoints, err := getMountPoints(dockerConfig.Volumes)
+	if err != nil {
+		return nil, err
+	}
+	app.MountPoints = mountPoints
+	isolators, err := getResourceIsolators(dockerConfig, overrides)
+	if err != nil {
+		return nil, err
+	}
+	capabilities, err := getCapabilityIsolators(overrides)
+	if err != nil {
+		return nil, err
+	}
+	app.Isolators = append(isolators, capabilities...)
 
-	if layerData.Parent != "" {
-		var dependencies types.Dependencies
-		parentAppNameString := dockerURL.IndexURL + "/" + dockerURL.ImageName + "-" + layerData.Parent
-		parentAppNameString, err := types.SanitizeACName(parentAppNameString)
-		if err != nil {
-			return nil, err
+	return app, nil
+}
+
+// getResourceIsolators translates the memory limit and CPU shares of a
+// Docker config, or the overrides, into resource isolators. Shares are a
+// relative weight, 1024 being a CPU, so they become a CPU request.
+func getResourceIsolators(dockerConfig *DockerImageConfig, overrides AppOverrides) ([]types.Isolator, error) {
+	type resource struct {
+		Request string `json:"request,omitempty"`
+		Limit   string `json:"limit,omitempty"`
+	}
+
+	var memory, cpu resource
+	if dockerConfig.Memory > 0 {
+		memory.Limit = strconv.FormatInt(dockerConfig.Memory, 10)
+	}
+	if overrides.Memory != "" {
+		memory.Limit = overrides.Memory
+	}
+	if dockerConfig.CpuShares > 0 {
+		cpu.Request = strconv.FormatInt(dockerConfig.CpuShares*1000/1024, 10) + "m"
+	}
+	if overrides.CPU != "" {
+		cpu.Limit = overrides.CPU
+	}
+
+	var isolators []types.Isolator
+	for _, r := range []struct {
+		name  string
+		value resource
+	}{
+		{"resource/memory", memory},
+		{"resource/cpu", cpu},
+	} {
+		if r.value == (resource{}) {
+			continue
 		}
-		parentAppName, err := types.NewACName(parentAppNameString)
+		isolator, err := newIsolator(r.name, r.value)
 		if err != nil {
 			return nil, err
 		}
+		isolators = append(isolators, *isolator)
+	}
 
-		dependencies = append(dependencies, types.Dependency{App: *parentAppName, Labels: parentLabels})
+	return isolators, nil
+}
 
-		genManifest.Dependencies = dependencies
+// getCapabilityIsolators returns the capability isolators of the overrides.
+// Docker images don't have capabilities of their own, they are given when
+// running them.
+func getCapabilityIsolators(overrides AppOverrides) ([]types.Isolator, error) {
+	name, caps := "", overrides.RetainCapabilities
+	switch {
+	case len(overrides.RetainCapabilities) > 0 && len(overrides.RemoveCapabilities) > 0:
+		return nil, fmt.Errorf("capabilities can't be both retained and removed")
+	case len(overrides.RetainCapabilities) > 0:
+		name = "os/linux/capabilities-retain-set"
+	case len(overrides.RemoveCapabilities) > 0:
+		name, caps = "os/linux/capabilities-remove-set", overrides.RemoveCapabilities
+	default:
+		return nil, nil
+	}
+
+	set := make([]string, len(caps))
+	for i, c := range caps {
+		c = strings.ToUpper(c)
+		if !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		set[i] = c
 	}
 
-	return genManifest, nil
+	isolator, err := newIsolator(name, struct {
+		Set []string `json:"set"`
+	}{set})
+	if err != nil {
+		return nil, err
+	}
+	return []types.Isolator{*isolator}, nil
+}
+
+// newIsolator returns the isolator name with value, going through its JSON
+// form so the value is checked like when reading a manifest.
+func newIsolator(name string, value interface{}) (*types.Isolator, error) {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(v)
+	b, err := json.Marshal(struct {
+		Name  string           `json:"name"`
+		Value *json.RawMessage `json:"value"`
+	}{name, &raw})
+	if err != nil {
+		return nil, err
+	}
+
+	var isolator types.Isolator
+	if err := json.Unmarshal(b, &isolator); err != nil {
+		return nil, fmt.Errorf("invalid %s isolator: %w", name, err)
+	}
+	return &isolator, nil
+}
+
+// getAppcOSArch returns the values of the os and arch labels of a layer.
+// Docker uses Go's names for architectures while appc uses the kernel's, see
+// dockerArchs.
+func getAppcOSArch(layerData DockerImageData) (string, string) {
+	arch := layerData.Architecture
+	if arch == "arm" {
+		arch += layerData.Variant
+	}
+	if appcArch, ok := dockerArchs[arch]; ok {
+		arch = appcArch
+	}
+	return layerData.OS, arch
 }
 
+// getExecCommand combines the entrypoint and cmd of a Docker image the way
+// Docker does: cmd is appended to the entrypoint as arguments, and either of
+// them is used alone when the other is empty. ENTRYPOINT [""] resets the
+// entrypoint of the base image, so it's empty too.
 func getExecCommand(entrypoint []string, cmd []string) types.Exec {
-	var command []string
-	if entrypoint == nil && cmd == nil {
+	if len(entrypoint) == 1 && entrypoint[0] == "" {
+		entrypoint = nil
+	}
+	if len(cmd) == 1 && cmd[0] == "" {
+		cmd = nil
+	}
+	command := make([]string, 0, len(entrypoint)+len(cmd))
+	command = append(command, entrypoint...)
+	command = append(command, cmd...)
+	if len(command) == 0 {
 		return nil
 	}
-	command = append(entrypoint, cmd...)
-	// non-absolute paths are not allowed, fallback to "/bin/sh -c command"
+	// non-absolute paths are not allowed, fallback to
+	// "/bin/sh -c exec command", quoting the arguments so they reach the
+	// command unchanged
 	if !filepath.IsAbs(command[0]) {
-		command_prefix := []string{"/bin/sh", "-c"}
-		command = append(command_prefix, strings.Join(command, " "))
+		quoted := make([]string, len(command))
+		for i, arg := range command {
+			quoted[i] = shellQuote(arg)
+		}
+		command = []string{"/bin/sh", "-c", "exec " + strings.Join(quoted, " ")}
 	}
 	return command
 }
 
-func parseDockerUser(dockerUser string) (string, string) {
-	// if the docker user is empty assume root user and group
-	if dockerUser == "" {
-		return "0", "0"
+// shellQuote quotes s so a POSIX shell reads it as a single word.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// getEnvironment translates the KEY=VALUE entries of a Docker image's Env to
+// an ACI environment. Entries without a name are skipped.
+func getEnvironment(dockerEnv []string) types.Environment {
+	var env types.Environment
+	for _, v := range dockerEnv {
+		parts := strings.SplitN(v, "=", 2)
+		if parts[0] == "" {
+			continue
+		}
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		env.Set(parts[0], value)
+	}
+	return env
+}
+
+// getWorkingDirectory translates the WorkingDir of a Docker image. ACIs need
+// an absolute path, and Docker resolves relative ones from /.
+func getWorkingDirectory(workingDir string) string {
+	if workingDir == "" {
+		return ""
 	}
+	return path.Clean("/" + workingDir)
+}
 
-	dockerUserParts := strings.Split(dockerUser, ":")
+// getPorts translates the ExposedPorts of a Docker image, of the form
+// port[/protocol], to ACI ports named like port-protocol. The protocol
+// defaults to tcp.
+func getPorts(exposedPorts map[string]struct{}) ([]types.Port, error) {
+	var specs []string
+	for spec := range exposedPorts {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+
+	var ports []types.Port
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "/", 2)
+		protocol := "tcp"
+		if len(parts) == 2 && parts[1] != "" {
+			protocol = strings.ToLower(parts[1])
+		}
 
-	// when only the user is given, the docker spec says that the default and
-	// supplementary groups of the user in /etc/passwd should be applied.
-	// Assume root group for now in this case.
-	if len(dockerUserParts) < 2 {
-		return dockerUserParts[0], "0"
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid exposed port %q", spec)
+		}
+
+		name, err := types.NewACName(fmt.Sprintf("%d-%s", port, protocol))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exposed port %q: %w", spec, err)
+		}
+
+		ports = append(ports, types.Port{
+			Name:     *name,
+			Protocol: protocol,
+			Port:     uint(port),
+		})
 	}
 
-	return dockerUserParts[0], dockerUserParts[1]
+	return ports, nil
 }
 
-func writeACI(layer io.ReadSeeker, manifest schema.ImageManifest, output string) error {
-	reader, err := aci.NewCompressedTarReader(layer)
+// getMountPoints translates the Volumes of a Docker image to ACI mount
+// points. They are named after their path, e.g. /var/lib/mysql gets
+// volume-var-lib-mysql.
+func getMountPoints(volumes map[string]struct{}) ([]types.MountPoint, error) {
+	var paths []string
+	for p := range volumes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var mountPoints []types.MountPoint
+	used := make(map[string]bool)
+	for _, p := range paths {
+		p = path.Clean("/" + p)
+		sanitized, err := types.SanitizeACName("volume" + strings.Replace(p, "/", "-", -1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume %q: %w", p, err)
+		}
+		// different paths can sanitize to the same name
+		nameString := sanitized
+		for i := 2; used[nameString]; i++ {
+			nameString = fmt.Sprintf("%s-%d", sanitized, i)
+		}
+		used[nameString] = true
+
+		name, err := types.NewACName(nameString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume %q: %w", p, err)
+		}
+
+		mountPoints = append(mountPoints, types.MountPoint{
+			Name: *name,
+			Path: p,
+		})
+	}
+
+	return mountPoints, nil
+}
+
+// writeACI writes the ACI of the layer tarball with manifest to output and
+// returns its key in a ConversionStore, hashing it as it's written. state
+// must already have the layer, entries that would be extracted out of the root
+// filesystem through one of its symlinks are left out.
+func writeACI(layer io.ReadSeeker, manifest schema.ImageManifest, output string, config Config, state *ancestryState) (string, error) {
+	reader, err := newLayerReader(layer)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	aciFile, err := os.Create(output)
+	// the ACI gets its name once complete
+	aciFile, err := createPartial(output)
 	if err != nil {
-		return fmt.Errorf("error creating ACI file: %v", err)
+		return "", fmt.Errorf("error creating ACI file: %w", err)
 	}
+	defer os.Remove(aciFile.Name())
 	defer aciFile.Close()
 
-	trw := tar.NewWriter(aciFile)
-	defer trw.Close()
+	h := sha512.New()
+	validator, w := newACIValidator(io.MultiWriter(aciFile, h))
+	trw := newSparseWriter(w, config.TmpDir)
+	err = writeLayerEntries(trw, reader, manifest, config, state)
+	if err == nil {
+		err = trw.Close()
+	}
+	if err := validator.close(err); err != nil {
+		return "", err
+	}
+	if err := commitPartial(aciFile, output); err != nil {
+		return "", fmt.Errorf("error committing ACI file: %w", err)
+	}
+	return fmt.Sprintf("%s%x", hashPrefix, h.Sum(nil)), nil
+}
 
-	if err := addMinimalACIStructure(trw, manifest); err != nil {
-		return fmt.Errorf("error writing rootfs entry: %v", err)
+// writeLayerEntries writes the ACI of a layer to trw: its manifest and the
+// entries of reader, the tarball of the layer, moved under rootfs/.
+func writeLayerEntries(trw *sparseWriter, reader *tar.Reader, manifest schema.ImageManifest, config Config, state *ancestryState) error {
+	if err := addMinimalACIStructure(trw.Writer, manifest); err != nil {
+		return fmt.Errorf("error writing rootfs entry: %w", err)
 	}
 
+	links := tarball.NewLinkTracker()
 	convWalker := func(t *tarball.TarFile) error {
-		name := t.Name()
-		if name == "./" {
+		name := tarball.CleanName(t.Name())
+		if name == "" || tarball.IsWhiteout(name) {
 			return nil
 		}
-		t.Header.Name = path.Join("rootfs", name)
-		if strings.Contains(t.Header.Name, "/.wh.") {
+		if tarball.Escapes(t.Name()) || (t.Header.Typeflag == tar.TypeLink && tarball.Escapes(t.Linkname())) {
+			logWarn(config.Logger, "skipping "+t.Name()+", it escapes the root filesystem", LogField{"file", t.Name()})
 			return nil
 		}
-		if t.Header.Typeflag == tar.TypeLink {
-			t.Header.Linkname = path.Join("rootfs", t.Linkname())
+		if state.escapesThroughSymlink(name) {
+			logWarn(config.Logger, "skipping "+t.Name()+", its parent is a symlink out of the root filesystem", LogField{"file", t.Name()})
+			return nil
 		}
-
-		if err := trw.WriteHeader(t.Header); err != nil {
-			return err
+		if state.filter.excluded(name) {
+			return nil
 		}
-		if _, err := io.Copy(trw, t.TarStream); err != nil {
-			return err
+		tarball.Rebase(t.Header, "rootfs")
+		transformHeader(t.Header, config)
+		if links.Dangling(t.Header) {
+			logWarn(config.Logger, "skipping hard link "+t.Name()+" to missing file "+t.Linkname(), LogField{"file", t.Name()})
+			return nil
+		}
+
+		if t.Header.Typeflag == tar.TypeReg {
+			if err := trw.writeFile(t.Header, t.TarStream); err != nil {
+				return err
+			}
+		} else {
+			if err := trw.WriteHeader(t.Header); err != nil {
+				return err
+			}
+			if _, err := io.Copy(trw, t.TarStream); err != nil {
+				return err
+			}
 		}
+		links.Add(t.Header)
 
 		return nil
 	}
@@ -624,30 +1727,40 @@ func writeManifest(outputWriter *tar.Writer, manifest schema.ImageManifest) erro
 // SquashLayers receives a list of ACI layer file names ordered from base image
 // to application image and squashes them into one ACI
 func SquashLayers(images []acirenderer.Image, aciRegistry acirenderer.ACIRegistry, parsedDockerURL ParsedDockerURL, outputDir string) (string, error) {
+	return squashLayers(images, aciRegistry, parsedDockerURL, outputDir, "", nil, nil)
+}
+
+// squashLayers is like SquashLayers but, if files isn't nil, only keeps the
+// rootfs paths in it, so the files deleted by whiteouts in upper layers are
+// left out. files is like ancestryState.files. If dups isn't nil, identical
+// files are hard linked with it. Large files are spooled in tmpDir to find
+// their holes.
+func squashLayers(images []acirenderer.Image, aciRegistry acirenderer.ACIRegistry, parsedDockerURL ParsedDockerURL, outputDir string, tmpDir string, files map[string]struct{}, dups *duplicateLinker) (string, error) {
 	renderedACI, err := acirenderer.GetRenderedACIFromList(images, aciRegistry)
 	if err != nil {
-		return "", fmt.Errorf("error rendering squashed image: %v\n", err)
+		return "", fmt.Errorf("error rendering squashed image: %w\n", err)
 	}
 	manifests, err := getManifests(renderedACI, aciRegistry)
 	if err != nil {
-		return "", fmt.Errorf("error getting manifests: %v", err)
+		return "", fmt.Errorf("error getting manifests: %w", err)
 	}
 
 	squashedFilename := getSquashedFilename(parsedDockerURL)
 	squashedImagePath := path.Join(outputDir, squashedFilename)
 
-	squashedImageFile, err := os.Create(squashedImagePath)
+	squashedImageFile, err := createPartial(squashedImagePath)
 	if err != nil {
 		return "", err
 	}
+	defer os.Remove(squashedImageFile.Name())
 	defer squashedImageFile.Close()
 
-	if err := writeSquashedImage(squashedImageFile, renderedACI, aciRegistry, manifests); err != nil {
-		return "", fmt.Errorf("error writing squashed image: %v", err)
+	validator, w := newACIValidator(squashedImageFile)
+	if err := validator.close(writeSquashedImage(w, renderedACI, aciRegistry, manifests, tmpDir, files, dups)); err != nil {
+		return "", fmt.Errorf("error writing squashed image: %w", err)
 	}
-
-	if err := validateACI(squashedImagePath); err != nil {
-		return "", fmt.Errorf("error validating image: %v", err)
+	if err := commitPartial(squashedImageFile, squashedImagePath); err != nil {
+		return "", fmt.Errorf("error writing squashed image: %w", err)
 	}
 
 	return squashedImagePath, nil
@@ -677,8 +1790,8 @@ func getManifests(renderedACI acirenderer.RenderedACI, aciRegistry acirenderer.A
 	return manifests, nil
 }
 
-func writeSquashedImage(outputFile *os.File, renderedACI acirenderer.RenderedACI, aciProvider acirenderer.ACIProvider, manifests []schema.ImageManifest) error {
-	outputWriter := tar.NewWriter(outputFile)
+func writeSquashedImage(outputFile io.Writer, renderedACI acirenderer.RenderedACI, aciProvider acirenderer.ACIProvider, manifests []schema.ImageManifest, tmpDir string, files map[string]struct{}, dups *duplicateLinker) error {
+	outputWriter := newSparseWriter(outputFile, tmpDir)
 	defer outputWriter.Close()
 
 	for _, aciFile := range renderedACI {
@@ -689,18 +1802,37 @@ func writeSquashedImage(outputFile *os.File, renderedACI acirenderer.RenderedACI
 		defer rs.Close()
 
 		squashWalker := func(t *tarball.TarFile) error {
-			cleanName := filepath.Clean(t.Name())
+			cleanName := tarball.CleanName(t.Name())
+
+			if rel := strings.TrimPrefix(cleanName, "rootfs/"); files != nil && rel != cleanName {
+				if _, ok := files[rel]; !ok {
+					return nil
+				}
+			}
 
 			if _, ok := aciFile.FileMap[cleanName]; ok {
 				// we generate and add the squashed manifest later
 				if cleanName == "manifest" {
 					return nil
 				}
+				normalizeHeader(t.Header)
+				if dups != nil && t.Header.Typeflag == tar.TypeReg && t.Header.Size > 0 {
+					if err := dups.write(outputWriter, t.Header, t.TarStream); err != nil {
+						return fmt.Errorf("error copying file into the tar out: %w", err)
+					}
+					return nil
+				}
+				if t.Header.Typeflag == tar.TypeReg {
+					if err := outputWriter.writeFile(t.Header, t.TarStream); err != nil {
+						return fmt.Errorf("error copying file into the tar out: %w", err)
+					}
+					return nil
+				}
 				if err := outputWriter.WriteHeader(t.Header); err != nil {
-					return fmt.Errorf("error writing header: %v", err)
+					return fmt.Errorf("error writing header: %w", err)
 				}
 				if _, err := io.Copy(outputWriter, t.TarStream); err != nil {
-					return fmt.Errorf("error copying file into the tar out: %v", err)
+					return fmt.Errorf("error copying file into the tar out: %w", err)
 				}
 			}
 			return nil
@@ -712,13 +1844,13 @@ func writeSquashedImage(outputFile *os.File, renderedACI acirenderer.RenderedACI
 		}
 	}
 
-	if err := writeRootfsDir(outputWriter); err != nil {
+	if err := writeRootfsDir(outputWriter.Writer); err != nil {
 		return err
 	}
 
 	finalManifest := mergeManifests(manifests)
 
-	if err := writeManifest(outputWriter, finalManifest); err != nil {
+	if err := writeManifest(outputWriter.Writer, finalManifest); err != nil {
 		return err
 	}
 
@@ -730,6 +1862,7 @@ func mergeManifests(manifests []schema.ImageManifest) schema.ImageManifest {
 	manifest := manifests[0]
 
 	manifest.Dependencies = nil
+	manifest.PathWhitelist = nil
 
 	layerIndex := -1
 	for i, l := range manifest.Labels {
@@ -20,6 +20,9 @@ import (
 
 const (
 	defaultIndex = "index.docker.io"
+	// officialNamespace is the namespace of the official images of the
+	// Docker Hub, which can be referred to without it.
+	officialNamespace = "library"
 )
 
 // splitReposName breaks a reposName into an index name and remote name
@@ -14,7 +14,10 @@
 
 package docker2aci
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // DockerImageData stores the JSON structure of a Docker image.
 // Taken and adapted from upstream Docker.
@@ -29,8 +32,22 @@ type DockerImageData struct {
 	Author          string             `json:"author,omitempty"`
 	Config          *DockerImageConfig `json:"config,omitempty"`
 	Architecture    string             `json:"architecture,omitempty"`
+	Variant         string             `json:"variant,omitempty"`
 	OS              string             `json:"os,omitempty"`
 	Checksum        string             `json:"checksum"`
+	History         []DockerHistory    `json:"history,omitempty"`
+}
+
+// DockerHistory describes how a layer of a Docker image was built. Image
+// configs list one per step of the build, including the ones that didn't
+// create a layer.
+// Taken and adapted from upstream Docker.
+type DockerHistory struct {
+	Created    time.Time `json:"created"`
+	Author     string    `json:"author,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
 }
 
 // Note: the Config structure should hold only portable information about the container.
@@ -54,12 +71,59 @@ type DockerImageConfig struct {
 	OpenStdin       bool // Open stdin
 	StdinOnce       bool // If true, close stdin after the 1 attached client disconnects.
 	Env             []string
-	Cmd             []string
+	Cmd             DockerCommand
 	Image           string // Name of the image as it was passed by the operator (eg. could be symbolic)
 	Volumes         map[string]struct{}
 	WorkingDir      string
-	Entrypoint      []string
+	Entrypoint      DockerCommand
 	NetworkDisabled bool
 	MacAddress      string
 	OnBuild         []string
+	Labels          map[string]string
+	Healthcheck     *DockerHealthConfig
+	StopSignal      string
+}
+
+// DockerHealthConfig holds the HEALTHCHECK of a Docker image.
+// Taken and adapted from upstream Docker.
+type DockerHealthConfig struct {
+	// Test is the check to perform: [] inherits the check, ["NONE"]
+	// disables it, ["CMD", args...] execs the arguments and
+	// ["CMD-SHELL", command] runs the command with the shell.
+	Test []string `json:",omitempty"`
+
+	// Zero means to inherit. Durations are expressed as integer nanoseconds.
+	Interval    time.Duration `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	StartPeriod time.Duration `json:",omitempty"`
+
+	// Retries is the number of consecutive failures needed to consider a
+	// container as unhealthy. Zero means inherit.
+	Retries int `json:",omitempty"`
+}
+
+// DockerCommand is the Cmd or Entrypoint of a Docker image. They are usually
+// stored in exec form, as a list of arguments, but older images can have
+// them in shell form, as a single string. Docker runs the latter through a
+// shell, so they are translated to ["/bin/sh", "-c", command].
+type DockerCommand []string
+
+func (c *DockerCommand) UnmarshalJSON(b []byte) error {
+	var command string
+	if err := json.Unmarshal(b, &command); err == nil {
+		// null and "" unset the command
+		if command == "" {
+			*c = nil
+		} else {
+			*c = DockerCommand{"/bin/sh", "-c", command}
+		}
+		return nil
+	}
+
+	var args []string
+	if err := json.Unmarshal(b, &args); err != nil {
+		return err
+	}
+	*c = DockerCommand(args)
+	return nil
 }
@@ -0,0 +1,203 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// dockerRunIgnoredFlags are the options of docker run taking a value which
+// have no pod manifest equivalent, and dockerRunIgnoredBoolFlags the ones
+// taking none. They're skipped with a warning. dockerRunAttachFlags tell
+// docker run how to attach to the container, they're skipped silently.
+var (
+	dockerRunIgnoredFlags = []string{
+		"add-host", "cap-add", "cap-drop", "device", "dns", "dns-search",
+		"h", "hostname", "l", "label", "log-driver", "log-opt", "net",
+		"network", "restart", "security-opt", "shm-size", "stop-signal",
+		"ulimit",
+	}
+	dockerRunIgnoredBoolFlags = []string{"init", "privileged", "read-only"}
+	dockerRunAttachFlags      = []string{"d", "detach", "i", "interactive", "t", "tty", "it", "ti", "rm"}
+)
+
+// ParseDockerRun parses the arguments of docker run following "docker run":
+// its options, the image and the command. It returns the image and the app
+// running it the way docker run would, named after --name or the image. The
+// relative host paths of the volumes are relative to dir.
+func ParseDockerRun(args []string, dir string) (string, *PodApp, error) {
+	fs := flag.NewFlagSet("docker run", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+
+	var publish, volumes, env, envFiles stringsFlag
+	var name, memory, cpus, user, workdir, entrypoint string
+	for _, n := range []string{"p", "publish"} {
+		fs.Var(&publish, n, "")
+	}
+	for _, n := range []string{"v", "volume"} {
+		fs.Var(&volumes, n, "")
+	}
+	for _, n := range []string{"e", "env"} {
+		fs.Var(&env, n, "")
+	}
+	fs.Var(&envFiles, "env-file", "")
+	fs.StringVar(&name, "name", "", "")
+	fs.StringVar(&memory, "m", "", "")
+	fs.StringVar(&memory, "memory", "", "")
+	fs.StringVar(&cpus, "cpus", "", "")
+	fs.StringVar(&user, "u", "", "")
+	fs.StringVar(&user, "user", "", "")
+	fs.StringVar(&workdir, "w", "", "")
+	fs.StringVar(&workdir, "workdir", "", "")
+	fs.StringVar(&entrypoint, "entrypoint", "", "")
+	ignored := make(map[string]*stringsFlag)
+	for _, n := range dockerRunIgnoredFlags {
+		ignored[n] = &stringsFlag{}
+		fs.Var(ignored[n], n, "")
+	}
+	ignoredBool := make(map[string]*bool)
+	for _, n := range append(dockerRunIgnoredBoolFlags, dockerRunAttachFlags...) {
+		ignoredBool[n] = fs.Bool(n, false, "")
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if fs.NArg() == 0 {
+		return "", nil, fmt.Errorf("no image")
+	}
+	for _, n := range dockerRunIgnoredFlags {
+		if len(*ignored[n]) > 0 {
+			logWarn(nil, fmt.Sprintf("skipping --%s, it isn't translated", n), LogField{"flag", n})
+		}
+	}
+	for _, n := range dockerRunIgnoredBoolFlags {
+		if *ignoredBool[n] {
+			logWarn(nil, fmt.Sprintf("skipping --%s, it isn't translated", n), LogField{"flag", n})
+		}
+	}
+
+	image := fs.Arg(0)
+	app := &PodApp{Name: name}
+	if app.Name == "" {
+		// the image name without its registry, repository and tag
+		app.Name = path.Base(strings.SplitN(image, "@", 2)[0])
+		if i := strings.Index(app.Name, ":"); i >= 0 {
+			app.Name = app.Name[:i]
+		}
+	}
+	if fs.NArg() > 1 {
+		app.Cmd = fs.Args()[1:]
+	}
+	if entrypoint != "" {
+		// docker run takes a single word
+		app.Entrypoint = []string{entrypoint}
+	}
+	parts := strings.SplitN(user, ":", 2)
+	app.User = parts[0]
+	if len(parts) == 2 {
+		app.Group = parts[1]
+	}
+	app.WorkingDirectory = workdir
+
+	var err error
+	if memory != "" {
+		if app.Memory, err = composeMemory(memory); err != nil {
+			return "", nil, err
+		}
+	}
+	if cpus != "" {
+		if app.CPU, err = composeCPUs(cpus); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// the variables of --env win over the ones of the files
+	var vars []interface{}
+	for _, f := range envFiles {
+		fileVars, err := readEnvFile(f)
+		if err != nil {
+			return "", nil, err
+		}
+		vars = append(vars, fileVars...)
+	}
+	for _, v := range env {
+		vars = append(vars, v)
+	}
+	if len(vars) > 0 {
+		if app.Env, err = composeEnvironment(vars); err != nil {
+			return "", nil, err
+		}
+	}
+
+	for _, spec := range publish {
+		ports, err := parsePortSpec(spec)
+		if err != nil {
+			return "", nil, err
+		}
+		app.Ports = append(app.Ports, ports...)
+	}
+	for _, spec := range volumes {
+		m, err := parseVolumeSpec(spec, dir)
+		if err != nil {
+			return "", nil, err
+		}
+		app.Mounts = append(app.Mounts, m)
+	}
+
+	return image, app, nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of the env file p, skipping the blank
+// ones and the comments.
+func readEnvFile(p string) ([]interface{}, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vars []interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vars = append(vars, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", p, err)
+	}
+	return vars, nil
+}
+
+// stringsFlag is a flag.Value collecting the values of an option given
+// several times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// layerDownloadPrefix is the prefix of the files of the layers being
+	// downloaded.
+	layerDownloadPrefix = "dockerlayer-"
+	// keptDigestSuffix is the suffix of the files next to the kept layers
+	// with their sha256.
+	keptDigestSuffix = ".sha256"
+)
+
+// layerDownload is a layer being downloaded in the background, so the next
+// layer can be downloaded while the current one is converted.
+type layerDownload struct {
+	done chan struct{}
+	stop context.CancelFunc
+	file *os.File
+	err  error
+	keep bool
+	// cached is true if the layer was downloaded already, elapsed is how
+	// long getting it took
+	cached  bool
+	elapsed time.Duration
+}
+
+// startLayerDownload starts downloading the layer layerID from src to a file
+// in dir, until ctx is done, logging to logger. Layers larger than maxSize, if
+// not zero, fail.
+// If keep is true, the layer is kept in dir, named after its ID, and a layer
+// already there is used instead of downloading it again if it still has the
+// sha256 recorded when it was downloaded. The download is
+// shown by bar, if not nil.
+func startLayerDownload(ctx context.Context, src Source, layerID string, dir string, keep bool, maxSize int64, logger Logger, bar *progressBar) *layerDownload {
+	ctx, stop := context.WithCancel(ctx)
+	d := &layerDownload{
+		done: make(chan struct{}),
+		stop: stop,
+		keep: keep,
+	}
+	go func() {
+		defer close(d.done)
+		start := time.Now()
+		d.file, d.cached, d.err = downloadLayer(ctx, src, layerID, dir, keep, maxSize, logger, bar)
+		d.elapsed = time.Since(start)
+	}()
+	return d
+}
+
+// wait returns the downloaded layer once it's complete.
+func (d *layerDownload) wait() (*os.File, error) {
+	<-d.done
+	return d.file, d.err
+}
+
+// cancel stops the download, if it's still running, and closes the layer,
+// removing it unless it's kept.
+func (d *layerDownload) cancel() {
+	d.stop()
+	if f, err := d.wait(); err == nil {
+		f.Close()
+		if !d.keep {
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// downloadLayer downloads the layer layerID from src to a file in dir and
+// returns it positioned at its start, and whether it was downloaded already.
+// The layer is never extracted: its
+// entries are rewritten straight into the ACI, which needs no privileges. It's
+// kept as it was downloaded since it's read twice, once to know its files
+// before the manifest is written.
+func downloadLayer(ctx context.Context, src Source, layerID string, dir string, keep bool, maxSize int64, logger Logger, bar *progressBar) (*os.File, bool, error) {
+	kept := filepath.Join(dir, layerID)
+	if keep {
+		unlock, err := lockKept(ctx, kept)
+		if err != nil {
+			return nil, false, err
+		}
+		defer unlock()
+		if f, err := os.Open(kept); err == nil {
+			if err := checkKeptSize(f, layerID, maxSize); err != nil {
+				f.Close()
+				return nil, false, err
+			}
+			if err := checkKeptDigest(ctx, f, kept); err != nil {
+				f.Close()
+				if ctx.Err() != nil {
+					return nil, false, ctx.Err()
+				}
+				logWarn(logger, fmt.Sprintf("Downloading layer %s again: %v", layerID, err), LogField{"layer", layerID})
+				os.Remove(kept)
+				return downloadLayerFile(ctx, src, layerID, dir, kept, maxSize, logger, bar)
+			}
+			logInfo(logger, "Using downloaded layer: "+layerID, LogField{"layer", layerID})
+			// GC removes the layers by the time they were last used
+			now := time.Now()
+			os.Chtimes(kept, now, now)
+			if bar != nil {
+				size := int64(-1)
+				if fi, err := f.Stat(); err == nil {
+					size = fi.Size()
+				}
+				bar.image.emit(Event{Type: EventLayerStarted, Layer: layerID, Size: size})
+			}
+			return f, true, nil
+		} else if !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("error opening layer: %w", err)
+		}
+		return downloadLayerFile(ctx, src, layerID, dir, kept, maxSize, logger, bar)
+	}
+	return downloadLayerFile(ctx, src, layerID, dir, "", maxSize, logger, bar)
+}
+
+// downloadLayerFile downloads the layer layerID from src to a file in dir,
+// renamed to kept with its sha256 next to it if kept isn't empty.
+func downloadLayerFile(ctx context.Context, src Source, layerID string, dir string, kept string, maxSize int64, logger Logger, bar *progressBar) (*os.File, bool, error) {
+	// the sources of the registries and of the containers storage log
+	// their reads with the conversion's logger themselves
+	switch src.(type) {
+	case *registrySource, *storageSource:
+	default:
+		logInfo(logger, "Reading layer: "+layerID, LogField{"layer", layerID})
+	}
+	layer, err := src.GetLayerReader(ctx, layerID)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting the remote layer: %w", err)
+	}
+	defer layer.Close()
+
+	layerFile, err := ioutil.TempFile(dir, layerDownloadPrefix)
+	if err != nil {
+		return nil, false, &ErrStore{Path: dir, Err: fmt.Errorf("error creating layer: %w", err)}
+	}
+
+	// a compressed layer is smaller than its contents, so maxSize bounds
+	// the download too
+	var download io.Reader = &cancelReader{r: layer, ctx: ctx}
+	if bar != nil {
+		size := int64(-1)
+		if sb, ok := layer.(*sizedBody); ok {
+			size = sb.size
+		}
+		bar.begin(size)
+		download = &progressReader{r: download, bar: bar}
+	}
+	if maxSize > 0 {
+		download = io.LimitReader(download, maxSize+1)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(layerFile, h), download)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = fmt.Errorf("layer %s is larger than the maximum layer size of %d bytes", layerID, maxSize)
+	} else if err != nil {
+		err = fmt.Errorf("error getting layer: %w", err)
+	}
+	if err == nil {
+		_, err = layerFile.Seek(0, os.SEEK_SET)
+	}
+	if err == nil && kept != "" {
+		// only complete layers get their name, once their digest is
+		// recorded
+		err = writeKeptDigest(kept, h.Sum(nil))
+	}
+	if err == nil && kept != "" {
+		if err = os.Rename(layerFile.Name(), kept); err != nil {
+			err = &ErrStore{Path: kept, Err: err}
+		}
+	}
+	if bar != nil {
+		bar.finish(err)
+	}
+	if err != nil {
+		layerFile.Close()
+		os.Remove(layerFile.Name())
+		return nil, false, err
+	}
+
+	return layerFile, false, nil
+}
+
+var (
+	// keptMu guards keptDownloads, the kept layers being downloaded by
+	// the conversions of this process
+	keptMu        sync.Mutex
+	keptDownloads = make(map[string]chan struct{})
+)
+
+// lockKept waits until no other conversion downloads the kept layer p, so
+// the conversions sharing a layer download it once, and returns the function
+// releasing it.
+func lockKept(ctx context.Context, p string) (func(), error) {
+	for {
+		keptMu.Lock()
+		done, ok := keptDownloads[p]
+		if !ok {
+			done = make(chan struct{})
+			keptDownloads[p] = done
+			keptMu.Unlock()
+			return func() {
+				keptMu.Lock()
+				delete(keptDownloads, p)
+				keptMu.Unlock()
+				close(done)
+			}, nil
+		}
+		keptMu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// checkKeptSize fails if f, the kept download of layerID, is larger than
+// maxSize, if not zero.
+func checkKeptSize(f *os.File, layerID string, maxSize int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && fi.Size() > maxSize {
+		return fmt.Errorf("layer %s is larger than the maximum layer size of %d bytes", layerID, maxSize)
+	}
+	return nil
+}
+
+// writeKeptDigest records sum, the sha256 of the kept layer p, next to it.
+func writeKeptDigest(p string, sum []byte) error {
+	f, err := createPartial(p + keptDigestSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%x\n", sum); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return &ErrStore{Path: p + keptDigestSuffix, Err: err}
+	}
+	return commitPartial(f, p+keptDigestSuffix)
+}
+
+// checkKeptDigest fails if f, the kept layer p, doesn't have the sha256
+// recorded when it was downloaded, and leaves it positioned at its start.
+func checkKeptDigest(ctx context.Context, f *os.File, p string) error {
+	b, err := ioutil.ReadFile(p + keptDigestSuffix)
+	if err != nil {
+		return fmt.Errorf("error reading its digest: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, &cancelReader{r: f, ctx: ctx}); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	want := strings.TrimSpace(string(b))
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != want {
+		return fmt.Errorf("its sha256 is %s instead of %s", got, want)
+	}
+	return nil
+}
+
+// cancelReadSeeker reads from the layers on disk until ctx is done.
+type cancelReadSeeker struct {
+	io.ReadSeeker
+	ctx context.Context
+}
+
+func (cr *cancelReadSeeker) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.ReadSeeker.Read(p)
+}
+
+// cancelReader reads from r until ctx is done.
+type cancelReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// isClosed reports whether the channel ch is closed. nil channels never are.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// DeadlineError is returned when Config.Deadline passes before all the
+// layers are converted. Layers already being converted when the deadline
+// passes are finished.
+type DeadlineError struct {
+	Deadline time.Time `json:"deadline"`
+	// Completed is the list of converted layer IDs.
+	Completed []string `json:"completed"`
+	// Remaining is the list of layer IDs that were not converted.
+	Remaining []string `json:"remaining"`
+	// ACIs is the list of generated ACIs that were kept. It is empty
+	// when squashing only, since there is nothing to squash.
+	ACIs []string `json:"acis"`
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("deadline %s exceeded with %d layer(s) converted and %d remaining",
+		e.Deadline.Format(time.RFC3339), len(e.Completed), len(e.Remaining))
+}
+
+// HTTPError is returned when a registry answers a request with an
+// unexpected status. The ones for bad credentials or missing images are
+// wrapped in ErrAuth or ErrNotFound.
+type HTTPError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP code: %d, URL: %s", e.StatusCode, e.URL)
+}
+
+// ErrAuth is returned when a registry rejects the credentials of a request,
+// or wants some. Err is the HTTPError of the response.
+type ErrAuth struct {
+	// Registry is the host the request was sent to.
+	Registry string
+	// Image is the image converted, as it was given.
+	Image string
+	Err   error
+}
+
+func (e *ErrAuth) Error() string {
+	msg := "authentication to " + e.Registry + " failed"
+	if e.Image != "" {
+		msg += " for " + e.Image
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *ErrAuth) Unwrap() error {
+	return e.Err
+}
+
+// ErrNotFound is returned when an image, its tag or one of its layers isn't
+// found, in a registry or a local store. Err is the HTTPError of the
+// response, if the registry answered one.
+type ErrNotFound struct {
+	// Registry is the host the request was sent to, empty for local
+	// stores like the containers storage.
+	Registry string
+	// Image is the image converted, as it was given.
+	Image string
+	Tag   string
+	// Layer is the ID of the layer which isn't found, empty if it's the
+	// image.
+	Layer string
+	Err   error
+}
+
+func (e *ErrNotFound) Error() string {
+	var what string
+	switch {
+	case e.Layer != "":
+		what = "layer " + e.Layer + forImage(e.Image)
+	case e.Tag != "":
+		what = "tag " + e.Tag + forImage(e.Image)
+	default:
+		what = "image " + e.Image
+	}
+	msg := what + " not found"
+	if e.Registry != "" {
+		msg += " in " + e.Registry
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ErrNotFound) Unwrap() error {
+	return e.Err
+}
+
+// ErrManifestInvalid is returned when the metadata describing an image, like
+// its manifest, its config or the JSON of a layer, can't be read or describes
+// something we can't convert.
+type ErrManifestInvalid struct {
+	// Image is the image converted, as it was given.
+	Image string
+	// Layer is the ID of the layer whose metadata is invalid, empty if
+	// it's the image's.
+	Layer string
+	Err   error
+}
+
+func (e *ErrManifestInvalid) Error() string {
+	what := "image"
+	if e.Layer != "" {
+		what = "layer " + e.Layer
+	}
+	return fmt.Sprintf("invalid metadata of %s%s: %v", what, forImage(e.Image), e.Err)
+}
+
+func (e *ErrManifestInvalid) Unwrap() error {
+	return e.Err
+}
+
+// ErrStore is returned when a file of the conversion can't be written, like
+// an ACI, a downloaded layer or the files of the cache or the work dir.
+type ErrStore struct {
+	// Path is the file or directory written.
+	Path string
+	// Image is the image converted, as it was given.
+	Image string
+	Err   error
+}
+
+func (e *ErrStore) Error() string {
+	return fmt.Sprintf("error writing %s%s: %v", e.Path, forImage(e.Image), e.Err)
+}
+
+func (e *ErrStore) Unwrap() error {
+	return e.Err
+}
+
+// ErrUntrusted is returned when the tag of an image isn't signed in the
+// trust data of its repository, the trust data doesn't verify or the
+// registry serves another manifest than the one signed.
+type ErrUntrusted struct {
+	// Image is the image converted, as it was given.
+	Image string
+	Tag   string
+	Err   error
+}
+
+func (e *ErrUntrusted) Error() string {
+	return fmt.Sprintf("tag %s%s isn't trusted: %v", e.Tag, forImage(e.Image), e.Err)
+}
+
+func (e *ErrUntrusted) Unwrap() error {
+	return e.Err
+}
+
+// forImage returns the suffix naming image in the messages of the errors
+// above, empty if the image isn't known.
+func forImage(image string) string {
+	if image == "" {
+		return ""
+	}
+	return " of " + image
+}
+
+// statusError returns the error of an unexpected response status, typed as
+// ErrAuth or ErrNotFound for the statuses telling so. layer is the ID of the
+// layer requested, empty if it's the image or its tag.
+func statusError(res *http.Response, registry string, tag string, layer string) error {
+	herr := &HTTPError{StatusCode: res.StatusCode, URL: res.Request.URL.String()}
+	switch res.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &ErrAuth{Registry: registry, Err: herr}
+	case http.StatusNotFound:
+		return &ErrNotFound{Registry: registry, Tag: tag, Layer: layer, Err: herr}
+	}
+	return herr
+}
+
+// withImage fills in the image of the errors above found in err with image,
+// which the functions returning them don't know.
+func withImage(err error, image string) error {
+	var aerr *ErrAuth
+	if errors.As(err, &aerr) && aerr.Image == "" {
+		aerr.Image = image
+	}
+	var nerr *ErrNotFound
+	if errors.As(err, &nerr) && nerr.Image == "" {
+		nerr.Image = image
+	}
+	var merr *ErrManifestInvalid
+	if errors.As(err, &merr) && merr.Image == "" {
+		merr.Image = image
+	}
+	var serr *ErrStore
+	if errors.As(err, &serr) && serr.Image == "" {
+		serr.Image = image
+	}
+	var uerr *ErrUntrusted
+	if errors.As(err, &uerr) && uerr.Image == "" {
+		uerr.Image = image
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	// EventLayerStarted is written when a layer starts being downloaded,
+	// or is found downloaded already. Size is the size of the download,
+	// -1 if it's unknown.
+	EventLayerStarted EventType = "layer-started"
+	// EventLayerProgress is written while a layer is downloaded, with the
+	// Bytes downloaded so far.
+	EventLayerProgress EventType = "layer-progress"
+	// EventLayerDownloaded is written once a layer is downloaded.
+	EventLayerDownloaded EventType = "layer-downloaded"
+	// EventLayerConverted is written once a layer is converted to the
+	// ACI with ImageID, or found converted already. Empty layers have no
+	// ACI.
+	EventLayerConverted EventType = "layer-converted"
+	// EventImageConverted is written once all the ACIs of the image are
+	// generated, they are in ACIs.
+	EventImageConverted EventType = "image-converted"
+)
+
+// Event is a step of a conversion, written to Config.Events as a line of
+// JSON and passed to Config.Callbacks.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Image is the image converted, as {registry}/{image name}:{tag}.
+	Image string `json:"image"`
+	Layer string `json:"layer,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	// ACI and ImageID are the ACI of a layer and its image ID, the
+	// SHA-512 of its uncompressed contents.
+	ACI     string     `json:"aci,omitempty"`
+	ImageID string     `json:"imageID,omitempty"`
+	ACIs    []EventACI `json:"acis,omitempty"`
+}
+
+// EventACI is an ACI generated for an image.
+type EventACI struct {
+	File    string `json:"file"`
+	ImageID string `json:"imageID"`
+}
+
+// Callbacks are the functions called with the steps of a conversion, the nil
+// ones are skipped. The layers are downloaded at once, so they can be called
+// from several goroutines, and they shouldn't block: the downloads wait for
+// them.
+type Callbacks struct {
+	// OnLayerStart is called with the EventLayerStarted events.
+	OnLayerStart func(Event)
+	// OnLayerProgress is called with the EventLayerProgress events.
+	OnLayerProgress func(Event)
+	// OnImageDone is called with the EventImageConverted event, once the
+	// conversion succeeded.
+	OnImageDone func(Event)
+}
+
+// call calls the callback of e, if there's one.
+func (c Callbacks) call(e Event) {
+	var f func(Event)
+	switch e.Type {
+	case EventLayerStarted:
+		f = c.OnLayerStart
+	case EventLayerProgress:
+		f = c.OnLayerProgress
+	case EventImageConverted:
+		f = c.OnImageDone
+	}
+	if f != nil {
+		e.Time = time.Now().UTC()
+		f(e)
+	}
+}
+
+// empty reports whether none of the callbacks is set.
+func (c Callbacks) empty() bool {
+	return c.OnLayerStart == nil && c.OnLayerProgress == nil && c.OnImageDone == nil
+}
+
+// eventsMu keeps the events of the conversions sharing a writer on their own
+// lines.
+var eventsMu sync.Mutex
+
+func writeEvent(w io.Writer, e Event) {
+	e.Time = time.Now().UTC()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	w.Write(append(b, '\n'))
+}
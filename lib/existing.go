@@ -0,0 +1,138 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// findConvertedImage returns the ACIs of the image whose top layer is
+// layerID if an earlier conversion with config left them all in
+// config.OutputDir, in the order convertImage returns them. They are
+// recognized by their name, version label, the layer they were converted
+// from and settings, the fingerprint of the options they were converted
+// with. Layer ACIs are followed from the top one through their dependencies.
+func findConvertedImage(layerID string, dockerURL *ParsedDockerURL, config Config, settings string) ([]string, bool) {
+	var aciPaths []string
+	if config.Squash != SquashOnly {
+		for id := layerID; id != ""; {
+			p, manifest, ok := findLayerACI(id, dockerURL, config, settings)
+			if !ok {
+				return nil, false
+			}
+			aciPaths = append(aciPaths, p)
+
+			id = ""
+			if len(manifest.Dependencies) > 0 {
+				if id, ok = manifest.Dependencies[0].Labels.Get("layer"); !ok {
+					return nil, false
+				}
+			}
+		}
+	}
+
+	if config.Squash != SquashNone {
+		p := path.Join(config.OutputDir, getSquashedFilename(*dockerURL))
+		manifest, err := readManifest(p)
+		if err != nil || !convertedFrom(manifest, config.Name, layerID, dockerURL.Tag, settings) {
+			return nil, false
+		}
+		aciPaths = append(aciPaths, p)
+	}
+
+	return aciPaths, true
+}
+
+// findLayerACI returns the path and the manifest of the ACI of layerID in
+// config.OutputDir converted with settings, named like buildACI names them.
+func findLayerACI(layerID string, dockerURL *ParsedDockerURL, config Config, settings string) (string, *schema.ImageManifest, bool) {
+	name, err := types.SanitizeACName(config.Name + "-" + layerID)
+	if err != nil {
+		return "", nil, false
+	}
+	prefix := strings.Replace(dockerURL.ImageName, "/", "-", -1) + "-" + layerID
+	candidates, err := filepath.Glob(filepath.Join(config.OutputDir, prefix+"*.aci"))
+	if err != nil {
+		return "", nil, false
+	}
+	for _, p := range candidates {
+		manifest, err := readManifest(p)
+		if err == nil && convertedFrom(manifest, name, layerID, dockerURL.Tag, settings) {
+			return p, manifest, true
+		}
+	}
+	return "", nil, false
+}
+
+// convertedFrom reports whether manifest is the one of the ACI named name
+// converted from layerID of the image tagged tag with settings. Layer ACIs
+// have the layer label, squashed ones only the annotation.
+func convertedFrom(manifest *schema.ImageManifest, name string, layerID string, tag string, settings string) bool {
+	id, ok := manifest.Labels.Get("layer")
+	if !ok {
+		id, _ = manifest.Annotations.Get(layerIDAnnotation)
+	}
+	version, _ := manifest.Labels.Get("version")
+	s, _ := manifest.Annotations.Get(settingsAnnotation)
+	return id == layerID && version == tag && manifest.Name.String() == name && s == settings
+}
+
+// convertSettings returns the fingerprint of the options changing the ACIs
+// of an image besides its layers, kept in their settingsAnnotation.
+func convertSettings(config Config) (string, error) {
+	settings := struct {
+		Name               string
+		App                AppOverrides
+		Labels             map[string]string
+		Annotations        map[string]string
+		StripCapabilities  bool
+		StripSetuid        bool
+		UIDMap             []IDMap
+		GIDMap             []IDMap
+		Timestamp          time.Time
+		Exclude            []string
+		Include            []string
+		PrePackHook        string
+		HardlinkDuplicates bool
+	}{
+		Name:               config.Name,
+		App:                config.App,
+		Labels:             config.Labels,
+		Annotations:        config.Annotations,
+		StripCapabilities:  config.StripCapabilities,
+		StripSetuid:        config.StripSetuid,
+		UIDMap:             config.UIDMap,
+		GIDMap:             config.GIDMap,
+		Timestamp:          config.Timestamp,
+		Exclude:            config.Exclude,
+		Include:            config.Include,
+		PrePackHook:        config.PrePackHook,
+		HardlinkDuplicates: config.HardlinkDuplicates,
+	}
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
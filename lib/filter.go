@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"fmt"
+	"path"
+)
+
+// pathFilter selects the files of the layers that go in the ACIs. Its
+// patterns are absolute path.Match patterns; matching a directory matches
+// everything under it.
+type pathFilter struct {
+	exclude []string
+	include []string
+}
+
+// newPathFilter returns a filter excluding the paths matching the patterns
+// of exclude, except those matching the patterns of include.
+func newPathFilter(exclude, include []string) (*pathFilter, error) {
+	f := &pathFilter{}
+	for _, p := range []struct {
+		patterns []string
+		dest     *[]string
+	}{
+		{exclude, &f.exclude},
+		{include, &f.include},
+	} {
+		for _, pattern := range p.patterns {
+			pattern = path.Clean("/" + pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			*p.dest = append(*p.dest, pattern)
+		}
+	}
+	return f, nil
+}
+
+// excluded reports whether name, a cleaned entry name, is left out of the
+// ACIs.
+func (f *pathFilter) excluded(name string) bool {
+	if f == nil || len(f.exclude) == 0 {
+		return false
+	}
+	return matchAny(f.exclude, name) && !matchAny(f.include, name)
+}
+
+// matchAny reports whether name or one of its parent directories matches one
+// of patterns.
+func matchAny(patterns []string, name string) bool {
+	for p := "/" + name; p != "/"; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// getForeignLayer downloads the foreign layer, a blob distributed outside of
+// the registries like the base layers of Windows images, with the given
+// digest from the first of urls that has it. The blob is checked against
+// digest as it's read.
+func getForeignLayer(ctx context.Context, client *http.Client, logger Logger, digest string, urls []string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(digest, storageDigestID) {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	var errs []string
+	for _, u := range urls {
+		logInfo(logger, "Downloading foreign layer: "+u, LogField{"url", u})
+
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if res.StatusCode != 200 {
+			res.Body.Close()
+			errs = append(errs, fmt.Sprintf("HTTP code: %d. URL: %s", res.StatusCode, u))
+			continue
+		}
+
+		vr := &verifiedReader{
+			ReadCloser: res.Body,
+			hash:       sha256.New(),
+			digest:     digest,
+		}
+		return &sizedBody{ReadCloser: vr, size: res.ContentLength}, nil
+	}
+
+	return nil, fmt.Errorf("error downloading foreign layer %s: %s", digest, strings.Join(errs, "; "))
+}
+
+// verifiedReader reads a blob and fails at its end if it doesn't have the
+// expected digest. If tag isn't empty, the digest is the one signed for it
+// and a blob with another one is an *ErrUntrusted.
+type verifiedReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	digest string
+	tag    string
+}
+
+func (vr *verifiedReader) Read(p []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(p)
+	vr.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := fmt.Sprintf("%s%x", storageDigestID, vr.hash.Sum(nil)); got != vr.digest {
+			err := fmt.Errorf("layer has digest %s, expected %s", got, vr.digest)
+			if vr.tag != "" {
+				err = &ErrUntrusted{Tag: vr.tag, Err: err}
+			}
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// foreignLayerError is the error of converting a foreign layer missing from
+// the storage without Config.AllowForeignLayers.
+func foreignLayerError(layerID string, urls []string) error {
+	return fmt.Errorf("layer %s is a foreign layer that isn't in the storage and downloading foreign layers isn't allowed, it's distributed at %s", layerID, strings.Join(urls, ", "))
+}
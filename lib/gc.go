@@ -0,0 +1,225 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GCPolicy is what GC removes.
+type GCPolicy struct {
+	// MaxAge, if not zero, removes the files not used for longer: the
+	// layers no conversion downloaded or reused since, the layer ACIs
+	// and the registry responses not written since.
+	MaxAge time.Duration
+	// MaxSize, if not zero, then removes the files used the longest ago
+	// until the ones left take at most MaxSize bytes.
+	MaxSize int64
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// GCResult is what GC removed.
+type GCResult struct {
+	// Removed are the files removed, or the ones which would be with
+	// DryRun.
+	Removed []string
+	// Freed is the size of the files removed and Kept the one of the
+	// files left.
+	Freed int64
+	Kept  int64
+}
+
+// gcFile is a file GC can remove.
+type gcFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// GC prunes the layer cache cacheDir and the work dir workDir, the ones of
+// Config.CacheDir and Config.WorkDir, according to policy. Either can be
+// empty. The files left by conversions which died while writing them are
+// removed too. The conversions using the directories at the same time
+// download or pack the files they need again.
+func GC(cacheDir string, workDir string, policy GCPolicy) (*GCResult, error) {
+	var dirs []string
+	if cacheDir != "" {
+		// a dir of layers for each registry, the layers of the caches
+		// written before are in the layers dir itself
+		layersDir := filepath.Join(cacheDir, cacheLayersDir)
+		registryDirs, err := filepath.Glob(filepath.Join(layersDir, "*"))
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, layersDir, filepath.Join(cacheDir, metadataDir))
+		for _, d := range registryDirs {
+			if fi, err := os.Stat(d); err == nil && fi.IsDir() {
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	if workDir != "" {
+		// a dir of layers for each registry and ID map, and of ACIs for
+		// each registry, the work dirs written before have them for each
+		// ID map and in the ACIs dir itself
+		for _, pattern := range []string{
+			filepath.Join(workDir, workLayersDir, "*"),
+			filepath.Join(workDir, workLayersDir, "*", "*"),
+			filepath.Join(workDir, workACIsDir, "*"),
+		} {
+			subDirs, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range subDirs {
+				if fi, err := os.Stat(d); err == nil && fi.IsDir() {
+					dirs = append(dirs, d)
+				}
+			}
+		}
+		dirs = append(dirs, filepath.Join(workDir, workACIsDir))
+	}
+
+	result := &GCResult{}
+	var files []gcFile
+	for _, dir := range dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			// the digests go with their layers
+			if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), keptDigestSuffix) {
+				continue
+			}
+			p := filepath.Join(dir, fi.Name())
+			if age, ok := partialAge(fi.Name()); ok {
+				if time.Since(fi.ModTime()) > age {
+					if err := result.remove(p, fi.Size(), policy.DryRun); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			files = append(files, gcFile{path: p, size: fi.Size(), used: fi.ModTime()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].used.Before(files[j].used)
+	})
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	removedACIs := make(map[string]bool)
+	for _, f := range files {
+		expired := policy.MaxAge > 0 && time.Since(f.used) > policy.MaxAge
+		if !expired && (policy.MaxSize <= 0 || size <= policy.MaxSize) {
+			result.Kept += f.size
+			continue
+		}
+		if err := result.remove(f.path, f.size, policy.DryRun); err != nil {
+			return nil, err
+		}
+		if !policy.DryRun {
+			os.Remove(f.path + keptDigestSuffix)
+		}
+		size -= f.size
+		if name, ok := workACIName(f.path); ok {
+			removedACIs[name] = true
+		}
+	}
+
+	if workDir != "" && !policy.DryRun && len(removedACIs) > 0 {
+		if err := forgetPacked(workDir, removedACIs); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// remove removes the file p of size bytes unless dryRun is true. Files
+// removed meanwhile by a conversion are skipped.
+func (r *GCResult) remove(p string, size int64, dryRun bool) error {
+	if !dryRun {
+		if err := os.Remove(p); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	r.Removed = append(r.Removed, p)
+	r.Freed += size
+	return nil
+}
+
+// partialAge returns the age after which the file name, if it's being
+// written, is taken for one left by a conversion which died.
+func partialAge(name string) (time.Duration, bool) {
+	switch {
+	case strings.HasPrefix(name, layerDownloadPrefix):
+		return staleDownloadAge, true
+	case strings.HasPrefix(name, "."):
+		// partialPrefix and the progress files being written
+		return stalePartialAge, true
+	}
+	return 0, false
+}
+
+// forgetPacked removes the records of the layer ACIs of the work dir whose
+// files, named in removed by workACIName, GC removed.
+func forgetPacked(dir string, removed map[string]bool) error {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	wd := &workDir{dir: dir}
+	if err := wd.load(); err != nil {
+		return err
+	}
+	changed := false
+	for id, lp := range wd.progress.Layers {
+		if name, ok := workACIName(lp.ACI); ok && removed[name] {
+			delete(wd.progress.Layers, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return wd.save()
+}
+
+// workACIName returns the name of the ACI p within the ACIs dir of a work
+// dir, if it's there. The ACIs recorded are named after the dir of the
+// conversion, so the names are compared rather than the paths.
+func workACIName(p string) (string, bool) {
+	dir, name := filepath.Split(filepath.Clean(p))
+	dir = filepath.Clean(dir)
+	if filepath.Base(dir) == workACIsDir {
+		return name, true
+	}
+	if filepath.Base(filepath.Dir(dir)) == workACIsDir {
+		return filepath.Join(filepath.Base(dir), name), true
+	}
+	return "", false
+}
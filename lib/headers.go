@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"time"
+)
+
+const (
+	// capabilityXattr is the extended attribute holding the capabilities
+	// of a file, as set by setcap.
+	capabilityXattr = "security.capability"
+
+	// paxXattrPrefix is the prefix of the PAX records storing extended
+	// attributes.
+	paxXattrPrefix = "SCHILY.xattr."
+
+	modeSetuid = 04000
+	modeSetgid = 02000
+)
+
+// transformHeader applies the options of config to the header of a layer
+// entry before it's written to the ACI.
+func transformHeader(hdr *tar.Header, config Config) {
+	normalizeHeader(hdr)
+	// The tar reader expands sparse files, and Go's writer would write old
+	// GNU sparse headers without their sparse map. They're regular files
+	// whose holes are found again when they're written.
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		hdr.Typeflag = tar.TypeReg
+	}
+	if config.StripCapabilities {
+		removeXattr(hdr, capabilityXattr)
+	}
+	if !config.Timestamp.IsZero() && hdr.ModTime.After(config.Timestamp) {
+		hdr.ModTime = config.Timestamp
+	}
+	if config.StripSetuid && isSetuid(hdr) {
+		hdr.Mode &^= modeSetuid | modeSetgid
+	}
+}
+
+// isSetuid reports whether hdr is a regular file with the setuid or setgid
+// bit. Directories are left alone, setgid is how they make their files
+// inherit their group.
+func isSetuid(hdr *tar.Header) bool {
+	regular := hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+	return regular && hdr.Mode&(modeSetuid|modeSetgid) != 0
+}
+
+// normalizeHeader prepares hdr to be written to an ACI.
+//
+// It lets the tar writer pick the format of hdr. The reader sets it to the
+// format of the layer, which can't always encode the entry once it's moved
+// under rootfs/ or got extended attributes, e.g. a ustar name that becomes
+// too long. Large IDs and long names then get PAX records.
+//
+// It also clears the access and change times, which depend on when and where
+// the layer was unpacked, so converting the same image twice gives the same
+// ACIs.
+func normalizeHeader(hdr *tar.Header) {
+	hdr.Format = tar.FormatUnknown
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+}
+
+// removeXattr removes the extended attribute name from hdr. The tar reader
+// keeps them both in Xattrs and in PAXRecords.
+func removeXattr(hdr *tar.Header, name string) {
+	delete(hdr.Xattrs, name)
+	delete(hdr.PAXRecords, paxXattrPrefix+name)
+}
@@ -0,0 +1,331 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/docker2aci/tarball"
+	"github.com/appc/spec/schema"
+)
+
+// runPrePackHook runs the shell command hook in the root filesystem of the
+// ACI at aciPath, whose path it gets in $ROOTFS, and packs the ACI again
+// with the hook's changes. The conversion fails if the hook does. The hook is
+// killed once ctx is done.
+//
+// The root filesystem is extracted as the current user, so the owners,
+// extended attributes, devices and FIFOs of its files are taken from the ACI
+// rather than from the disk. New files belong to root.
+func runPrePackHook(ctx context.Context, aciPath string, hook string, config Config) error {
+	tmpDir, err := ioutil.TempDir(config.TmpDir, "docker2aci-")
+	if err != nil {
+		return fmt.Errorf("error creating dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rootfs := filepath.Join(tmpDir, "rootfs")
+	manifest, headers, err := extractACI(aciPath, rootfs)
+	if err != nil {
+		return fmt.Errorf("error extracting ACI: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook)
+	cmd.Dir = rootfs
+	cmd.Env = append(os.Environ(), "ROOTFS="+rootfs)
+	// stdout can be the events, the hook's output goes with the messages
+	cmd.Stdout = Messages
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pre-pack hook failed: %w", err)
+	}
+
+	if err := packACI(aciPath, rootfs, *manifest, headers, config); err != nil {
+		return fmt.Errorf("error packing ACI: %w", err)
+	}
+	return nil
+}
+
+// extractACI extracts the root filesystem of the ACI at aciPath to rootfs.
+// It returns the manifest of the ACI and the headers of the files, keyed by
+// their name in the root filesystem. Devices and FIFOs are extracted as empty
+// regular files, which needs no privileges.
+func extractACI(aciPath string, rootfs string) (*schema.ImageManifest, map[string]*tar.Header, error) {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	var manifest schema.ImageManifest
+	headers := make(map[string]*tar.Header)
+	var links []*tar.Header
+	walker := func(t *tarball.TarFile) error {
+		name := tarball.CleanName(t.Name())
+		if name == "manifest" {
+			return json.NewDecoder(t.TarStream).Decode(&manifest)
+		}
+		rel := strings.TrimPrefix(name, "rootfs/")
+		if rel == name || underSymlink(headers, rel) {
+			return nil
+		}
+
+		hdr := t.Header
+		p := filepath.Join(rootfs, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			out, err := os.Create(p)
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				_, _, err = spoolSparse(out, t.TarStream)
+			}
+			out.Close()
+			if err != nil {
+				return err
+			}
+			if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// chmod would follow the symlink
+			headers[rel] = hdr
+			return os.Symlink(hdr.Linkname, p)
+		case tar.TypeLink:
+			// the target can come later in the ACI
+			links = append(links, hdr)
+			return nil
+		default:
+			return nil
+		}
+		headers[rel] = hdr
+		return os.Chmod(p, extractedMode(hdr))
+	}
+
+	tr := tar.NewReader(f)
+	if err := tarball.Walk(*tr, walker); err != nil {
+		return nil, nil, err
+	}
+
+	for _, hdr := range links {
+		rel := strings.TrimPrefix(tarball.CleanName(hdr.Name), "rootfs/")
+		target := strings.TrimPrefix(tarball.CleanName(hdr.Linkname), "rootfs/")
+		if _, ok := headers[target]; !ok {
+			continue
+		}
+		p := filepath.Join(rootfs, filepath.FromSlash(rel))
+		if err := os.Link(filepath.Join(rootfs, filepath.FromSlash(target)), p); err != nil {
+			return nil, nil, err
+		}
+		headers[rel] = headers[target]
+	}
+
+	return &manifest, headers, nil
+}
+
+// underSymlink reports whether one of the parent directories of name was
+// extracted as a symlink, so extracting name would follow it.
+func underSymlink(headers map[string]*tar.Header, name string) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if hdr, ok := headers[dir]; ok && hdr.Typeflag == tar.TypeSymlink {
+			return true
+		}
+	}
+	return false
+}
+
+// extractedMode returns the permissions of the file of hdr once extracted:
+// the owner can always write to it, so can the hook, and setuid, setgid and
+// sticky bits are left out.
+func extractedMode(hdr *tar.Header) os.FileMode {
+	mode := os.FileMode(hdr.Mode) & os.ModePerm
+	if hdr.Typeflag == tar.TypeDir {
+		return mode | 0700
+	}
+	return mode | 0600
+}
+
+// packACI replaces the ACI at aciPath with one of manifest and the root
+// filesystem rootfs, applying config to its files. headers are the ones
+// extractACI returned.
+func packACI(aciPath string, rootfs string, manifest schema.ImageManifest, headers map[string]*tar.Header, config Config) error {
+	out, err := ioutil.TempFile(filepath.Dir(aciPath), partialPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if err := keepMode(out, aciPath); err != nil {
+		return err
+	}
+
+	validator, w := newACIValidator(out)
+	tw := newSparseWriter(w, config.TmpDir)
+	if err := validator.close(writeRootfs(tw, rootfs, manifest, headers, config)); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), aciPath)
+}
+
+// writeRootfs writes the ACI of manifest and the root filesystem rootfs to tw
+// and closes it. Files with holes are written as sparse entries.
+func writeRootfs(tw *sparseWriter, rootfs string, manifest schema.ImageManifest, headers map[string]*tar.Header, config Config) error {
+	if err := addMinimalACIStructure(tw.Writer, manifest); err != nil {
+		return err
+	}
+
+	// names of the files with several hard links already written
+	linked := make(map[fileID]string)
+	walker := func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		hdr, err := packedHeader(name, p, fi, headers[name])
+		if err != nil || hdr == nil {
+			return err
+		}
+		if id, ok := inode(fi); ok {
+			if target, ok := linked[id]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = target
+				hdr.Size = 0
+			} else {
+				linked[id] = name
+			}
+		}
+		tarball.Rebase(hdr, "rootfs")
+		transformHeader(hdr, config)
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			data, err := dataFragments(f, hdr.Size)
+			if err != nil {
+				return err
+			}
+			return tw.writeSparse(hdr, f, data)
+		}
+		return tw.WriteHeader(hdr)
+	}
+
+	if err := filepath.Walk(rootfs, walker); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// packedHeader returns the header of the file p, named name in the root
+// filesystem, whose header in the extracted ACI was orig if it existed. The
+// files the hook didn't replace keep the metadata of orig. It returns nil for
+// files which can't be stored in tarballs.
+func packedHeader(name string, p string, fi os.FileInfo, orig *tar.Header) (*tar.Header, error) {
+	special := orig != nil && (orig.Typeflag == tar.TypeChar || orig.Typeflag == tar.TypeBlock || orig.Typeflag == tar.TypeFifo)
+	if special && fi.Mode().IsRegular() && fi.Size() == 0 {
+		hdr := *orig
+		hdr.Name = name
+		return &hdr, nil
+	}
+	if fi.Mode()&os.ModeSocket != 0 {
+		return nil, nil
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return nil, err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		setDeviceNumbers(hdr, fi)
+	}
+
+	if orig == nil || !sameFileType(orig.Typeflag, hdr.Typeflag) {
+		return hdr, nil
+	}
+	hdr.Uid, hdr.Gid = orig.Uid, orig.Gid
+	hdr.Uname, hdr.Gname = orig.Uname, orig.Gname
+	hdr.Xattrs = orig.Xattrs
+	if fi.Mode()&os.ModePerm == extractedMode(orig) {
+		hdr.Mode = orig.Mode
+	}
+	// directories get new times whenever their contents change, whether
+	// the hook touched them or not
+	unchanged := fi.IsDir() ||
+		(hdr.Typeflag == tar.TypeSymlink && link == orig.Linkname) ||
+		fi.ModTime().Equal(orig.ModTime)
+	if unchanged {
+		hdr.ModTime = orig.ModTime
+	}
+	return hdr, nil
+}
+
+// sameFileType reports whether the tar entry types a and b are the same type
+// of file.
+func sameFileType(a, b byte) bool {
+	if a == tar.TypeRegA {
+		a = tar.TypeReg
+	}
+	if b == tar.TypeRegA {
+		b = tar.TypeReg
+	}
+	return a == b
+}
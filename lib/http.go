@@ -0,0 +1,242 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxIdleConnsPerHost is the number of idle connections to each
+	// host DefaultHTTPClient keeps alive, enough for the requests of a
+	// conversion to reuse them.
+	DefaultMaxIdleConnsPerHost = 4
+	// DefaultConnectTimeout and DefaultReadTimeout are the timeouts of
+	// DefaultHTTPClient.
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultReadTimeout    = time.Minute
+)
+
+// DefaultHTTPClient makes the requests of the conversions whose
+// Config.HTTPClient is nil, and of Push.
+var DefaultHTTPClient = NewHTTPClient(HTTPOptions{
+	MaxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+	ConnectTimeout:      DefaultConnectTimeout,
+	ReadTimeout:         DefaultReadTimeout,
+})
+
+// HTTPOptions are the settings of the clients made by NewHTTPClient.
+type HTTPOptions struct {
+	// MaxIdleConnsPerHost is the number of idle connections to each host
+	// kept alive between requests.
+	MaxIdleConnsPerHost int
+	// TLSConfig, if not nil, is used for HTTPS connections, e.g. to trust
+	// the CA of a private registry.
+	TLSConfig *tls.Config
+	// ConnectTimeout, if not zero, is how long connecting to a host,
+	// including the TLS handshake, can take.
+	ConnectTimeout time.Duration
+	// ReadTimeout, if not zero, is how long the client waits for data from
+	// a host, whether the headers of a response or the next bytes of its
+	// body, before failing. Downloads of any size are fine as long as they
+	// make progress.
+	ReadTimeout time.Duration
+	// RateLimit, if not zero, is the number of bytes per second all the
+	// responses of the client are read at, together. Uploads aren't
+	// limited.
+	RateLimit int64
+	// Trace, if not nil, gets every request made, with the status and the
+	// time of its response, and their headers. The credentials are
+	// redacted.
+	Trace io.Writer
+}
+
+// NewHTTPClient returns a client with the settings of opts, using the proxy
+// of the environment.
+func NewHTTPClient(opts HTTPOptions) *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       opts.TLSConfig,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.ReadTimeout,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+	}
+	if opts.Trace != nil {
+		// every redirect is a request of its own
+		transport = &traceTransport{RoundTripper: transport, w: opts.Trace}
+	}
+	if opts.ReadTimeout != 0 {
+		transport = &readTimeoutTransport{RoundTripper: transport, timeout: opts.ReadTimeout}
+	}
+	if opts.RateLimit != 0 {
+		transport = &rateLimitTransport{RoundTripper: transport, limiter: &rateLimiter{rate: opts.RateLimit}}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// readTimeoutTransport cancels the requests whose response bodies don't get
+// data for timeout. http.Client.Timeout would also limit how long reading
+// whole layers takes.
+type readTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *readTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	res, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &timeoutBody{
+		ReadCloser: res.Body,
+		timeout:    t.timeout,
+		cancel:     cancel,
+	}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		atomic.StoreInt32(&body.expired, 1)
+		cancel()
+	})
+	res.Body = body
+	return res, nil
+}
+
+// timeoutBody is a response body whose request is cancelled by timer when
+// no data is read for timeout.
+type timeoutBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+	// expired is set to 1 once timer has fired
+	expired int32
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.expired) == 1 {
+		return n, &readTimeoutError{timeout: b.timeout}
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+// readTimeoutError is a net.Error, like the errors of the connections.
+type readTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *readTimeoutError) Error() string {
+	return fmt.Sprintf("no data received for %v", e.timeout)
+}
+
+func (e *readTimeoutError) Timeout() bool   { return true }
+func (e *readTimeoutError) Temporary() bool { return true }
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// rateLimitTransport makes the response bodies of its requests share the
+// bandwidth of limiter.
+type rateLimitTransport struct {
+	http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, limiter: t.limiter}
+	return res, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// small reads keep the waits short and the flow steady
+	if max := b.limiter.rate/10 + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.limiter.wait(n)
+	return n, err
+}
+
+// rateLimiter spaces out the reads of the bodies sharing it so they get rate
+// bytes per second together.
+type rateLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	// next is when the bytes read so far are paid for
+	next time.Time
+}
+
+// wait blocks until reading n more bytes keeps to the rate.
+func (l *rateLimiter) wait(n int) {
+	if n == 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// httpClient returns the client the requests of a conversion with config are
+// made with.
+func httpClient(config Config) *http.Client {
+	client := DefaultHTTPClient
+	if config.HTTPClient != nil {
+		client = config.HTTPClient
+	}
+	return client
+}
+
+// client returns the client the requests for repoData are made with.
+func (repoData *RepoData) client() *http.Client {
+	if repoData.httpClient != nil {
+		return repoData.httpClient
+	}
+	return DefaultHTTPClient
+}
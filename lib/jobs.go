@@ -0,0 +1,348 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// serverConvertPath is where the jobs are created and serverJobsPrefix
+	// where they're tracked. The discovery pages of images named like
+	// them are still served there with ac-discovery=1.
+	serverConvertPath = "/convert"
+	serverJobsPrefix  = "/jobs/"
+	// serverJobsDir is the directory of ServerOptions.Dir the jobs convert
+	// to, which no image name can clash with.
+	serverJobsDir = "_jobs"
+	// maxJobRequestSize is the largest body of a POST /convert.
+	maxJobRequestSize = 1 << 16
+)
+
+// The states of a job.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobRequest is the body of a POST /convert.
+type jobRequest struct {
+	// Image is the image to convert, as given to Convert.
+	Image string `json:"image"`
+	// Name, if not empty, is the name of the ACIs, see Config.Name.
+	Name string `json:"name,omitempty"`
+	// Squash, if not nil, is whether the layers are squashed instead of
+	// following the server's configuration.
+	Squash *bool `json:"squash,omitempty"`
+}
+
+// serverJob is a conversion started with a POST /convert, its fields are
+// its status. They're guarded by the mutex of the server's jobs.
+type serverJob struct {
+	ID       string     `json:"id"`
+	Image    string     `json:"image"`
+	Name     string     `json:"name,omitempty"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// ACIs are the paths the generated ACIs are served at.
+	ACIs  []string `json:"acis,omitempty"`
+	Error string   `json:"error,omitempty"`
+
+	config Config
+	dir    string
+	// files are the ACIs generated, by their name in ACIs
+	files map[string]string
+	log   *jobLog
+}
+
+// jobLog is the log of a job: the events of its conversion and the changes
+// of its state, as lines of JSON.
+type jobLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// jobEvent is the line of a change of the state of a job in its log, its
+// type is the state prefixed with "job-".
+type jobEvent struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// state logs that the job is now in state, which it's in because of msg if
+// it failed.
+func (l *jobLog) state(state string, msg string) {
+	b, err := json.Marshal(jobEvent{Type: "job-" + state, Time: time.Now().UTC(), Error: msg})
+	if err != nil {
+		return
+	}
+	l.Write(append(b, '\n'))
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *jobLog) bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// serverJobs are the jobs of a Server.
+type serverJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*serverJob
+	// slots has a value for each job running, if the jobs run at once are
+	// limited
+	slots chan struct{}
+}
+
+// serveConvert starts the job of the image in the body of the request and
+// answers with its status.
+func (s *Server) serveConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req jobRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxJobRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Image == "" {
+		http.Error(w, "invalid request: no image", http.StatusBadRequest)
+		return
+	}
+	if _, err := parseDockerURL(req.Image); err != nil {
+		http.Error(w, fmt.Sprintf("invalid image %q: %v", req.Image, err), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	job := &serverJob{
+		ID:      id,
+		Image:   req.Image,
+		Name:    req.Name,
+		State:   jobQueued,
+		Created: time.Now().UTC(),
+		config:  s.opts.Config,
+		dir:     filepath.Join(s.opts.Dir, serverJobsDir, id),
+		files:   make(map[string]string),
+		log:     &jobLog{},
+	}
+	job.config.Name = req.Name
+	job.log.state(jobQueued, "")
+	if req.Squash != nil {
+		job.config.Squash = SquashNone
+		if *req.Squash {
+			job.config.Squash = SquashOnly
+		}
+	}
+
+	s.jobs.mu.Lock()
+	s.jobs.jobs[id] = job
+	status := *job
+	s.jobs.mu.Unlock()
+	go s.runJob(job)
+
+	w.Header().Set("Location", serverJobsPrefix+id)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// serveJob serves the status of a job at /jobs/ID, its log at /jobs/ID/log
+// and its ACIs at /jobs/ID/acis/FILE.
+func (s *Server) serveJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, serverJobsPrefix), "/", 2)
+	var status serverJob
+	var aciPath string
+	s.jobs.mu.Lock()
+	job, ok := s.jobs.jobs[parts[0]]
+	if ok {
+		status = *job
+		if len(parts) == 2 {
+			aciPath = job.files[strings.TrimPrefix(parts[1], "acis/")]
+		}
+	}
+	s.jobs.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, http.StatusOK, status)
+	case parts[1] == "log":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(job.log.bytes())
+	case strings.HasPrefix(parts[1], "acis/") && aciPath != "":
+		serveFile(w, r, aciPath, "application/octet-stream")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// runJob converts the image of job once there's room for it, recording its
+// events in its log.
+func (s *Server) runJob(job *serverJob) {
+	if s.jobs.slots != nil {
+		select {
+		case s.jobs.slots <- struct{}{}:
+			defer func() { <-s.jobs.slots }()
+		case <-s.ctx.Done():
+			s.finishJob(job, nil, s.ctx.Err())
+			return
+		}
+	}
+
+	started := time.Now().UTC()
+	s.jobs.mu.Lock()
+	job.State = jobRunning
+	job.Started = &started
+	s.jobs.mu.Unlock()
+	job.log.state(jobRunning, "")
+
+	config := job.config
+	config.OutputDir = job.dir
+	if config.Events != nil {
+		config.Events = io.MultiWriter(config.Events, job.log)
+	} else {
+		config.Events = job.log
+	}
+	if s.opts.Metrics != nil {
+		config.Stats = &Stats{}
+	}
+	aciPaths, err := s.convertJob(job.Image, config)
+	if s.opts.Metrics != nil {
+		s.opts.Metrics.Observe(time.Since(started), config.Stats, err)
+	}
+	s.finishJob(job, aciPaths, err)
+}
+
+func (s *Server) convertJob(image string, config Config) ([]string, error) {
+	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+		return nil, &ErrStore{Path: config.OutputDir, Err: err}
+	}
+	aciPaths, err := ConvertWithContext(s.ctx, image, config)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.SignKey != "" {
+		for _, aciPath := range aciPaths {
+			if err := SignACI(s.ctx, aciPath, s.opts.SignKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return aciPaths, nil
+}
+
+// finishJob records the end of job, which generated aciPaths or failed with
+// err, and removes it once it's JobTTL old.
+func (s *Server) finishJob(job *serverJob, aciPaths []string, err error) {
+	finished := time.Now().UTC()
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	job.Finished = &finished
+	time.AfterFunc(s.opts.JobTTL, func() { s.expireJob(job) })
+	if err != nil {
+		job.State = jobFailed
+		job.Error = strings.TrimSpace(err.Error())
+		job.log.state(jobFailed, job.Error)
+		logWarn(s.opts.Config.Logger, fmt.Sprintf("Job %s converting %s failed: %v", job.ID, job.Image, err), LogField{"job", job.ID}, LogField{"image", job.Image})
+		return
+	}
+	job.State = jobSucceeded
+	job.log.state(jobSucceeded, "")
+	for _, aciPath := range aciPaths {
+		file := filepath.Base(aciPath)
+		job.files[file] = aciPath
+		job.ACIs = append(job.ACIs, path.Join(serverJobsPrefix, job.ID, "acis", file))
+	}
+}
+
+// expireJob removes job, which finished JobTTL ago, and its ACIs.
+func (s *Server) expireJob(job *serverJob) {
+	s.jobs.mu.Lock()
+	delete(s.jobs.jobs, job.ID)
+	s.jobs.mu.Unlock()
+	if err := os.RemoveAll(job.dir); err != nil {
+		logWarn(s.opts.Config.Logger, fmt.Sprintf("error removing job %s: %v", job.ID, err), LogField{"job", job.ID})
+	}
+}
+
+// removeOldJobs removes the dirs in dir of the jobs of earlier servers
+// modified more than ttl ago. Their jobs are gone with their server.
+func removeOldJobs(dir string, ttl time.Duration) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if fi.IsDir() && time.Since(fi.ModTime()) > ttl {
+			os.RemoveAll(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
+
+// newJobID returns a random ID for a job.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating job ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/appc/spec/schema"
+)
+
+// LayerSet records the layers converted by the conversions sharing it, see
+// Config.Layers, so the later ones reuse the ACIs of the layers they have in
+// common with the earlier ones instead of downloading and packing them
+// again. A layer ID stands for the layer and all its ancestors, so the
+// layers reused are the lower ones of an image.
+//
+// The conversions sharing a LayerSet must use the same options, besides the
+// app overrides which only apply to the top layer. Several conversions can
+// use it at once.
+type LayerSet struct {
+	mu     sync.Mutex
+	layers map[string]*convertedLayer
+	// dir keeps the layer ACIs of squashed images, which are otherwise
+	// removed once the image is squashed.
+	dir string
+}
+
+// convertedLayer is a layer recorded by a LayerSet.
+type convertedLayer struct {
+	// aciPath is empty for the empty layers which got no ACI.
+	aciPath  string
+	key      string
+	manifest *schema.ImageManifest
+	// state is the ancestry state once the layer was converted.
+	state *ancestryState
+}
+
+// NewLayerSet returns an empty LayerSet.
+func NewLayerSet() *LayerSet {
+	return &LayerSet{layers: make(map[string]*convertedLayer)}
+}
+
+// Close removes the layer ACIs the set kept for squashed images. The set
+// can't be used anymore.
+func (s *LayerSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.layers = nil
+	if s.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// acisDir returns the directory for the layer ACIs of squashed images,
+// creating it in tmpDir the first time.
+func (s *LayerSet) acisDir(tmpDir string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		dir, err := ioutil.TempDir(tmpDir, "docker2aci-")
+		if err != nil {
+			return "", err
+		}
+		s.dir = dir
+	}
+	return s.dir, nil
+}
+
+// add records layerID, converted to the ACI at aciPath, with the state once
+// the layer was converted.
+func (s *LayerSet) add(layerID string, aciPath string, key string, manifest *schema.ImageManifest, state *ancestryState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.layers == nil {
+		return
+	}
+	s.layers[layerID] = &convertedLayer{
+		aciPath:  aciPath,
+		key:      key,
+		manifest: manifest,
+		state:    state.clone(),
+	}
+}
+
+// reuse returns the index of the highest layer of ancestry, but the top one,
+// from which every layer down to the base was recorded and still has its
+// ACI, with the recorded layers from it, in the order of ancestry. It
+// returns len(ancestry) if there is none.
+func (s *LayerSet) reuse(ancestry []string) (int, []*convertedLayer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 1; i < len(ancestry); i++ {
+		if layers, ok := s.converted(ancestry[i:]); ok {
+			return i, layers
+		}
+	}
+	return len(ancestry), nil
+}
+
+func (s *LayerSet) converted(ancestry []string) ([]*convertedLayer, bool) {
+	var layers []*convertedLayer
+	for _, id := range ancestry {
+		l, ok := s.layers[id]
+		if !ok {
+			return nil, false
+		}
+		if l.aciPath != "" {
+			if _, err := os.Stat(l.aciPath); err != nil {
+				return nil, false
+			}
+		}
+		layers = append(layers, l)
+	}
+	return layers, true
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// LogLevel is the importance of a message of the conversions.
+type LogLevel int
+
+const (
+	// LevelInfo is the level of the messages telling what the
+	// conversions do, like the layers they download.
+	LevelInfo LogLevel = iota
+	// LevelWarn is the level of the problems which don't stop the
+	// conversions, like the files left out of an ACI.
+	LevelWarn
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// LogField is a piece of the context of a message, like the ID of the layer
+// it's about.
+type LogField struct {
+	Key   string
+	Value string
+}
+
+// Logger gets the messages of the conversions. The messages are sentences
+// for people to read, which already have the values of their fields in them.
+// The conversions of several images can log at once.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// DefaultLogger is the Logger of the conversions without a Config.Logger, and
+// of the functions taking no Config. Applications set it to show the messages
+// their own way.
+var DefaultLogger Logger = TextLogger{}
+
+// TextLogger prints the messages as lines, the info ones to Out and the
+// warnings, prefixed with "Warning: ", to Err, above the progress bars.
+// The fields are left out.
+type TextLogger struct {
+	// Out and Err are Messages and stderr if nil.
+	Out io.Writer
+	Err io.Writer
+}
+
+func (l TextLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if level >= LevelWarn {
+		w := l.Err
+		if w == nil {
+			w = os.Stderr
+		}
+		progressTerminal.printf(w, "Warning: %s\n", msg)
+		return
+	}
+	w := l.Out
+	if w == nil {
+		w = Messages
+	}
+	progressTerminal.printf(w, "%s\n", msg)
+}
+
+// logInfo logs what a conversion does to l, DefaultLogger if nil.
+func logInfo(l Logger, msg string, fields ...LogField) {
+	if l == nil {
+		l = DefaultLogger
+	}
+	l.Log(LevelInfo, msg, fields...)
+}
+
+// logWarn logs a problem which doesn't stop a conversion to l, DefaultLogger
+// if nil.
+func logWarn(l Logger, msg string, fields ...LogField) {
+	if l == nil {
+		l = DefaultLogger
+	}
+	l.Log(LevelWarn, msg, fields...)
+}
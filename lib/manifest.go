@@ -0,0 +1,220 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// ManifestOptions is what GenerateManifest translates the Docker JSON of a
+// layer with: what the conversion knows of the layer's image and files, and
+// its options.
+type ManifestOptions struct {
+	// Name is the name of the ACIs of the image, the one of the layer is
+	// {Name}-{layer ID}.
+	Name string
+	// Image is the image of the layer, which gives the version label and
+	// the original name annotation.
+	Image ParsedDockerURL
+	// RawConfig, if not empty, is the image config describing the layer,
+	// kept as an annotation.
+	RawConfig []byte
+	// History is the history of the image up to the layer.
+	History []DockerHistory
+	// PathWhitelist is the pathWhitelist of the ACI, every path of the
+	// image's root filesystem if the layer deleted files.
+	PathWhitelist []string
+	// Passwd and Group are the /etc/passwd and /etc/group files of the
+	// image up to the layer, the user and group of the app are looked up
+	// there.
+	Passwd []byte
+	Group  []byte
+	// SetuidFiles are the setuid and setgid files stripped from the
+	// image, recorded as an annotation.
+	SetuidFiles []string
+	// Labels, Annotations, App, Exclude and Include are the ones of
+	// Config.
+	Labels      map[string]string
+	Annotations map[string]string
+	App         AppOverrides
+	Exclude     []string
+	Include     []string
+	// Parent, if not nil, is the ACI the layer depends on.
+	Parent *ManifestParent
+	// Logger, if not nil, gets the warnings about the labels of the image
+	// left out instead of DefaultLogger.
+	Logger Logger
+}
+
+// ManifestParent is the ACI a layer depends on, the one of its closest
+// ancestor that wasn't empty.
+type ManifestParent struct {
+	LayerID string
+	// ImageID, if not empty, pins the ACI of the dependency.
+	ImageID string
+	// App and Labels, if App isn't nil, are the name and the labels of the
+	// ACI when it was converted with another image, see LayerSet, which
+	// has another name than the one of Name.
+	App    *types.ACName
+	Labels types.Labels
+}
+
+// GenerateManifest translates the Docker JSON of a layer to the manifest of
+// its ACI, with opts. It only depends on its arguments, which it doesn't
+// change.
+func GenerateManifest(layerData DockerImageData, opts ManifestOptions) (*schema.ImageManifest, error) {
+	dockerConfig := layerData.Config
+	genManifest := &schema.ImageManifest{}
+
+	appURL := opts.Name + "-" + layerData.ID
+	appURL, err := types.SanitizeACName(appURL)
+	if err != nil {
+		return nil, err
+	}
+	appName, err := types.NewACName(appURL)
+	if err != nil {
+		return nil, err
+	}
+	genManifest.Name = *appName
+
+	acVersion, _ := types.NewSemVer(schemaVersion)
+	genManifest.ACVersion = *acVersion
+
+	genManifest.ACKind = types.ACKind("ImageManifest")
+
+	var labels types.Labels
+	var parentLabels types.Labels
+
+	layer, _ := types.NewACName("layer")
+	labels = append(labels, types.Label{Name: *layer, Value: layerData.ID})
+
+	tag := opts.Image.Tag
+	version, _ := types.NewACName("version")
+	labels = append(labels, types.Label{Name: *version, Value: tag})
+	parentLabels = append(parentLabels, types.Label{Name: *version, Value: tag})
+
+	appcOS, appcArch := getAppcOSArch(layerData)
+	if appcOS != "" {
+		os, _ := types.NewACName("os")
+		labels = append(labels, types.Label{Name: *os, Value: appcOS})
+		parentLabels = append(parentLabels, types.Label{Name: *os, Value: appcOS})
+
+		if appcArch != "" {
+			arch, _ := types.NewACName("arch")
+			labels = append(labels, types.Label{Name: *arch, Value: appcArch})
+			parentLabels = append(parentLabels, types.Label{Name: *arch, Value: appcArch})
+		}
+	}
+
+	if labels, parentLabels, err = addLabels(labels, parentLabels, opts.Labels); err != nil {
+		return nil, err
+	}
+	genManifest.Labels = labels
+	genManifest.PathWhitelist = opts.PathWhitelist
+
+	annotations := annotationBuilder{logger: opts.Logger}
+	// the user's annotations go first so they win over ours
+	if err := annotations.addUserAnnotations(opts.Annotations); err != nil {
+		return nil, err
+	}
+	if err := annotations.addProvenance(layerData); err != nil {
+		return nil, err
+	}
+	if err := annotations.add(originalNameAnnotation, opts.Image.IndexURL+"/"+opts.Image.ImageName); err != nil {
+		return nil, err
+	}
+	if err := annotations.add(layerIDAnnotation, layerData.ID); err != nil {
+		return nil, err
+	}
+	if err := annotations.addHistory(opts.History); err != nil {
+		return nil, err
+	}
+	if len(opts.RawConfig) > 0 {
+		if err := annotations.add(configAnnotation, string(opts.RawConfig)); err != nil {
+			return nil, err
+		}
+	}
+	if err := annotations.addList(strippedSetuidAnnotation, opts.SetuidFiles); err != nil {
+		return nil, err
+	}
+	if err := annotations.addList(excludeAnnotation, opts.Exclude); err != nil {
+		return nil, err
+	}
+	if err := annotations.addList(includeAnnotation, opts.Include); err != nil {
+		return nil, err
+	}
+	if dockerConfig != nil {
+		if err := annotations.addHealthcheck(dockerConfig.Healthcheck); err != nil {
+			return nil, err
+		}
+		if dockerConfig.StopSignal != "" {
+			if err := annotations.add(stopSignalAnnotation, dockerConfig.StopSignal); err != nil {
+				return nil, err
+			}
+		}
+		if err := annotations.addOnBuild(dockerConfig.OnBuild); err != nil {
+			return nil, err
+		}
+		// labels go last so they can't take the names of the annotations
+		// we generate
+		if err := annotations.addLabels(dockerConfig.Labels); err != nil {
+			return nil, err
+		}
+	}
+	genManifest.Annotations = annotations.annotations
+
+	users := userDatabase{passwd: opts.Passwd, group: opts.Group}
+	app, err := generateApp(dockerConfig, opts.App, &users)
+	if err != nil {
+		return nil, err
+	}
+	genManifest.App = app
+
+	if parent := opts.Parent; parent != nil {
+		var dependencies types.Dependencies
+		parentAppNameString := opts.Name + "-" + parent.LayerID
+		parentAppNameString, err := types.SanitizeACName(parentAppNameString)
+		if err != nil {
+			return nil, err
+		}
+		parentAppName, err := types.NewACName(parentAppNameString)
+		if err != nil {
+			return nil, err
+		}
+
+		// the parent's layer label makes the dependency unambiguous even
+		// when resolved by discovery instead of by name in a local store
+		dependencyLabels := append(types.Labels{{Name: *layer, Value: parent.LayerID}}, parentLabels...)
+		dependency := types.Dependency{App: *parentAppName, Labels: dependencyLabels}
+		// a parent converted with another image has its name
+		if parent.App != nil {
+			dependency = types.Dependency{App: *parent.App, Labels: parent.Labels}
+		}
+		// the image ID additionally pins the exact ACI we generated
+		if parent.ImageID != "" {
+			imageID, err := types.NewHash(parent.ImageID)
+			if err != nil {
+				return nil, err
+			}
+			dependency.ImageID = imageID
+		}
+		dependencies = append(dependencies, dependency)
+
+		genManifest.Dependencies = dependencies
+	}
+
+	return genManifest, nil
+}
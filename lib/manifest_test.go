@@ -0,0 +1,431 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	testPasswd = `root:x:0:0:root:/root:/bin/sh
+daemon:x:2:2:daemon:/sbin:/sbin/nologin
+# comment
+www:x:33:33:www:/var/www:/sbin/nologin
+`
+	testGroup = `root:x:0:
+daemon:x:2:
+adm:x:4:daemon
+www:x:33:
+`
+)
+
+// testImageID is a well-formed image ID.
+var testImageID = "sha512-" + strings.Repeat("0123456789abcdef", 8)
+
+func testManifestOptions() ManifestOptions {
+	return ManifestOptions{
+		Name:  "example.com/app",
+		Image: ParsedDockerURL{IndexURL: "example.com", ImageName: "app", Tag: "1.0"},
+	}
+}
+
+func generateTestManifest(t *testing.T, layerData DockerImageData, opts ManifestOptions) *schema.ImageManifest {
+	t.Helper()
+	manifest, err := GenerateManifest(layerData, opts)
+	if err != nil {
+		t.Fatalf("GenerateManifest: %v", err)
+	}
+	return manifest
+}
+
+func labelMap(labels types.Labels) map[string]string {
+	m := make(map[string]string)
+	for _, l := range labels {
+		m[l.Name.String()] = l.Value
+	}
+	return m
+}
+
+func TestGenerateManifestLabels(t *testing.T) {
+	tests := []struct {
+		desc      string
+		layerData DockerImageData
+		labels    map[string]string
+		want      map[string]string
+	}{
+		{
+			desc:      "no platform",
+			layerData: DockerImageData{ID: "abc"},
+			want:      map[string]string{"layer": "abc", "version": "1.0"},
+		},
+		{
+			desc:      "os only",
+			layerData: DockerImageData{ID: "abc", OS: "linux"},
+			want:      map[string]string{"layer": "abc", "version": "1.0", "os": "linux"},
+		},
+		{
+			desc:      "arch without os",
+			layerData: DockerImageData{ID: "abc", Architecture: "amd64"},
+			want:      map[string]string{"layer": "abc", "version": "1.0"},
+		},
+		{
+			desc:      "amd64",
+			layerData: DockerImageData{ID: "abc", OS: "linux", Architecture: "amd64"},
+			want:      map[string]string{"layer": "abc", "version": "1.0", "os": "linux", "arch": "amd64"},
+		},
+		{
+			desc:      "386",
+			layerData: DockerImageData{ID: "abc", OS: "linux", Architecture: "386"},
+			want:      map[string]string{"layer": "abc", "version": "1.0", "os": "linux", "arch": "i386"},
+		},
+		{
+			desc:      "arm with variant",
+			layerData: DockerImageData{ID: "abc", OS: "linux", Architecture: "arm", Variant: "v6"},
+			want:      map[string]string{"layer": "abc", "version": "1.0", "os": "linux", "arch": "armv6l"},
+		},
+		{
+			desc:      "arm without variant",
+			layerData: DockerImageData{ID: "abc", OS: "linux", Architecture: "arm"},
+			want:      map[string]string{"layer": "abc", "version": "1.0", "os": "linux", "arch": "armv7l"},
+		},
+		{
+			desc:      "arm64 variant",
+			layerData: DockerImageData{ID: "abc", OS: "linux", Architecture: "arm64", Variant: "v8"},
+			want:      map[string]string{"layer": "abc", "version": "1.0", "os": "linux", "arch": "aarch64"},
+		},
+		{
+			desc:      "user labels",
+			layerData: DockerImageData{ID: "abc", OS: "linux", Architecture: "amd64"},
+			labels:    map[string]string{"channel": "stable", "version": "2.0", "arch": "x86_64"},
+			want:      map[string]string{"layer": "abc", "version": "2.0", "os": "linux", "arch": "x86_64", "channel": "stable"},
+		},
+	}
+	for _, tt := range tests {
+		opts := testManifestOptions()
+		opts.Labels = tt.labels
+		manifest := generateTestManifest(t, tt.layerData, opts)
+		if got := labelMap(manifest.Labels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: labels = %v, want %v", tt.desc, got, tt.want)
+		}
+		if manifest.Labels[0].Name != "layer" {
+			t.Errorf("%s: first label = %q, want layer", tt.desc, manifest.Labels[0].Name)
+		}
+	}
+}
+
+func TestGenerateManifestName(t *testing.T) {
+	manifest := generateTestManifest(t, DockerImageData{ID: "abc"}, testManifestOptions())
+	if manifest.Name != "example.com/app-abc" {
+		t.Errorf("name = %q, want example.com/app-abc", manifest.Name)
+	}
+	if manifest.ACKind != "ImageManifest" {
+		t.Errorf("acKind = %q, want ImageManifest", manifest.ACKind)
+	}
+}
+
+func TestGenerateManifestLayerLabel(t *testing.T) {
+	opts := testManifestOptions()
+	opts.Labels = map[string]string{"layer": "other"}
+	if _, err := GenerateManifest(DockerImageData{ID: "abc"}, opts); err == nil {
+		t.Error("GenerateManifest set the layer label")
+	}
+}
+
+func TestGenerateManifestUser(t *testing.T) {
+	tests := []struct {
+		user      string
+		overrides AppOverrides
+		noFiles   bool
+		wantUser  string
+		wantGroup string
+		wantErr   bool
+	}{
+		{user: "", wantUser: "0", wantGroup: "0"},
+		{user: "root", wantUser: "0", wantGroup: "0"},
+		{user: "daemon", wantUser: "2", wantGroup: "2"},
+		{user: "www", wantUser: "33", wantGroup: "33"},
+		{user: "daemon:adm", wantUser: "2", wantGroup: "4"},
+		{user: "daemon:100", wantUser: "2", wantGroup: "100"},
+		{user: "33", wantUser: "33", wantGroup: "33"},
+		{user: "1000", wantUser: "1000", wantGroup: "0"},
+		{user: "1000:1000", wantUser: "1000", wantGroup: "1000"},
+		{user: "1000:", wantUser: "1000", wantGroup: "0"},
+		{user: "1000", noFiles: true, wantUser: "1000", wantGroup: "0"},
+		{user: "nobody", wantErr: true},
+		{user: "daemon:nogroup", wantErr: true},
+		{user: "daemon", noFiles: true, wantErr: true},
+		{user: "daemon", overrides: AppOverrides{User: "www"}, wantUser: "33", wantGroup: "33"},
+		{user: "daemon", overrides: AppOverrides{Group: "adm"}, wantUser: "2", wantGroup: "4"},
+		{user: "daemon:daemon", overrides: AppOverrides{Group: "adm"}, wantUser: "2", wantGroup: "4"},
+		{user: "", overrides: AppOverrides{Group: "adm"}, wantUser: "0", wantGroup: "4"},
+		{user: "www", overrides: AppOverrides{User: "1000", Group: "adm"}, wantUser: "1000", wantGroup: "4"},
+	}
+	for _, tt := range tests {
+		opts := testManifestOptions()
+		if !tt.noFiles {
+			opts.Passwd = []byte(testPasswd)
+			opts.Group = []byte(testGroup)
+		}
+		opts.App = tt.overrides
+		layerData := DockerImageData{
+			ID:     "abc",
+			Config: &DockerImageConfig{User: tt.user, Cmd: []string{"/bin/true"}},
+		}
+
+		manifest, err := GenerateManifest(layerData, opts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("user %q, %+v: resolved to %s:%s, want an error", tt.user, tt.overrides, manifest.App.User, manifest.App.Group)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("user %q, %+v: %v", tt.user, tt.overrides, err)
+			continue
+		}
+		if manifest.App.User != tt.wantUser || manifest.App.Group != tt.wantGroup {
+			t.Errorf("user %q, %+v: resolved to %s:%s, want %s:%s", tt.user, tt.overrides, manifest.App.User, manifest.App.Group, tt.wantUser, tt.wantGroup)
+		}
+	}
+}
+
+func TestGenerateManifestExec(t *testing.T) {
+	tests := []struct {
+		entrypoint []string
+		cmd        []string
+		override   []string
+		want       types.Exec
+	}{
+		{nil, nil, nil, nil},
+		{[]string{""}, []string{""}, nil, nil},
+		{nil, []string{"/bin/ls", "-l"}, nil, types.Exec{"/bin/ls", "-l"}},
+		{[]string{"/bin/ls"}, nil, nil, types.Exec{"/bin/ls"}},
+		{[]string{"/bin/sh", "-c"}, []string{"echo hi"}, nil, types.Exec{"/bin/sh", "-c", "echo hi"}},
+		// ENTRYPOINT [""] resets the entrypoint
+		{[]string{""}, []string{"/bin/ls"}, nil, types.Exec{"/bin/ls"}},
+		// relative commands are run with the shell
+		{[]string{"nginx"}, []string{"-g", "daemon off;"}, nil, types.Exec{"/bin/sh", "-c", "exec nginx -g 'daemon off;'"}},
+		{nil, []string{"echo", "it's", ""}, nil, types.Exec{"/bin/sh", "-c", `exec echo 'it'\''s' ''`}},
+		// the override replaces both, like --entrypoint
+		{[]string{"/bin/sh", "-c"}, []string{"echo hi"}, []string{"/bin/date"}, types.Exec{"/bin/date"}},
+		{nil, nil, []string{"date", "-u"}, types.Exec{"/bin/sh", "-c", "exec date -u"}},
+	}
+	for _, tt := range tests {
+		opts := testManifestOptions()
+		opts.App.Exec = tt.override
+		layerData := DockerImageData{
+			ID:     "abc",
+			Config: &DockerImageConfig{Entrypoint: tt.entrypoint, Cmd: tt.cmd},
+		}
+
+		manifest := generateTestManifest(t, layerData, opts)
+		if tt.want == nil {
+			if manifest.App != nil {
+				t.Errorf("entrypoint %q, cmd %q: app %+v, want none", tt.entrypoint, tt.cmd, manifest.App)
+			}
+			continue
+		}
+		if manifest.App == nil {
+			t.Errorf("entrypoint %q, cmd %q, override %q: no app", tt.entrypoint, tt.cmd, tt.override)
+			continue
+		}
+		if !reflect.DeepEqual(manifest.App.Exec, tt.want) {
+			t.Errorf("entrypoint %q, cmd %q, override %q: exec %q, want %q", tt.entrypoint, tt.cmd, tt.override, manifest.App.Exec, tt.want)
+		}
+	}
+}
+
+func TestGenerateManifestApp(t *testing.T) {
+	layerData := DockerImageData{
+		ID: "abc",
+		Config: &DockerImageConfig{
+			Cmd:          []string{"/bin/httpd"},
+			Env:          []string{"PATH=/usr/bin:/bin", "EMPTY=", "NOVALUE", "=skipped"},
+			WorkingDir:   "srv/../www",
+			ExposedPorts: map[string]struct{}{"80/tcp": {}, "53/UDP": {}, "8080": {}},
+		},
+	}
+	manifest := generateTestManifest(t, layerData, testManifestOptions())
+	app := manifest.App
+
+	wantEnv := types.Environment{
+		{Name: "PATH", Value: "/usr/bin:/bin"},
+		{Name: "EMPTY", Value: ""},
+		{Name: "NOVALUE", Value: ""},
+	}
+	if !reflect.DeepEqual(app.Environment, wantEnv) {
+		t.Errorf("environment = %+v, want %+v", app.Environment, wantEnv)
+	}
+	if app.WorkingDirectory != "/www" {
+		t.Errorf("working directory = %q, want /www", app.WorkingDirectory)
+	}
+
+	var ports []string
+	for _, p := range app.Ports {
+		ports = append(ports, p.Name.String())
+	}
+	if want := []string{"53-udp", "80-tcp", "8080-tcp"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("ports = %q, want %q", ports, want)
+	}
+}
+
+func TestGenerateManifestDependencies(t *testing.T) {
+	parentApp := types.ACName("example.com/base-def")
+	parentLabels := types.Labels{{Name: "layer", Value: "def"}, {Name: "version", Value: "3"}}
+
+	tests := []struct {
+		desc        string
+		parent      *ManifestParent
+		wantApp     types.ACName
+		wantImageID string
+		wantLabels  map[string]string
+	}{
+		{
+			desc:       "by name",
+			parent:     &ManifestParent{LayerID: "def"},
+			wantApp:    "example.com/app-def",
+			wantLabels: map[string]string{"layer": "def", "version": "2.0", "os": "linux", "arch": "amd64"},
+		},
+		{
+			desc:        "pinned",
+			parent:      &ManifestParent{LayerID: "def", ImageID: testImageID},
+			wantApp:     "example.com/app-def",
+			wantImageID: testImageID,
+			wantLabels:  map[string]string{"layer": "def", "version": "2.0", "os": "linux", "arch": "amd64"},
+		},
+		{
+			desc:       "converted with another image",
+			parent:     &ManifestParent{LayerID: "def", App: &parentApp, Labels: parentLabels},
+			wantApp:    parentApp,
+			wantLabels: map[string]string{"layer": "def", "version": "3"},
+		},
+		{
+			desc:        "converted with another image, pinned",
+			parent:      &ManifestParent{LayerID: "def", ImageID: testImageID, App: &parentApp, Labels: parentLabels},
+			wantApp:     parentApp,
+			wantImageID: testImageID,
+			wantLabels:  map[string]string{"layer": "def", "version": "3"},
+		},
+	}
+	for _, tt := range tests {
+		opts := testManifestOptions()
+		// the labels of the user only go to the dependencies if they
+		// replace generated ones
+		opts.Labels = map[string]string{"version": "2.0", "channel": "stable"}
+		opts.Parent = tt.parent
+		manifest := generateTestManifest(t, DockerImageData{ID: "abc", OS: "linux", Architecture: "amd64"}, opts)
+
+		if len(manifest.Dependencies) != 1 {
+			t.Errorf("%s: %d dependencies, want 1", tt.desc, len(manifest.Dependencies))
+			continue
+		}
+		dep := manifest.Dependencies[0]
+		if dep.App != tt.wantApp {
+			t.Errorf("%s: app = %q, want %q", tt.desc, dep.App, tt.wantApp)
+		}
+		if got := labelMap(dep.Labels); !reflect.DeepEqual(got, tt.wantLabels) {
+			t.Errorf("%s: labels = %v, want %v", tt.desc, got, tt.wantLabels)
+		}
+		switch {
+		case tt.wantImageID == "" && dep.ImageID != nil:
+			t.Errorf("%s: image ID = %v, want none", tt.desc, dep.ImageID)
+		case tt.wantImageID != "" && (dep.ImageID == nil || dep.ImageID.String() != tt.wantImageID):
+			t.Errorf("%s: image ID = %v, want %s", tt.desc, dep.ImageID, tt.wantImageID)
+		}
+	}
+
+	manifest := generateTestManifest(t, DockerImageData{ID: "abc"}, testManifestOptions())
+	if len(manifest.Dependencies) != 0 {
+		t.Errorf("dependencies of a base layer = %+v, want none", manifest.Dependencies)
+	}
+}
+
+func TestGenerateManifestAnnotations(t *testing.T) {
+	created := time.Date(2015, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	layerData := DockerImageData{
+		ID:            "abc",
+		Created:       created,
+		Author:        "someone",
+		DockerVersion: "1.7.0",
+		Config: &DockerImageConfig{
+			StopSignal: "SIGQUIT",
+			Labels: map[string]string{
+				"maintainer": "label",
+				"authors":    "label",
+				"Some Label": "value",
+			},
+		},
+	}
+	opts := testManifestOptions()
+	opts.Exclude = []string{"/var/cache/**"}
+	opts.Annotations = map[string]string{
+		"authors":                            "user",
+		"appc.io/docker/stop-signal":         "SIGTERM",
+		"appc.io/docker/original-name":       "user",
+		"maintainer":                         "user",
+		"appc.io/docker/label/authors":       "user",
+		"appc.io/docker/label/something-far": "user",
+	}
+	manifest := generateTestManifest(t, layerData, opts)
+
+	want := map[string]string{
+		// the user's
+		"authors":                            "user",
+		"appc.io/docker/stop-signal":         "SIGTERM",
+		"appc.io/docker/original-name":       "user",
+		"maintainer":                         "user",
+		"appc.io/docker/label/authors":       "user",
+		"appc.io/docker/label/something-far": "user",
+		// generated
+		"created":                       "2015-06-01T10:00:00Z",
+		"appc.io/docker/docker-version": "1.7.0",
+		"appc.io/docker/layer-id":       "abc",
+		"appc.io/docker/exclude":        `["/var/cache/**"]`,
+		"some-label":                    "value",
+	}
+	got := make(map[string]string)
+	for _, a := range manifest.Annotations {
+		if _, ok := got[a.Name.String()]; ok {
+			t.Errorf("annotation %q is there twice", a.Name)
+		}
+		got[a.Name.String()] = a.Value
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("annotations = %v, want %v", got, want)
+	}
+}
+
+func TestGenerateManifestKeepsOptions(t *testing.T) {
+	opts := testManifestOptions()
+	opts.Labels = map[string]string{"version": "2.0"}
+	opts.Annotations = map[string]string{"authors": "user"}
+	opts.Parent = &ManifestParent{LayerID: "def"}
+	layerData := DockerImageData{ID: "abc", OS: "linux", Config: &DockerImageConfig{Cmd: []string{"/bin/true"}}}
+
+	first := generateTestManifest(t, layerData, opts)
+	second := generateTestManifest(t, layerData, opts)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("GenerateManifest returned %+v, then %+v", first, second)
+	}
+	if !reflect.DeepEqual(opts.Labels, map[string]string{"version": "2.0"}) || opts.Parent.App != nil {
+		t.Errorf("GenerateManifest changed its options: %+v", opts)
+	}
+}
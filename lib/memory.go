@@ -0,0 +1,126 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MemorySource is a Source of an image held in memory, so the applications
+// converting images can test their conversions without a registry.
+type MemorySource struct {
+	*configImage
+	// tarballs are the layer tarballs, keyed by layer ID
+	tarballs map[string][]byte
+}
+
+// memoryConfig is the image config of a MemorySource.
+type memoryConfig struct {
+	DockerImageData
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// NewMemorySource returns the source of the image with config and layers,
+// the tarballs of its layers from the base one, which can be compressed.
+// config gets the rootfs of the layers, its ID and parent are ignored. The
+// layers are named after their chain IDs, see MemoryLayer to make them.
+func NewMemorySource(config DockerImageData, layers ...[]byte) (*MemorySource, error) {
+	var diffIDs []string
+	for _, l := range layers {
+		diffIDs = append(diffIDs, fmt.Sprintf("%s%x", storageDigestID, sha256.Sum256(l)))
+	}
+	config.ID, config.Parent = "", ""
+	imageConfig := memoryConfig{DockerImageData: config}
+	imageConfig.RootFS.Type = "layers"
+	imageConfig.RootFS.DiffIDs = diffIDs
+	rawConfig, err := json.Marshal(imageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := newConfigImage(rawConfig, diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	src := &MemorySource{configImage: img, tarballs: make(map[string][]byte)}
+	for i, id := range img.layers {
+		src.tarballs[id] = layers[i]
+	}
+	return src, nil
+}
+
+// GetLayerReader returns the tarball of layerID.
+func (s *MemorySource) GetLayerReader(ctx context.Context, layerID string) (io.ReadCloser, error) {
+	b, ok := s.tarballs[layerID]
+	if !ok {
+		return nil, &ErrNotFound{Layer: layerID}
+	}
+	return &sizedBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(b)), size: int64(len(b))}, nil
+}
+
+// MemoryLayer returns the uncompressed tarball of a layer with files, their
+// contents keyed by their path. The files are 0644 and belong to root, the
+// names ending with a slash are directories and the parent directories are
+// added. Docker's .wh. files delete the files of the lower layers.
+func MemoryLayer(files map[string]string) []byte {
+	contents := make(map[string]string)
+	entries := make(map[string]bool)
+	for name, content := range files {
+		name = strings.TrimPrefix(name, "/")
+		contents[name] = content
+		entries[name] = true
+		for dir := path.Dir(strings.TrimSuffix(name, "/")); dir != "."; dir = path.Dir(dir) {
+			entries[dir+"/"] = true
+		}
+	}
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	// parents sort before their children
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+		} else {
+			hdr.Size = int64(len(contents[name]))
+		}
+		// writing to a buffer doesn't fail
+		tw.WriteHeader(hdr)
+		if hdr.Typeflag == tar.TypeReg {
+			io.WriteString(tw, contents[name])
+		}
+	}
+	tw.Close()
+	return b.Bytes()
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const metadataDir = "metadata"
+
+// metadataCache keeps the registry responses describing images in the cache
+// dir: the image IDs tags resolve to, with their validators so they are only
+// downloaded again once the tag moves, and the ancestries and layer JSON of
+// image IDs, which never change. The repository index isn't cached, the
+// tokens it gives are for one session.
+type metadataCache struct {
+	dir string
+}
+
+// metadataEntry is a cached response.
+type metadataEntry struct {
+	Key          string `json:"key"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// Size is the X-Docker-Size of a layer JSON, -1 if there was none.
+	Size int    `json:"size"`
+	Body []byte `json:"body"`
+}
+
+func openMetadataCache(dir string) (*metadataCache, error) {
+	mc := &metadataCache{dir: filepath.Join(dir, metadataDir)}
+	if err := os.MkdirAll(mc.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := removeStale(mc.dir, partialPrefix, stalePartialAge); err != nil {
+		return nil, err
+	}
+	return mc, nil
+}
+
+func tagKey(indexURL, imageName, tag string) string {
+	return "tag " + indexURL + "/" + imageName + ":" + tag
+}
+
+func ancestryKey(indexURL, imageID string) string {
+	return "ancestry " + indexURL + " " + imageID
+}
+
+func layerJSONKey(indexURL, layerID string) string {
+	return "json " + indexURL + " " + layerID
+}
+
+func (mc *metadataCache) path(key string) string {
+	return filepath.Join(mc.dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// get returns the entry of key, if it's cached.
+func (mc *metadataCache) get(key string) (*metadataEntry, bool) {
+	b, err := ioutil.ReadFile(mc.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var e metadataEntry
+	if err := json.Unmarshal(b, &e); err != nil || e.Key != key {
+		return nil, false
+	}
+	return &e, true
+}
+
+// put caches e, replacing the previous entry of its key at once so the
+// conversions sharing the cache never read half an entry.
+func (mc *metadataCache) put(e metadataEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	p := mc.path(e.Key)
+	f, err := createPartial(p)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return commitPartial(f, p)
+}
+
+// cachedMetadata returns the cached entry of key for repoData, if it has a
+// cache.
+func cachedMetadata(repoData *RepoData, key string) (*metadataEntry, bool) {
+	if repoData.metadata == nil {
+		return nil, false
+	}
+	return repoData.metadata.get(key)
+}
+
+// cacheMetadata caches e for repoData, if it has a cache. The conversion
+// doesn't need the cache, failing to write it is only a warning.
+func cacheMetadata(repoData *RepoData, e metadataEntry) {
+	if repoData.metadata == nil {
+		return
+	}
+	if err := repoData.metadata.put(e); err != nil {
+		logWarn(repoData.logger, fmt.Sprintf("error caching %s: %v", e.Key, err), LogField{"key", e.Key})
+	}
+}
+
+// offlineSource returns the source of the image of parsedURL taken from the
+// cache of config.CacheDir only, and its ancestry. It fails if the cache
+// misses anything the conversion needs, before converting anything.
+func offlineSource(parsedURL *ParsedDockerURL, config Config) (*registrySource, []string, error) {
+	if config.CacheDir == "" {
+		return nil, nil, fmt.Errorf("offline conversions need a cache dir")
+	}
+	mc, err := openMetadataCache(config.CacheDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening cache: %w", err)
+	}
+	layersDir, err := openLayerCache(config.CacheDir, parsedURL.IndexURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening cache: %w", err)
+	}
+
+	var ancestry []string
+	layersJSON := make(map[string][]byte)
+	if config.Resolved != nil {
+		ancestry = config.Resolved.Ancestry
+		for id, j := range config.Resolved.LayersJSON {
+			layersJSON[id] = j
+		}
+	} else {
+		imageID := config.ImageID
+		if imageID == "" {
+			e, ok := mc.get(tagKey(parsedURL.IndexURL, parsedURL.ImageName, parsedURL.Tag))
+			if !ok {
+				return nil, nil, fmt.Errorf("tag %s of %s isn't in the cache", parsedURL.Tag, parsedURL.ImageName)
+			}
+			imageID = string(e.Body)
+		}
+		e, ok := mc.get(ancestryKey(parsedURL.IndexURL, imageID))
+		if !ok {
+			return nil, nil, fmt.Errorf("the ancestry of image %s isn't in the cache", imageID)
+		}
+		if err := json.Unmarshal(e.Body, &ancestry); err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling cached ancestry: %w", err)
+		}
+	}
+	if len(ancestry) == 0 {
+		return nil, nil, fmt.Errorf("the image has no layers")
+	}
+
+	sizes := make(map[string]int)
+	for _, id := range ancestry {
+		if _, ok := layersJSON[id]; !ok {
+			e, ok := mc.get(layerJSONKey(parsedURL.IndexURL, id))
+			if !ok {
+				return nil, nil, fmt.Errorf("the JSON of layer %s isn't in the cache", id)
+			}
+			layersJSON[id] = e.Body
+			sizes[id] = e.Size
+		}
+		if _, err := os.Stat(filepath.Join(layersDir, id)); err != nil {
+			return nil, nil, fmt.Errorf("layer %s isn't in the cache", id)
+		}
+	}
+
+	src := &registrySource{
+		repoData:     &RepoData{},
+		layersJSON:   layersJSON,
+		sizes:        sizes,
+		showProgress: config.ShowProgress,
+		logger:       config.Logger,
+		offline:      true,
+	}
+	return src, ancestry, nil
+}
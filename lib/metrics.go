@@ -0,0 +1,154 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsDurationBuckets are the upper bounds, in seconds, of the buckets of
+// the conversion durations.
+var metricsDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// metricsFailureClasses are the classes of the failed conversions, reported
+// even before one fails so alerts can rely on them.
+var metricsFailureClasses = []string{"auth", "not_found", "invalid", "network", "store", "untrusted", "deadline", "canceled", "other"}
+
+// Metrics counts the conversions of a long-running process, like a Server,
+// and serves them in the Prometheus text format.
+type Metrics struct {
+	mu          sync.Mutex
+	conversions int64
+	failures    map[string]int64
+	downloaded  int64
+	// buckets are the numbers of conversions which took at most the
+	// durations of metricsDurationBuckets, not cumulative
+	buckets  []int64
+	duration float64
+}
+
+// NewMetrics returns Metrics with no conversion recorded.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		failures: make(map[string]int64),
+		buckets:  make([]int64, len(metricsDurationBuckets)),
+	}
+}
+
+// Observe records a conversion which took d and failed with err, if it's
+// not nil. stats are the ones the conversion filled in, if any, for the
+// bytes it downloaded.
+func (m *Metrics) Observe(d time.Duration, stats *Stats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conversions++
+	if err != nil {
+		m.failures[errorClass(err)]++
+	}
+	if stats != nil {
+		for _, l := range stats.Layers {
+			if !l.Reused && !l.Cached {
+				m.downloaded += l.DownloadSize
+			}
+		}
+	}
+	seconds := d.Seconds()
+	m.duration += seconds
+	for i, le := range metricsDurationBuckets {
+		if seconds <= le {
+			m.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP docker2aci_conversions_total Conversions of images, failed or not.")
+	fmt.Fprintln(w, "# TYPE docker2aci_conversions_total counter")
+	fmt.Fprintf(w, "docker2aci_conversions_total %d\n", m.conversions)
+
+	fmt.Fprintln(w, "# HELP docker2aci_conversion_failures_total Failed conversions of images, by class of error.")
+	fmt.Fprintln(w, "# TYPE docker2aci_conversion_failures_total counter")
+	for _, class := range metricsFailureClasses {
+		fmt.Fprintf(w, "docker2aci_conversion_failures_total{class=%q} %d\n", class, m.failures[class])
+	}
+
+	fmt.Fprintln(w, "# HELP docker2aci_downloaded_bytes_total Bytes of layers downloaded from the registries.")
+	fmt.Fprintln(w, "# TYPE docker2aci_downloaded_bytes_total counter")
+	fmt.Fprintf(w, "docker2aci_downloaded_bytes_total %d\n", m.downloaded)
+
+	fmt.Fprintln(w, "# HELP docker2aci_conversion_duration_seconds Time the conversions of images took.")
+	fmt.Fprintln(w, "# TYPE docker2aci_conversion_duration_seconds histogram")
+	var count int64
+	for i, le := range metricsDurationBuckets {
+		count += m.buckets[i]
+		fmt.Fprintf(w, "docker2aci_conversion_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(w, "docker2aci_conversion_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.conversions)
+	fmt.Fprintf(w, "docker2aci_conversion_duration_seconds_sum %g\n", m.duration)
+	fmt.Fprintf(w, "docker2aci_conversion_duration_seconds_count %d\n", m.conversions)
+}
+
+// errorClass returns the class of metricsFailureClasses of err.
+func errorClass(err error) string {
+	var derr *DeadlineError
+	var aerr *ErrAuth
+	var nferr *ErrNotFound
+	var mierr *ErrManifestInvalid
+	var sterr *ErrStore
+	var uerr *ErrUntrusted
+	var herr *HTTPError
+	var nerr net.Error
+	var perr *os.PathError
+	var lerr *os.LinkError
+	switch {
+	case errors.As(err, &derr):
+		return "deadline"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &aerr):
+		return "auth"
+	case errors.As(err, &nferr):
+		return "not_found"
+	case errors.As(err, &mierr):
+		return "invalid"
+	case errors.As(err, &sterr):
+		return "store"
+	case errors.As(err, &uerr):
+		return "untrusted"
+	case errors.As(err, &herr), errors.As(err, &nerr):
+		return "network"
+	case errors.As(err, &perr), errors.As(err, &lerr):
+		return "store"
+	}
+	return "other"
+}
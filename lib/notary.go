@@ -0,0 +1,548 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultNotaryServer is the Notary server of Docker Hub, which has
+	// the trust data of the images signed with Docker Content Trust.
+	DefaultNotaryServer = "https://notary.docker.io"
+
+	// hubRegistry is the host of the registry API v2 of Docker Hub, and
+	// hubGUN the prefix of the names of its repositories in Notary.
+	hubRegistry = "registry-1.docker.io"
+	hubGUN      = "docker.io"
+	// releasesRole is the delegation docker signs the tags it pushes
+	// with.
+	releasesRole = "targets/releases"
+
+	mediaTypeSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	mediaTypeSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeSchema2       = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// trustedImage is the image the tag of an image was signed for.
+type trustedImage struct {
+	// Digest is the digest of its manifest.
+	Digest string
+	// ImageID is the ID of the Docker image its manifest describes.
+	ImageID string
+	// Layers are the layers of the image its manifest describes, top
+	// layer first like an ancestry.
+	Layers []trustedLayer
+}
+
+// trustedLayer is a layer of a signed schema 1 manifest.
+type trustedLayer struct {
+	// ID is the ID of its image and JSON its v1Compatibility, the JSON
+	// of the image.
+	ID   string
+	JSON []byte
+	// BlobSum is the digest of its tarball.
+	BlobSum string
+}
+
+// checkAncestry fails if ancestry isn't the one of the layers signed.
+func (ti *trustedImage) checkAncestry(ancestry []string) error {
+	if len(ancestry) != len(ti.Layers) {
+		return fmt.Errorf("the image has %d layers, %d were signed", len(ancestry), len(ti.Layers))
+	}
+	for i, id := range ancestry {
+		if id != ti.Layers[i].ID {
+			return fmt.Errorf("layer %d of the image is %s, %s was signed", i, id, ti.Layers[i].ID)
+		}
+	}
+	return nil
+}
+
+// verifyTrust verifies the tag of dockerURL against the trust data of its
+// repository on its Notary server, as Docker Content Trust does, and
+// returns the image it was signed for. The manifest of the image is fetched
+// from the registry API v2 and must be the one signed. Only schema 1
+// manifests name the IDs of the images of the registry API v1 the layers
+// are downloaded with, and their digests.
+func verifyTrust(ctx context.Context, dockerURL *ParsedDockerURL, config Config) (*trustedImage, error) {
+	gun, registry := dockerURL.IndexURL+"/"+dockerURL.ImageName, dockerURL.IndexURL
+	if dockerURL.IndexURL == defaultIndex {
+		gun, registry = hubGUN+"/"+dockerURL.ImageName, hubRegistry
+	}
+	server := strings.TrimSuffix(config.NotaryServer, "/")
+	if server == "" {
+		server = "https://" + dockerURL.IndexURL
+		if dockerURL.IndexURL == defaultIndex {
+			server = DefaultNotaryServer
+		}
+	} else if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	client := httpClient(config)
+	creds, hasCreds := credentialsFor(config.Credentials, dockerURL.IndexURL)
+
+	untrusted := func(err error) error {
+		return &ErrUntrusted{Tag: dockerURL.Tag, Err: err}
+	}
+	notary := &tokenClient{client: client, creds: creds, hasCreds: hasCreds}
+	target, err := trustedTarget(ctx, notary, server, gun, dockerURL.Tag, config.TrustDir)
+	var nferr *ErrNotFound
+	switch {
+	case errors.As(err, &nferr):
+		return nil, untrusted(fmt.Errorf("no trust data on %s", server))
+	case fetchFailed(err):
+		return nil, fmt.Errorf("error fetching trust data: %w", err)
+	case err != nil:
+		return nil, untrusted(err)
+	}
+
+	sum, ok := target.Hashes["sha256"]
+	if !ok {
+		return nil, untrusted(fmt.Errorf("the target of the tag has no sha256 hash"))
+	}
+	digest := "sha256:" + hex.EncodeToString(sum)
+	u := "https://" + registry + "/v2/" + dockerURL.ImageName + "/manifests/" + digest
+	reg := &tokenClient{client: client, creds: creds, hasCreds: hasCreds}
+	b, _, err := reg.fetch(ctx, u, mediaTypeSchema1Signed, mediaTypeSchema1, mediaTypeSchema2, mediaTypeOCIManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest %s: %w", digest, err)
+	}
+
+	layers, err := schema1Layers(b, target)
+	if err != nil {
+		return nil, err
+	}
+	if layers == nil {
+		return nil, untrusted(fmt.Errorf("the registry served another manifest than %s", digest))
+	}
+	return &trustedImage{Digest: digest, ImageID: layers[0].ID, Layers: layers}, nil
+}
+
+// fetchFailed reports whether err is an error of a request or of the files
+// of the trust dir rather than one of the trust data.
+func fetchFailed(err error) bool {
+	var aerr *ErrAuth
+	var herr *HTTPError
+	var nerr net.Error
+	var perr *os.PathError
+	return errors.As(err, &aerr) || errors.As(err, &herr) || errors.As(err, &nerr) || errors.As(err, &perr)
+}
+
+// trustedTarget returns the target the tag of gun is signed for in the trust
+// data on server, checking their chain of signatures from the root. The
+// root is pinned in trustDir if it isn't empty.
+func trustedTarget(ctx context.Context, tc *tokenClient, server string, gun string, tag string, trustDir string) (*tufFileMeta, error) {
+	base := server + "/v2/" + gun + "/_trust/tuf/"
+	get := func(role string, meta *tufFileMeta) (*tufSigned, []byte, error) {
+		b, _, err := tc.fetch(ctx, base+role+".json", "application/json")
+		if err != nil {
+			return nil, nil, err
+		}
+		if meta != nil {
+			if err := meta.check(b); err != nil {
+				return nil, nil, fmt.Errorf("%s doesn't match the snapshot: %w", role, err)
+			}
+		}
+		var s tufSigned
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling %s: %w", role, err)
+		}
+		return &s, b, nil
+	}
+
+	rootSigned, rootBytes, err := get("root", nil)
+	if err != nil {
+		return nil, err
+	}
+	// the root is signed with its own keys
+	var root tufRoot
+	if err := json.Unmarshal(rootSigned.Signed, &root); err != nil {
+		return nil, fmt.Errorf("error unmarshaling root: %w", err)
+	}
+	if err := rootSigned.verify(root.Roles["root"], root.Keys, "Root", &root); err != nil {
+		return nil, err
+	}
+	if trustDir != "" {
+		if err := pinRoot(trustDir, gun, rootSigned, rootBytes, root); err != nil {
+			return nil, err
+		}
+	}
+
+	timestampSigned, _, err := get("timestamp", nil)
+	if err != nil {
+		return nil, err
+	}
+	var timestamp tufMeta
+	if err := timestampSigned.verify(root.Roles["timestamp"], root.Keys, "Timestamp", &timestamp); err != nil {
+		return nil, err
+	}
+	snapshotMeta, ok := timestamp.Meta["snapshot"]
+	if !ok {
+		return nil, fmt.Errorf("the timestamp has no snapshot")
+	}
+
+	snapshotSigned, _, err := get("snapshot", &snapshotMeta)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot tufMeta
+	if err := snapshotSigned.verify(root.Roles["snapshot"], root.Keys, "Snapshot", &snapshot); err != nil {
+		return nil, err
+	}
+	targetsMeta, ok := snapshot.Meta["targets"]
+	if !ok {
+		return nil, fmt.Errorf("the snapshot has no targets")
+	}
+
+	targetsSigned, _, err := get("targets", &targetsMeta)
+	if err != nil {
+		return nil, err
+	}
+	var targets tufTargets
+	if err := targetsSigned.verify(root.Roles["targets"], root.Keys, "Targets", &targets); err != nil {
+		return nil, err
+	}
+
+	// docker looks for the tag in the releases delegation first
+	for _, d := range targets.Delegations.Roles {
+		if d.Name != releasesRole || !delegatedPath(d.Paths, tag) {
+			continue
+		}
+		releasesMeta, ok := snapshot.Meta[releasesRole]
+		if !ok {
+			return nil, fmt.Errorf("the snapshot has no %s", releasesRole)
+		}
+		releasesSigned, _, err := get(releasesRole, &releasesMeta)
+		if err != nil {
+			return nil, err
+		}
+		var releases tufTargets
+		if err := releasesSigned.verify(d.tufRole, targets.Delegations.Keys, "Targets", &releases); err != nil {
+			return nil, fmt.Errorf("%s: %w", releasesRole, err)
+		}
+		if target, ok := releases.Targets[tag]; ok {
+			return &target, nil
+		}
+	}
+	if target, ok := targets.Targets[tag]; ok {
+		return &target, nil
+	}
+	return nil, fmt.Errorf("the tag isn't signed")
+}
+
+// delegatedPath reports whether a delegation with paths signs the target
+// name.
+func delegatedPath(paths []string, name string) bool {
+	for _, p := range paths {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinRoot checks the root of gun, its signed file and b its contents,
+// against the one kept in trustDir, trusting the first one found: a new root
+// must be signed by the root keys of the one kept, which it then replaces.
+func pinRoot(trustDir string, gun string, signed *tufSigned, b []byte, root tufRoot) error {
+	if path.Clean("/"+gun) != "/"+gun {
+		return fmt.Errorf("invalid repository name %q", gun)
+	}
+	p := filepath.Join(trustDir, filepath.FromSlash(gun), "root.json")
+	pinnedBytes, err := ioutil.ReadFile(p)
+	if err == nil {
+		if bytes.Equal(pinnedBytes, b) {
+			return nil
+		}
+		var pinnedSigned tufSigned
+		var pinned tufRoot
+		if err := json.Unmarshal(pinnedBytes, &pinnedSigned); err != nil {
+			return fmt.Errorf("error unmarshaling %s: %w", p, err)
+		}
+		if err := json.Unmarshal(pinnedSigned.Signed, &pinned); err != nil {
+			return fmt.Errorf("error unmarshaling %s: %w", p, err)
+		}
+		if root.Version < pinned.Version {
+			return fmt.Errorf("root version %d is older than the pinned version %d", root.Version, pinned.Version)
+		}
+		if err := signed.verify(pinned.Roles["root"], pinned.Keys, "Root", &tufRoot{}); err != nil {
+			return fmt.Errorf("root isn't signed by the pinned root keys: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, b, 0644)
+}
+
+// schema1Layers returns the layers of the Docker image described by the
+// manifest b, top layer first, if it's the file of target, or nil if it
+// isn't. The digest of a signed schema 1 manifest is the one of its payload,
+// without the signatures.
+func schema1Layers(b []byte, target *tufFileMeta) ([]trustedLayer, error) {
+	var manifest struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		MediaType     string `json:"mediaType"`
+		FSLayers      []struct {
+			BlobSum string `json:"blobSum"`
+		} `json:"fsLayers"`
+		History []struct {
+			V1Compatibility string `json:"v1Compatibility"`
+		} `json:"history"`
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, &ErrManifestInvalid{Err: fmt.Errorf("error unmarshaling manifest: %w", err)}
+	}
+	if manifest.SchemaVersion != 1 {
+		if target.check(b) != nil {
+			return nil, nil
+		}
+		mediaType := manifest.MediaType
+		if mediaType == "" {
+			mediaType = fmt.Sprintf("schema %d manifest", manifest.SchemaVersion)
+		}
+		return nil, &ErrManifestInvalid{Err: fmt.Errorf("the signed manifest is a %s, only schema 1 manifests name the image IDs of the registry", mediaType)}
+	}
+
+	payload := b
+	if len(manifest.Signatures) > 0 {
+		var err error
+		if payload, err = jwsPayload(b, manifest.Signatures[0].Protected); err != nil {
+			return nil, &ErrManifestInvalid{Err: err}
+		}
+	}
+	if target.check(payload) != nil {
+		return nil, nil
+	}
+
+	if len(manifest.History) == 0 {
+		return nil, &ErrManifestInvalid{Err: fmt.Errorf("the signed manifest has no history")}
+	}
+	// the history and the fsLayers are in the same order
+	if len(manifest.FSLayers) != len(manifest.History) {
+		return nil, &ErrManifestInvalid{Err: fmt.Errorf("the signed manifest has %d fsLayers and %d history entries", len(manifest.FSLayers), len(manifest.History))}
+	}
+	layers := make([]trustedLayer, len(manifest.History))
+	for i, h := range manifest.History {
+		var v1 struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(h.V1Compatibility), &v1); err != nil {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("error unmarshaling v1Compatibility: %w", err)}
+		}
+		if _, err := hex.DecodeString(v1.ID); err != nil || len(v1.ID) != 64 {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("invalid image ID %q", v1.ID)}
+		}
+		blobSum := manifest.FSLayers[i].BlobSum
+		if sum := strings.TrimPrefix(blobSum, storageDigestID); sum == blobSum || len(sum) != 64 {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("invalid blobSum %q", blobSum)}
+		}
+		layers[i] = trustedLayer{ID: v1.ID, JSON: []byte(h.V1Compatibility), BlobSum: blobSum}
+	}
+	return layers, nil
+}
+
+// jwsPayload returns the payload of the signed schema 1 manifest b, whose
+// protected header tells how long it is and how it ends.
+func jwsPayload(b []byte, protected string) ([]byte, error) {
+	h, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid protected header: %w", err)
+	}
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(h, &header); err != nil {
+		return nil, fmt.Errorf("invalid protected header: %w", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid format tail: %w", err)
+	}
+	if header.FormatLength < 0 || header.FormatLength > len(b) {
+		return nil, fmt.Errorf("invalid format length %d", header.FormatLength)
+	}
+	return append(b[:header.FormatLength:header.FormatLength], tail...), nil
+}
+
+// tokenClient makes the requests of the registry API v2 and of Notary,
+// answering their challenges with a bearer token fetched with the
+// credentials of the registry. The token is kept for the requests to the
+// same server and repository.
+type tokenClient struct {
+	client   *http.Client
+	creds    Credentials
+	hasCreds bool
+	token    string
+}
+
+// fetch GETs u accepting the media types accept and returns its body and
+// content type.
+func (tc *tokenClient) fetch(ctx context.Context, u string, accept ...string) ([]byte, string, error) {
+	res, err := tc.get(ctx, u, accept)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode == http.StatusUnauthorized && tc.token == "" {
+		challenge := res.Header.Get("Www-Authenticate")
+		res.Body.Close()
+		if tc.token, err = tc.getToken(ctx, challenge); err != nil {
+			return nil, "", err
+		}
+		if res, err = tc.get(ctx, u, accept); err != nil {
+			return nil, "", err
+		}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, "", statusError(res, res.Request.URL.Host, "", "")
+	}
+	b, err := ioutil.ReadAll(newBoundedReader(res.Body, maxJSONSize))
+	if err != nil {
+		return nil, "", err
+	}
+	return b, res.Header.Get("Content-Type"), nil
+}
+
+func (tc *tokenClient) get(ctx context.Context, u string, accept []string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	if tc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+	}
+	return tc.client.Do(req.WithContext(ctx))
+}
+
+// getToken fetches the token of the bearer challenge of a WWW-Authenticate
+// header.
+func (tc *tokenClient) getToken(ctx context.Context, challenge string) (string, error) {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid realm %q: %w", params["realm"], err)
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v := params[k]; v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if tc.hasCreds {
+		req.SetBasicAuth(tc.creds.Username, tc.creds.Password)
+	}
+	res, err := tc.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return "", statusError(res, u.Host, "", "")
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(newBoundedReader(res.Body, maxJSONSize)).Decode(&token); err != nil {
+		return "", fmt.Errorf("error unmarshaling token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("no token from %s", u.Host)
+	}
+	return token.Token, nil
+}
+
+// parseBearerChallenge returns the parameters of the bearer challenge h, like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseBearerChallenge(h string) (map[string]string, bool) {
+	const scheme = "bearer "
+	if len(h) < len(scheme) || !strings.EqualFold(h[:len(scheme)], scheme) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	s := strings.TrimSpace(h[len(scheme):])
+	for s != "" {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimSpace(s[i+1:])
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				value.WriteByte(s[j])
+			}
+			if j < len(s) {
+				j++
+			}
+			s = s[j:]
+		} else {
+			j := strings.Index(s, ",")
+			if j < 0 {
+				j = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:j]))
+			s = s[j:]
+		}
+		params[key] = value.String()
+		s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), ","))
+	}
+	return params, true
+}
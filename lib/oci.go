@@ -0,0 +1,238 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	ociIndex  = "index.json"
+	ociLayout = "oci-layout"
+
+	mediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifests = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	annotationRefName       = "org.opencontainers.image.ref.name"
+	annotationContainerdRef = "io.containerd.image.name"
+)
+
+// ociDescriptor is a descriptor of an OCI index.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociIndexFile struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// OCILayoutSource takes an image from an OCI image layout directory.
+type OCILayoutSource struct {
+	*configImage
+	dir  string
+	name string
+	// blobs are the digests of the blobs of the layers
+	blobs map[string]string
+}
+
+// NewOCILayoutSource opens the image ref of the OCI image layout in dir. ref
+// is the org.opencontainers.image.ref.name annotation of the image in the
+// index, usually its tag, or its full name as containerd annotates it. It
+// can be empty if the index has a single image. Multi-platform images are
+// taken for Linux on the current architecture.
+func NewOCILayoutSource(dir string, ref string) (*OCILayoutSource, error) {
+	if _, err := os.Stat(filepath.Join(dir, ociLayout)); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", dir, err)
+	}
+	src := &OCILayoutSource{dir: dir, blobs: make(map[string]string)}
+
+	var index ociIndexFile
+	if err := readStorageJSON(filepath.Join(dir, ociIndex), &index); err != nil {
+		return nil, err
+	}
+	desc, err := findOCIManifest(index.Manifests, ref)
+	if err != nil {
+		return nil, err
+	}
+	src.name = ociImageName(dir, *desc)
+
+	for desc.MediaType == mediaTypeOCIIndex || desc.MediaType == mediaTypeDockerManifests {
+		var nested ociIndexFile
+		if err := src.readBlobJSON(desc.Digest, &nested); err != nil {
+			return nil, err
+		}
+		if desc, err = findOCIPlatform(nested.Manifests); err != nil {
+			return nil, err
+		}
+	}
+
+	var manifest imageManifest
+	if err := src.readBlobJSON(desc.Digest, &manifest); err != nil {
+		return nil, fmt.Errorf("error reading image manifest: %w", err)
+	}
+	hasConfig, err := checkMediaTypes(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var rawConfig []byte
+	if hasConfig {
+		if rawConfig, err = src.readBlob(manifest.Config.Digest); err != nil {
+			return nil, fmt.Errorf("error reading image config: %w", err)
+		}
+	}
+
+	var digests []string
+	for _, l := range manifest.Layers {
+		digests = append(digests, l.Digest)
+	}
+	if src.configImage, err = newConfigImage(rawConfig, digests); err != nil {
+		return nil, err
+	}
+	for i, id := range src.layers {
+		src.blobs[id] = digests[i]
+	}
+	return src, nil
+}
+
+// findOCIManifest returns the descriptor of the image ref in manifests, or
+// the only one if ref is empty.
+func findOCIManifest(manifests []ociDescriptor, ref string) (*ociDescriptor, error) {
+	if ref == "" {
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("the index has %d images, one must be chosen", len(manifests))
+		}
+		return &manifests[0], nil
+	}
+
+	wanted, err := parseDockerURL(ref)
+	for i, m := range manifests {
+		if m.Annotations[annotationRefName] == ref {
+			return &manifests[i], nil
+		}
+		if name, ok := m.Annotations[annotationContainerdRef]; ok && err == nil {
+			if candidate, cerr := parseDockerURL(name); cerr == nil && normalizeStorageName(candidate) == normalizeStorageName(wanted) {
+				return &manifests[i], nil
+			}
+		}
+	}
+
+	return nil, &ErrNotFound{Image: ref}
+}
+
+// findOCIPlatform returns the descriptor of the Linux image for the current
+// architecture in manifests.
+func findOCIPlatform(manifests []ociDescriptor) (*ociDescriptor, error) {
+	for i, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return &manifests[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no image for linux/%s", runtime.GOARCH)
+}
+
+// ociImageName returns the name of the image of desc in the layout dir: the
+// one containerd annotated it with, or the name of dir with the tag of the
+// image. Names which aren't valid image names are replaced by the short
+// digest of the image.
+func ociImageName(dir string, desc ociDescriptor) string {
+	name := desc.Annotations[annotationContainerdRef]
+	if name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			abs = dir
+		}
+		name = filepath.Base(abs)
+		if tag := desc.Annotations[annotationRefName]; tag != "" && !strings.ContainsAny(tag, "/:@") {
+			name += ":" + tag
+		}
+	}
+	if _, err := parseDockerURL(name); err != nil {
+		name = strings.TrimPrefix(desc.Digest, storageDigestID)
+		if len(name) > 12 {
+			name = name[:12]
+		}
+	}
+	return name
+}
+
+// blobPath returns the path of the blob of digest in the layout.
+func (s *OCILayoutSource) blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[1], "/\\.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(s.dir, "blobs", parts[0], parts[1]), nil
+}
+
+func (s *OCILayoutSource) readBlob(digest string) ([]byte, error) {
+	p, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+func (s *OCILayoutSource) readBlobJSON(digest string, v interface{}) error {
+	p, err := s.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	return readStorageJSON(p, v)
+}
+
+// Name returns the name of the image, to pass to ConvertSource.
+func (s *OCILayoutSource) Name() string {
+	return s.name
+}
+
+// GetLayerReader returns the tarball of layerID, read from its blob.
+func (s *OCILayoutSource) GetLayerReader(ctx context.Context, layerID string) (io.ReadCloser, error) {
+	digest, ok := s.blobs[layerID]
+	if !ok {
+		return nil, &ErrNotFound{Layer: layerID}
+	}
+	p, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sizedBody{ReadCloser: f, size: fi.Size()}, nil
+}
+
+// Close does nothing, the blobs are opened when they are read.
+func (s *OCILayoutSource) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// partialPrefix is the prefix of the files being written, like ACIs,
+	// which get their name once complete so a file with its name is never
+	// partial.
+	partialPrefix = ".docker2aci-"
+	// stalePartialAge is the age after which a partial file is taken for
+	// one left by a conversion that died. Files are written without
+	// pausing, the downloads which can stall are in the caches.
+	stalePartialAge = time.Hour
+)
+
+// createPartial creates the file written in place of the one at p until
+// it's committed.
+func createPartial(p string) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(p), partialPrefix)
+	if err != nil {
+		return nil, &ErrStore{Path: p, Err: err}
+	}
+	// TempFile creates files only their owner can read
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, &ErrStore{Path: p, Err: err}
+	}
+	return f, nil
+}
+
+// commitPartial closes f, created by createPartial, and renames it to p,
+// replacing it at once.
+func commitPartial(f *os.File, p string) error {
+	if err := f.Close(); err != nil {
+		return &ErrStore{Path: p, Err: err}
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return &ErrStore{Path: p, Err: err}
+	}
+	return nil
+}
+
+// removeStale removes the files of dir starting with prefix older than age,
+// the ones left by the conversions which died before completing them.
+// Younger ones can belong to another conversion.
+func removeStale(dir string, prefix string, age time.Duration) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), prefix) && time.Since(fi.ModTime()) > age {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+	return nil
+}
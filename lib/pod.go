@@ -0,0 +1,303 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// PodApp is an app of a pod manifest: the ACI of an image and what it's run
+// with, like the options of docker run or a service of a compose file.
+type PodApp struct {
+	// Name is the name of the app in the pod.
+	Name string
+	// ACI is the path of the converted ACI of the app.
+	ACI string
+	// Entrypoint and Cmd, if not nil, replace the ones of the image the
+	// way Docker does: replacing the entrypoint drops the image's cmd.
+	Entrypoint []string
+	Cmd        []string
+	// Env are KEY=VALUE variables set on top of the image's.
+	Env []string
+	// User, Group and WorkingDirectory replace the image's if not empty.
+	User             string
+	Group            string
+	WorkingDirectory string
+	// Memory and CPU are the limits of the app, e.g. 512M and 500m.
+	Memory string
+	CPU    string
+	Ports  []PodPort
+	Mounts []PodMount
+}
+
+// PodPort is a port of an app exposed on the host.
+type PodPort struct {
+	// Port and Protocol are the ones of the app, the protocol being tcp
+	// if empty.
+	Port     uint
+	Protocol string
+	HostPort uint
+}
+
+// PodMount is a volume mounted in an app.
+type PodMount struct {
+	// Source is the absolute path of a host directory, or the name of a
+	// volume the apps naming it share. Empty is a volume of the app's own.
+	Source string
+	// Target is where the volume is mounted in the app.
+	Target   string
+	ReadOnly bool
+}
+
+// GeneratePodManifest returns the pod manifest running apps. Their ACIs are
+// referred to by name and image ID.
+func GeneratePodManifest(apps []PodApp) (*schema.PodManifest, error) {
+	pod := &schema.PodManifest{ACKind: types.ACKind("PodManifest")}
+	acVersion, _ := types.NewSemVer(schemaVersion)
+	pod.ACVersion = *acVersion
+
+	volumes := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, app := range apps {
+		name, err := types.SanitizeACName(app.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid app name %q: %w", app.Name, err)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate app name %q", name)
+		}
+		names[name] = true
+
+		ra, err := runtimeApp(name, app)
+		if err != nil {
+			return nil, fmt.Errorf("error generating app %s: %w", name, err)
+		}
+
+		for _, m := range app.Mounts {
+			volume, err := podVolume(name, m)
+			if err != nil {
+				return nil, fmt.Errorf("error generating app %s: %w", name, err)
+			}
+			// the apps naming a volume share it
+			if !volumes[volume.Name.String()] {
+				volumes[volume.Name.String()] = true
+				pod.Volumes = append(pod.Volumes, *volume)
+			} else if volume.Kind == "host" {
+				return nil, fmt.Errorf("error generating app %s: volume %s mounted twice", name, volume.Name)
+			}
+			ra.App.MountPoints = replaceMountPoint(ra.App.MountPoints, types.MountPoint{
+				Name:     volume.Name,
+				Path:     path.Clean(m.Target),
+				ReadOnly: m.ReadOnly,
+			})
+			ra.Mounts = append(ra.Mounts, schema.Mount{Volume: volume.Name, MountPoint: volume.Name})
+		}
+
+		for _, p := range app.Ports {
+			portName, err := exposePort(ra.App, name, p)
+			if err != nil {
+				return nil, fmt.Errorf("error generating app %s: %w", name, err)
+			}
+			if p.HostPort != 0 {
+				pod.Ports = append(pod.Ports, types.ExposedPort{Name: *portName, HostPort: p.HostPort})
+			}
+		}
+
+		pod.Apps = append(pod.Apps, *ra)
+	}
+
+	return pod, nil
+}
+
+// runtimeApp returns the app name of the pod running app, without its
+// mounts and exposed ports.
+func runtimeApp(name string, app PodApp) (*schema.RuntimeApp, error) {
+	manifest, err := readManifest(app.ACI)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest from %s: %w", app.ACI, err)
+	}
+	id, err := ACIImageID(app.ACI)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing %s: %w", app.ACI, err)
+	}
+	hash, err := types.NewHash(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// the app of the pod replaces the one of the image
+	a := &types.App{}
+	if manifest.App != nil {
+		*a = *manifest.App
+		a.Environment = append(types.Environment(nil), manifest.App.Environment...)
+		a.Isolators = append([]types.Isolator(nil), manifest.App.Isolators...)
+		a.Ports = append([]types.Port(nil), manifest.App.Ports...)
+		a.MountPoints = append([]types.MountPoint(nil), manifest.App.MountPoints...)
+	}
+	if app.Entrypoint != nil || app.Cmd != nil {
+		a.Exec = podExec(manifest, app)
+	}
+	for _, v := range getEnvironment(app.Env) {
+		a.Environment.Set(v.Name, v.Value)
+	}
+	if app.User != "" {
+		a.User = app.User
+	}
+	if app.Group != "" {
+		a.Group = app.Group
+	}
+	if app.WorkingDirectory != "" {
+		a.WorkingDirectory = getWorkingDirectory(app.WorkingDirectory)
+	}
+	isolators, err := getResourceIsolators(&DockerImageConfig{}, AppOverrides{Memory: app.Memory, CPU: app.CPU})
+	if err != nil {
+		return nil, err
+	}
+	for _, isolator := range isolators {
+		a.Isolators = replaceIsolator(a.Isolators, isolator)
+	}
+
+	acName, err := types.NewACName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &schema.RuntimeApp{
+		Name: *acName,
+		Image: schema.RuntimeImage{
+			Name:   &manifest.Name,
+			ID:     *hash,
+			Labels: manifest.Labels,
+		},
+		App: a,
+	}, nil
+}
+
+// podExec returns the command of app. The entrypoint and cmd of the image
+// are the ones of the Docker config kept in the manifest, without it the
+// command of the image stands for its entrypoint.
+func podExec(manifest *schema.ImageManifest, app PodApp) types.Exec {
+	var entrypoint, cmd []string
+	if raw, ok := manifest.Annotations.Get(configAnnotation); ok {
+		var data DockerImageData
+		if err := json.Unmarshal([]byte(raw), &data); err == nil && data.Config != nil {
+			entrypoint, cmd = data.Config.Entrypoint, data.Config.Cmd
+		}
+	} else if manifest.App != nil {
+		entrypoint = manifest.App.Exec
+	}
+	if app.Entrypoint != nil {
+		entrypoint, cmd = app.Entrypoint, nil
+	}
+	if app.Cmd != nil {
+		cmd = app.Cmd
+	}
+	return getExecCommand(entrypoint, cmd)
+}
+
+// replaceIsolator returns isolators with the one named like isolator
+// replaced by it, or with it added.
+func replaceIsolator(isolators []types.Isolator, isolator types.Isolator) []types.Isolator {
+	for i, iso := range isolators {
+		if iso.Name == isolator.Name {
+			isolators[i] = isolator
+			return isolators
+		}
+	}
+	return append(isolators, isolator)
+}
+
+// replaceMountPoint returns mountPoints with the one at the path of
+// mountPoint replaced by it, or with it added. The volumes of the pod take
+// the place of the ones the image declares.
+func replaceMountPoint(mountPoints []types.MountPoint, mountPoint types.MountPoint) []types.MountPoint {
+	for i, mp := range mountPoints {
+		if mp.Path == mountPoint.Path {
+			mountPoints[i] = mountPoint
+			return mountPoints
+		}
+	}
+	return append(mountPoints, mountPoint)
+}
+
+// podVolume returns the volume of the pod mounted by m in the app name.
+func podVolume(name string, m PodMount) (*types.Volume, error) {
+	if !path.IsAbs(m.Target) {
+		return nil, fmt.Errorf("invalid mount target %q: not absolute", m.Target)
+	}
+	target := path.Clean(m.Target)
+
+	var volume types.Volume
+	var volumeName string
+	switch {
+	case m.Source == "":
+		volume.Kind = "empty"
+		volumeName = name + strings.Replace(target, "/", "-", -1)
+	case filepath.IsAbs(m.Source):
+		volume.Kind = "host"
+		volume.Source = filepath.Clean(m.Source)
+		volumeName = name + strings.Replace(target, "/", "-", -1)
+	default:
+		volume.Kind = "empty"
+		volumeName = m.Source
+	}
+	if m.ReadOnly {
+		readOnly := true
+		volume.ReadOnly = &readOnly
+	}
+
+	sanitized, err := types.SanitizeACName(volumeName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume %q: %w", volumeName, err)
+	}
+	acName, err := types.NewACName(sanitized)
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume %q: %w", volumeName, err)
+	}
+	volume.Name = *acName
+	return &volume, nil
+}
+
+// exposePort adds the port p to the ports of the app name and returns its
+// name. Ports are named after their app, so the apps of a pod exposing the
+// same port don't clash.
+func exposePort(app *types.App, name string, p PodPort) (*types.ACName, error) {
+	protocol := strings.ToLower(p.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if p.Port == 0 || p.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", p.Port)
+	}
+	portName, err := types.NewACName(fmt.Sprintf("%s-%d-%s", name, p.Port, protocol))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %d/%s: %w", p.Port, protocol, err)
+	}
+	port := types.Port{Name: *portName, Protocol: protocol, Port: p.Port}
+	for i, existing := range app.Ports {
+		if existing.Port == p.Port && existing.Protocol == protocol {
+			app.Ports[i] = port
+			return portName, nil
+		}
+	}
+	app.Ports = append(app.Ports, port)
+	return portName, nil
+}
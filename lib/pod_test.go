@@ -0,0 +1,211 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// writeTestACI writes an ACI of manifest, with an empty root filesystem, to
+// dir and returns its path.
+func writeTestACI(t *testing.T, dir string, manifest schema.ImageManifest) string {
+	t.Helper()
+	p := filepath.Join(dir, filepath.Base(manifest.Name.String())+".aci")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	if err := addMinimalACIStructure(tw, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testImageManifest(name string) schema.ImageManifest {
+	return schema.ImageManifest{
+		ACKind: types.ACKind("ImageManifest"),
+		Name:   types.ACName(name),
+		App: &types.App{
+			Exec:  types.Exec{"/bin/app", "--default"},
+			User:  "0",
+			Group: "0",
+			MountPoints: []types.MountPoint{
+				{Name: "volume-data", Path: "/data"},
+			},
+			Ports: []types.Port{
+				{Name: "80-tcp", Protocol: "tcp", Port: 80},
+			},
+		},
+	}
+}
+
+func TestGeneratePodManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker2aci-pod-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	web := writeTestACI(t, dir, testImageManifest("example.com/web"))
+	db := writeTestACI(t, dir, testImageManifest("example.com/db"))
+
+	pod, err := GeneratePodManifest([]PodApp{
+		{
+			Name: "web",
+			ACI:  web,
+			Cmd:  []string{"--serve"},
+			Env:  []string{"MODE=production"},
+			User: "1000",
+			Ports: []PodPort{
+				{Port: 80, HostPort: 8080},
+				{Port: 53, Protocol: "udp"},
+			},
+			Mounts: []PodMount{
+				{Source: "shared", Target: "/data/"},
+				{Source: "/srv/conf", Target: "/etc/web", ReadOnly: true},
+			},
+		},
+		{
+			Name:   "db",
+			ACI:    db,
+			Mounts: []PodMount{{Source: "shared", Target: "/var/lib/db"}, {Target: "/tmp"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pod.Apps) != 2 {
+		t.Fatalf("apps = %+v, want web and db", pod.Apps)
+	}
+	webApp, dbApp := pod.Apps[0], pod.Apps[1]
+	if webApp.Name != "web" || dbApp.Name != "db" {
+		t.Errorf("app names = %s, %s, want web, db", webApp.Name, dbApp.Name)
+	}
+	if *webApp.Image.Name != "example.com/web" {
+		t.Errorf("web image = %s, want example.com/web", *webApp.Image.Name)
+	}
+
+	// the image's command stands for its entrypoint
+	if want := (types.Exec{"/bin/app", "--default", "--serve"}); !reflect.DeepEqual(webApp.App.Exec, want) {
+		t.Errorf("web exec = %q, want %q", webApp.App.Exec, want)
+	}
+	if webApp.App.User != "1000" || webApp.App.Group != "0" {
+		t.Errorf("web user = %s:%s, want 1000:0", webApp.App.User, webApp.App.Group)
+	}
+	if v, ok := webApp.App.Environment.Get("MODE"); !ok || v != "production" {
+		t.Errorf("web MODE = %q, want production", v)
+	}
+
+	wantMountPoints := []types.MountPoint{
+		{Name: "shared", Path: "/data"},
+		{Name: "web-etc-web", Path: "/etc/web", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(webApp.App.MountPoints, wantMountPoints) {
+		t.Errorf("web mount points = %+v, want %+v", webApp.App.MountPoints, wantMountPoints)
+	}
+	wantMounts := []schema.Mount{
+		{Volume: "shared", MountPoint: "shared"},
+		{Volume: "web-etc-web", MountPoint: "web-etc-web"},
+	}
+	if !reflect.DeepEqual(webApp.Mounts, wantMounts) {
+		t.Errorf("web mounts = %+v, want %+v", webApp.Mounts, wantMounts)
+	}
+	wantMountPoints = []types.MountPoint{
+		{Name: "volume-data", Path: "/data"},
+		{Name: "shared", Path: "/var/lib/db"},
+		{Name: "db-tmp", Path: "/tmp"},
+	}
+	if !reflect.DeepEqual(dbApp.App.MountPoints, wantMountPoints) {
+		t.Errorf("db mount points = %+v, want %+v", dbApp.App.MountPoints, wantMountPoints)
+	}
+
+	readOnly := true
+	wantVolumes := []types.Volume{
+		{Name: "shared", Kind: "empty"},
+		{Name: "web-etc-web", Kind: "host", Source: "/srv/conf", ReadOnly: &readOnly},
+		{Name: "db-tmp", Kind: "empty"},
+	}
+	if !reflect.DeepEqual(pod.Volumes, wantVolumes) {
+		t.Errorf("volumes = %+v, want %+v", pod.Volumes, wantVolumes)
+	}
+
+	wantPorts := []types.Port{
+		{Name: "web-80-tcp", Protocol: "tcp", Port: 80},
+		{Name: "web-53-udp", Protocol: "udp", Port: 53},
+	}
+	if !reflect.DeepEqual(webApp.App.Ports, wantPorts) {
+		t.Errorf("web ports = %+v, want %+v", webApp.App.Ports, wantPorts)
+	}
+	wantExposed := []types.ExposedPort{{Name: "web-80-tcp", HostPort: 8080}}
+	if !reflect.DeepEqual(pod.Ports, wantExposed) {
+		t.Errorf("exposed ports = %+v, want %+v", pod.Ports, wantExposed)
+	}
+}
+
+func TestGeneratePodManifestErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker2aci-pod-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aci := writeTestACI(t, dir, testImageManifest("example.com/web"))
+
+	tests := []struct {
+		desc string
+		apps []PodApp
+	}{
+		{
+			desc: "duplicate app",
+			apps: []PodApp{{Name: "web", ACI: aci}, {Name: "web", ACI: aci}},
+		},
+		{
+			desc: "missing ACI",
+			apps: []PodApp{{Name: "web", ACI: filepath.Join(dir, "missing.aci")}},
+		},
+		{
+			desc: "relative target",
+			apps: []PodApp{{Name: "web", ACI: aci, Mounts: []PodMount{{Target: "data"}}}},
+		},
+		{
+			desc: "host volume mounted twice",
+			apps: []PodApp{{Name: "web", ACI: aci, Mounts: []PodMount{
+				{Source: "/srv", Target: "/srv"},
+				{Source: "/srv/www", Target: "/srv/"},
+			}}},
+		},
+		{
+			desc: "invalid port",
+			apps: []PodApp{{Name: "web", ACI: aci, Ports: []PodPort{{Port: 70000}}}},
+		},
+	}
+	for _, tt := range tests {
+		if _, err := GeneratePodManifest(tt.apps); err == nil {
+			t.Errorf("%s: generated a pod manifest, want an error", tt.desc)
+		}
+	}
+}
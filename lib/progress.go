@@ -0,0 +1,310 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressInterval is how often the progress bars are redrawn at
+	// most.
+	progressInterval = 100 * time.Millisecond
+	progressBarWidth = 30
+)
+
+// Messages is where TextLogger prints what the conversions do, like the
+// layers they download, unless it's given another writer. Warnings go to
+// stderr.
+var Messages io.Writer = os.Stdout
+
+// progressTerminal draws the progress bars of the downloads of every
+// conversion of the process below the messages printed on stdout, which is a
+// terminal when Config.ShowProgress is true.
+var progressTerminal terminal
+
+type terminal struct {
+	mu   sync.Mutex
+	bars []*progressBar
+	// lines is the number of lines of the bars drawn last, which are
+	// erased before drawing them again
+	lines int
+	drawn time.Time
+}
+
+// printf prints a message to w above the progress bars.
+func (t *terminal) printf(w io.Writer, format string, a ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.erase()
+	fmt.Fprintf(w, format, a...)
+	t.draw()
+}
+
+func (t *terminal) erase() {
+	if t.lines > 0 {
+		// up to the first bar and clear to the end of the screen
+		fmt.Fprintf(os.Stdout, "\033[%dA\033[J", t.lines)
+		t.lines = 0
+	}
+}
+
+func (t *terminal) draw() {
+	for _, b := range t.bars {
+		fmt.Fprintln(os.Stdout, b.line())
+	}
+	t.lines = len(t.bars)
+	t.drawn = time.Now()
+}
+
+func (t *terminal) add(b *progressBar) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bars = append(t.bars, b)
+	t.erase()
+	t.draw()
+}
+
+// advance records that n more bytes of b were downloaded. It reports whether
+// the progress is due to be reported again.
+func (t *terminal) advance(b *progressBar, n int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b.read += int64(n)
+	b.image.read += int64(n)
+	if b.image.draw && time.Since(t.drawn) >= progressInterval {
+		t.erase()
+		t.draw()
+	}
+	if time.Since(b.reported) < progressInterval {
+		return false
+	}
+	b.reported = time.Now()
+	return true
+}
+
+// finish removes b once its download ended with err, logging what was
+// downloaded if it succeeded.
+func (t *terminal) finish(b *progressBar, err error) {
+	t.mu.Lock()
+	for i, bar := range t.bars {
+		if bar == b {
+			t.bars = append(t.bars[:i], t.bars[i+1:]...)
+			break
+		}
+	}
+	t.erase()
+	t.draw()
+	t.mu.Unlock()
+	if err == nil {
+		elapsed := time.Since(b.start)
+		logInfo(b.image.logger, fmt.Sprintf("Downloaded layer: %s (%s in %v, %s/s)", b.layerID, formatSize(b.read), elapsed.Round(100*time.Millisecond), formatSize(rate(b.read, elapsed))), LogField{"layer", b.layerID})
+	}
+}
+
+// imageProgress is the progress of the conversion of an image, drawn as
+// progress bars, reported as events, to callbacks or all of them.
+type imageProgress struct {
+	// image is the reference of the image in the events
+	image     string
+	draw      bool
+	events    io.Writer
+	callbacks Callbacks
+	logger    Logger
+	// layers is the number of layers to download and bars the number
+	// of their bars so far
+	layers int
+	bars   int
+	// read is what was downloaded of the layers so far
+	read int64
+}
+
+// newImageProgress returns the progress of the image of dockerURL, which has
+// layers to download.
+func newImageProgress(layers int, dockerURL *ParsedDockerURL, config Config) *imageProgress {
+	return &imageProgress{
+		image:     dockerURL.IndexURL + "/" + dockerURL.ImageName + ":" + dockerURL.Tag,
+		draw:      config.ShowProgress,
+		events:    config.Events,
+		callbacks: config.Callbacks,
+		logger:    config.Logger,
+		layers:    layers,
+	}
+}
+
+// bar returns the progress bar of the next layer downloaded, or nil if the
+// progress isn't shown.
+func (p *imageProgress) bar(layerID string) *progressBar {
+	if !p.draw && !p.reported() {
+		return nil
+	}
+	p.bars++
+	return &progressBar{layerID: layerID, index: p.bars, image: p, size: -1}
+}
+
+// reported reports whether the steps of the conversion are reported as
+// events or to callbacks.
+func (p *imageProgress) reported() bool {
+	return p.events != nil || !p.callbacks.empty()
+}
+
+// emit writes the event e, filling in its image, and calls its callback.
+func (p *imageProgress) emit(e Event) {
+	e.Image = p.image
+	if p.events != nil {
+		writeEvent(p.events, e)
+	}
+	p.callbacks.call(e)
+}
+
+// imageConverted writes the event of the ACIs generated for the image. keys
+// are the image IDs known already, the other ACIs are hashed.
+func (p *imageProgress) imageConverted(aciPaths []string, keys map[string]string) {
+	if p.events == nil && p.callbacks.OnImageDone == nil {
+		return
+	}
+	var acis []EventACI
+	for _, aciPath := range aciPaths {
+		id, ok := keys[aciPath]
+		if !ok {
+			// the ID is left out if it can't be computed
+			id, _ = ACIImageID(aciPath)
+		}
+		acis = append(acis, EventACI{File: aciPath, ImageID: id})
+	}
+	p.emit(Event{Type: EventImageConverted, ACIs: acis})
+}
+
+// progressBar is the progress of the download of a layer.
+type progressBar struct {
+	layerID string
+	// index is the position of the layer among the ones of image, from 1
+	index int
+	image *imageProgress
+	// size is the size of the download, -1 if it's unknown
+	size     int64
+	read     int64
+	start    time.Time
+	reported time.Time
+}
+
+// begin records the start of a download of size bytes, -1 if unknown.
+func (b *progressBar) begin(size int64) {
+	b.size = size
+	b.start = time.Now()
+	b.reported = b.start
+	b.image.emit(Event{Type: EventLayerStarted, Layer: b.layerID, Size: size})
+	if b.image.draw {
+		progressTerminal.add(b)
+	}
+}
+
+func (b *progressBar) advance(n int) {
+	if progressTerminal.advance(b, n) {
+		b.image.emit(Event{Type: EventLayerProgress, Layer: b.layerID, Bytes: b.read, Size: b.size})
+	}
+}
+
+// finish records the end of the download, which failed if err isn't nil.
+func (b *progressBar) finish(err error) {
+	if b.image.draw {
+		progressTerminal.finish(b, err)
+	}
+	if err == nil {
+		b.image.emit(Event{Type: EventLayerDownloaded, Layer: b.layerID, Bytes: b.read, Size: b.size})
+	}
+}
+
+func (b *progressBar) line() string {
+	id := b.layerID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	elapsed := time.Since(b.start)
+	r := rate(b.read, elapsed)
+
+	fields := []string{fmt.Sprintf("[%d/%d] %s", b.index, b.image.layers, id)}
+	if b.size > 0 {
+		done := b.read
+		if done > b.size {
+			done = b.size
+		}
+		filled := int(done * progressBarWidth / b.size)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+		if filled < progressBarWidth {
+			bar = bar[:filled] + ">" + bar[filled+1:]
+		}
+		fields = append(fields,
+			"["+bar+"]",
+			fmt.Sprintf("%3d%%", done*100/b.size),
+			formatSize(b.read)+"/"+formatSize(b.size))
+	} else {
+		fields = append(fields, formatSize(b.read))
+	}
+	fields = append(fields, formatSize(r)+"/s")
+	if b.size > 0 && r > 0 && b.read < b.size {
+		eta := time.Duration(float64(b.size-b.read) / float64(r) * float64(time.Second))
+		fields = append(fields, "ETA "+eta.Round(time.Second).String())
+	}
+	fields = append(fields, "(image: "+formatSize(b.image.read)+")")
+	return strings.Join(fields, " ")
+}
+
+// progressReader reports the reads of r to bar.
+type progressReader struct {
+	r   io.Reader
+	bar *progressBar
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.bar.advance(n)
+	return n, err
+}
+
+// sizedBody is a layer stream whose size is known, like a response with a
+// Content-Length, so its progress bar has an end.
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+// rate returns the bytes per second of n bytes read in elapsed.
+func rate(n int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(n) / elapsed.Seconds())
+}
+
+// formatSize formats n bytes in binary units, e.g. 4.2M.
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
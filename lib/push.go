@@ -0,0 +1,207 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	signatureExt       = ".asc"
+	defaultS3Region    = "us-east-1"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	amzDateFormat      = "20060102T150405Z"
+	amzShortDateFormat = "20060102"
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// Push uploads the given ACIs, and their signatures if there is a file with
+// the same name and an .asc extension next to them, to pushURL.
+// pushURL can be an http(s) URL, in which case every file is PUT to
+// {pushURL}/{file name}, or an S3 URL of the form:
+//
+//	s3://{bucket}/{prefix}
+//
+// S3 requests are signed with the credentials found in the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and, optionally, AWS_SESSION_TOKEN environment
+// variables. The region is taken from AWS_REGION or AWS_DEFAULT_REGION.
+func Push(aciPaths []string, pushURL string) error {
+	return PushWithContext(context.Background(), aciPaths, pushURL)
+}
+
+// PushWithContext is like Push but aborts the upload in flight and returns
+// the error of ctx once it's done.
+func PushWithContext(ctx context.Context, aciPaths []string, pushURL string) error {
+	u, err := url.Parse(pushURL)
+	if err != nil {
+		return fmt.Errorf("error parsing push url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "s3":
+	default:
+		return fmt.Errorf("unsupported push url scheme: %q", u.Scheme)
+	}
+
+	for _, aciPath := range aciPaths {
+		files := []string{aciPath}
+		if _, err := os.Stat(aciPath + signatureExt); err == nil {
+			files = append(files, aciPath+signatureExt)
+		}
+
+		for _, file := range files {
+			logInfo(nil, "Pushing "+file, LogField{"file", file})
+			if err := pushFile(ctx, file, u); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("error pushing %s: %w", file, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func pushFile(ctx context.Context, file string, pushURL *url.URL) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	dest := *pushURL
+	dest.Path = path.Join("/", pushURL.Path, filepath.Base(file))
+
+	var s3Region string
+	if dest.Scheme == "s3" {
+		s3Region = getS3Region()
+		dest.Scheme = "https"
+		dest.Host = pushURL.Host + ".s3." + s3Region + ".amazonaws.com"
+	}
+
+	req, err := http.NewRequest("PUT", dest.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	if s3Region != "" {
+		if err := signS3Request(req, s3Region, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	res, err := DefaultHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		herr := &HTTPError{StatusCode: res.StatusCode, URL: req.URL.String()}
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return &ErrAuth{Registry: dest.Host, Err: herr}
+		}
+		return herr
+	}
+
+	return nil
+}
+
+func getS3Region() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	return defaultS3Region
+}
+
+// signS3Request adds an AWS signature version 4 Authorization header to req.
+// The payload is left unsigned so the body can be streamed.
+func signS3Request(req *http.Request, region string, now time.Time) error {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to push to S3")
+	}
+
+	amzDate := now.Format(amzDateFormat)
+	shortDate := now.Format(amzShortDateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + token + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := strings.Join([]string{shortDate, region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, s := range []string{shortDate, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := fmt.Sprintf("%x", hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgorithm, accessKey, scope, signedHeaders, signature))
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,411 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	// DefaultServerRefresh is how long a Server serves a converted ACI
+	// before resolving its tag again.
+	DefaultServerRefresh = 10 * time.Minute
+	// DefaultJobTTL is how long a Server keeps a finished job.
+	DefaultJobTTL = 24 * time.Hour
+
+	// serverACIPrefix is the path the ACIs are served under. Docker image
+	// names can't start with an underscore, so it's never the one of a
+	// discovery page, neither is serverPubKeysPath.
+	serverACIPrefix   = "/_aci/"
+	serverPubKeysPath = "/_pubkeys.gpg"
+	// serverMetricsPath is the path of the metrics, the discovery page of
+	// an image named metrics is still served there with ac-discovery=1.
+	serverMetricsPath = "/metrics"
+)
+
+var (
+	// serverImagePath and serverTag are the image names and tags Docker
+	// accepts, which are safe to use as paths.
+	serverImagePath = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	serverTag       = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// ServerOptions configures a Server.
+type ServerOptions struct {
+	// Registry is the registry the images are converted from, e.g.
+	// quay.io: the image of the name example.com/coreos/etcd is then
+	// quay.io/coreos/etcd. Empty is Docker Hub.
+	Registry string
+	// Domain is the domain of the image names served, e.g. example.com.
+	// Empty is the host of each request.
+	Domain string
+	// BaseURL is the URL the server is reached at, e.g.
+	// https://example.com, advertised in the discovery pages. Empty is the
+	// scheme and host of each request.
+	BaseURL string
+	// Dir is the directory the ACIs are converted to and kept in.
+	Dir string
+	// SignKey, if not empty, is the gpg key the ACIs are signed with. Its
+	// public key is advertised in the discovery pages.
+	SignKey string
+	// Refresh is how long a converted ACI is served before its tag is
+	// resolved again, which converts it again if the tag moved. 0 is
+	// DefaultServerRefresh.
+	Refresh time.Duration
+	// Config is the configuration of the conversions. The server sets
+	// their name, output directory and squashing.
+	Config Config
+	// Metrics, if not nil, records the conversions, and is served at
+	// /metrics.
+	Metrics *Metrics
+	// Jobs is the number of jobs converted at once, the others wait. 0
+	// doesn't limit them.
+	Jobs int
+	// JobTTL is how long a job is kept once finished: its status, its log
+	// and its ACIs are then removed. The ACIs left in Dir by the jobs of
+	// an earlier server are removed once as old. 0 is DefaultJobTTL.
+	JobTTL time.Duration
+}
+
+// Server is an http.Handler converting Docker images to ACIs on demand and
+// serving them with appc discovery, so rkt fetches example.com/nginx from a
+// Server at example.com by converting nginx from the registry.
+//
+// The ACIs are squashed and kept in ServerOptions.Dir, the requests for an
+// image and tag being converted wait for that conversion.
+//
+// Build systems convert images with jobs instead. POST /convert with
+// {"image": IMAGE} and optionally "name" and "squash" starts converting IMAGE
+// and answers with the status of the job, at /jobs/ID. Its events are at
+// /jobs/ID/log as lines of JSON, and its ACIs at the paths listed in its
+// status once it succeeded, until ServerOptions.JobTTL after it finished.
+type Server struct {
+	ctx  context.Context
+	opts ServerOptions
+
+	mu sync.Mutex
+	// conversions are the last conversions of each image name and tag
+	conversions map[string]*serverConversion
+
+	jobs serverJobs
+}
+
+// serverConversion is a conversion of an image and tag, running until done
+// is closed.
+type serverConversion struct {
+	done     chan struct{}
+	aciPath  string
+	labels   types.Labels
+	err      error
+	finished time.Time
+}
+
+// NewServer returns a Server with opts. The conversions it starts are
+// canceled with ctx, not with the requests waiting for them.
+func NewServer(ctx context.Context, opts ServerOptions) *Server {
+	if opts.Refresh <= 0 {
+		opts.Refresh = DefaultServerRefresh
+	}
+	if opts.JobTTL <= 0 {
+		opts.JobTTL = DefaultJobTTL
+	}
+	s := &Server{
+		ctx:         ctx,
+		opts:        opts,
+		conversions: make(map[string]*serverConversion),
+		jobs:        serverJobs{jobs: make(map[string]*serverJob)},
+	}
+	if opts.Jobs > 0 {
+		s.jobs.slots = make(chan struct{}, opts.Jobs)
+	}
+	removeOldJobs(filepath.Join(opts.Dir, serverJobsDir), opts.JobTTL)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	discovery := r.URL.Query().Get("ac-discovery") == "1"
+	switch {
+	case r.URL.Path == serverConvertPath && !discovery:
+		s.serveConvert(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, serverJobsPrefix) && !discovery:
+		s.serveJob(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case r.URL.Path == serverPubKeysPath:
+		s.servePubKeys(w, r)
+	case strings.HasPrefix(r.URL.Path, serverACIPrefix):
+		s.serveACI(w, r)
+	case discovery:
+		s.serveDiscovery(w, r)
+	case r.URL.Path == serverMetricsPath && s.opts.Metrics != nil:
+		s.opts.Metrics.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveDiscovery serves the discovery page of the image name of the request,
+// e.g. example.com/nginx for /nginx.
+func (s *Server) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	imagePath := strings.Trim(r.URL.Path, "/")
+	name := s.domain(r) + "/" + imagePath
+	if !serverImagePath.MatchString(imagePath) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := types.NewACName(name); err != nil {
+		http.Error(w, fmt.Sprintf("invalid name %q: %v", name, err), http.StatusNotFound)
+		return
+	}
+
+	baseURL := s.baseURL(r)
+	page := discoveryPage{
+		Name:      name,
+		Templates: []string{baseURL + serverACIPrefix + imagePath + "/{version}-{os}-{arch}.{ext}"},
+	}
+	if s.opts.SignKey != "" {
+		page.PubKeys = baseURL + serverPubKeysPath
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	discoveryTemplate.Execute(w, page)
+}
+
+// serveACI serves the ACI, or its signature, of a path of the discovery
+// template, e.g. /_aci/nginx/latest-linux-amd64.aci, converting it if needed.
+func (s *Server) serveACI(w http.ResponseWriter, r *http.Request) {
+	dir, file := path.Split(strings.TrimPrefix(r.URL.Path, serverACIPrefix))
+	imagePath := strings.TrimSuffix(dir, "/")
+	signature := strings.HasSuffix(file, ".aci"+signatureExt)
+	base := strings.TrimSuffix(strings.TrimSuffix(file, signatureExt), ".aci")
+	version, appcOS, appcArch, ok := splitServerFileName(base)
+	if !ok || base == file || !serverImagePath.MatchString(imagePath) || !serverTag.MatchString(version) {
+		http.NotFound(w, r)
+		return
+	}
+
+	c, err := s.convert(r.Context(), s.domain(r), imagePath, version)
+	if err != nil {
+		http.Error(w, err.Error(), serverErrorStatus(err))
+		return
+	}
+	for _, l := range []struct{ name, value string }{{"os", appcOS}, {"arch", appcArch}} {
+		if v, ok := c.labels.Get(l.name); ok && v != l.value {
+			http.Error(w, fmt.Sprintf("%s:%s isn't available for %s/%s", imagePath, version, appcOS, appcArch), http.StatusNotFound)
+			return
+		}
+	}
+
+	if signature {
+		serveFile(w, r, c.aciPath+signatureExt, "application/pgp-signature")
+	} else {
+		serveFile(w, r, c.aciPath, "application/octet-stream")
+	}
+}
+
+// servePubKeys serves the public key of ServerOptions.SignKey.
+func (s *Server) servePubKeys(w http.ResponseWriter, r *http.Request) {
+	if s.opts.SignKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := ExportPublicKey(r.Context(), s.opts.SignKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	w.Write(key)
+}
+
+// convert returns the conversion of imagePath and version, named after
+// domain, once it's done. The conversion found is reused unless it failed or
+// is older than ServerOptions.Refresh.
+func (s *Server) convert(ctx context.Context, domain string, imagePath string, version string) (*serverConversion, error) {
+	name := domain + "/" + imagePath
+	key := name + ":" + version
+
+	s.mu.Lock()
+	c, ok := s.conversions[key]
+	if !ok || (isClosed(c.done) && (c.err != nil || time.Since(c.finished) >= s.opts.Refresh)) {
+		c = &serverConversion{done: make(chan struct{})}
+		s.conversions[key] = c
+		go s.run(c, name, imagePath, version)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return nil, c.err
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run converts the image imagePath with the tag version to an ACI named name
+// into the directory of the image and tag, and signs it.
+func (s *Server) run(c *serverConversion, name string, imagePath string, version string) {
+	defer close(c.done)
+
+	dockerURL := imagePath + ":" + version
+	if s.opts.Registry != "" {
+		dockerURL = s.opts.Registry + "/" + dockerURL
+	}
+	config := s.opts.Config
+	if s.opts.Metrics != nil {
+		config.Stats = &Stats{}
+	}
+	start := time.Now()
+	c.aciPath, c.labels, c.err = s.convertImage(dockerURL, name, filepath.Join(s.opts.Dir, filepath.FromSlash(imagePath), version), config)
+	if c.err != nil {
+		logWarn(s.opts.Config.Logger, fmt.Sprintf("Error converting %s: %v", dockerURL, c.err), LogField{"image", dockerURL})
+	}
+	c.finished = time.Now()
+	if s.opts.Metrics != nil {
+		s.opts.Metrics.Observe(c.finished.Sub(start), config.Stats, c.err)
+	}
+}
+
+func (s *Server) convertImage(dockerURL string, name string, outputDir string, config Config) (string, types.Labels, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", nil, &ErrStore{Path: outputDir, Err: err}
+	}
+
+	config.Name = name
+	config.Squash = SquashOnly
+	config.OutputDir = outputDir
+	// the ACI is converted again only if the tag moved
+	config.SkipExisting = true
+	aciPaths, err := ConvertWithContext(s.ctx, dockerURL, config)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(aciPaths) == 0 {
+		return "", nil, fmt.Errorf("no ACI converted from %s", dockerURL)
+	}
+	aciPath := aciPaths[len(aciPaths)-1]
+
+	if s.opts.SignKey != "" && !signatureCurrent(aciPath) {
+		if err := SignACI(s.ctx, aciPath, s.opts.SignKey); err != nil {
+			return "", nil, err
+		}
+	}
+	manifest, err := readManifest(aciPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading manifest from %s: %w", aciPath, err)
+	}
+	return aciPath, manifest.Labels, nil
+}
+
+// domain returns the domain of the image names of the request.
+func (s *Server) domain(r *http.Request) string {
+	if s.opts.Domain != "" {
+		return s.opts.Domain
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+// baseURL returns the URL of the server advertised to the request.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.opts.BaseURL != "" {
+		return strings.TrimSuffix(s.opts.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// splitServerFileName splits the name of an ACI of the discovery template,
+// without its extension, into its version, os and arch. The tag can have
+// dashes, the os and arch can't.
+func splitServerFileName(base string) (string, string, string, bool) {
+	i := strings.LastIndex(base, "-")
+	if i < 0 {
+		return "", "", "", false
+	}
+	j := strings.LastIndex(base[:i], "-")
+	if j < 0 {
+		return "", "", "", false
+	}
+	return base[:j], base[j+1 : i], base[i+1:], true
+}
+
+// serverErrorStatus returns the status of the responses to the requests of
+// an ACI whose conversion failed with err.
+func serverErrorStatus(err error) int {
+	var nferr *ErrNotFound
+	var aerr *ErrAuth
+	var uerr *ErrUntrusted
+	var nerr net.Error
+	switch {
+	case errors.As(err, &uerr):
+		return http.StatusForbidden
+	case errors.As(err, &nferr):
+		return http.StatusNotFound
+	case errors.As(err, &aerr), errors.As(err, &nerr):
+		// the registry rejected the server or couldn't be reached
+		return http.StatusBadGateway
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, p string, contentType string) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultRktKeystore is the directory of the keys rkt trusts which `rkt
+// trust` writes to.
+const DefaultRktKeystore = "/etc/rkt/trustedkeys"
+
+// gpgCommand is the command signing the ACIs and exporting the public keys.
+var gpgCommand = "gpg"
+
+// SignACI writes the detached ASCII-armored signature of the ACI at aciPath,
+// made by gpg with the secret key of key, next to it with an .asc extension,
+// where rkt looks for it. An empty key uses gpg's default key.
+func SignACI(ctx context.Context, aciPath string, key string) error {
+	args := []string{"--batch", "--yes", "--armor"}
+	if key != "" {
+		args = append(args, "--local-user", key)
+	}
+	args = append(args, "--output", aciPath+signatureExt, "--detach-sign", aciPath)
+	if _, err := runGPG(ctx, args...); err != nil {
+		return fmt.Errorf("error signing %s: %w", aciPath, err)
+	}
+	return nil
+}
+
+// ExportPublicKey returns the ASCII-armored public key of key, the one rkt
+// trusts to verify the signatures of SignACI.
+func ExportPublicKey(ctx context.Context, key string) ([]byte, error) {
+	out, err := runGPG(ctx, "--batch", "--armor", "--export", key)
+	if err != nil {
+		return nil, fmt.Errorf("error exporting the public key of %q: %w", key, err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no public key %q", key)
+	}
+	return out, nil
+}
+
+// TrustKey installs the public key of key in the rkt keystore dir, trusted
+// to sign the images whose name is prefix or starts with prefix/, as `rkt
+// trust --prefix` does. It returns the path of the key installed.
+func TrustKey(ctx context.Context, keystore string, prefix string, key string) (string, error) {
+	if prefix == "" || path.IsAbs(prefix) || path.Clean("/"+prefix) != "/"+prefix {
+		return "", fmt.Errorf("invalid prefix %q", prefix)
+	}
+	fingerprint, err := keyFingerprint(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := ExportPublicKey(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(keystore, "prefix.d", filepath.FromSlash(prefix))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating dir: %w", err)
+	}
+	keyPath := filepath.Join(dir, fingerprint)
+	if err := writeFileAtomic(keyPath, pubKey, 0644); err != nil {
+		return "", fmt.Errorf("error writing %s: %w", keyPath, err)
+	}
+	return keyPath, nil
+}
+
+// TrustACIs installs the public key of key in the rkt keystore dir, trusted
+// for the names of the ACIs at aciPaths, so rkt can run them verifying the
+// signatures of SignACI. It returns the paths of the keys installed.
+func TrustACIs(ctx context.Context, aciPaths []string, keystore string, key string) ([]string, error) {
+	var keyPaths []string
+	trusted := make(map[string]bool)
+	for _, aciPath := range aciPaths {
+		manifest, err := readManifest(aciPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest from %s: %w", aciPath, err)
+		}
+		name := manifest.Name.String()
+		if trusted[name] {
+			continue
+		}
+		keyPath, err := TrustKey(ctx, keystore, name, key)
+		if err != nil {
+			return nil, err
+		}
+		trusted[name] = true
+		keyPaths = append(keyPaths, keyPath)
+	}
+	return keyPaths, nil
+}
+
+// keyFingerprint returns the fingerprint of the primary key of key in lower
+// case hex, the name rkt gives the files of the keys it trusts.
+func keyFingerprint(ctx context.Context, key string) (string, error) {
+	out, err := runGPG(ctx, "--batch", "--with-colons", "--fingerprint", key)
+	if err != nil {
+		return "", fmt.Errorf("error getting the fingerprint of %q: %w", key, err)
+	}
+	// every primary key is a pub record followed by its fpr record, the
+	// subkeys have theirs after a sub record
+	var fingerprints []string
+	primary := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "pub":
+			primary = true
+		case "sub":
+			primary = false
+		case "fpr":
+			if primary && len(fields) > 9 {
+				fingerprints = append(fingerprints, strings.ToLower(fields[9]))
+				primary = false
+			}
+		}
+	}
+	switch len(fingerprints) {
+	case 0:
+		return "", fmt.Errorf("no public key %q", key)
+	case 1:
+		return fingerprints[0], nil
+	}
+	return "", fmt.Errorf("%q matches %d keys", key, len(fingerprints))
+}
+
+// writeFileAtomic writes b to the file p with perm, replacing it at once.
+func writeFileAtomic(p string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// signatureCurrent reports whether the signature of the ACI at aciPath was
+// made after the ACI was written.
+func signatureCurrent(aciPath string) bool {
+	aci, err := os.Stat(aciPath)
+	if err != nil {
+		return false
+	}
+	sig, err := os.Stat(aciPath + signatureExt)
+	return err == nil && !sig.ModTime().Before(aci.ModTime())
+}
+
+func runGPG(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gpgCommand, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
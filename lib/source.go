@@ -0,0 +1,200 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Source is where the layers of an image and their Docker JSON come from.
+// The conversion only goes through it, so new kinds of images, like the ones
+// of docker save archives or OCI layouts, only need a new Source. Its methods
+// give up once ctx is done, the tarballs stop being read then.
+type Source interface {
+	// GetAncestry returns the IDs of the layers of the image, from the
+	// top layer to the base one.
+	GetAncestry(ctx context.Context) ([]string, error)
+	// GetImageConfig returns the Docker v1 JSON of the layer layerID,
+	// with its ID, parent, config and history.
+	GetImageConfig(ctx context.Context, layerID string) ([]byte, error)
+	// GetLayerReader returns the tarball of the layer layerID, which can
+	// be compressed with gzip, bzip2 or xz.
+	GetLayerReader(ctx context.Context, layerID string) (io.ReadCloser, error)
+}
+
+// rawConfigSource is a Source which also has the image config the Docker
+// JSON of its layers was taken from, for the annotations of the ACIs.
+type rawConfigSource interface {
+	// getRawConfig returns the image config of layerID, nil if the
+	// config doesn't describe that layer.
+	getRawConfig(layerID string) ([]byte, error)
+}
+
+// sizedSource is a Source which knows the size of the files of its layers
+// before reading them.
+type sizedSource interface {
+	// getLayerSize returns the size in bytes of the layer's files, or -1
+	// if it's unknown.
+	getLayerSize(ctx context.Context, layerID string) (int64, error)
+}
+
+// sourceRawConfig returns the image config of layerID in src, or its Docker
+// JSON if src has no other config.
+func sourceRawConfig(ctx context.Context, src Source, layerID string) ([]byte, error) {
+	if rs, ok := src.(rawConfigSource); ok {
+		return rs.getRawConfig(layerID)
+	}
+	return src.GetImageConfig(ctx, layerID)
+}
+
+// sourceLayerSize returns the size of the files of layerID in src, -1 if
+// it's unknown.
+func sourceLayerSize(ctx context.Context, src Source, layerID string) (int64, error) {
+	if ss, ok := src.(sizedSource); ok {
+		return ss.getLayerSize(ctx, layerID)
+	}
+	return -1, nil
+}
+
+// ConvertSource is like ConvertWithContext but takes the image from src
+// instead of a registry. name is the image name the ACIs are named after, of
+// the form:
+//
+//	[{registry}/]{image name}[:{tag}]
+//
+// config.Resolved is ignored. Only the images of registries have trust data
+// to verify with config.ContentTrust.
+func ConvertSource(ctx context.Context, src Source, name string, config Config) ([]string, error) {
+	if config.ContentTrust {
+		return nil, fmt.Errorf("content trust only verifies the images of registries")
+	}
+	aciPaths, err := convertFromSource(ctx, src, name, config)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return aciPaths, withImage(err, name)
+}
+
+func convertFromSource(ctx context.Context, src Source, name string, config Config) ([]string, error) {
+	parsedURL, err := parseDockerURL(name)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing docker url: %w\n", err)
+	}
+
+	ancestry, err := src.GetAncestry(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting ancestry: %w\n", err)
+	}
+
+	return convertImage(ctx, src, ancestry, parsedURL, config)
+}
+
+// configImage is an image described by a Docker v2 or OCI image config, like
+// the ones of docker save archives and OCI layouts. Its layers are named
+// after their chain IDs, so a layer gets the same ID on the same parents
+// whichever image it comes from.
+type configImage struct {
+	config    DockerImageData
+	rawConfig []byte
+	// layers are the IDs of the layers from the base one, and index
+	// their position there
+	layers []string
+	index  map[string]int
+}
+
+// newConfigImage returns the image of rawConfig whose layer blobs have
+// digests, from the base layer. Images without a config, like OCI artifacts,
+// have a nil rawConfig and their layers are named after their blobs.
+func newConfigImage(rawConfig []byte, digests []string) (*configImage, error) {
+	img := &configImage{rawConfig: rawConfig, index: make(map[string]int)}
+	diffIDs := digests
+	if rawConfig != nil {
+		if err := json.Unmarshal(rawConfig, &img.config); err != nil {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("error unmarshaling image config: %w", err)}
+		}
+		var rootfs struct {
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		if err := json.Unmarshal(rawConfig, &rootfs); err != nil {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("error unmarshaling image config: %w", err)}
+		}
+		diffIDs = rootfs.RootFS.DiffIDs
+		if len(diffIDs) != len(digests) {
+			return nil, &ErrManifestInvalid{Err: fmt.Errorf("the image config has %d layers, the manifest %d", len(diffIDs), len(digests))}
+		}
+	}
+	if len(diffIDs) == 0 {
+		return nil, &ErrManifestInvalid{Err: fmt.Errorf("the image has no layers")}
+	}
+
+	chainID := ""
+	for i, diffID := range diffIDs {
+		if chainID == "" {
+			chainID = diffID
+		} else {
+			chainID = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(chainID+" "+diffID)))
+		}
+		id := strings.TrimPrefix(chainID, storageDigestID)
+		img.layers = append(img.layers, id)
+		img.index[id] = i
+	}
+	return img, nil
+}
+
+// GetAncestry returns the list of layers from the image's top layer to the
+// base layer.
+func (img *configImage) GetAncestry(ctx context.Context) ([]string, error) {
+	ancestry := make([]string, len(img.layers))
+	for i, id := range img.layers {
+		ancestry[len(img.layers)-1-i] = id
+	}
+	return ancestry, nil
+}
+
+func (img *configImage) GetImageConfig(ctx context.Context, layerID string) ([]byte, error) {
+	i, ok := img.index[layerID]
+	if !ok {
+		return nil, &ErrNotFound{Layer: layerID}
+	}
+
+	var layerData DockerImageData
+	if i == len(img.layers)-1 {
+		layerData = img.config
+	} else {
+		layerData = lowerLayerData(img.config, i)
+	}
+	layerData.ID = layerID
+	if i > 0 {
+		layerData.Parent = img.layers[i-1]
+	}
+
+	return json.Marshal(layerData)
+}
+
+// getRawConfig returns the image config for the top layer, the only one it
+// describes.
+func (img *configImage) getRawConfig(layerID string) ([]byte, error) {
+	if img.index[layerID] != len(img.layers)-1 {
+		return nil, nil
+	}
+	return img.rawConfig, nil
+}
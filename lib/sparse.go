@@ -0,0 +1,304 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	// sparseMinSize is the size from which the holes of the regular
+	// files of a tarball are looked for, which needs spooling them.
+	sparseMinSize = 1 << 20
+	// sparseBlock is the granularity of the runs of zeros found in
+	// files.
+	sparseBlock = 4096
+	// sparseHoleSize is the shortest hole kept, shorter runs of zeros
+	// are stored as data rather than growing the sparse map.
+	sparseHoleSize = 16 * sparseBlock
+	// sparseMaxFragments is the most data fragments a sparse entry gets,
+	// so its map stays well under what tar readers accept.
+	sparseMaxFragments = 10000
+
+	paxGNUSparseMajor    = "GNU.sparse.major"
+	paxGNUSparseMinor    = "GNU.sparse.minor"
+	paxGNUSparseName     = "GNU.sparse.name"
+	paxGNUSparseRealSize = "GNU.sparse.realsize"
+)
+
+// sparseFragment is a range of a file holding data, the rest of the file is
+// holes.
+type sparseFragment struct {
+	offset int64
+	length int64
+}
+
+func (f sparseFragment) end() int64 {
+	return f.offset + f.length
+}
+
+// appendFragment adds the data at off, n bytes long, to data, merging it
+// with the last fragment when the hole between them is shorter than
+// sparseHoleSize.
+func appendFragment(data []sparseFragment, off, n int64) []sparseFragment {
+	if last := len(data) - 1; last >= 0 && off-data[last].end() < sparseHoleSize {
+		data[last].length = off + n - data[last].offset
+		return data
+	}
+	return append(data, sparseFragment{offset: off, length: n})
+}
+
+// spoolSparse copies r to f, leaving its blocks of zeros unwritten so f gets
+// holes where the filesystem supports them. It returns the size of r and its
+// data fragments.
+func spoolSparse(f *os.File, r io.Reader) (int64, []sparseFragment, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, nil, err
+	}
+
+	var data []sparseFragment
+	var size int64
+	buf := make([]byte, sparseBlock)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !isZeros(buf[:n]) {
+			if _, err := f.WriteAt(buf[:n], size); err != nil {
+				return 0, nil, err
+			}
+			data = appendFragment(data, size, int64(n))
+		}
+		size += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return 0, nil, err
+	}
+	return size, data, nil
+}
+
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseWriter is a tar.Writer that stores the regular files with holes as
+// PAX 1.0 sparse entries. Go's writer can't write them
+// (https://golang.org/issue/22735), so they're encoded here and written to
+// w, what the tar.Writer writes to, between its entries.
+type sparseWriter struct {
+	*tar.Writer
+	w      io.Writer
+	tmpDir string
+	spool  *os.File
+}
+
+// newSparseWriter returns a sparseWriter writing to w and spooling the files
+// it looks for holes in to tmpDir, or the default directory for temporary
+// files if it's empty.
+func newSparseWriter(w io.Writer, tmpDir string) *sparseWriter {
+	return &sparseWriter{Writer: tar.NewWriter(w), w: w, tmpDir: tmpDir}
+}
+
+// Close finishes the tarball and removes the spool file of sw.
+func (sw *sparseWriter) Close() error {
+	err := sw.Writer.Close()
+	if sw.spool != nil {
+		sw.spool.Close()
+		os.Remove(sw.spool.Name())
+	}
+	return err
+}
+
+// writeFile writes the regular file of hdr with the contents of r. The files
+// of at least sparseMinSize are spooled to find their runs of zeros, which are
+// stored as holes.
+func (sw *sparseWriter) writeFile(hdr *tar.Header, r io.Reader) error {
+	if hdr.Size < sparseMinSize {
+		if err := sw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(sw, r)
+		return err
+	}
+
+	if sw.spool == nil {
+		spool, err := ioutil.TempFile(sw.tmpDir, "docker2aci-")
+		if err != nil {
+			return err
+		}
+		sw.spool = spool
+	}
+	size, data, err := spoolSparse(sw.spool, r)
+	if err != nil {
+		return err
+	}
+	if size != hdr.Size {
+		return fmt.Errorf("%s has %d bytes, expected %d", hdr.Name, size, hdr.Size)
+	}
+	return sw.writeSparse(hdr, sw.spool, data)
+}
+
+// writeSparse writes the regular file of hdr, whose contents r has in the
+// data fragments and which has holes elsewhere. It's written as a sparse
+// entry if it has holes.
+func (sw *sparseWriter) writeSparse(hdr *tar.Header, r io.ReaderAt, data []sparseFragment) error {
+	var dataSize int64
+	for _, f := range data {
+		dataSize += f.length
+	}
+	if dataSize == hdr.Size || len(data) > sparseMaxFragments {
+		if err := sw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(sw, io.NewSectionReader(r, 0, hdr.Size))
+		return err
+	}
+
+	// readers expect a file ending with a hole to have a last, empty,
+	// fragment at its end
+	if len(data) == 0 || data[len(data)-1].end() < hdr.Size {
+		data = append(data, sparseFragment{offset: hdr.Size})
+	}
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(data))
+	for _, f := range data {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", f.offset, f.length)
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+
+	// The tar writer encodes the header of the entry, with the PAX records
+	// ustar can't hold, and the GNU.sparse records are added to them.
+	entry := *hdr
+	entry.Name = path.Join(path.Dir(hdr.Name), "GNUSparseFile.0", path.Base(hdr.Name))
+	entry.Typeflag = tar.TypeReg
+	entry.Size = int64(sparseMap.Len()) + dataSize
+	entry.Format = tar.FormatPAX
+	var encoded bytes.Buffer
+	if err := tar.NewWriter(&encoded).WriteHeader(&entry); err != nil {
+		return err
+	}
+	records := make(map[string]string)
+	if encoded.Len() > blockSize {
+		h, err := tar.NewReader(bytes.NewReader(encoded.Bytes())).Next()
+		if err != nil {
+			return err
+		}
+		for k, v := range h.PAXRecords {
+			records[k] = v
+		}
+	}
+	records[paxGNUSparseMajor] = "1"
+	records[paxGNUSparseMinor] = "0"
+	records[paxGNUSparseName] = hdr.Name
+	records[paxGNUSparseRealSize] = strconv.FormatInt(hdr.Size, 10)
+
+	// the previous entry gets its padding
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	pax := encodePAXRecords(records)
+	xName := path.Join(path.Dir(entry.Name), "PaxHeaders.0", path.Base(entry.Name))
+	if _, err := sw.w.Write(paxHeaderBlock(xName, int64(len(pax)))); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(append(pax, make([]byte, padding(int64(len(pax))))...)); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(encoded.Bytes()[encoded.Len()-blockSize:]); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+	for _, f := range data {
+		if _, err := io.CopyN(sw.w, io.NewSectionReader(r, f.offset, f.length), f.length); err != nil {
+			return fmt.Errorf("error reading %s: %w", hdr.Name, err)
+		}
+	}
+	_, err := sw.w.Write(make([]byte, padding(entry.Size)))
+	return err
+}
+
+// padding returns how many bytes pad n bytes to a whole number of tar
+// blocks.
+func padding(n int64) int64 {
+	return -n & (blockSize - 1)
+}
+
+// encodePAXRecords returns the body of a PAX extended header with records,
+// sorted by key so entries are always encoded the same.
+func encodePAXRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		// the length of a record counts its own digits
+		size := len(k) + len(records[k]) + len(" =\n")
+		size += len(strconv.Itoa(size))
+		record := fmt.Sprintf("%d %s=%s\n", size, k, records[k])
+		if len(record) != size {
+			record = fmt.Sprintf("%d %s=%s\n", len(record), k, records[k])
+		}
+		b.WriteString(record)
+	}
+	return b.Bytes()
+}
+
+// paxHeaderBlock returns the ustar header of a PAX extended header named
+// name with a body of size bytes.
+func paxHeaderBlock(name string, size int64) []byte {
+	blk := make([]byte, blockSize)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(blk[0:], name)
+	copy(blk[100:], "0000000\x00") // mode
+	copy(blk[108:], "0000000\x00") // uid
+	copy(blk[116:], "0000000\x00") // gid
+	copy(blk[124:], fmt.Sprintf("%011o\x00", size))
+	copy(blk[136:], "00000000000\x00") // mtime
+	blk[156] = tar.TypeXHeader
+	copy(blk[257:], "ustar\x0000")
+
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
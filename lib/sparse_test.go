@@ -0,0 +1,151 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sparseContent returns size bytes of zeros with data written at the offsets
+// of data.
+func sparseContent(size int, data map[int]string) []byte {
+	b := make([]byte, size)
+	for off, s := range data {
+		copy(b[off:], s)
+	}
+	return b
+}
+
+func TestSparseWriterRoundTrip(t *testing.T) {
+	longName := "rootfs/" + strings.Repeat("long-directory/", 10) + "disk.img"
+	tests := []struct {
+		desc    string
+		hdr     tar.Header
+		content []byte
+	}{
+		{
+			desc:    "trailing hole",
+			hdr:     tar.Header{Name: "rootfs/var/lib/db", Mode: 0600},
+			content: sparseContent(3<<20, map[int]string{0: "header", 100: "more"}),
+		},
+		{
+			desc:    "only holes",
+			hdr:     tar.Header{Name: "rootfs/zeros", Mode: 0644},
+			content: sparseContent(2<<20, nil),
+		},
+		{
+			desc: "long name",
+			hdr: tar.Header{
+				Name:   longName,
+				Mode:   0644,
+				Uid:    1 << 22,
+				Xattrs: map[string]string{"user.comment": "vm image"},
+			},
+			content: sparseContent(5<<20+100, map[int]string{0: "boot", 3<<20 + 7: "data", 5 << 20: "end"}),
+		},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		sw := newSparseWriter(&b, "")
+		if err := sw.writeFile(&tar.Header{Name: "rootfs/before", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, strings.NewReader("abc")); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+		hdr := tt.hdr
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(tt.content))
+		if err := sw.writeFile(&hdr, bytes.NewReader(tt.content)); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+		if err := sw.WriteHeader(&tar.Header{Name: "rootfs/after/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+		if err := sw.Close(); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+		if b.Len() >= len(tt.content) {
+			t.Errorf("%s: tarball has %d bytes for a file of %d", tt.desc, b.Len(), len(tt.content))
+		}
+
+		tr := tar.NewReader(&b)
+		var names []string
+		for {
+			got, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.desc, err)
+			}
+			names = append(names, got.Name)
+			if got.Name != hdr.Name {
+				continue
+			}
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.desc, err)
+			}
+			if !bytes.Equal(contents, tt.content) {
+				t.Errorf("%s: contents differ", tt.desc)
+			}
+			if got.Typeflag != tar.TypeReg || got.Size != hdr.Size || got.Mode != hdr.Mode || got.Uid != hdr.Uid {
+				t.Errorf("%s: header = %+v, want %+v", tt.desc, got, hdr)
+			}
+			if len(hdr.Xattrs) > 0 && !reflect.DeepEqual(got.Xattrs, hdr.Xattrs) {
+				t.Errorf("%s: xattrs = %v, want %v", tt.desc, got.Xattrs, hdr.Xattrs)
+			}
+			if got.PAXRecords[paxGNUSparseMajor] != "1" || got.PAXRecords[paxGNUSparseMinor] != "0" {
+				t.Errorf("%s: not a PAX 1.0 sparse entry: %v", tt.desc, got.PAXRecords)
+			}
+		}
+		if want := []string{"rootfs/before", hdr.Name, "rootfs/after/"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: entries = %q, want %q", tt.desc, names, want)
+		}
+	}
+}
+
+func TestSparseWriterNoHoles(t *testing.T) {
+	content := bytes.Repeat([]byte{1}, 2<<20)
+	var b bytes.Buffer
+	sw := newSparseWriter(&b, "")
+	hdr := &tar.Header{Name: "rootfs/full", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+	if err := sw.writeFile(hdr, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&b)
+	got, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.PAXRecords[paxGNUSparseMajor]; ok {
+		t.Errorf("file without holes written as a sparse entry")
+	}
+	contents, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, content) {
+		t.Error("contents differ")
+	}
+}
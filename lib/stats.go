@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"os"
+	"time"
+)
+
+// Stats is where the time and the space of the conversion of an image went.
+// The durations are in nanoseconds in JSON.
+type Stats struct {
+	// Layers are the layers of the image from the base one, in the order
+	// they are converted.
+	Layers []LayerStats `json:"layers"`
+	// ACIs are the ACIs generated, with their final size.
+	ACIs         []ACIStats    `json:"acis"`
+	SquashTime   time.Duration `json:"squashTime,omitempty"`
+	HookTime     time.Duration `json:"hookTime,omitempty"`
+	CompressTime time.Duration `json:"compressTime,omitempty"`
+	// TotalTime is the time the whole conversion took. The layers are
+	// downloaded while the previous ones are converted, so it's less than
+	// the sum of the other times.
+	TotalTime time.Duration `json:"totalTime"`
+}
+
+// LayerStats is where the time and the space of the conversion of a layer
+// went. Layers are rewritten into ACIs without being extracted: ReadTime is
+// the time reading the layer's files took, which stands for the extraction.
+type LayerStats struct {
+	Layer string `json:"layer"`
+	// Reused is true if the ACI of the layer was converted by an earlier
+	// conversion, so the layer wasn't downloaded or read.
+	Reused bool `json:"reused,omitempty"`
+	// Cached is true if the layer was downloaded already, DownloadTime is
+	// then the time waiting for it.
+	Cached       bool          `json:"cached,omitempty"`
+	DownloadTime time.Duration `json:"downloadTime"`
+	// DownloadSize is the size of the layer as downloaded, which is
+	// usually compressed.
+	DownloadSize int64         `json:"downloadSize"`
+	ReadTime     time.Duration `json:"readTime"`
+	// FilesSize is the uncompressed size of the layer's files.
+	FilesSize int64 `json:"filesSize"`
+	// PackTime is zero if the ACI was packed already, in the work dir.
+	PackTime time.Duration `json:"packTime"`
+	// ACI is the ACI of the layer and ACISize its size before being
+	// compressed. Empty layers have no ACI.
+	ACI     string `json:"aci,omitempty"`
+	ACISize int64  `json:"aciSize,omitempty"`
+}
+
+// ACIStats is an ACI generated for an image.
+type ACIStats struct {
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+// addACIs records the final size of the ACIs at aciPaths.
+func (s *Stats) addACIs(aciPaths []string) {
+	for _, p := range aciPaths {
+		s.ACIs = append(s.ACIs, ACIStats{File: p, Size: fileSize(p)})
+	}
+}
+
+// fileSize returns the size of the file at p, 0 if it can't be read.
+func fileSize(p string) int64 {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
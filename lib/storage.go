@@ -0,0 +1,560 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/docker2aci/tarball"
+)
+
+const (
+	// DefaultStorageRoot is the default graph root of containers/storage,
+	// the image store used by podman and buildah.
+	DefaultStorageRoot = "/var/lib/containers/storage"
+
+	storageDriver   = "overlay"
+	storageDigestID = "sha256:"
+	storageManifest = "manifest"
+
+	mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCIEmpty     = "application/vnd.oci.empty.v1+json"
+)
+
+// supportedLayerMediaTypes are the media types of the layers we know are
+// tarballs of a root filesystem.
+var supportedLayerMediaTypes = map[string]bool{
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":            true,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+	"application/vnd.oci.image.layer.v1.tar":                       true,
+	"application/vnd.oci.image.layer.v1.tar+gzip":                  true,
+	"application/vnd.oci.image.layer.v1.tar+zstd":                  true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": true,
+	"application/vnd.docker.image.rootfs.diff.tar":                 true,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar":         true,
+	"application/vnd.docker.image.rootfs.diff.tar.zstd":            true,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.zstd":    true,
+}
+
+// storageImage is an entry of overlay-images/images.json.
+type storageImage struct {
+	ID           string   `json:"id"`
+	Names        []string `json:"names,omitempty"`
+	TopLayer     string   `json:"layer"`
+	BigDataNames []string `json:"big-data-names,omitempty"`
+}
+
+// imageManifest holds the fields of Docker v2 and OCI image manifests that
+// tell what kind of content an image has.
+type imageManifest struct {
+	Config struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		// URLs are where foreign layers are distributed.
+		URLs []string `json:"urls,omitempty"`
+	} `json:"layers"`
+}
+
+// storageLayer is an entry of overlay-layers/layers.json.
+type storageLayer struct {
+	ID               string `json:"id"`
+	Parent           string `json:"parent,omitempty"`
+	CompressedDigest string `json:"compressed-diff-digest,omitempty"`
+	DiffSize         *int64 `json:"diff-size,omitempty"`
+}
+
+// fileID identifies a file of the storage, to find its hard links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// storageSource takes the layers of an image from a containers/storage graph
+// root using the overlay driver.
+type storageSource struct {
+	root      string
+	image     storageImage
+	layers    map[string]storageLayer
+	config    DockerImageData
+	rawConfig []byte
+	uidMap    []IDMap
+	gidMap    []IDMap
+	// foreignURLs are the URLs of the foreign layers of the image, keyed
+	// by the digest of their blob. They're only downloaded if
+	// allowForeign is true.
+	foreignURLs  map[string][]string
+	allowForeign bool
+	client       *http.Client
+	// showProgress leaves the reads to their progress bars
+	showProgress bool
+	// logger gets the messages of the conversion
+	logger Logger
+}
+
+// ConvertContainersStorage is like ConvertWithConfig but takes the image
+// from the containers/storage graph root storageRoot, as used by podman and
+// buildah, instead of a registry. Only the overlay driver is supported.
+// imageName can be a name of the form:
+//
+//	[{registry}/]{image name}[:{tag}]
+//
+// or the ID of the image. config.Resolved is ignored, and config.ContentTrust
+// can't be used.
+func ConvertContainersStorage(storageRoot string, imageName string, config Config) ([]string, error) {
+	return ConvertContainersStorageWithContext(context.Background(), storageRoot, imageName, config)
+}
+
+// ConvertContainersStorageWithContext is like ConvertContainersStorage but
+// stops once ctx is done, like ConvertWithContext.
+func ConvertContainersStorageWithContext(ctx context.Context, storageRoot string, imageName string, config Config) ([]string, error) {
+	if config.ContentTrust {
+		return nil, fmt.Errorf("content trust only verifies the images of registries")
+	}
+	// the layers are already on disk
+	config.CacheDir = ""
+	aciPaths, err := convertFromStorage(ctx, storageRoot, imageName, config)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return aciPaths, withImage(err, imageName)
+}
+
+func convertFromStorage(ctx context.Context, storageRoot string, imageName string, config Config) ([]string, error) {
+	src, err := newStorageSource(storageRoot, imageName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading containers storage: %w\n", err)
+	}
+	src.uidMap, src.gidMap = config.UIDMap, config.GIDMap
+	src.allowForeign = config.AllowForeignLayers
+	src.client = httpClient(config)
+	src.showProgress = config.ShowProgress
+	src.logger = config.Logger
+
+	name := imageName
+	if len(src.image.Names) > 0 {
+		name = src.image.Names[0]
+	}
+	parsedURL, err := parseDockerURL(name)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing docker url: %w\n", err)
+	}
+
+	ancestry, err := src.GetAncestry(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting ancestry: %w\n", err)
+	}
+
+	return convertImage(ctx, src, ancestry, parsedURL, config)
+}
+
+func newStorageSource(root string, imageName string) (*storageSource, error) {
+	var images []storageImage
+	if err := readStorageJSON(filepath.Join(root, storageDriver+"-images", "images.json"), &images); err != nil {
+		return nil, err
+	}
+	image, err := findStorageImage(images, imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []storageLayer
+	if err := readStorageJSON(filepath.Join(root, storageDriver+"-layers", "layers.json"), &layers); err != nil {
+		return nil, err
+	}
+
+	src := &storageSource{
+		root:        root,
+		image:       *image,
+		layers:      make(map[string]storageLayer),
+		foreignURLs: make(map[string][]string),
+	}
+	for _, l := range layers {
+		src.layers[l.ID] = l
+	}
+
+	imagesDir := filepath.Join(root, storageDriver+"-images", image.ID)
+	hasConfig := true
+	for _, name := range image.BigDataNames {
+		if name == storageManifest {
+			var manifest imageManifest
+			if err := readStorageJSON(filepath.Join(imagesDir, storageBigDataName(name)), &manifest); err != nil {
+				return nil, fmt.Errorf("error reading image manifest: %w", err)
+			}
+			if hasConfig, err = checkMediaTypes(manifest); err != nil {
+				return nil, err
+			}
+			for _, l := range manifest.Layers {
+				if len(l.URLs) > 0 {
+					src.foreignURLs[l.Digest] = l.URLs
+				}
+			}
+		}
+	}
+
+	configKey := storageDigestID + image.ID
+	for _, name := range image.BigDataNames {
+		if hasConfig && name == configKey {
+			configPath := filepath.Join(imagesDir, storageBigDataName(name))
+			if src.rawConfig, err = ioutil.ReadFile(configPath); err != nil {
+				return nil, fmt.Errorf("error reading image config: %w", err)
+			}
+			if err := json.Unmarshal(src.rawConfig, &src.config); err != nil {
+				return nil, &ErrManifestInvalid{Err: fmt.Errorf("error unmarshaling %s: %w", configPath, err)}
+			}
+		}
+	}
+
+	return src, nil
+}
+
+// checkMediaTypes checks that we know how to convert the content described
+// by manifest and returns an error listing the unsupported media types
+// otherwise. It reports whether the image has a config: OCI artifacts can
+// have an empty one, in which case only their layers are converted.
+func checkMediaTypes(manifest imageManifest) (bool, error) {
+	var unsupported []string
+	hasConfig := true
+	switch manifest.Config.MediaType {
+	case "", mediaTypeDockerConfig, mediaTypeOCIConfig:
+	case mediaTypeOCIEmpty:
+		hasConfig = false
+	default:
+		unsupported = append(unsupported, "config "+manifest.Config.MediaType)
+	}
+
+	for _, l := range manifest.Layers {
+		if l.MediaType != "" && !supportedLayerMediaTypes[l.MediaType] {
+			unsupported = append(unsupported, "layer "+l.MediaType)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return false, &ErrManifestInvalid{Err: fmt.Errorf("unsupported media types: %s", strings.Join(unsupported, ", "))}
+	}
+	return hasConfig, nil
+}
+
+// mapToContainer returns the ID of the image the host ID id maps to. Without
+// maps IDs are kept.
+func mapToContainer(id int, maps []IDMap) (int, error) {
+	if len(maps) == 0 {
+		return id, nil
+	}
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID, nil
+		}
+	}
+	return 0, fmt.Errorf("ID %d is not mapped", id)
+}
+
+func readStorageJSON(p string, v interface{}) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("error unmarshaling %s: %w", p, err)
+	}
+	return nil
+}
+
+// findStorageImage looks an image up by name or ID. Names are compared after
+// normalizing them like docker URLs, so busybox matches
+// docker.io/library/busybox:latest.
+func findStorageImage(images []storageImage, imageName string) (*storageImage, error) {
+	wanted, err := parseDockerURL(imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, image := range images {
+		if strings.HasPrefix(image.ID, imageName) {
+			return &images[i], nil
+		}
+		for _, name := range image.Names {
+			candidate, err := parseDockerURL(name)
+			if err != nil {
+				continue
+			}
+			if normalizeStorageName(candidate) == normalizeStorageName(wanted) {
+				return &images[i], nil
+			}
+		}
+	}
+
+	return nil, &ErrNotFound{Image: imageName}
+}
+
+func normalizeStorageName(u *ParsedDockerURL) string {
+	return u.IndexURL + "/" + u.ImageName + ":" + u.Tag
+}
+
+// storageBigDataName returns the file name containers/storage uses to store a
+// big data item of an image: the key itself if it's made of safe characters,
+// and its base64 encoding prefixed by "=" otherwise.
+func storageBigDataName(key string) string {
+	for _, c := range key {
+		if c != '.' && !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') {
+			return "=" + base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+	return key
+}
+
+// GetAncestry returns the list of layers from the image's top layer to the
+// base layer.
+func (ss *storageSource) GetAncestry(ctx context.Context) ([]string, error) {
+	var ancestry []string
+	for id := ss.image.TopLayer; id != ""; {
+		l, ok := ss.layers[id]
+		if !ok {
+			return nil, &ErrNotFound{Layer: id}
+		}
+		ancestry = append(ancestry, id)
+		id = l.Parent
+	}
+	return ancestry, nil
+}
+
+func (ss *storageSource) GetImageConfig(ctx context.Context, layerID string) ([]byte, error) {
+	l, ok := ss.layers[layerID]
+	if !ok {
+		return nil, &ErrNotFound{Layer: layerID}
+	}
+
+	var layerData DockerImageData
+	if layerID == ss.image.TopLayer {
+		layerData = ss.config
+	} else {
+		layerData = lowerLayerData(ss.config, ss.depth(l))
+	}
+	layerData.ID = l.ID
+	layerData.Parent = l.Parent
+
+	return json.Marshal(layerData)
+}
+
+// getRawConfig returns the image config for the top layer, the only one it
+// describes.
+func (ss *storageSource) getRawConfig(layerID string) ([]byte, error) {
+	if layerID != ss.image.TopLayer {
+		return nil, nil
+	}
+	return ss.rawConfig, nil
+}
+
+// depth returns the number of parents of l.
+func (ss *storageSource) depth(l storageLayer) int {
+	depth := 0
+	for p := l.Parent; p != ""; p = ss.layers[p].Parent {
+		depth++
+	}
+	return depth
+}
+
+// lowerLayerData returns the Docker JSON of the layer of an image with config
+// which has depth parents, if it's not the top layer: the config only
+// describes the top layer, the other ones only get the platform information
+// like in Docker's v1 layers, and the history up to them.
+func lowerLayerData(config DockerImageData, depth int) DockerImageData {
+	return DockerImageData{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+		Created:      config.Created,
+		History:      historyUntil(config.History, depth),
+	}
+}
+
+// historyUntil returns the steps of history up to the one that created the
+// layer with depth parents, or nil if the history doesn't have that many
+// layers.
+func historyUntil(history []DockerHistory, depth int) []DockerHistory {
+	for i, h := range history {
+		if h.EmptyLayer {
+			continue
+		}
+		if depth == 0 {
+			return history[:i+1]
+		}
+		depth--
+	}
+	return nil
+}
+
+// getLayerSize returns the uncompressed size of the layer the storage
+// recorded, if it did.
+func (ss *storageSource) getLayerSize(ctx context.Context, layerID string) (int64, error) {
+	if size := ss.layers[layerID].DiffSize; size != nil {
+		return *size, nil
+	}
+	return -1, nil
+}
+
+func (ss *storageSource) GetLayerReader(ctx context.Context, layerID string) (io.ReadCloser, error) {
+	diffDir := filepath.Join(ss.root, storageDriver, layerID, "diff")
+	if _, err := os.Stat(diffDir); err != nil {
+		// stores can skip the foreign layers of the images they pull
+		digest := ss.layers[layerID].CompressedDigest
+		if urls := ss.foreignURLs[digest]; os.IsNotExist(err) && len(urls) > 0 {
+			if !ss.allowForeign {
+				return nil, foreignLayerError(layerID, urls)
+			}
+			return getForeignLayer(ctx, ss.client, ss.logger, digest, urls)
+		}
+		return nil, err
+	}
+
+	if !ss.showProgress {
+		logInfo(ss.logger, "Reading layer: "+layerID, LogField{"layer", layerID})
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeOverlayTar(diffDir, pw, ss.uidMap, ss.gidMap))
+	}()
+
+	return pr, nil
+}
+
+// writeOverlayTar writes the overlay layer in dir as an uncompressed tarball
+// to w, translating overlay whiteouts (0/0 character devices and opaque
+// directories) to Docker's .wh. files and the owners of the files with
+// uidMap and gidMap. Files with holes are written as sparse entries.
+func writeOverlayTar(dir string, w io.Writer, uidMap []IDMap, gidMap []IDMap) error {
+	tw := newSparseWriter(w, "")
+	// names of the files with several hard links already written
+	linked := make(map[fileID]string)
+
+	walker := func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		if isOverlayWhiteout(fi) {
+			hdr := getGenericTarHeader()
+			hdr.Name = path.Join(path.Dir(name), tarball.WhiteoutPrefix+path.Base(name))
+			hdr.Mode = 0600
+			hdr.Typeflag = tar.TypeReg
+			return tw.WriteHeader(hdr)
+		}
+
+		// sockets can't be stored in tarballs
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if hdr.Uid, err = mapToContainer(hdr.Uid, uidMap); err != nil {
+			return fmt.Errorf("error mapping the owner of %s: %w", name, err)
+		}
+		if hdr.Gid, err = mapToContainer(hdr.Gid, gidMap); err != nil {
+			return fmt.Errorf("error mapping the group of %s: %w", name, err)
+		}
+		// the names FileInfoHeader found are the host's, and extractors
+		// prefer names to IDs, so only the image's IDs are kept
+		hdr.Uname, hdr.Gname = "", ""
+		if hdr.Xattrs, err = readXattrs(p, fi); err != nil {
+			return err
+		}
+		if id, ok := inode(fi); ok {
+			if target, ok := linked[id]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = target
+				hdr.Size = 0
+			} else {
+				linked[id] = name
+			}
+		}
+		// devices and FIFOs are only recorded in the tarball, nothing is
+		// created on the host so this works without root
+		if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+			setDeviceNumbers(hdr, fi)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			data, err := dataFragments(f, hdr.Size)
+			if err != nil {
+				return err
+			}
+			return tw.writeSparse(hdr, f, data)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if fi.IsDir() && isOverlayOpaque(p) {
+			ohdr := getGenericTarHeader()
+			ohdr.Name = path.Join(name, tarball.OpaqueWhiteout)
+			ohdr.Mode = 0600
+			ohdr.Typeflag = tar.TypeReg
+			return tw.WriteHeader(ohdr)
+		}
+
+		return nil
+	}
+
+	if err := filepath.Walk(dir, walker); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The whence values of lseek looking for data and holes, which the syscall
+// package doesn't have.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// isOverlayWhiteout reports whether fi is an overlay whiteout, a character
+// device with 0/0 device number.
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// setDeviceNumbers sets the major and minor numbers of hdr, the header of
+// the device fi, which tar.FileInfoHeader doesn't fill in everywhere.
+func setDeviceNumbers(hdr *tar.Header, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	dev := uint64(st.Rdev)
+	hdr.Devmajor = int64((dev>>8)&0xfff | (dev>>32)&^0xfff)
+	hdr.Devminor = int64(dev&0xff | (dev>>12)&^0xff)
+}
+
+// inode identifies the file fi is the FileInfo of. It reports false if the
+// file has no other hard links.
+func inode(fi os.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 || fi.IsDir() {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// dataFragments returns the data fragments of f, size bytes long, as the
+// filesystem reports them. Filesystems which don't report holes have the
+// whole file as data.
+func dataFragments(f *os.File, size int64) ([]sparseFragment, error) {
+	var data []sparseFragment
+	for off := int64(0); off < size; {
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// only holes are left
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return []sparseFragment{{length: size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		data = appendFragment(data, start, end-start)
+		off = end
+	}
+	return data, nil
+}
+
+// isOverlayOpaque reports whether the directory dir is marked as opaque,
+// either by the kernel overlay driver or by fuse-overlayfs in rootless mode.
+func isOverlayOpaque(dir string) bool {
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		value := make([]byte, 1)
+		n, err := syscall.Getxattr(dir, attr, value)
+		if err == nil && n == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// readXattrs returns the user.* and trusted.* extended attributes of the file
+// at p, leaving out the ones overlay uses for its own bookkeeping, and its
+// file capabilities. Symlinks have none, as they'd be read from their target.
+func readXattrs(p string, fi os.FileInfo) (map[string]string, error) {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, nil
+	}
+
+	names, err := listXattrs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string]string
+	for _, name := range names {
+		if !strings.HasPrefix(name, "user.") && !strings.HasPrefix(name, "trusted.") && name != capabilityXattr {
+			continue
+		}
+		if strings.HasPrefix(name, "user.overlay.") || strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.fuseoverlayfs.") {
+			continue
+		}
+		value, err := getXattr(p, name)
+		if err != nil {
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = string(value)
+	}
+
+	return xattrs, nil
+}
+
+func listXattrs(p string) ([]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		if err == syscall.ENOTSUP {
+			err = nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(p, buf); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(p string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(p, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(p, name, value); err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
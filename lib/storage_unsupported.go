@@ -0,0 +1,48 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package docker2aci
+
+import (
+	"archive/tar"
+	"os"
+)
+
+// overlay only exists on Linux, so there are no whiteouts to translate nor
+// extended attributes to keep.
+
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	return false
+}
+
+func isOverlayOpaque(dir string) bool {
+	return false
+}
+
+func readXattrs(p string, fi os.FileInfo) (map[string]string, error) {
+	return nil, nil
+}
+
+func setDeviceNumbers(hdr *tar.Header, fi os.FileInfo) {}
+
+func inode(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func dataFragments(f *os.File, size int64) ([]sparseFragment, error) {
+	return []sparseFragment{{length: size}}, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redactedHeaders are the headers carrying credentials, which are left out
+// of the traces.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Docker-Token":      true,
+}
+
+// redactedParams are the query parameters of the URLs, like the ones of the
+// presigned URLs registries redirect the downloads to, carrying
+// credentials.
+var redactedParams = []string{"signature", "token", "credential", "key"}
+
+// traceTransport writes the requests it makes and their responses to w.
+type traceTransport struct {
+	http.RoundTripper
+	w io.Writer
+	// n numbers the requests, so the responses of requests made at once
+	// can be told apart
+	n uint64
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := atomic.AddUint64(&t.n, 1)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[%d] > %s %s\n", id, req.Method, redactURL(req.URL))
+	writeTraceHeaders(&b, id, ">", req.Header)
+	progressTerminal.printf(t.w, "%s", b.String())
+
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	b.Reset()
+	if err != nil {
+		fmt.Fprintf(&b, "[%d] ! %v (%v)\n", id, err, elapsed)
+	} else {
+		fmt.Fprintf(&b, "[%d] < %s (%v)\n", id, res.Status, elapsed)
+		writeTraceHeaders(&b, id, "<", res.Header)
+	}
+	progressTerminal.printf(t.w, "%s", b.String())
+	return res, err
+}
+
+func writeTraceHeaders(b *bytes.Buffer, id uint64, dir string, h http.Header) {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			if redactedHeaders[http.CanonicalHeaderKey(name)] {
+				v = redactHeader(name, v)
+			} else if u, err := url.Parse(v); err == nil && http.CanonicalHeaderKey(name) == "Location" {
+				v = redactURL(u)
+			}
+			fmt.Fprintf(b, "[%d] %s   %s: %s\n", id, dir, name, v)
+		}
+	}
+}
+
+// redactHeader returns the value v of the header name without its
+// credentials, keeping the authentication scheme.
+func redactHeader(name string, v string) string {
+	if strings.HasSuffix(http.CanonicalHeaderKey(name), "Authorization") {
+		if i := strings.Index(v, " "); i > 0 {
+			return v[:i] + " [redacted]"
+		}
+	}
+	return "[redacted]"
+}
+
+// redactURL returns u without its password and the values of the query
+// parameters carrying credentials.
+func redactURL(u *url.URL) string {
+	r := *u
+	if r.User != nil {
+		r.User = url.User(r.User.Username())
+	}
+	q := r.Query()
+	redacted := false
+	for name := range q {
+		lower := strings.ToLower(name)
+		for _, p := range redactedParams {
+			if strings.Contains(lower, p) {
+				q.Set(name, "redacted")
+				redacted = true
+				break
+			}
+		}
+	}
+	if redacted {
+		r.RawQuery = q.Encode()
+	}
+	return r.String()
+}
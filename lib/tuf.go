@@ -0,0 +1,302 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tufSigned is a metadata file of the TUF repository Notary keeps for an
+// image repository: its signed part and the signatures of its canonical
+// JSON.
+type tufSigned struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []tufSignature  `json:"signatures"`
+}
+
+type tufSignature struct {
+	KeyID  string `json:"keyid"`
+	Method string `json:"method"`
+	Sig    []byte `json:"sig"`
+}
+
+// tufKey is a public key of the trust data. Root keys are X.509
+// certificates.
+type tufKey struct {
+	Type  string `json:"keytype"`
+	Value struct {
+		Public []byte `json:"public"`
+	} `json:"keyval"`
+}
+
+// tufRole is a role of the trust data, the keys whose signatures it takes.
+type tufRole struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+// tufCommon holds the fields of the signed parts of every role.
+type tufCommon struct {
+	Type    string    `json:"_type"`
+	Version int       `json:"version"`
+	Expires time.Time `json:"expires"`
+}
+
+type tufRoot struct {
+	tufCommon
+	Keys  map[string]tufKey  `json:"keys"`
+	Roles map[string]tufRole `json:"roles"`
+}
+
+// tufMeta is the signed part of the timestamp and the snapshot, describing
+// the files of the other roles.
+type tufMeta struct {
+	tufCommon
+	Meta map[string]tufFileMeta `json:"meta"`
+}
+
+type tufFileMeta struct {
+	Length int64             `json:"length"`
+	Hashes map[string][]byte `json:"hashes"`
+}
+
+type tufTargets struct {
+	tufCommon
+	Targets     map[string]tufFileMeta `json:"targets"`
+	Delegations struct {
+		Keys  map[string]tufKey `json:"keys"`
+		Roles []tufDelegation   `json:"roles"`
+	} `json:"delegations"`
+}
+
+type tufDelegation struct {
+	tufRole
+	Name  string   `json:"name"`
+	Paths []string `json:"paths"`
+}
+
+// verify checks that s is signed by the threshold of the keys of role, found
+// in keys, and unmarshals its signed part into v, which must have the type
+// typ, like Root, and must not have expired.
+func (s *tufSigned) verify(role tufRole, keys map[string]tufKey, typ string, v interface{}) error {
+	msg, err := canonicalJSON(s.Signed)
+	if err != nil {
+		return err
+	}
+	if role.Threshold < 1 {
+		return fmt.Errorf("invalid threshold %d", role.Threshold)
+	}
+	roleKeys := make(map[string]bool)
+	for _, id := range role.KeyIDs {
+		roleKeys[id] = true
+	}
+	valid := make(map[string]bool)
+	for _, sig := range s.Signatures {
+		key, ok := keys[sig.KeyID]
+		if !roleKeys[sig.KeyID] || !ok || valid[sig.KeyID] {
+			continue
+		}
+		// the same key listed with several IDs mustn't count several
+		// times
+		if id, err := key.id(); err != nil || id != sig.KeyID {
+			continue
+		}
+		if err := key.verify(sig.Method, msg, sig.Sig); err == nil {
+			valid[sig.KeyID] = true
+		}
+	}
+	if len(valid) < role.Threshold {
+		return fmt.Errorf("%s has %d valid signature(s) of %d needed", strings.ToLower(typ), len(valid), role.Threshold)
+	}
+
+	var common tufCommon
+	if err := json.Unmarshal(s.Signed, &common); err != nil {
+		return err
+	}
+	if !strings.EqualFold(common.Type, typ) {
+		return fmt.Errorf("%s is of type %q", strings.ToLower(typ), common.Type)
+	}
+	if time.Now().After(common.Expires) {
+		return fmt.Errorf("%s expired on %s", strings.ToLower(typ), common.Expires.Format(time.RFC3339))
+	}
+	return json.Unmarshal(s.Signed, v)
+}
+
+// id returns the ID of k, the SHA-256 of the canonical JSON of its public
+// part.
+func (k tufKey) id() (string, error) {
+	// the fields are in their canonical order
+	pub := struct {
+		Type  string `json:"keytype"`
+		Value struct {
+			Private []byte `json:"private"`
+			Public  []byte `json:"public"`
+		} `json:"keyval"`
+	}{Type: k.Type}
+	pub.Value.Public = k.Value.Public
+	b, err := json.Marshal(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (k tufKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Type {
+	case "ed25519":
+		if len(k.Value.Public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(k.Value.Public), nil
+	case "ecdsa", "rsa":
+		return x509.ParsePKIXPublicKey(k.Value.Public)
+	case "ecdsa-x509", "rsa-x509":
+		block, _ := pem.Decode(k.Value.Public)
+		if block == nil {
+			return nil, fmt.Errorf("invalid %s key", k.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().After(cert.NotAfter) {
+			return nil, fmt.Errorf("certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Type)
+}
+
+// verify checks that sig is a signature of msg made with k by method.
+func (k tufKey) verify(method string, msg []byte, sig []byte) error {
+	pub, err := k.publicKey()
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(msg)
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		// r and s, each the size of the curve
+		if method != "ecdsa" || len(sig) == 0 || len(sig)%2 != 0 {
+			break
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if ecdsa.Verify(pub, digest[:], r, s) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		switch method {
+		case "rsapss":
+			return rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		case "rsa":
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+		}
+	case ed25519.PublicKey:
+		if method == "ed25519" && ed25519.Verify(pub, msg, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s signature", method)
+}
+
+// check checks that b is the file described by m.
+func (m tufFileMeta) check(b []byte) error {
+	if int64(len(b)) != m.Length {
+		return fmt.Errorf("size %d instead of %d", len(b), m.Length)
+	}
+	want, ok := m.Hashes["sha256"]
+	if !ok {
+		return fmt.Errorf("no sha256 hash")
+	}
+	if sum := sha256.Sum256(b); !bytes.Equal(sum[:], want) {
+		return fmt.Errorf("sha256 %x instead of %x", sum, want)
+	}
+	return nil
+}
+
+// canonicalJSON returns the canonical JSON of b, the one TUF signs: the keys
+// of the objects are sorted and there is no whitespace.
+func canonicalJSON(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, k); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
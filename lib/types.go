@@ -14,10 +14,28 @@
 
 package docker2aci
 
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
 type RepoData struct {
 	Tokens    []string
 	Endpoints []string
 	Cookie    []string
+	// Credentials are keyed by registry host and used for the endpoints
+	// when the index didn't give us any token.
+	Credentials map[string]Credentials
+	// httpClient makes the requests to the registries, DefaultHTTPClient
+	// if nil.
+	httpClient *http.Client
+	// metadata, if not nil, caches the responses describing the images of
+	// the index indexURL.
+	metadata *metadataCache
+	indexURL string
+	// logger gets the messages of the conversion
+	logger Logger
 }
 
 type ParsedDockerURL struct {
@@ -25,3 +43,228 @@ type ParsedDockerURL struct {
 	ImageName string
 	Tag       string
 }
+
+// SquashMode selects which kind of ACIs a conversion produces.
+type SquashMode int
+
+const (
+	// SquashOnly squashes all the layers into a single ACI.
+	SquashOnly SquashMode = iota
+	// SquashNone generates one ACI per layer with the right dependencies.
+	SquashNone
+	// SquashAlso generates one ACI per layer and, from the same downloaded
+	// data, a single squashed ACI.
+	SquashAlso
+)
+
+// ResolvedImage holds the registry information of an image that the caller
+// already resolved, e.g. with its own registry client. When it is given, only
+// the layers are fetched from the registry.
+type ResolvedImage struct {
+	// RepoData holds the endpoints and credentials used to fetch the layers.
+	RepoData *RepoData
+	// Ancestry is the list of layer IDs, from the image to its base layer.
+	Ancestry []string
+	// LayersJSON maps layer IDs to their Docker JSON. The JSON of layers
+	// missing from the map is fetched from the registry.
+	LayersJSON map[string][]byte
+}
+
+// Config holds the options of a conversion.
+type Config struct {
+	Squash    SquashMode
+	OutputDir string
+	// Resolved, if not nil, is used instead of resolving the image with the
+	// registry.
+	Resolved *ResolvedImage
+	// ImageID, if not empty, is the ID of the Docker image to convert. It
+	// is used instead of resolving the tag of the docker URL, see
+	// ResolveImageID.
+	ImageID string
+	// ContentTrust verifies the tag of the image against the trust data
+	// of its repository on a Notary server before converting it, as
+	// Docker Content Trust does. Tags which aren't signed, whose trust
+	// data doesn't verify or whose manifest isn't the one signed are
+	// refused with an *ErrUntrusted. The image signed is converted, the
+	// digest of its manifest is kept in an annotation: its layers must be
+	// the ones of the manifest and have their digests. They're all
+	// downloaded and converted, CacheDir, WorkDir, Layers and
+	// SkipExisting are ignored. It can't be used with Offline or Resolved.
+	ContentTrust bool
+	// NotaryServer, if not empty, is the URL of the Notary server used
+	// by ContentTrust instead of DefaultNotaryServer for Docker Hub and
+	// of the registry itself for the others, as docker does.
+	NotaryServer string
+	// TrustDir, if not empty, is a directory keeping the root of the
+	// trust data of each repository verified: the later roots must be
+	// signed by its keys. Otherwise the root found is trusted every time.
+	TrustDir string
+	// Deadline, if not zero, is the time after which no new layers are
+	// converted. A *DeadlineError is returned when it passes.
+	Deadline time.Time
+	// Credentials are used to log into the registries, keyed by host. Each
+	// host only gets its own credentials, so the same Config can be used to
+	// convert images from different registries.
+	Credentials map[string]Credentials
+	// Name, if not empty, is the ACName of the generated image, instead of
+	// the docker URL's index and image name. Layer ACIs get it followed by
+	// their layer ID.
+	Name string
+	// App overrides the values of the app derived from the Docker config.
+	App AppOverrides
+	// Labels are added to the manifests of the generated ACIs, replacing
+	// the generated labels with the same name, except layer.
+	Labels map[string]string
+	// Annotations are added to the manifests of the generated ACIs and
+	// take precedence over the generated ones.
+	Annotations map[string]string
+	// StripCapabilities removes the file capabilities, kept in the
+	// security.capability extended attribute, from the layers' files.
+	StripCapabilities bool
+	// StripSetuid removes the setuid and setgid bits from the layers'
+	// files. The files are listed in an annotation.
+	StripSetuid bool
+	// MaxLayerSize and MaxImageSize, if not zero, are the maximum size in
+	// bytes of the files of a layer and of all the layers of the image.
+	// Conversions of larger images fail before writing their ACIs.
+	MaxLayerSize int64
+	MaxImageSize int64
+	// UIDMap and GIDMap map the owners of the files of a containers
+	// storage, as seen on the host, back to the IDs of the image. Rootless
+	// stores keep the files of the image owned by subordinate IDs of the
+	// user. Registry layers are used as they are.
+	UIDMap []IDMap
+	GIDMap []IDMap
+	// Timestamp, if not zero, clamps the modification times of the files
+	// of the generated ACIs: later ones are set to it, for reproducible
+	// builds.
+	Timestamp time.Time
+	// Exclude lists the path.Match patterns of the paths left out of the
+	// generated ACIs, with everything under them, and Include the ones of
+	// the paths kept anyway.
+	Exclude []string
+	Include []string
+	// PrePackHook, if not empty, is a shell command run in the extracted
+	// root filesystem of the squashed ACI before it's packed, e.g. to add
+	// certificates. It can't be used with SquashNone.
+	PrePackHook string
+	// AllowForeignLayers allows downloading the foreign layers of images,
+	// which are distributed outside of the registries, from their URLs
+	// when the containers storage doesn't have them.
+	AllowForeignLayers bool
+	// AllowNonLinux allows converting images for other operating systems
+	// than Linux, the os label of their ACIs says which.
+	AllowNonLinux bool
+	// HardlinkDuplicates makes the identical files of the squashed ACI,
+	// like the ones of packages installed in several layers, hard links
+	// to a single copy. The files then change together when written to.
+	HardlinkDuplicates bool
+	// CompressionLevel, if not zero, is the gzip level the generated ACIs
+	// are compressed with, from 1 (fastest) to 9 (smallest) or -1 for the
+	// default one.
+	CompressionLevel int
+	// TmpDir, if not empty, is the directory the downloads and the other
+	// temporary files of the conversion are written to instead of the
+	// default one, usually /tmp.
+	TmpDir string
+	// WorkDir, if not empty, is a directory where the downloaded layers
+	// and the packed layer ACIs are kept, with a record of them, so
+	// converting the image again, e.g. after an interruption, resumes
+	// where the last conversion stopped. It's kept once the conversion
+	// succeeds and can be shared by the conversions of images with common
+	// layers: the ones of a process at once, the ones of several processes
+	// one at a time.
+	WorkDir string
+	// CacheDir, if not empty, is a directory where the layers downloaded
+	// from registries are kept, named after their registry and ID, so the
+	// conversions of images sharing layers, like the tags of an image,
+	// download them once. A layer is downloaded again if it no longer has
+	// the sha256 it was downloaded with. Several conversions can use it at once. The layers of a
+	// containers storage are already on disk and aren't cached. It's
+	// used instead of WorkDir for the downloads. The registry responses
+	// describing the images are cached there too, the tags are checked
+	// with their validators.
+	CacheDir string
+	// Offline converts the image from CacheDir only, without contacting
+	// the registry: its tag, or ImageID, its ancestry, the layers' JSON
+	// and the layers have to be cached by an earlier conversion. It fails
+	// before converting anything if one of them is missing.
+	Offline bool
+	// SkipSpaceCheck disables the check, before converting anything, that
+	// the temporary and output directories have room for the layers as
+	// large as their sizes say.
+	SkipSpaceCheck bool
+	// SkipExisting makes the conversion return the ACIs already in
+	// OutputDir, without downloading anything, if they were converted from
+	// the same layers of the image with the same name and tag, and the
+	// same options changing the ACIs, whose fingerprint they keep in an
+	// annotation.
+	SkipExisting bool
+	// Layers, if not nil, records the layers converted so the conversions
+	// sharing it, like the ones of the images of a batch, reuse the ACIs
+	// of the layers they have in common. See LayerSet.
+	Layers *LayerSet
+	// ShowProgress draws progress bars of the downloads on stdout, which
+	// has to be a terminal, instead of printing their start.
+	ShowProgress bool
+	// Logger, if not nil, gets the messages of the conversion instead of
+	// DefaultLogger.
+	Logger Logger
+	// Events, if not nil, gets the steps of the conversion as lines of
+	// JSON, see Event.
+	Events io.Writer
+	// Callbacks are called with the same steps as Events, for the
+	// applications embedding the conversion to show its progress.
+	Callbacks Callbacks
+	// Stats, if not nil, is filled in with where the time and the space
+	// of the conversion went. The conversions must not share it.
+	Stats *Stats
+	// ChunkedDownloads, if more than 1, downloads the layers of registries
+	// larger than 256MiB with that many ranged requests at once, which
+	// is faster from registries storing them on S3 or the like. The
+	// chunks downloaded ahead of the one written are kept in memory,
+	// 16MiB each.
+	ChunkedDownloads int
+	// HTTPClient, if not nil, makes the requests of the conversion instead
+	// of DefaultHTTPClient, e.g. to use other TLS settings or timeouts.
+	// NewHTTPClient returns one keeping its connections alive.
+	HTTPClient *http.Client
+}
+
+// IDMap maps Size IDs starting at ContainerID in the image to the IDs
+// starting at HostID, like the user namespace mappings of podman.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// AppOverrides holds the values replacing the ones of the Docker config in
+// the generated app. Empty values are left as the Docker config has them.
+type AppOverrides struct {
+	// Exec is the command to run, like a Docker entrypoint: a relative
+	// command is run with the shell.
+	Exec []string
+	// User and Group are a user and group name or ID, resolved against
+	// the image's /etc/passwd and /etc/group.
+	User  string
+	Group string
+	// WorkingDirectory is the directory the app is run in.
+	WorkingDirectory string
+	// Memory and CPU are the limits of the resource/memory and
+	// resource/cpu isolators, as quantities like 512M or 500m.
+	Memory string
+	CPU    string
+	// RetainCapabilities and RemoveCapabilities are the Linux capabilities
+	// of the os/linux/capabilities-retain-set and -remove-set isolators,
+	// with or without the CAP_ prefix. Only one of them can be given.
+	RetainCapabilities []string
+	RemoveCapabilities []string
+}
+
+// empty reports whether o overrides nothing.
+func (o AppOverrides) empty() bool {
+	return len(o.Exec) == 0 && o.User == "" && o.Group == "" &&
+		o.WorkingDirectory == "" && o.Memory == "" && o.CPU == "" &&
+		len(o.RetainCapabilities) == 0 && len(o.RemoveCapabilities) == 0
+}
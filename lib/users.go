@@ -0,0 +1,164 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	passwdPath = "etc/passwd"
+	groupPath  = "etc/group"
+)
+
+// userDatabase holds the /etc/passwd and /etc/group files of an image's
+// root filesystem as seen from the layer being converted, so user and group
+// names can be resolved to IDs. Files have to be added from the base layer.
+type userDatabase struct {
+	passwd []byte
+	group  []byte
+}
+
+// addFile updates db with the layer file name, a cleaned tar entry name, if
+// it is one of the files db holds.
+func (db *userDatabase) addFile(name string, r io.Reader) error {
+	var dest *[]byte
+	switch name {
+	case passwdPath:
+		dest = &db.passwd
+	case groupPath:
+		dest = &db.group
+	default:
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	*dest = b
+	return nil
+}
+
+// prune forgets the files of db that are not in files, the paths of the root
+// filesystem, anymore.
+func (db *userDatabase) prune(files map[string]struct{}) {
+	if _, ok := files[passwdPath]; !ok {
+		db.passwd = nil
+	}
+	if _, ok := files[groupPath]; !ok {
+		db.group = nil
+	}
+}
+
+// resolve translates the User of a Docker image, of the form user[:group]
+// where both can be names or IDs, to the user and group IDs of an ACI.
+// When only the user is given, their primary group from /etc/passwd is
+// used, or root's if they're not there.
+func (db *userDatabase) resolve(dockerUser string) (string, string, error) {
+	// if the docker user is empty assume root user and group
+	if dockerUser == "" {
+		return "0", "0", nil
+	}
+
+	parts := strings.SplitN(dockerUser, ":", 2)
+
+	uid, gid, err := db.lookupUser(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		if gid, err = db.lookupGroup(parts[1]); err != nil {
+			return "", "", err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupUser returns the user ID of user and the ID of their primary group.
+func (db *userDatabase) lookupUser(user string) (string, string, error) {
+	numeric := isNumericID(user)
+	gid := "0"
+	found := false
+
+	forEachEntry(db.passwd, func(fields []string) bool {
+		// name:password:UID:GID:GECOS:directory:shell
+		if len(fields) < 4 {
+			return true
+		}
+		if (numeric && fields[2] == user) || (!numeric && fields[0] == user) {
+			user, gid, found = fields[2], fields[3], true
+			return false
+		}
+		return true
+	})
+
+	if !numeric && !found {
+		return "", "", fmt.Errorf("user %q not found in /etc/passwd", user)
+	}
+
+	return user, gid, nil
+}
+
+// lookupGroup returns the ID of group.
+func (db *userDatabase) lookupGroup(group string) (string, error) {
+	if isNumericID(group) {
+		return group, nil
+	}
+
+	gid := ""
+	forEachEntry(db.group, func(fields []string) bool {
+		// name:password:GID:members
+		if len(fields) >= 3 && fields[0] == group {
+			gid = fields[2]
+			return false
+		}
+		return true
+	})
+
+	if gid == "" {
+		return "", fmt.Errorf("group %q not found in /etc/group", group)
+	}
+
+	return gid, nil
+}
+
+// forEachEntry calls fn with the fields of every entry of a passwd or group
+// file until it returns false.
+func forEachEntry(file []byte, fn func(fields []string) bool) {
+	s := bufio.NewScanner(bytes.NewReader(file))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !fn(strings.Split(line, ":")) {
+			return
+		}
+	}
+}
+
+func isNumericID(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 32)
+	return err == nil
+}
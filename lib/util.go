@@ -15,10 +15,16 @@
 package docker2aci
 
 import (
+	"fmt"
+	"io"
 	"path"
 	"strings"
 )
 
+// maxJSONSize bounds the JSON documents read from registries, which are
+// small, so a broken registry can't make us read an endless response.
+const maxJSONSize = 16 << 20
+
 func makeEndpointsList(headers []string) []string {
 	var endpoints []string
 
@@ -34,3 +40,40 @@ func makeEndpointsList(headers []string) []string {
 
 	return endpoints
 }
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// boundedReader reads at most limit bytes from r and fails if there are
+// more.
+type boundedReader struct {
+	r     io.Reader
+	limit int64
+	// n is what's left to read
+	n int64
+}
+
+func newBoundedReader(r io.Reader, limit int64) *boundedReader {
+	return &boundedReader{r: r, limit: limit, n: limit}
+}
+
+func (br *boundedReader) Read(p []byte) (int, error) {
+	// one more byte tells whether there are more
+	if int64(len(p)) > br.n+1 {
+		p = p[:br.n+1]
+	}
+	n, err := br.r.Read(p)
+	if int64(n) > br.n {
+		n = int(br.n)
+		br.n = 0
+		return n, fmt.Errorf("more than %d bytes", br.limit)
+	}
+	br.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// ValidateACI checks that the ACI at aciPath, compressed or not, has the
+// layout of the appc spec and a manifest following its schema, as actool
+// validate does. It returns the manifest.
+func ValidateACI(aciPath string) (*schema.ImageManifest, error) {
+	f, err := os.Open(aciPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr, err := aci.NewCompressedTarReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ACI: %w", err)
+	}
+	if err := aci.ValidateArchive(tr); err != nil {
+		return nil, fmt.Errorf("invalid ACI: %w", err)
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	manifest, err := aci.ManifestFromImage(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// ValidateDependencies checks the chain of dependencies of the ACI at
+// aciPath, like the one of the layer ACIs of an image converted without
+// squashing: every dependency must resolve to a single valid ACI with its
+// name, its labels and its image ID if it's given, among aciPaths and the
+// ACIs next to aciPath, whose own dependencies resolve in turn, without
+// cycles.
+func ValidateDependencies(aciPath string, aciPaths []string) error {
+	manifest, err := readManifest(aciPath)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	candidates, err := dependencyCandidates(aciPath, aciPaths)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(aciPath)
+	if err != nil {
+		return err
+	}
+	return validateChain(aciPath, manifest, candidates, map[string]bool{abs: true})
+}
+
+// dependencyCandidate is an ACI dependencies can resolve to.
+type dependencyCandidate struct {
+	path     string
+	manifest *schema.ImageManifest
+	// id is the image ID, computed once needed
+	id string
+}
+
+func (c *dependencyCandidate) imageID() (string, error) {
+	if c.id == "" {
+		id, err := ACIImageID(c.path)
+		if err != nil {
+			return "", err
+		}
+		c.id = id
+	}
+	return c.id, nil
+}
+
+// dependencyCandidates returns the ACIs of aciPaths and the ones next to
+// aciPath, their absolute path once each. The ones whose manifest can't be
+// read are left out.
+func dependencyCandidates(aciPath string, aciPaths []string) ([]*dependencyCandidate, error) {
+	neighbours, err := filepath.Glob(filepath.Join(filepath.Dir(aciPath), "*.aci"))
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*dependencyCandidate
+	seen := make(map[string]bool)
+	for _, p := range append(aciPaths, neighbours...) {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+		manifest, err := readManifest(abs)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, &dependencyCandidate{path: abs, manifest: manifest})
+	}
+	return candidates, nil
+}
+
+// validateChain checks the dependencies of the ACI at p, whose manifest is
+// manifest. chain holds the ACIs depending on it, which it can't depend on.
+func validateChain(p string, manifest *schema.ImageManifest, candidates []*dependencyCandidate, chain map[string]bool) error {
+	for _, dep := range manifest.Dependencies {
+		c, err := resolveDependency(dep, candidates)
+		if err != nil {
+			return fmt.Errorf("dependency %s of %s: %w", dep.App, manifest.Name, err)
+		}
+		if chain[c.path] {
+			return fmt.Errorf("dependency %s of %s: the chain loops back to %s", dep.App, manifest.Name, c.path)
+		}
+		if _, err := ValidateACI(c.path); err != nil {
+			return fmt.Errorf("dependency %s of %s, %s: %w", dep.App, manifest.Name, c.path, err)
+		}
+		chain[c.path] = true
+		if err := validateChain(c.path, c.manifest, candidates, chain); err != nil {
+			return err
+		}
+		delete(chain, c.path)
+	}
+	return nil
+}
+
+// resolveDependency returns the candidate dep resolves to. Several ACIs
+// with the same contents are the same one.
+func resolveDependency(dep types.Dependency, candidates []*dependencyCandidate) (*dependencyCandidate, error) {
+	var matches []*dependencyCandidate
+	for _, c := range candidates {
+		if c.manifest.Name.String() != dep.App.String() || !hasLabels(c.manifest.Labels, dep.Labels) {
+			continue
+		}
+		if dep.ImageID != nil && !dep.ImageID.Empty() {
+			if id, err := c.imageID(); err != nil || id != dep.ImageID.String() {
+				continue
+			}
+		}
+		matches = append(matches, c)
+	}
+
+	if len(matches) == 0 {
+		what := "no ACI with its name"
+		if len(dep.Labels) > 0 {
+			what += " and labels"
+		}
+		if dep.ImageID != nil && !dep.ImageID.Empty() {
+			what += " and image ID " + dep.ImageID.String()
+		}
+		return nil, fmt.Errorf("%s found", what)
+	}
+	if len(matches) > 1 {
+		first, err := matches[0].imageID()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range matches[1:] {
+			id, err := c.imageID()
+			if err != nil {
+				return nil, err
+			}
+			if id != first {
+				var paths []string
+				for _, m := range matches {
+					paths = append(paths, m.path)
+				}
+				return nil, fmt.Errorf("several different ACIs match: %s", strings.Join(paths, ", "))
+			}
+		}
+	}
+	return matches[0], nil
+}
+
+// hasLabels reports whether labels has every label of want with the same
+// value.
+func hasLabels(labels types.Labels, want types.Labels) bool {
+	for _, w := range want {
+		found := false
+		for _, l := range labels {
+			if l.Name == w.Name && l.Value == w.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
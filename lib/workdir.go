@@ -0,0 +1,282 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/appc/spec/schema"
+)
+
+const (
+	workProgressFile = "progress.json"
+	workACIsDir      = "acis"
+	workLayersDir    = "layers"
+)
+
+// workDir is the persistent directory of Config.WorkDir. It keeps the
+// downloaded layers and records the layer ACIs already packed, so an
+// interrupted conversion resumes where it stopped. Layers are never
+// extracted, so there is no extraction to resume. The layers and their ACIs
+// are kept by registry, like in the cache, as layer IDs are only unique
+// within one.
+//
+// A layer is downloaded to a temporary file which is renamed to its ID once
+// complete, so the layers found there are whole.
+type workDir struct {
+	dir      string
+	progress workProgress
+}
+
+var (
+	// progressMu guards the progress files, which the conversions of this
+	// process sharing a work dir update at once, and cleanedWorkDirs
+	progressMu sync.Mutex
+	// cleanedWorkDirs are the work dirs whose interrupted downloads were
+	// removed, the downloads found there later are the ones of this
+	// process
+	cleanedWorkDirs = make(map[string]bool)
+)
+
+type workProgress struct {
+	Layers map[string]layerProgress `json:"layers"`
+}
+
+// layerProgress records the layer ACI packed from a layer, by progressKey.
+type layerProgress struct {
+	ACI  string `json:"aci"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// Settings is the fingerprint of what the ACI was packed with, see
+	// packSettings.
+	Settings string `json:"settings"`
+	// Compressed is true once the ACI is compressed, Size is then the
+	// size of the compressed ACI.
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// openWorkDir opens the work directory dir, creating it if needed. It removes
+// the layers whose download was interrupted.
+func openWorkDir(dir string) (*workDir, error) {
+	for _, d := range []string{workACIsDir, workLayersDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	wd := &workDir{dir: dir}
+	if err := wd.load(); err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !cleanedWorkDirs[abs] {
+		partial, err := filepath.Glob(filepath.Join(dir, workLayersDir, "*", "*", layerDownloadPrefix+"*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range partial {
+			os.Remove(p)
+		}
+		cleanedWorkDirs[abs] = true
+	}
+
+	return wd, nil
+}
+
+// load reads the progress file, which is missing until a layer is packed.
+func (wd *workDir) load() error {
+	wd.progress = workProgress{Layers: make(map[string]layerProgress)}
+	b, err := ioutil.ReadFile(filepath.Join(wd.dir, workProgressFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &wd.progress); err != nil {
+		return fmt.Errorf("error unmarshaling %s: %w", workProgressFile, err)
+	}
+	if wd.progress.Layers == nil {
+		wd.progress.Layers = make(map[string]layerProgress)
+	}
+	return nil
+}
+
+// layersDir returns the directory of the layers of the registry indexURL
+// downloaded with config. Layers from a containers storage depend on the ID
+// maps used to read them.
+func (wd *workDir) layersDir(config Config, indexURL string) (string, error) {
+	name := "default"
+	if len(config.UIDMap) > 0 || len(config.GIDMap) > 0 {
+		b, err := json.Marshal([][]IDMap{config.UIDMap, config.GIDMap})
+		if err != nil {
+			return "", err
+		}
+		name = fmt.Sprintf("%x", sha256.Sum256(b))[:16]
+	}
+	dir := filepath.Join(wd.dir, workLayersDir, registryDirName(indexURL), name)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// acisDir returns the directory for the layer ACIs of the registry indexURL
+// that aren't output.
+func (wd *workDir) acisDir(indexURL string) (string, error) {
+	dir := filepath.Join(wd.dir, workACIsDir, registryDirName(indexURL))
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// progressKey returns the key of the progress of the layer layerID of the
+// registry indexURL.
+func progressKey(indexURL string, layerID string) string {
+	return registryDirName(indexURL) + "/" + layerID
+}
+
+// packed returns the key of the ACI of the layer layerID of the registry
+// indexURL if it was packed to aciPath with settings and is still there.
+func (wd *workDir) packed(indexURL string, layerID string, aciPath string, settings string) (string, bool) {
+	lp, ok := wd.progress.Layers[progressKey(indexURL, layerID)]
+	if !ok || lp.ACI != aciPath || lp.Settings != settings {
+		return "", false
+	}
+	fi, err := os.Stat(aciPath)
+	if err != nil || fi.Size() != lp.Size {
+		return "", false
+	}
+	return lp.Key, true
+}
+
+// setPacked records that the ACI of the layer layerID of the registry
+// indexURL was packed to aciPath with settings. The progress file is read
+// again first so the layers recorded meanwhile by the other conversions
+// sharing the work dir are kept.
+func (wd *workDir) setPacked(indexURL string, layerID string, aciPath string, key string, settings string) error {
+	fi, err := os.Stat(aciPath)
+	if err != nil {
+		return err
+	}
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if err := wd.load(); err != nil {
+		return err
+	}
+	wd.progress.Layers[progressKey(indexURL, layerID)] = layerProgress{
+		ACI:      aciPath,
+		Key:      key,
+		Size:     fi.Size(),
+		Settings: settings,
+	}
+	return wd.save()
+}
+
+// setCompressed records that the ACI at aciPath is compressed now, and its
+// new size, so it's still found packed.
+func (wd *workDir) setCompressed(aciPath string) error {
+	fi, err := os.Stat(aciPath)
+	if err != nil {
+		return err
+	}
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if err := wd.load(); err != nil {
+		return err
+	}
+	changed := false
+	for k, lp := range wd.progress.Layers {
+		if lp.ACI == aciPath {
+			lp.Size, lp.Compressed = fi.Size(), true
+			wd.progress.Layers[k] = lp
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return wd.save()
+}
+
+// compressed returns whether the ACI at aciPath, packed and recorded in the
+// work dir, is compressed already.
+func (wd *workDir) compressed(aciPath string) bool {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	for _, lp := range wd.progress.Layers {
+		if lp.ACI == aciPath && lp.Compressed {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the progress file, replacing the previous one at once.
+func (wd *workDir) save() error {
+	b, err := json.MarshalIndent(wd.progress, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(wd.dir, "."+workProgressFile+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(wd.dir, workProgressFile))
+}
+
+// packSettings returns the fingerprint of what the ACI of a layer is packed
+// with besides the layer: its manifest, the options changing its files and
+// the compression level, as the ACIs output are compressed after they're
+// recorded.
+func packSettings(manifest schema.ImageManifest, config Config) (string, error) {
+	settings := struct {
+		Manifest          schema.ImageManifest
+		StripCapabilities bool
+		StripSetuid       bool
+		Timestamp         time.Time
+		Exclude           []string
+		Include           []string
+		CompressionLevel  int
+	}{
+		Manifest:          manifest,
+		StripCapabilities: config.StripCapabilities,
+		StripSetuid:       config.StripSetuid,
+		Timestamp:         config.Timestamp,
+		Exclude:           config.Exclude,
+		Include:           config.Include,
+		CompressionLevel:  config.CompressionLevel,
+	}
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker2aci
+
+import (
+	"gopkg.in/yaml.v2"
+)
+
+// parseYAML parses the YAML document b. Mappings become
+// map[string]interface{}, sequences []interface{} and scalars strings, as
+// they're written, or nil for null.
+func parseYAML(b []byte) (interface{}, error) {
+	var v yamlValue
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v.v, nil
+}
+
+// yamlValue is a node of a YAML document, as parseYAML returns it. The
+// scalars are kept as they're written, compose files take 1.10 or 0755 as
+// strings.
+type yamlValue struct {
+	v interface{}
+}
+
+func (yv *yamlValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var node interface{}
+	if err := unmarshal(&node); err != nil {
+		return err
+	}
+	switch node.(type) {
+	case nil:
+		yv.v = nil
+	case map[interface{}]interface{}:
+		var m map[string]yamlValue
+		if err := unmarshal(&m); err != nil {
+			return err
+		}
+		values := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			values[k] = v.v
+		}
+		yv.v = values
+	case []interface{}:
+		var s []yamlValue
+		if err := unmarshal(&s); err != nil {
+			return err
+		}
+		values := make([]interface{}, len(s))
+		for i, v := range s {
+			values[i] = v.v
+		}
+		yv.v = values
+	default:
+		var s string
+		if err := unmarshal(&s); err != nil {
+			return err
+		}
+		yv.v = s
+	}
+	return nil
+}
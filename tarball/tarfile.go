@@ -12,6 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package tarball provides helpers to walk the entries of tarballs and to
+// transform Docker layer entries into ACI ones.
 package tarball
 
 import (
@@ -0,0 +1,101 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"path"
+	"strings"
+)
+
+const (
+	// WhiteoutPrefix is the prefix of the files Docker uses to mark the
+	// deletion of a file from a lower layer.
+	WhiteoutPrefix = ".wh."
+	// OpaqueWhiteout is the name of the file Docker uses to mark a
+	// directory whose lower layers' contents are hidden.
+	OpaqueWhiteout = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// CleanName normalizes the name of a tar entry: it's cleaned and made
+// relative, so "./etc/", "/etc" and "etc" are all "etc". The root directory
+// is "".
+func CleanName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// Escapes reports whether name, taken relative to the root directory, goes
+// above it, e.g. "../etc/passwd". CleanName would silently move such entries
+// back into the root directory.
+func Escapes(name string) bool {
+	p := path.Clean(strings.TrimLeft(name, "/"))
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// IsWhiteout reports whether name is a whiteout file, including opaque ones.
+func IsWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), WhiteoutPrefix)
+}
+
+// IsOpaqueWhiteout reports whether name is an opaque whiteout file.
+func IsOpaqueWhiteout(name string) bool {
+	return path.Base(name) == OpaqueWhiteout
+}
+
+// WhiteoutTarget returns the path deleted by the whiteout file name. For
+// opaque whiteouts it is the directory whose lower contents are hidden.
+func WhiteoutTarget(name string) string {
+	name = CleanName(name)
+	dir, base := path.Split(name)
+	if base == OpaqueWhiteout {
+		return CleanName(dir)
+	}
+	return path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+}
+
+// Rebase moves the entry described by hdr under the directory prefix,
+// normalizing its name and, for hard links, the name of their target.
+func Rebase(hdr *tar.Header, prefix string) {
+	hdr.Name = path.Join(prefix, CleanName(hdr.Name))
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = path.Join(prefix, CleanName(hdr.Linkname))
+	}
+}
+
+// LinkTracker records the entries written to a tarball so hard links whose
+// target was left out can be detected. Extracting such links fails.
+type LinkTracker struct {
+	written map[string]struct{}
+}
+
+// NewLinkTracker returns an empty LinkTracker.
+func NewLinkTracker() *LinkTracker {
+	return &LinkTracker{written: make(map[string]struct{})}
+}
+
+// Add records that the entry described by hdr was written.
+func (lt *LinkTracker) Add(hdr *tar.Header) {
+	lt.written[CleanName(hdr.Name)] = struct{}{}
+}
+
+// Dangling reports whether hdr is a hard link to an entry that wasn't
+// written.
+func (lt *LinkTracker) Dangling(hdr *tar.Header) bool {
+	if hdr.Typeflag != tar.TypeLink {
+		return false
+	}
+	_, ok := lt.written[CleanName(hdr.Linkname)]
+	return !ok
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"etc", "etc"},
+		{"etc/", "etc"},
+		{"./etc/", "etc"},
+		{"/etc", "etc"},
+		{"etc//passwd", "etc/passwd"},
+		{"etc/./passwd", "etc/passwd"},
+		{"etc/ssl/../passwd", "etc/passwd"},
+		{"../etc", "etc"},
+		{".", ""},
+		{"./", ""},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := CleanName(tt.name); got != tt.want {
+			t.Errorf("CleanName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"etc/passwd", false},
+		{"/etc/passwd", false},
+		{"./etc", false},
+		{"etc/../passwd", false},
+		{"..foo", false},
+		{"etc/..foo", false},
+		{"", false},
+		{"..", true},
+		{"../etc/passwd", true},
+		{"/../etc/passwd", true},
+		{"etc/../../passwd", true},
+		{"./../etc", true},
+	}
+	for _, tt := range tests {
+		if got := Escapes(tt.name); got != tt.want {
+			t.Errorf("Escapes(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWhiteout(t *testing.T) {
+	tests := []struct {
+		name     string
+		whiteout bool
+		opaque   bool
+		target   string
+	}{
+		{"etc/passwd", false, false, ""},
+		{"etc/.wh.passwd", true, false, "etc/passwd"},
+		{"./etc/.wh.passwd", true, false, "etc/passwd"},
+		{"/.wh.etc", true, false, "etc"},
+		{".wh.etc", true, false, "etc"},
+		{"etc/.wh..wh..opq", true, true, "etc"},
+		{"./var/lib/.wh..wh..opq", true, true, "var/lib"},
+		{".wh..wh..opq", true, true, ""},
+		{".whiteout", false, false, ""},
+		{".wh.etc/passwd", false, false, ""},
+	}
+	for _, tt := range tests {
+		if got := IsWhiteout(tt.name); got != tt.whiteout {
+			t.Errorf("IsWhiteout(%q) = %v, want %v", tt.name, got, tt.whiteout)
+		}
+		if got := IsOpaqueWhiteout(tt.name); got != tt.opaque {
+			t.Errorf("IsOpaqueWhiteout(%q) = %v, want %v", tt.name, got, tt.opaque)
+		}
+		if !tt.whiteout {
+			continue
+		}
+		if got := WhiteoutTarget(tt.name); got != tt.target {
+			t.Errorf("WhiteoutTarget(%q) = %q, want %q", tt.name, got, tt.target)
+		}
+	}
+}
+
+func TestRebase(t *testing.T) {
+	tests := []struct {
+		hdr      tar.Header
+		name     string
+		linkname string
+	}{
+		{tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, "rootfs/etc/passwd", ""},
+		{tar.Header{Name: "./etc/", Typeflag: tar.TypeDir}, "rootfs/etc", ""},
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir}, "rootfs", ""},
+		{tar.Header{Name: "/usr/bin/../lib", Typeflag: tar.TypeDir}, "rootfs/usr/lib", ""},
+		// hard link targets are names in the tarball
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "./bin/bash"}, "rootfs/bin/sh", "rootfs/bin/bash"},
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "/bin/bash"}, "rootfs/bin/sh", "rootfs/bin/bash"},
+		// symlink targets are paths in the root filesystem
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/bash"}, "rootfs/bin/sh", "/bin/bash"},
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "bash"}, "rootfs/bin/sh", "bash"},
+	}
+	for _, tt := range tests {
+		hdr := tt.hdr
+		Rebase(&hdr, "rootfs")
+		if hdr.Name != tt.name || hdr.Linkname != tt.linkname {
+			t.Errorf("Rebase(%q -> %q) = %q -> %q, want %q -> %q", tt.hdr.Name, tt.hdr.Linkname, hdr.Name, hdr.Linkname, tt.name, tt.linkname)
+		}
+	}
+}
+
+func TestLinkTracker(t *testing.T) {
+	lt := NewLinkTracker()
+	for _, name := range []string{"./bin/", "./bin/bash", "/etc/passwd"} {
+		lt.Add(&tar.Header{Name: name})
+	}
+
+	tests := []struct {
+		hdr  tar.Header
+		want bool
+	}{
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/bash"}, false},
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "./bin/bash"}, false},
+		{tar.Header{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}, false},
+		{tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}, true},
+		{tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin"}, false},
+		// only hard links can dangle
+		{tar.Header{Name: "bin/ls", Typeflag: tar.TypeSymlink, Linkname: "busybox"}, false},
+		{tar.Header{Name: "bin/ls", Typeflag: tar.TypeReg}, false},
+	}
+	for _, tt := range tests {
+		if got := lt.Dangling(&tt.hdr); got != tt.want {
+			t.Errorf("Dangling(%q -> %q) = %v, want %v", tt.hdr.Name, tt.hdr.Linkname, got, tt.want)
+		}
+	}
+}